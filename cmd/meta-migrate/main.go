@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/rs/zerolog/log"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+// meta-migrate converts a meta file where parts reference storages by index in STORAGES
+// to node IDs. Run it with the STORAGES list the file was written with.
+type options struct {
+	MetaFile       string        `long:"meta-file" env:"META_FILE" description:"Meta state file" default:"meta.json"`
+	Storages       []string      `long:"storages" env:"STORAGES" env-delim:"," description:"Storages in the order the meta file was written with"`
+	IDs            []string      `long:"ids" env:"IDS" env-delim:"," description:"Node IDs in the order of storages (queried from the nodes if empty)"`
+	ConnectTimeout time.Duration `long:"connect-timeout" env:"CONNECT_TIMEOUT" description:"Timeout for connecting to storages" default:"30s"`
+}
+
+func main() {
+	var opts options
+
+	if _, err := flags.NewParser(&opts, flags.Default).Parse(); err != nil {
+		log.Fatal().Err(err).Msg("failed to parse options")
+	}
+
+	ids := opts.IDs
+	if len(ids) == 0 {
+		weights := make([]int, len(opts.Storages))
+		for i := range weights {
+			weights[i] = 1
+		}
+
+		storages, err := topology.FromEndpoints(opts.Storages, weights)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid storages")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ConnectTimeout)
+		err = storages.Connect(ctx)
+		cancel()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to get node ids")
+		}
+
+		for _, node := range storages.Nodes {
+			ids = append(ids, node.ID)
+		}
+	}
+
+	log.Info().Strs("ids", ids).Msg("migrating meta file")
+
+	migrated, err := inmemory.MigrateServerIndexes(opts.MetaFile, ids)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate meta file")
+	}
+
+	log.Info().Int("parts", migrated).Msg("meta file migrated")
+}
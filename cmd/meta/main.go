@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/recovery"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/grpc"
+
+	"github.com/theoptz/basic-s3/internal/meta/config"
+	"github.com/theoptz/basic-s3/internal/rest/meta/backend"
+	"github.com/theoptz/basic-s3/internal/rest/meta/raftmeta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/remote"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+// meta serves a meta storage over gRPC, so several REST instances with META_BACKEND=remote share it.
+func main() {
+	cfg, err := config.FromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config from env")
+	}
+
+	log.Debug().Any("config", cfg).Msg("Parsed config")
+
+	endpoint := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		log.Fatal().Err(err).Str("endpoint", endpoint).Msg("failed to listen")
+	}
+
+	metaStorage, err := backend.Open(backend.Config{
+		Backend:  cfg.MetaBackend,
+		File:     cfg.MetaFile,
+		Shards:   cfg.MetaShards,
+		FeedSize: cfg.MetaFeedSize,
+		Raft: raftmeta.Config{
+			ID:                cfg.RaftID,
+			Address:           cfg.RaftAddress,
+			Directory:         cfg.RaftDirectory,
+			Bootstrap:         cfg.RaftBootstrap,
+			ApplyTimeout:      cfg.RaftApplyTimeout,
+			SnapshotInterval:  cfg.RaftSnapshotInterval,
+			SnapshotThreshold: cfg.RaftSnapshotThreshold,
+		},
+	}, log.With().Str("pkg", "meta").Logger())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize meta storage")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	grpcPanicRecoveryHandler := func(p any) error {
+		log.Error().Any("panic", p).Stack().Msg("Panic")
+		return nil
+	}
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+		),
+		grpc.ChainStreamInterceptor(
+			recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+		),
+	)
+	proto.RegisterMetaServer(
+		srv,
+		remote.NewServer(
+			metaStorage,
+			log.With().Str("pkg", "grpc").Logger(),
+		),
+	)
+
+	go backend.RunSnapshots(ctx, metaStorage, cfg.MetaSnapshotInterval)
+
+	if cfg.MetaBackend == backend.Raft && len(cfg.RaftJoin) > 0 {
+		go join(ctx, cfg, log.With().Str("pkg", "join").Logger())
+	}
+
+	go func() {
+		defer stop()
+
+		log.Info().Str("endpoint", endpoint).Msg("listening")
+		if err = srv.Serve(listener); err != nil {
+			log.Error().Err(err).Msg("failed to serve")
+		}
+	}()
+
+	<-ctx.Done()
+
+	srv.GracefulStop()
+
+	if err = metaStorage.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close meta storage")
+	}
+}
+
+const joinInterval = 3 * time.Second
+
+// join adds the node to the raft cluster through the meta servers of its members. It retries until a
+// leader accepts the node, joining is a no-op for a member.
+func join(ctx context.Context, cfg *config.Config, logger zerolog.Logger) {
+	client, err := remote.Dial(cfg.RaftJoin, logger)
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to create join client")
+		return
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+
+	ticker := time.NewTicker(joinInterval)
+	defer ticker.Stop()
+
+	for {
+		if err = client.Join(ctx, cfg.RaftID, cfg.RaftAddress); err == nil {
+			logger.Info().Str("id", cfg.RaftID).Msg("joined the cluster")
+			return
+		}
+
+		logger.Warn().Err(err).Msg("failed to join the cluster")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -4,17 +4,32 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os/signal"
 	"syscall"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/theoptz/basic-s3/internal/rest/cache/lru"
+	"github.com/theoptz/basic-s3/internal/rest/capacity"
 	"github.com/theoptz/basic-s3/internal/rest/config"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/distributor/classes"
+	"github.com/theoptz/basic-s3/internal/rest/distributor/rendezvous"
 	"github.com/theoptz/basic-s3/internal/rest/distributor/weight"
-	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/fsck"
+	"github.com/theoptz/basic-s3/internal/rest/health"
+	"github.com/theoptz/basic-s3/internal/rest/membership"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/backend"
 	"github.com/theoptz/basic-s3/internal/rest/orchestrator/service"
+	"github.com/theoptz/basic-s3/internal/rest/pruner"
+	"github.com/theoptz/basic-s3/internal/rest/rebalancer"
+	"github.com/theoptz/basic-s3/internal/rest/replica"
 	"github.com/theoptz/basic-s3/internal/rest/server"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
 )
 
 func main() {
@@ -25,43 +40,277 @@ func main() {
 
 	log.Debug().Any("config", cfg).Msg("Parsed config")
 
-	if len(cfg.Storages) == 0 {
-		log.Fatal().Msg("No storage configured")
+	var storages *topology.Topology
+	if cfg.TopologyFile != "" {
+		storages, err = topology.Load(cfg.TopologyFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			// nodes register with heartbeats and are saved to the file
+			storages, err = &topology.Topology{}, nil
+		}
+	} else {
+		storages, err = topology.FromEndpoints(cfg.Storages, cfg.Weights)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load storage topology")
 	}
 
-	metaStorage, err := inmemory.New(
-		cfg.MetaFile,
-		log.With().Str("pkg", "meta").Logger(),
-	)
+	// only nodes without an ID in the topology are waited for
+	connectCtx, cancelConnect := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	err = storages.Connect(connectCtx)
+	cancelConnect()
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to storages")
+	}
+
+	metaStorage, err := backend.Open(backend.Config{
+		Backend:   cfg.MetaBackend,
+		File:      cfg.MetaFile,
+		Shards:    cfg.MetaShards,
+		Addresses: cfg.MetaAddresses,
+		FeedSize:  cfg.MetaFeedSize,
+	}, log.With().Str("pkg", "meta").Logger())
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to initialize meta storage")
 	}
 
-	partDistributor, err := weight.New(weight.DistributorConfig{
-		Endpoints:   cfg.Storages,
-		Weights:     cfg.Weights,
+	healthTracker := health.New(health.Config{
+		FailureThreshold: cfg.BreakerFailureThreshold,
+		OpenTimeout:      cfg.BreakerOpenTimeout,
+		ProbeInterval:    cfg.HealthProbeInterval,
+		ProbeTimeout:     cfg.HealthProbeTimeout,
+	}, log.With().Str("pkg", "health").Logger())
+
+	capacityMonitor := capacity.New(capacity.Config{
+		HighWaterMark: cfg.CapacityHighWaterMark,
+		PollInterval:  cfg.CapacityPollInterval,
+		PollTimeout:   cfg.HealthProbeTimeout,
+	}, log.With().Str("pkg", "capacity").Logger())
+
+	partSizing := distributor.PartSizing{
 		MaxParts:    cfg.MaxParts,
 		MinPartSize: cfg.MinPartSize,
+		MaxPartSize: cfg.MaxPartSize,
+	}
+
+	placement := distributor.Placement{
+		Replicas: cfg.ReplicationFactor,
+		Domain:   distributor.FailureDomain(cfg.PlacementDomain),
+	}
+
+	storageClasses := []classes.Class{{Name: classes.DefaultClass, Placement: placement}}
+	if len(cfg.StorageClasses) > 0 {
+		storageClasses = storageClasses[:0]
+		for _, c := range cfg.StorageClasses {
+			storageClass, classErr := classes.ParseClass(c, placement)
+			if classErr != nil {
+				log.Fatal().Err(classErr).Msg("invalid storage class")
+			}
+
+			storageClasses = append(storageClasses, storageClass)
+		}
+	}
+
+	partDistributor, err := classes.New(classes.DistributorConfig{
+		Nodes:   storages.Nodes,
+		Classes: storageClasses,
+		Default: cfg.DefaultStorageClass,
+		New: func(c classes.Class, nodes []topology.Node) (distributor.Dynamic, error) {
+			if cfg.Distributor == "rendezvous" {
+				return rendezvous.New(rendezvous.DistributorConfig{
+					Nodes:     nodes,
+					Parts:     partSizing,
+					Placement: c.Placement,
+					Health:    healthTracker,
+					Capacity:  capacityMonitor,
+				})
+			}
+
+			return weight.New(weight.DistributorConfig{
+				Nodes:     nodes,
+				Parts:     partSizing,
+				Placement: c.Placement,
+				Health:    healthTracker,
+				Capacity:  capacityMonitor,
+			})
+		},
 	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create part distributor")
 	}
 
+	members := membership.New(storages.Nodes, partDistributor, membership.Config{
+		ConnectTimeout:   cfg.ConnectTimeout,
+		HeartbeatTimeout: cfg.HeartbeatTimeout,
+		File:             cfg.TopologyFile,
+	}, log.With().Str("pkg", "membership").Logger())
+
+	replicaSelector, err := replica.New(replica.Config{
+		Policy: replica.Policy(cfg.ReadPolicy),
+		Zone:   cfg.Zone,
+	}, members.Zone)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create replica selector")
+	}
+
+	versionPruner := pruner.New(partDistributor, pruner.Config{
+		DeleteDelay: cfg.VersionsDeleteDelay,
+		QueueSize:   cfg.VersionsDeleteQueue,
+		QueueFile:   cfg.VersionsDeleteFile,
+	}, log.With().Str("pkg", "pruner").Logger())
+
+	serviceCfg := service.Config{
+		ChunkSize:          cfg.ChunkSize,
+		UploadConcurrency:  cfg.UploadConcurrency,
+		UploadMemory:       cfg.UploadMemory,
+		HedgePercentile:    cfg.HedgePercentile,
+		HedgeDelay:         cfg.HedgeDelay,
+		CacheMaxObjectSize: cfg.CacheMaxObjectSize,
+		Health:             healthTracker,
+		Replicas:           replicaSelector,
+		BucketClasses:      cfg.BucketStorageClasses,
+		MaxVersions:        cfg.MaxVersions,
+		BucketMaxVersions:  cfg.BucketMaxVersions,
+		Pruner:             versionPruner,
+	}
+
+	serverOpts := []server.Option{
+		server.WithHealth(healthTracker),
+		server.WithCapacity(capacityMonitor),
+		server.WithMembership(members),
+		server.WithReplicaSelector(replicaSelector),
+		server.WithPruner(versionPruner),
+	}
+
+	if cfg.CacheSize > 0 {
+		objectCache, cacheErr := lru.New(lru.Config{
+			MemorySize: cfg.CacheSize,
+			Directory:  cfg.CacheDirectory,
+			DiskSize:   cfg.CacheDiskSize,
+		}, log.With().Str("pkg", "cache").Logger())
+		if cacheErr != nil {
+			log.Fatal().Err(cacheErr).Msg("failed to create cache")
+		}
+
+		serviceCfg.Cache = objectCache
+		serverOpts = append(serverOpts, server.WithCache(objectCache))
+	}
+
+	var tierRules []rebalancer.TierRule
+	for _, s := range cfg.TieringRules {
+		rule, ruleErr := rebalancer.ParseTierRule(s)
+		if ruleErr != nil {
+			log.Fatal().Err(ruleErr).Msg("invalid tiering rule")
+		}
+
+		if _, ok := partDistributor.ForClass(rule.Class); !ok {
+			log.Fatal().Str("class", rule.Class).Msg("unknown storage class of tiering rule")
+		}
+
+		tierRules = append(tierRules, rule)
+	}
+
+	partRebalancer := rebalancer.New(metaStorage, partDistributor, members.Address, rebalancer.Config{
+		Interval:           cfg.RebalanceInterval,
+		BytesPerSecond:     cfg.RebalanceBytesPerSecond,
+		TransferTimeout:    cfg.RebalanceTransferTimeout,
+		DeleteDelay:        cfg.RebalanceDeleteDelay,
+		DeleteQueueFile:    cfg.RebalanceDeleteQueue,
+		DrainRetryInterval: cfg.DrainRetryInterval,
+		StuckUploadAge:     cfg.DrainStuckUploadAge,
+		TierInterval:       cfg.TieringInterval,
+		TierRules:          tierRules,
+	}, log.With().Str("pkg", "rebalancer").Logger())
+
+	if cfg.RebalanceInterval > 0 && !partRebalancer.HasPlacement() {
+		log.Warn().Str("distributor", cfg.Distributor).
+			Msg("rebalance passes need DISTRIBUTOR=rendezvous, only drains and tiering run")
+	}
+
+	// drains survive restarts in the topology file, evacuation goes on where it stopped
+	for _, n := range members.Nodes() {
+		if n.Drain {
+			partRebalancer.Drain(n.ID)
+		}
+	}
+
+	serverOpts = append(serverOpts, server.WithRebalancer(partRebalancer))
+
+	checker := fsck.New(metaStorage, partDistributor, members.IDs, members.Address, fsck.Config{
+		OrphanAge:       cfg.FsckOrphanAge,
+		TransferTimeout: cfg.RebalanceTransferTimeout,
+	}, log.With().Str("pkg", "fsck").Logger())
+
+	serverOpts = append(serverOpts, server.WithFsck(checker))
+
+	if watcher, ok := meta.As[meta.Watcher](metaStorage); ok {
+		serverOpts = append(serverOpts, server.WithWatcher(watcher))
+	}
+
 	orchestrator := service.New(
 		metaStorage,
 		partDistributor,
 		log.With().Str("pkg", "service").Logger(),
-		cfg.ChunkSize,
+		serviceCfg,
 	)
 
 	srv := server.New(
 		*cfg,
 		orchestrator,
 		log.With().Str("pkg", "server").Logger(),
+		serverOpts...,
 	)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 
+	if cfg.TopologyFile != "" {
+		go members.WatchFile(ctx, cfg.TopologyReloadInterval)
+	}
+	go members.RunLiveness(ctx)
+	go backend.RunSnapshots(ctx, metaStorage, cfg.MetaSnapshotInterval)
+
+	go partRebalancer.Run(ctx)
+	go checker.Run(ctx)
+	go versionPruner.Run(ctx)
+
+	go healthTracker.Run(ctx, members.IDs, func(ctx context.Context, id string) error {
+		cl, clErr := partDistributor.GetClientByID(id)
+		if clErr != nil {
+			return clErr
+		}
+
+		// a node answering on the address of another one refuses its calls, the probe marks it unavailable
+		// before uploads are planned on it
+		res, clErr := cl.Info(ctx, &proto.InfoRequest{})
+		if clErr != nil {
+			return clErr
+		}
+
+		if res.Id != id {
+			return fmt.Errorf("node %s reported id %q", id, res.Id)
+		}
+
+		return nil
+	})
+
+	go capacityMonitor.Run(ctx, members.IDs, func(ctx context.Context, id string) (*capacity.NodeStats, error) {
+		cl, clErr := partDistributor.GetClientByID(id)
+		if clErr != nil {
+			return nil, clErr
+		}
+
+		res, clErr := cl.Stats(ctx, &proto.StatsRequest{})
+		if clErr != nil {
+			return nil, clErr
+		}
+
+		return &capacity.NodeStats{
+			TotalBytes:  res.TotalBytes,
+			FreeBytes:   res.FreeBytes,
+			TotalInodes: res.TotalInodes,
+			FreeInodes:  res.FreeInodes,
+		}, nil
+	})
+
 	go func() {
 		defer stop()
 
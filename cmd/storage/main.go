@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/recovery"
@@ -12,8 +14,10 @@ import (
 
 	"google.golang.org/grpc"
 
+	"github.com/theoptz/basic-s3/internal/nodeid"
 	"github.com/theoptz/basic-s3/internal/storage/config"
 	"github.com/theoptz/basic-s3/internal/storage/filestorage"
+	"github.com/theoptz/basic-s3/internal/storage/registration"
 	"github.com/theoptz/basic-s3/internal/storage/server"
 	"github.com/theoptz/basic-s3/proto"
 )
@@ -33,6 +37,13 @@ func main() {
 		log.Fatal().Err(err).Str("endpoint", endpoint).Msg("failed to listen")
 	}
 
+	nodeID, err := filestorage.LoadOrCreateNodeID(cfg.Directory, cfg.NodeID)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load node id")
+	}
+
+	log.Info().Str("id", nodeID).Msg("node id loaded")
+
 	storage := filestorage.New(cfg.Directory)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -45,14 +56,17 @@ func main() {
 	srv := grpc.NewServer(
 		grpc.ChainUnaryInterceptor(
 			recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+			nodeid.UnaryServerInterceptor(nodeID),
 		),
 		grpc.ChainStreamInterceptor(
 			recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+			nodeid.StreamServerInterceptor(nodeID),
 		),
 	)
 	proto.RegisterStorageServer(
 		srv,
 		server.New(
+			nodeID,
 			storage,
 			log.With().Str("pkg", "grpc").Logger(),
 		),
@@ -67,7 +81,40 @@ func main() {
 		}
 	}()
 
+	if cfg.RegistryURL != "" {
+		address := cfg.AdvertiseAddress
+		if address == "" {
+			address = advertiseAddress(cfg.Host, cfg.Port)
+		}
+
+		registrar := registration.New(nodeID, storage, registration.Config{
+			URL:      cfg.RegistryURL,
+			Token:    cfg.RegistryToken,
+			Address:  address,
+			Weight:   cfg.Weight,
+			Zone:     cfg.Zone,
+			Rack:     cfg.Rack,
+			Host:     cfg.PhysicalHost,
+			Pool:     cfg.Pool,
+			Interval: cfg.HeartbeatInterval,
+			Timeout:  cfg.HeartbeatInterval,
+		}, log.With().Str("pkg", "registration").Logger())
+
+		go registrar.Run(ctx)
+	}
+
 	<-ctx.Done()
 
 	srv.GracefulStop()
 }
+
+// advertiseAddress uses the hostname when listening on all interfaces.
+func advertiseAddress(host string, port int) string {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,88 @@
+// Package atomicfile replaces files so that a crash never leaves them partially written.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// File is written to a temporary file next to the file it replaces. Commit puts it in place, Close
+// without Commit discards it, so readers see either the old or the complete new content.
+type File struct {
+	*os.File
+	filename  string
+	committed bool
+}
+
+// Create starts replacing the file. The directory must exist.
+func Create(filename string) (*File, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &File{File: f, filename: filename}, nil
+}
+
+// Commit syncs the written data and replaces the file with it.
+func (f *File) Commit() error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	if err := f.File.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), f.filename); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	f.committed = true
+
+	dir, err := os.Open(filepath.Dir(f.filename))
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer func() {
+		_ = dir.Close()
+	}()
+
+	if err = dir.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// Close discards the file unless it is committed.
+func (f *File) Close() error {
+	if f.committed {
+		return nil
+	}
+
+	_ = f.File.Close()
+
+	if err := os.Remove(f.Name()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+
+	return nil
+}
+
+// WriteFile replaces the file with data, so a crash leaves either the old or the new content.
+func WriteFile(filename string, data []byte) error {
+	f, err := Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return f.Commit()
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+type Config struct {
+	Host string `long:"host" env:"HOST" description:"Host" default:"localhost"`
+	Port int    `long:"port" env:"PORT" description:"Port" default:"5050"`
+
+	MetaBackend          string        `long:"meta-backend" env:"META_BACKEND" description:"Meta storage, META_FILE is its state file or database" choice:"inmemory" choice:"bolt" choice:"sqlite" choice:"raft" default:"inmemory"`
+	MetaFile             string        `long:"meta-file" env:"META_FILE" description:"Meta state file" default:"meta.json"`
+	MetaShards           int           `long:"meta-shards" env:"META_SHARDS" description:"Number of inmemory meta shards, each with its own lock" default:"64"`
+	MetaSnapshotInterval time.Duration `long:"meta-snapshot-interval" env:"META_SNAPSHOT_INTERVAL" description:"Interval between meta snapshots that truncate the write-ahead log (0 - only on shutdown)" default:"5m"`
+	MetaFeedSize         int           `long:"meta-feed-size" env:"META_FEED_SIZE" description:"Number of meta change events retained for watchers (0 - change feed is disabled)" default:"10000"`
+
+	RaftID                string        `long:"raft-id" env:"RAFT_ID" description:"Node ID in the raft cluster, must not change between restarts"`
+	RaftAddress           string        `long:"raft-address" env:"RAFT_ADDRESS" description:"Raft replication address" default:"localhost:5060"`
+	RaftDirectory         string        `long:"raft-directory" env:"RAFT_DIRECTORY" description:"Directory of the raft log and snapshots" default:"raft"`
+	RaftBootstrap         bool          `long:"raft-bootstrap" env:"RAFT_BOOTSTRAP" description:"Start a new cluster with this node, ignored if the node has state"`
+	RaftJoin              []string      `long:"raft-join" env:"RAFT_JOIN" env-delim:"," description:"Meta server addresses of cluster members to join through"`
+	RaftApplyTimeout      time.Duration `long:"raft-apply-timeout" env:"RAFT_APPLY_TIMEOUT" description:"Time a change or a read waits for the cluster" default:"10s"`
+	RaftSnapshotInterval  time.Duration `long:"raft-snapshot-interval" env:"RAFT_SNAPSHOT_INTERVAL" description:"Interval between checks whether the raft log should be compacted (0 - raft default)"`
+	RaftSnapshotThreshold uint64        `long:"raft-snapshot-threshold" env:"RAFT_SNAPSHOT_THRESHOLD" description:"Number of log entries that trigger a snapshot (0 - raft default)"`
+}
+
+func FromEnv() (*Config, error) {
+	var cfg Config
+
+	parser := flags.NewParser(&cfg, flags.Default)
+	if _, err := parser.Parse(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
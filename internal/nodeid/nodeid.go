@@ -0,0 +1,76 @@
+// Package nodeid binds gRPC calls to the storage node they are meant for. Clients send the expected
+// node ID with every call and storage nodes refuse calls for another ID, so a process answering on the
+// address of another node never serves or receives its parts.
+package nodeid
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const metadataKey = "x-storage-node-id"
+
+// DialOptions make every call of the connection carry the ID of the node it is meant for.
+func DialOptions(id string) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(
+			ctx context.Context,
+			method string,
+			req, reply any,
+			cc *grpc.ClientConn,
+			invoker grpc.UnaryInvoker,
+			opts ...grpc.CallOption,
+		) error {
+			return invoker(metadata.AppendToOutgoingContext(ctx, metadataKey, id), method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(
+			ctx context.Context,
+			desc *grpc.StreamDesc,
+			cc *grpc.ClientConn,
+			method string,
+			streamer grpc.Streamer,
+			opts ...grpc.CallOption,
+		) (grpc.ClientStream, error) {
+			return streamer(metadata.AppendToOutgoingContext(ctx, metadataKey, id), desc, cc, method, opts...)
+		}),
+	}
+}
+
+// UnaryServerInterceptor refuses calls meant for a node other than id. Calls without an ID, e.g. asking
+// an unknown node for its ID, are served.
+func UnaryServerInterceptor(id string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := check(ctx, id); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is UnaryServerInterceptor for streams.
+func StreamServerInterceptor(id string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := check(ss.Context(), id); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func check(ctx context.Context, id string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	for _, expected := range md.Get(metadataKey) {
+		if expected != id {
+			return status.Errorf(codes.FailedPrecondition, "call for node %q reached node %q", expected, id)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package nodeid_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/nodeid"
+	"github.com/theoptz/basic-s3/internal/storage/filestorage"
+	"github.com/theoptz/basic-s3/internal/storage/server"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+func TestInterceptors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(nodeid.UnaryServerInterceptor("a")),
+		grpc.ChainStreamInterceptor(nodeid.StreamServerInterceptor("a")),
+	)
+	proto.RegisterStorageServer(srv, server.New("a", filestorage.New(t.TempDir()), zerolog.Nop()))
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(srv.Stop)
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode codes.Code
+	}{
+		{name: "expected node", id: "a", wantCode: codes.OK},
+		{name: "no id", wantCode: codes.OK},
+		{name: "another node", id: "b", wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+			if tt.id != "" {
+				opts = append(opts, nodeid.DialOptions(tt.id)...)
+			}
+
+			conn, err := grpc.NewClient(listener.Addr().String(), opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+
+			client := proto.NewStorageClient(conn)
+
+			_, err = client.Info(context.Background(), &proto.InfoRequest{})
+			assert.Equal(t, tt.wantCode, status.Code(err), "unary call")
+
+			stream, err := client.List(context.Background(), &proto.ListRequest{})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			if tt.wantCode == codes.OK {
+				assert.ErrorIs(t, err, io.EOF, "an empty node lists nothing")
+			} else {
+				assert.Equal(t, tt.wantCode, status.Code(err), "stream call")
+			}
+		})
+	}
+}
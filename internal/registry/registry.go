@@ -0,0 +1,17 @@
+// Package registry holds the heartbeat storage nodes register themselves with, shared by the sender in
+// internal/storage/registration and the receiver in internal/rest/membership.
+package registry
+
+// Heartbeat is posted by a storage node to /_admin/nodes/{id}/heartbeat of the REST tier.
+type Heartbeat struct {
+	Address     string `json:"address"`
+	Weight      int    `json:"weight"`
+	Zone        string `json:"zone"`
+	Rack        string `json:"rack"`
+	Host        string `json:"host"`
+	Pool        string `json:"pool"`
+	TotalBytes  uint64 `json:"total_bytes"`
+	FreeBytes   uint64 `json:"free_bytes"`
+	TotalInodes uint64 `json:"total_inodes"`
+	FreeInodes  uint64 `json:"free_inodes"`
+}
@@ -0,0 +1,10 @@
+package lru
+
+type Config struct {
+	// MemorySize is the byte budget of the in-memory tier.
+	MemorySize int64
+	// Directory enables the local-disk tier when not empty.
+	Directory string
+	// DiskSize is the byte budget of the local-disk tier.
+	DiskSize int64
+}
@@ -0,0 +1,108 @@
+package lru
+
+import (
+	"container/list"
+
+	"github.com/theoptz/basic-s3/internal/rest/cache"
+)
+
+type entry struct {
+	key  cache.Key
+	size int64
+	data []byte
+}
+
+// sizedList is an LRU index with a byte budget. It is not safe for concurrent use.
+type sizedList struct {
+	budget int64
+	size   int64
+	ll     *list.List
+	items  map[cache.Key]*list.Element
+	files  map[string]map[int]struct{}
+}
+
+func (l *sizedList) get(key cache.Key) (*entry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.ll.MoveToFront(el)
+
+	return el.Value.(*entry), true
+}
+
+// add puts the entry in front of the list and returns the entries evicted to fit the budget.
+func (l *sizedList) add(e *entry) []*entry {
+	l.remove(e.key)
+
+	l.items[e.key] = l.ll.PushFront(e)
+	l.size += e.size
+
+	file := fileKey(e.key.Bucket, e.key.Key)
+	if _, ok := l.files[file]; !ok {
+		l.files[file] = make(map[int]struct{})
+	}
+	l.files[file][e.key.Version] = struct{}{}
+
+	var evicted []*entry
+	for l.size > l.budget {
+		el := l.ll.Back()
+		if el == nil {
+			break
+		}
+
+		old := el.Value.(*entry)
+		l.remove(old.key)
+		evicted = append(evicted, old)
+	}
+
+	return evicted
+}
+
+func (l *sizedList) remove(key cache.Key) (*entry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+
+	l.ll.Remove(el)
+	delete(l.items, key)
+	l.size -= e.size
+
+	file := fileKey(key.Bucket, key.Key)
+	delete(l.files[file], key.Version)
+	if len(l.files[file]) == 0 {
+		delete(l.files, file)
+	}
+
+	return e, true
+}
+
+func (l *sizedList) removeFile(bucket, key string) []*entry {
+	versions := l.files[fileKey(bucket, key)]
+
+	removed := make([]*entry, 0, len(versions))
+	for version := range versions {
+		if e, ok := l.remove(cache.Key{Bucket: bucket, Key: key, Version: version}); ok {
+			removed = append(removed, e)
+		}
+	}
+
+	return removed
+}
+
+func newSizedList(budget int64) *sizedList {
+	return &sizedList{
+		budget: budget,
+		ll:     list.New(),
+		items:  make(map[cache.Key]*list.Element),
+		files:  make(map[string]map[int]struct{}),
+	}
+}
+
+func fileKey(bucket, key string) string {
+	return bucket + "/" + key
+}
@@ -0,0 +1,234 @@
+package lru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/cache"
+)
+
+// markerFile marks a directory as owned by the cache, only such directories are wiped on start.
+const markerFile = ".basic-s3-cache"
+
+// Cache is a two-tier LRU cache: objects are kept in memory within a byte budget and, when a
+// directory is configured, are also written through to local disk. Disk hits are promoted back
+// to memory. The disk tier is wiped on start.
+type Cache struct {
+	memory *sizedList
+	disk   *sizedList
+	dir    string
+	logger zerolog.Logger
+	mu     sync.Mutex
+
+	hits      atomic.Uint64
+	diskHits  atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func New(cfg Config, logger zerolog.Logger) (*Cache, error) {
+	c := &Cache{
+		memory: newSizedList(cfg.MemorySize),
+		logger: logger,
+	}
+
+	if cfg.Directory != "" {
+		if err := prepareDir(cfg.Directory); err != nil {
+			return nil, err
+		}
+
+		c.dir = cfg.Directory
+		c.disk = newSizedList(cfg.DiskSize)
+	}
+
+	return c, nil
+}
+
+// prepareDir creates the cache directory or wipes the one left by a previous run. A non-empty
+// directory without the marker file is refused, so a mistyped path never loses data.
+func prepareDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+
+	marker := path.Join(dir, markerFile)
+	if len(entries) > 0 {
+		if _, err = os.Stat(marker); err != nil {
+			return fmt.Errorf("cache directory %s is not empty and is not a cache directory", dir)
+		}
+	}
+
+	for _, e := range entries {
+		if e.Name() == markerFile {
+			continue
+		}
+
+		if err = os.RemoveAll(path.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("failed to clean cache directory: %w", err)
+		}
+	}
+
+	if err = os.WriteFile(marker, nil, 0644); err != nil {
+		return fmt.Errorf("failed to mark cache directory: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Cache) Get(key cache.Key) ([]byte, bool) {
+	c.mu.Lock()
+
+	if e, ok := c.memory.get(key); ok {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return e.data, true
+	}
+
+	if c.disk == nil {
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	_, ok := c.disk.get(key)
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	data, err := os.ReadFile(c.filename(key))
+	if err != nil {
+		c.logger.Warn().Err(err).Str("key", key.String()).Msg("failed to read cached object")
+
+		c.mu.Lock()
+		c.disk.remove(key)
+		c.mu.Unlock()
+
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.mu.Lock()
+	c.addToMemory(key, data)
+	c.mu.Unlock()
+
+	c.diskHits.Add(1)
+
+	return data, true
+}
+
+// Set caches the object. The cache takes ownership of data.
+func (c *Cache) Set(key cache.Key, data []byte) {
+	size := int64(len(data))
+
+	c.mu.Lock()
+	c.addToMemory(key, data)
+	c.mu.Unlock()
+
+	if c.disk == nil || size > c.disk.budget {
+		return
+	}
+
+	if err := c.writeFile(key, data); err != nil {
+		c.logger.Warn().Err(err).Str("key", key.String()).Msg("failed to write cached object")
+		return
+	}
+
+	c.mu.Lock()
+	evicted := c.disk.add(&entry{key: key, size: size})
+	c.mu.Unlock()
+
+	c.removeFiles(evicted)
+	c.evictions.Add(uint64(len(evicted)))
+}
+
+func (c *Cache) Invalidate(bucket, key string) {
+	c.mu.Lock()
+	c.memory.removeFile(bucket, key)
+
+	var removed []*entry
+	if c.disk != nil {
+		removed = c.disk.removeFile(bucket, key)
+	}
+	c.mu.Unlock()
+
+	c.removeFiles(removed)
+}
+
+func (c *Cache) Stats() cache.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := cache.Stats{
+		Hits:      c.hits.Load(),
+		DiskHits:  c.diskHits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Items:     len(c.memory.items),
+		Size:      c.memory.size,
+	}
+
+	if c.disk != nil {
+		res.DiskItems = len(c.disk.items)
+		res.DiskSize = c.disk.size
+	}
+
+	return res
+}
+
+func (c *Cache) addToMemory(key cache.Key, data []byte) {
+	if int64(len(data)) > c.memory.budget {
+		return
+	}
+
+	evicted := c.memory.add(&entry{key: key, size: int64(len(data)), data: data})
+	c.evictions.Add(uint64(len(evicted)))
+}
+
+func (c *Cache) writeFile(key cache.Key, data []byte) error {
+	filename := c.filename(key)
+
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("mkdirall: %w", err)
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("rename file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Cache) removeFiles(entries []*entry) {
+	for _, e := range entries {
+		if err := os.Remove(c.filename(e.key)); err != nil && !os.IsNotExist(err) {
+			c.logger.Warn().Err(err).Str("key", e.key.String()).Msg("failed to remove cached object")
+		}
+	}
+}
+
+func (c *Cache) filename(key cache.Key) string {
+	hash := sha256.Sum256([]byte(fileKey(key.Bucket, key.Key)))
+
+	return path.Join(c.dir, hex.EncodeToString(hash[:]), strconv.Itoa(key.Version))
+}
@@ -0,0 +1,178 @@
+package lru
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/cache"
+)
+
+func TestCache(t *testing.T) {
+	key := func(k string, version int) cache.Key {
+		return cache.Key{Bucket: "bucket", Key: k, Version: version}
+	}
+
+	tests := []struct {
+		name      string
+		cfg       func(t *testing.T) Config
+		actions   func(c *Cache)
+		wantHit   []cache.Key
+		wantMiss  []cache.Key
+		wantStats cache.Stats
+	}{
+		{
+			name: "evicts least recently used",
+			cfg: func(*testing.T) Config {
+				return Config{MemorySize: 10}
+			},
+			actions: func(c *Cache) {
+				c.Set(key("a", 0), make([]byte, 4))
+				c.Set(key("b", 0), make([]byte, 4))
+				c.Get(key("a", 0))
+				c.Set(key("c", 0), make([]byte, 4))
+			},
+			wantHit:  []cache.Key{key("a", 0), key("c", 0)},
+			wantMiss: []cache.Key{key("b", 0)},
+			wantStats: cache.Stats{
+				Hits:      3,
+				Misses:    1,
+				Evictions: 1,
+				Items:     2,
+				Size:      8,
+			},
+		},
+		{
+			name: "skips objects larger than budget",
+			cfg: func(*testing.T) Config {
+				return Config{MemorySize: 10}
+			},
+			actions: func(c *Cache) {
+				c.Set(key("a", 0), make([]byte, 11))
+			},
+			wantMiss: []cache.Key{key("a", 0)},
+			wantStats: cache.Stats{
+				Misses: 1,
+			},
+		},
+		{
+			name: "invalidates every version of a key",
+			cfg: func(*testing.T) Config {
+				return Config{MemorySize: 100}
+			},
+			actions: func(c *Cache) {
+				c.Set(key("a", 0), make([]byte, 4))
+				c.Set(key("a", 1), make([]byte, 4))
+				c.Set(key("b", 0), make([]byte, 4))
+				c.Invalidate("bucket", "a")
+			},
+			wantHit:  []cache.Key{key("b", 0)},
+			wantMiss: []cache.Key{key("a", 0), key("a", 1)},
+			wantStats: cache.Stats{
+				Hits:   1,
+				Misses: 2,
+				Items:  1,
+				Size:   4,
+			},
+		},
+		{
+			name: "promotes disk hits to memory",
+			cfg: func(t *testing.T) Config {
+				return Config{MemorySize: 4, Directory: t.TempDir(), DiskSize: 100}
+			},
+			actions: func(c *Cache) {
+				c.Set(key("a", 0), []byte("aaaa"))
+				c.Set(key("b", 0), []byte("bbbb"))
+			},
+			wantHit: []cache.Key{key("a", 0), key("a", 0)},
+			wantStats: cache.Stats{
+				Hits:      1,
+				DiskHits:  1,
+				Evictions: 2,
+				Items:     1,
+				Size:      4,
+				DiskItems: 2,
+				DiskSize:  8,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(tt.cfg(t), zerolog.Nop())
+			require.NoError(t, err)
+
+			tt.actions(c)
+
+			for _, k := range tt.wantHit {
+				_, ok := c.Get(k)
+				assert.Truef(t, ok, "Get(%s)", k)
+			}
+			for _, k := range tt.wantMiss {
+				_, ok := c.Get(k)
+				assert.Falsef(t, ok, "Get(%s)", k)
+			}
+
+			assert.Equal(t, tt.wantStats, c.Stats())
+		})
+	}
+}
+
+func TestNew_Directory(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, dir string)
+		wantErr  bool
+		wantKept []string
+	}{
+		{
+			name:    "creates missing directory",
+			prepare: func(*testing.T, string) {},
+		},
+		{
+			name: "wipes previous cache",
+			prepare: func(t *testing.T, dir string) {
+				c, err := New(Config{MemorySize: 4, Directory: dir, DiskSize: 100}, zerolog.Nop())
+				require.NoError(t, err)
+				c.Set(cache.Key{Bucket: "bucket", Key: "a"}, []byte("aaaa"))
+			},
+		},
+		{
+			name: "refuses foreign directory",
+			prepare: func(t *testing.T, dir string) {
+				require.NoError(t, os.MkdirAll(dir, 0755))
+				require.NoError(t, os.WriteFile(path.Join(dir, "data"), []byte("data"), 0644))
+			},
+			wantErr:  true,
+			wantKept: []string{"data"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := path.Join(t.TempDir(), "cache")
+			tt.prepare(t, dir)
+
+			c, err := New(Config{MemorySize: 4, Directory: dir, DiskSize: 100}, zerolog.Nop())
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Zero(t, c.Stats().DiskItems)
+
+				entries, readErr := os.ReadDir(dir)
+				require.NoError(t, readErr)
+				require.Len(t, entries, 1)
+				assert.Equal(t, markerFile, entries[0].Name())
+			}
+
+			for _, name := range tt.wantKept {
+				assert.FileExists(t, path.Join(dir, name))
+			}
+		})
+	}
+}
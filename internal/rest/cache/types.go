@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+)
+
+type Cache interface {
+	Get(Key) ([]byte, bool)
+	Set(Key, []byte)
+	Invalidate(bucket, key string)
+	Stats() Stats
+}
+
+type Key struct {
+	Bucket  string
+	Key     string
+	Version int
+}
+
+func (k Key) String() string {
+	return strings.Join([]string{k.Bucket, k.Key, strconv.Itoa(k.Version)}, "/")
+}
+
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	DiskHits  uint64 `json:"disk_hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Items     int    `json:"items"`
+	Size      int64  `json:"size"`
+	DiskItems int    `json:"disk_items"`
+	DiskSize  int64  `json:"disk_size"`
+}
@@ -0,0 +1,172 @@
+package capacity
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+type NodeStats struct {
+	ID          string    `json:"id"`
+	TotalBytes  uint64    `json:"total_bytes"`
+	FreeBytes   uint64    `json:"free_bytes"`
+	TotalInodes uint64    `json:"total_inodes"`
+	FreeInodes  uint64    `json:"free_inodes"`
+	Full        bool      `json:"full"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Monitor keeps the last reported free space of every storage node.
+type Monitor struct {
+	cfg    Config
+	nodes  map[string]NodeStats
+	logger zerolog.Logger
+	mu     sync.RWMutex
+}
+
+func New(cfg Config, logger zerolog.Logger) *Monitor {
+	if cfg.HighWaterMark <= 0 || cfg.HighWaterMark > 1 {
+		cfg.HighWaterMark = 1
+	}
+	if cfg.PollTimeout <= 0 {
+		cfg.PollTimeout = cfg.PollInterval
+	}
+
+	return &Monitor{
+		cfg:    cfg,
+		nodes:  make(map[string]NodeStats),
+		logger: logger,
+	}
+}
+
+// Factor returns the share of free bytes of the node relative to the node with the most free bytes,
+// so weights scaled by it prefer emptier nodes. ok is false if the node is above the high-water mark.
+// Nodes that haven't reported stats yet get factor 1.
+func (m *Monitor) Factor(id string) (factor float64, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats, found := m.nodes[id]
+	if !found {
+		return 1, true
+	}
+
+	if stats.Full {
+		return 0, false
+	}
+
+	var maxFree uint64
+	for _, n := range m.nodes {
+		maxFree = max(maxFree, n.FreeBytes)
+	}
+
+	if maxFree == 0 {
+		return 1, true
+	}
+
+	return float64(stats.FreeBytes) / float64(maxFree), true
+}
+
+func (m *Monitor) Update(stats NodeStats) {
+	stats.Full = isAbove(stats.TotalBytes, stats.FreeBytes, m.cfg.HighWaterMark) ||
+		isAbove(stats.TotalInodes, stats.FreeInodes, m.cfg.HighWaterMark)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prev, ok := m.nodes[stats.ID]; ok && prev.Full != stats.Full {
+		m.logger.Warn().Str("node", stats.ID).Bool("full", stats.Full).Msg("node capacity state changed")
+	}
+
+	m.nodes[stats.ID] = stats
+}
+
+func (m *Monitor) Snapshot() []NodeStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make([]NodeStats, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		res = append(res, n)
+	}
+
+	slices.SortFunc(res, func(a, b NodeStats) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return res
+}
+
+// Run polls stats of every node returned by nodes each PollInterval until ctx is done. A node that fails
+// to report keeps its last stats, stats of nodes no longer returned by nodes are dropped.
+func (m *Monitor) Run(ctx context.Context, nodes func() []string, fetch func(ctx context.Context, id string) (*NodeStats, error)) {
+	if m.cfg.PollInterval <= 0 {
+		return
+	}
+
+	poll := func() {
+		ids := nodes()
+		m.retain(ids)
+
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				pollCtx, cancel := context.WithTimeout(ctx, m.cfg.PollTimeout)
+				defer cancel()
+
+				stats, err := fetch(pollCtx, id)
+				if err != nil {
+					m.logger.Debug().Err(err).Str("node", id).Msg("failed to get node stats")
+					return
+				}
+
+				stats.ID = id
+				stats.UpdatedAt = time.Now()
+				m.Update(*stats)
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	ticker := time.NewTicker(m.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		poll()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// retain drops stats of nodes that are not in ids.
+func (m *Monitor) retain(ids []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id := range m.nodes {
+		if !slices.Contains(ids, id) {
+			delete(m.nodes, id)
+		}
+	}
+}
+
+func isAbove(total, free uint64, mark float64) bool {
+	if total == 0 {
+		return false
+	}
+
+	return float64(total-min(free, total))/float64(total) >= mark
+}
@@ -0,0 +1,127 @@
+package capacity
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitor_Factor(t *testing.T) {
+	tests := []struct {
+		name          string
+		highWaterMark float64
+		stats         []NodeStats
+		id            string
+		wantFactor    float64
+		wantOK        bool
+	}{
+		{
+			name:       "unknown node",
+			stats:      []NodeStats{{ID: "a", TotalBytes: 100, FreeBytes: 50}},
+			id:         "b",
+			wantFactor: 1,
+			wantOK:     true,
+		},
+		{
+			name:       "share of the most free bytes",
+			stats:      []NodeStats{{ID: "a", TotalBytes: 100, FreeBytes: 20}, {ID: "b", TotalBytes: 100, FreeBytes: 80}},
+			id:         "a",
+			wantFactor: 0.25,
+			wantOK:     true,
+		},
+		{
+			name:       "node with the most free bytes",
+			stats:      []NodeStats{{ID: "a", TotalBytes: 100, FreeBytes: 20}, {ID: "b", TotalBytes: 100, FreeBytes: 80}},
+			id:         "b",
+			wantFactor: 1,
+			wantOK:     true,
+		},
+		{
+			name:          "below the high-water mark",
+			highWaterMark: 0.9,
+			stats:         []NodeStats{{ID: "a", TotalBytes: 100, FreeBytes: 11}, {ID: "b", TotalBytes: 100, FreeBytes: 44}},
+			id:            "a",
+			wantFactor:    0.25,
+			wantOK:        true,
+		},
+		{
+			name:          "bytes above the high-water mark",
+			highWaterMark: 0.9,
+			stats:         []NodeStats{{ID: "a", TotalBytes: 100, FreeBytes: 10}, {ID: "b", TotalBytes: 100, FreeBytes: 80}},
+			id:            "a",
+		},
+		{
+			name:          "inodes above the high-water mark",
+			highWaterMark: 0.9,
+			stats: []NodeStats{
+				{ID: "a", TotalBytes: 100, FreeBytes: 80, TotalInodes: 10, FreeInodes: 1},
+				{ID: "b", TotalBytes: 100, FreeBytes: 80},
+			},
+			id: "a",
+		},
+		{
+			name:  "completely full without a high-water mark",
+			stats: []NodeStats{{ID: "a", TotalBytes: 100}, {ID: "b", TotalBytes: 100, FreeBytes: 80}},
+			id:    "a",
+		},
+		{
+			name:       "no free bytes reported",
+			stats:      []NodeStats{{ID: "a"}, {ID: "b"}},
+			id:         "a",
+			wantFactor: 1,
+			wantOK:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(Config{HighWaterMark: tt.highWaterMark}, zerolog.Nop())
+			for _, stats := range tt.stats {
+				m.Update(stats)
+			}
+
+			factor, ok := m.Factor(tt.id)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.InDelta(t, tt.wantFactor, factor, 1e-9)
+		})
+	}
+}
+
+func TestMonitor_Run(t *testing.T) {
+	m := New(Config{PollInterval: time.Hour}, zerolog.Nop())
+	m.Update(NodeStats{ID: "removed", TotalBytes: 100, FreeBytes: 100})
+	m.Update(NodeStats{ID: "failing", TotalBytes: 100, FreeBytes: 20})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// with ctx done Run polls once
+	m.Run(ctx, func() []string {
+		return []string{"ok", "failing"}
+	}, func(_ context.Context, id string) (*NodeStats, error) {
+		if id == "failing" {
+			return nil, errors.New("unavailable")
+		}
+
+		return &NodeStats{TotalBytes: 100, FreeBytes: 80}, nil
+	})
+
+	snapshot := m.Snapshot()
+	require.Len(t, snapshot, 2)
+
+	assert.Equal(t, "failing", snapshot[0].ID)
+	assert.Equal(t, uint64(20), snapshot[0].FreeBytes, "a failed poll keeps the last stats")
+
+	assert.Equal(t, "ok", snapshot[1].ID)
+	assert.Equal(t, uint64(80), snapshot[1].FreeBytes)
+	assert.False(t, snapshot[1].UpdatedAt.IsZero())
+
+	factor, ok := m.Factor("failing")
+	assert.True(t, ok)
+	assert.InDelta(t, 0.25, factor, 1e-9, "stats of removed nodes are dropped")
+}
@@ -0,0 +1,11 @@
+package capacity
+
+import "time"
+
+type Config struct {
+	// HighWaterMark is the used share of bytes or inodes (0..1) after which a node gets no new parts.
+	HighWaterMark float64
+	// PollInterval is the interval of stats polling, zero disables polling.
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+}
@@ -6,4 +6,5 @@ var (
 	ErrNotFound   = errors.New("not found")
 	ErrBadRequest = errors.New("bad request")
 	ErrInternal   = errors.New("internal error")
+	ErrConflict   = errors.New("conflict")
 )
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/jessevdk/go-flags"
 )
 
@@ -8,14 +10,77 @@ type Config struct {
 	Host     string   `long:"host" env:"HOST" description:"Host" default:"localhost"`
 	Port     int      `long:"port" env:"PORT" description:"Port" default:"8080"`
 	MetaFile string   `long:"meta file" env:"META_FILE" description:"Meta state file" default:"meta.json"`
-	Storages []string `long:"storages" env:"STORAGES" env-delim:"," description:"Storages" default:"localhost:5555"`
-	Weights  []int    `long:"weights" env:"WEIGHTS" env-delim:"," description:"Weight for storages" default:"1"`
+	Storages []string `long:"storages" env:"STORAGES" env-delim:"," description:"Storages (empty - nodes register themselves)"`
+	Weights  []int    `long:"weights" env:"WEIGHTS" env-delim:"," description:"Weight for storages (empty - 1 for every storage)"`
+
+	AdminToken string `long:"admin-token" env:"ADMIN_TOKEN" description:"Bearer token required by /_admin routes, including storage heartbeats (empty - admin API is disabled)"`
+
+	MetaBackend          string        `long:"meta-backend" env:"META_BACKEND" description:"Meta storage, META_FILE is its state file or database" choice:"inmemory" choice:"bolt" choice:"sqlite" choice:"remote" default:"inmemory"`
+	MetaAddresses        []string      `long:"meta-address" env:"META_ADDRESS" env-delim:"," description:"Meta server addresses used by the remote meta backend, several for a raft cluster"`
+	MetaShards           int           `long:"meta-shards" env:"META_SHARDS" description:"Number of inmemory meta shards, each with its own lock" default:"64"`
+	MetaSnapshotInterval time.Duration `long:"meta-snapshot-interval" env:"META_SNAPSHOT_INTERVAL" description:"Interval between meta snapshots that truncate the write-ahead log (0 - only on shutdown)" default:"5m"`
+	MetaFeedSize         int           `long:"meta-feed-size" env:"META_FEED_SIZE" description:"Number of meta change events retained for watchers (0 - change feed is disabled)" default:"10000"`
+
+	Distributor            string        `long:"distributor" env:"DISTRIBUTOR" description:"Part distributor" choice:"weight" choice:"rendezvous" default:"weight"`
+	TopologyFile           string        `long:"topology-file" env:"TOPOLOGY_FILE" description:"Storage topology file mapping node IDs to addresses, runtime changes are saved to it (overrides storages)"`
+	TopologyReloadInterval time.Duration `long:"topology-reload-interval" env:"TOPOLOGY_RELOAD_INTERVAL" description:"How often the topology file is checked for changes (0 - disabled)" default:"10s"`
+	ConnectTimeout         time.Duration `long:"connect-timeout" env:"CONNECT_TIMEOUT" description:"Timeout for connecting to storages" default:"30s"`
+	HeartbeatTimeout       time.Duration `long:"heartbeat-timeout" env:"HEARTBEAT_TIMEOUT" description:"Missed heartbeats period after which a registered storage gets no new parts (0 - disabled)" default:"15s"`
+
+	ReplicationFactor int    `long:"replication-factor" env:"REPLICATION_FACTOR" description:"Number of storages every part is uploaded to" default:"1"`
+	PlacementDomain   string `long:"placement-domain" env:"PLACEMENT_DOMAIN" description:"Failure domain that replicas and parts are spread across" choice:"none" choice:"zone" choice:"rack" choice:"host" default:"host"`
+
+	StorageClasses       []string          `long:"storage-classes" env:"STORAGE_CLASSES" env-delim:"," description:"Storage classes as NAME[:POOL[:REPLICAS]] (empty - STANDARD on all storages)"`
+	DefaultStorageClass  string            `long:"default-storage-class" env:"DEFAULT_STORAGE_CLASS" description:"Storage class of uploads without one (empty - the first class)"`
+	BucketStorageClasses map[string]string `long:"bucket-storage-classes" env:"BUCKET_STORAGE_CLASSES" env-delim:"," description:"Storage classes of buckets as BUCKET:CLASS"`
 
 	MaxConnections int `long:"max-connections" env:"MAX_CONNECTIONS" description:"Max connections" default:"1000"`
 	MaxBodySize    int `long:"max-body-size" env:"MAX_BODY_SIZE" description:"Max body size" default:"1073741824"`
 	ChunkSize      int `long:"chunk-size" env:"CHUNK_SIZE" description:"Chunk size" default:"8192"`
 	MinPartSize    int `long:"min-part-size" env:"MIN_PART_SIZE" description:"Min part size" default:"8192"`
+	MaxPartSize    int `long:"max-part-size" env:"MAX_PART_SIZE" description:"Max part size (0 - unlimited)" default:"67108864"`
 	MaxParts       int `long:"max-parts" env:"MAX_PARTS" description:"Max parts" default:"6"`
+
+	UploadConcurrency int   `long:"upload-concurrency" env:"UPLOAD_CONCURRENCY" description:"Max parts uploaded concurrently" default:"4"`
+	UploadMemory      int64 `long:"upload-memory" env:"UPLOAD_MEMORY" description:"Memory in bytes for part buffers shared by all uploads (0 - unlimited)" default:"1073741824"`
+
+	HedgePercentile float64       `long:"hedge-percentile" env:"HEDGE_PERCENTILE" description:"Percentile of first chunk latency after which a download is hedged (0 - disabled)" default:"95"`
+	HedgeDelay      time.Duration `long:"hedge-delay" env:"HEDGE_DELAY" description:"Hedge delay used until enough latency samples are collected" default:"100ms"`
+
+	ReadPolicy string `long:"read-policy" env:"READ_POLICY" description:"Replica a part is read from" choice:"random" choice:"least-outstanding" choice:"ewma" choice:"same-zone" default:"ewma"`
+	Zone       string `long:"zone" env:"ZONE" description:"Zone of this node, used by the same-zone read policy"`
+
+	CacheSize          int64  `long:"cache-size" env:"CACHE_SIZE" description:"In-memory cache size in bytes (0 - disabled)" default:"0"`
+	CacheMaxObjectSize int    `long:"cache-max-object-size" env:"CACHE_MAX_OBJECT_SIZE" description:"Max size of a cached object" default:"8388608"`
+	CacheDirectory     string `long:"cache-directory" env:"CACHE_DIRECTORY" description:"Directory for the local-disk cache tier (empty - disabled)"`
+	CacheDiskSize      int64  `long:"cache-disk-size" env:"CACHE_DISK_SIZE" description:"Local-disk cache size in bytes" default:"1073741824"`
+
+	BreakerFailureThreshold int           `long:"breaker-failure-threshold" env:"BREAKER_FAILURE_THRESHOLD" description:"Consecutive failures that open a storage node breaker" default:"5"`
+	BreakerOpenTimeout      time.Duration `long:"breaker-open-timeout" env:"BREAKER_OPEN_TIMEOUT" description:"Time before an open breaker lets a trial request through" default:"10s"`
+	HealthProbeInterval     time.Duration `long:"health-probe-interval" env:"HEALTH_PROBE_INTERVAL" description:"Storage node probe interval (0 - disabled)" default:"5s"`
+	HealthProbeTimeout      time.Duration `long:"health-probe-timeout" env:"HEALTH_PROBE_TIMEOUT" description:"Storage node probe timeout" default:"1s"`
+
+	CapacityHighWaterMark float64       `long:"capacity-high-water-mark" env:"CAPACITY_HIGH_WATER_MARK" description:"Used share of storage node disk after which it gets no new parts" default:"0.9"`
+	CapacityPollInterval  time.Duration `long:"capacity-poll-interval" env:"CAPACITY_POLL_INTERVAL" description:"Storage node stats poll interval (0 - disabled)" default:"30s"`
+
+	RebalanceInterval        time.Duration `long:"rebalance-interval" env:"REBALANCE_INTERVAL" description:"Interval between rebalance passes, needs DISTRIBUTOR=rendezvous (0 - only on demand)" default:"1h"`
+	RebalanceBytesPerSecond  int64         `long:"rebalance-bytes-per-second" env:"REBALANCE_BYTES_PER_SECOND" description:"Rebalance transfer rate limit (0 - unlimited)" default:"10485760"`
+	RebalanceTransferTimeout time.Duration `long:"rebalance-transfer-timeout" env:"REBALANCE_TRANSFER_TIMEOUT" description:"Timeout for moving a single part" default:"5m"`
+	RebalanceDeleteDelay     time.Duration `long:"rebalance-delete-delay" env:"REBALANCE_DELETE_DELAY" description:"Delay before source copies of moved parts are deleted" default:"1m"`
+	RebalanceDeleteQueue     string        `long:"rebalance-delete-queue" env:"REBALANCE_DELETE_QUEUE" description:"File keeping source copies waiting for the delete delay across restarts (empty - left for fsck)"`
+	DrainRetryInterval       time.Duration `long:"drain-retry-interval" env:"DRAIN_RETRY_INTERVAL" description:"Interval between evacuation passes of draining storages" default:"30s"`
+	DrainStuckUploadAge      time.Duration `long:"drain-stuck-upload-age" env:"DRAIN_STUCK_UPLOAD_AGE" description:"Age after which parts of versions still loading are reported as stuck and don't block a drain (0 - never)" default:"24h"`
+
+	TieringRules    []string      `long:"tiering-rules" env:"TIERING_RULES" env-delim:"," description:"Rules moving old versions to another storage class as BUCKET:AGE:CLASS, * - any bucket"`
+	TieringInterval time.Duration `long:"tiering-interval" env:"TIERING_INTERVAL" description:"Interval between tiering passes (0 - only on demand)" default:"1h"`
+
+	MaxVersions         int            `long:"max-versions" env:"MAX_VERSIONS" description:"Versions kept per key, older noncurrent versions are pruned on upload (0 - unlimited)" default:"0"`
+	BucketMaxVersions   map[string]int `long:"bucket-max-versions" env:"BUCKET_MAX_VERSIONS" env-delim:"," description:"Versions kept per key in buckets as BUCKET:N (0 - unlimited)"`
+	VersionsDeleteDelay time.Duration  `long:"versions-delete-delay" env:"VERSIONS_DELETE_DELAY" description:"Delay before parts of pruned versions are deleted" default:"1m"`
+	VersionsDeleteQueue int            `long:"versions-delete-queue" env:"VERSIONS_DELETE_QUEUE" description:"Max pruned versions waiting for deletion of their parts, the rest are left for fsck" default:"10000"`
+	VersionsDeleteFile  string         `long:"versions-delete-file" env:"VERSIONS_DELETE_FILE" description:"File keeping pruned versions waiting for the delete delay across restarts (empty - left for fsck)"`
+
+	FsckOrphanAge time.Duration `long:"fsck-orphan-age" env:"FSCK_ORPHAN_AGE" description:"Files modified more recently before fsck started are never reported as orphaned" default:"1h"`
 }
 
 func FromEnv() (*Config, error) {
@@ -0,0 +1,142 @@
+package classes
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type class struct {
+	Class
+	distributor distributor.Dynamic
+}
+
+// ClassDistributor routes requests to a distributor per storage class. Every class has its own
+// placement and only uses the nodes of its pool.
+type ClassDistributor struct {
+	classes      []class
+	defaultClass string
+}
+
+func (c *ClassDistributor) GetPlan(req *distributor.PlanRequest) ([][]string, int) {
+	d, ok := c.ForClass(req.StorageClass)
+	if !ok {
+		return nil, 0
+	}
+
+	return d.GetPlan(req)
+}
+
+// GetClientByID looks the node up in every class, as a pool may be shared by classes and a node may
+// have moved to another pool.
+func (c *ClassDistributor) GetClientByID(id string) (proto.StorageClient, error) {
+	for _, cl := range c.classes {
+		if client, err := cl.distributor.GetClientByID(id); err == nil {
+			return client, nil
+		}
+	}
+
+	return nil, fmt.Errorf("client %s not found", id)
+}
+
+func (c *ClassDistributor) ForClass(name string) (distributor.Distributor, bool) {
+	cl, ok := c.class(name)
+	if !ok {
+		return nil, false
+	}
+
+	return cl.distributor, true
+}
+
+func (c *ClassDistributor) Replicas(name string) (int, bool) {
+	cl, ok := c.class(name)
+	if !ok {
+		return 0, false
+	}
+
+	return max(cl.Placement.Replicas, 1), true
+}
+
+func (c *ClassDistributor) class(name string) (class, bool) {
+	if name == "" {
+		name = c.defaultClass
+	}
+
+	for _, cl := range c.classes {
+		if cl.Name == name {
+			return cl, true
+		}
+	}
+
+	return class{}, false
+}
+
+// Classes returns names of the configured classes.
+func (c *ClassDistributor) Classes() []string {
+	names := make([]string, len(c.classes))
+	for i, cl := range c.classes {
+		names[i] = cl.Name
+	}
+
+	return names
+}
+
+// SetNodes passes every class the nodes of its pool.
+func (c *ClassDistributor) SetNodes(nodes []topology.Node) error {
+	for _, cl := range c.classes {
+		if err := cl.distributor.SetNodes(cl.poolNodes(nodes)); err != nil {
+			return fmt.Errorf("failed to set nodes of class %s: %w", cl.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c class) poolNodes(nodes []topology.Node) []topology.Node {
+	if c.Pool == "" {
+		return nodes
+	}
+
+	return slices.DeleteFunc(slices.Clone(nodes), func(n topology.Node) bool {
+		return n.Pool != c.Pool
+	})
+}
+
+func New(cfg DistributorConfig) (*ClassDistributor, error) {
+	if len(cfg.Classes) == 0 {
+		return nil, fmt.Errorf("no storage classes")
+	}
+
+	c := &ClassDistributor{
+		classes:      make([]class, 0, len(cfg.Classes)),
+		defaultClass: cfg.Default,
+	}
+	if c.defaultClass == "" {
+		c.defaultClass = cfg.Classes[0].Name
+	}
+
+	for _, cls := range cfg.Classes {
+		if _, ok := c.ForClass(cls.Name); ok {
+			return nil, fmt.Errorf("duplicate storage class %s", cls.Name)
+		}
+
+		cl := class{Class: cls}
+
+		d, err := cfg.New(cls, cl.poolNodes(cfg.Nodes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create distributor of class %s: %w", cls.Name, err)
+		}
+
+		cl.distributor = d
+		c.classes = append(c.classes, cl)
+	}
+
+	if _, ok := c.ForClass(c.defaultClass); !ok {
+		return nil, fmt.Errorf("unknown default storage class %s", c.defaultClass)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,198 @@
+package classes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/distributor/weight"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testClient struct {
+	proto.StorageClient
+}
+
+func testNode(id, pool string) topology.Node {
+	return topology.Node{ID: id, Address: id + ":5555", Weight: 1, Pool: pool, Client: &testClient{}}
+}
+
+func newTestDistributor(t *testing.T, nodes []topology.Node, classes ...Class) *ClassDistributor {
+	t.Helper()
+
+	d, err := New(DistributorConfig{
+		Nodes:   nodes,
+		Classes: classes,
+		New: func(c Class, nodes []topology.Node) (distributor.Dynamic, error) {
+			return weight.New(weight.DistributorConfig{
+				Nodes:     nodes,
+				Parts:     distributor.PartSizing{MinPartSize: 1, MaxParts: 4},
+				Placement: c.Placement,
+			})
+		},
+	})
+	require.NoError(t, err)
+
+	return d
+}
+
+func TestParseClass(t *testing.T) {
+	placement := distributor.Placement{Replicas: 1, Domain: distributor.DomainHost}
+
+	tests := []struct {
+		name    string
+		s       string
+		want    Class
+		wantErr bool
+	}{
+		{
+			name: "name only",
+			s:    "STANDARD",
+			want: Class{Name: "STANDARD", Placement: placement},
+		},
+		{
+			name: "pool",
+			s:    "STANDARD:ssd",
+			want: Class{Name: "STANDARD", Pool: "ssd", Placement: placement},
+		},
+		{
+			name: "pool and replicas",
+			s:    "COLD:hdd:2",
+			want: Class{Name: "COLD", Pool: "hdd", Placement: distributor.Placement{Replicas: 2, Domain: distributor.DomainHost}},
+		},
+		{
+			name:    "invalid replicas",
+			s:       "COLD:hdd:two",
+			wantErr: true,
+		},
+		{
+			name:    "no replicas",
+			s:       "COLD:hdd:0",
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			s:       ":hdd",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClass(tt.s, placement)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClassDistributor_GetPlan(t *testing.T) {
+	nodes := []topology.Node{
+		testNode("ssd-1", "ssd"),
+		testNode("ssd-2", "ssd"),
+		testNode("hdd-1", "hdd"),
+		testNode("hdd-2", "hdd"),
+		testNode("hdd-3", "hdd"),
+	}
+
+	d := newTestDistributor(t, nodes,
+		Class{Name: "STANDARD", Pool: "ssd", Placement: distributor.Placement{Replicas: 1, Domain: distributor.DomainNone}},
+		Class{Name: "COLD", Pool: "hdd", Placement: distributor.Placement{Replicas: 2, Domain: distributor.DomainNone}},
+	)
+
+	tests := []struct {
+		name         string
+		storageClass string
+		wantReplicas int
+		wantNodes    []string
+	}{
+		{
+			name:         "default class",
+			wantReplicas: 1,
+			wantNodes:    []string{"ssd-1", "ssd-2"},
+		},
+		{
+			name:         "cold",
+			storageClass: "COLD",
+			wantReplicas: 2,
+			wantNodes:    []string{"hdd-1", "hdd-2", "hdd-3"},
+		},
+		{
+			name:         "unknown class",
+			storageClass: "GLACIER",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicas, ok := d.Replicas(tt.storageClass)
+			assert.Equal(t, tt.wantReplicas != 0, ok)
+			assert.Equal(t, tt.wantReplicas, replicas)
+
+			plan, _ := d.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 100, StorageClass: tt.storageClass})
+			if tt.wantReplicas == 0 {
+				assert.Empty(t, plan)
+				return
+			}
+
+			require.NotEmpty(t, plan)
+			for _, servers := range plan {
+				assert.Len(t, servers, tt.wantReplicas)
+				assert.Subset(t, tt.wantNodes, servers)
+			}
+		})
+	}
+}
+
+func TestClassDistributor_SetNodes(t *testing.T) {
+	d := newTestDistributor(t, []topology.Node{testNode("ssd-1", "ssd")},
+		Class{Name: "STANDARD", Pool: "ssd", Placement: distributor.Placement{Replicas: 1, Domain: distributor.DomainNone}},
+		Class{Name: "ANY", Placement: distributor.Placement{Replicas: 1, Domain: distributor.DomainNone}},
+	)
+
+	plan, _ := d.GetPlan(&distributor.PlanRequest{FileSize: 1, StorageClass: "STANDARD"})
+	assert.Equal(t, [][]string{{"ssd-1"}}, plan)
+
+	require.NoError(t, d.SetNodes([]topology.Node{testNode("hdd-1", "hdd")}))
+
+	plan, _ = d.GetPlan(&distributor.PlanRequest{FileSize: 1, StorageClass: "STANDARD"})
+	assert.Empty(t, plan, "the pool has no nodes left")
+
+	plan, _ = d.GetPlan(&distributor.PlanRequest{FileSize: 1, StorageClass: "ANY"})
+	assert.Equal(t, [][]string{{"hdd-1"}}, plan, "a class without a pool uses every node")
+
+	_, err := d.GetClientByID("ssd-1")
+	assert.NoError(t, err, "removed nodes stay readable")
+
+	_, err = d.GetClientByID("unknown")
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	placement := distributor.Placement{Replicas: 1, Domain: distributor.DomainNone}
+
+	_, err := New(DistributorConfig{
+		Classes: []Class{{Name: "STANDARD", Placement: placement}, {Name: "STANDARD", Placement: placement}},
+		New: func(Class, []topology.Node) (distributor.Dynamic, error) {
+			return weight.New(weight.DistributorConfig{Parts: distributor.PartSizing{MinPartSize: 1, MaxParts: 1}, Placement: placement})
+		},
+	})
+	assert.Error(t, err, "duplicate class")
+
+	_, err = New(DistributorConfig{
+		Classes: []Class{{Name: "STANDARD", Placement: placement}},
+		Default: "COLD",
+		New: func(Class, []topology.Node) (distributor.Dynamic, error) {
+			return weight.New(weight.DistributorConfig{Parts: distributor.PartSizing{MinPartSize: 1, MaxParts: 1}, Placement: placement})
+		},
+	})
+	assert.Error(t, err, "unknown default class")
+}
@@ -0,0 +1,54 @@
+package classes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+const DefaultClass = "STANDARD"
+
+type Class struct {
+	Name string
+	// Pool is the pool of nodes the class is stored on, empty - all nodes.
+	Pool      string
+	Placement distributor.Placement
+}
+
+// ParseClass parses NAME[:POOL[:REPLICAS]], e.g. COLD:hdd:2. Missing replicas are taken from placement.
+func ParseClass(s string, placement distributor.Placement) (Class, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 || fields[0] == "" {
+		return Class{}, fmt.Errorf("invalid storage class %q", s)
+	}
+
+	c := Class{Name: fields[0], Placement: placement}
+	if len(fields) > 1 {
+		c.Pool = fields[1]
+	}
+	if len(fields) > 2 {
+		replicas, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return Class{}, fmt.Errorf("invalid replicas of storage class %q: %w", s, err)
+		}
+		if replicas < 1 {
+			return Class{}, fmt.Errorf("storage class %q needs at least one replica", s)
+		}
+
+		c.Placement.Replicas = replicas
+	}
+
+	return c, nil
+}
+
+type DistributorConfig struct {
+	Nodes   []topology.Node
+	Classes []Class
+	// Default is the class of requests without one, the first class if empty.
+	Default string
+	// New creates the distributor of a class for the nodes of its pool.
+	New func(c Class, nodes []topology.Node) (distributor.Dynamic, error)
+}
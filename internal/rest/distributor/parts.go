@@ -0,0 +1,53 @@
+package distributor
+
+import "errors"
+
+type PartSizing struct {
+	MaxParts    int
+	MinPartSize int
+	MaxPartSize int
+}
+
+func (p PartSizing) Validate() error {
+	if p.MaxParts <= 0 || p.MinPartSize <= 0 {
+		return errors.New("invalid part settings")
+	}
+
+	if p.MaxPartSize > 0 && p.MaxPartSize < p.MinPartSize {
+		return errors.New("max part size is less than min part size")
+	}
+
+	return nil
+}
+
+// Split returns the number of parts and the part size for a file. The file is split into MaxParts parts
+// unless they would be smaller than MinPartSize or larger than MaxPartSize.
+func (p PartSizing) Split(fileSize int) (parts int, size int) {
+	if fileSize <= 0 {
+		return 0, 0
+	}
+
+	size = fileSize / p.MaxParts
+	if size >= p.MinPartSize {
+		parts = p.MaxParts
+	} else {
+		size = p.MinPartSize
+		parts = divCeil(fileSize, p.MinPartSize)
+	}
+
+	if p.MaxPartSize > 0 && size > p.MaxPartSize {
+		parts = divCeil(fileSize, p.MaxPartSize)
+		size = divCeil(fileSize, parts)
+	}
+
+	return parts, size
+}
+
+func divCeil(a, b int) int {
+	res := a / b
+	if a%b != 0 {
+		res++
+	}
+
+	return res
+}
@@ -0,0 +1,53 @@
+package distributor
+
+import (
+	"fmt"
+
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+// FailureDomain is the level of the topology that replicas of a part must not share.
+type FailureDomain string
+
+const (
+	DomainNone FailureDomain = "none"
+	DomainZone FailureDomain = "zone"
+	DomainRack FailureDomain = "rack"
+	DomainHost FailureDomain = "host"
+)
+
+type Placement struct {
+	// Replicas is the number of nodes every part is uploaded to.
+	Replicas int
+	// Domain that replicas of a part are spread across. Parts of an object are spread across domains
+	// as well, as far as the distributor allows.
+	Domain FailureDomain
+}
+
+func (p Placement) Validate() error {
+	if p.Replicas <= 0 {
+		return fmt.Errorf("invalid replicas count %d", p.Replicas)
+	}
+
+	switch p.Domain {
+	case DomainNone, DomainZone, DomainRack, DomainHost:
+		return nil
+	default:
+		return fmt.Errorf("unknown failure domain %q", p.Domain)
+	}
+}
+
+// Of returns the failure domain of the node. A node without the label of the level is a domain
+// of its own, so unlabeled nodes are treated as independent.
+func (d FailureDomain) Of(n topology.Node) string {
+	switch {
+	case d == DomainZone && n.Zone != "":
+		return n.Zone
+	case d == DomainRack && n.Rack != "":
+		return n.Zone + "/" + n.Rack
+	case d == DomainHost && n.Host != "":
+		return n.Zone + "/" + n.Rack + "/" + n.Host
+	default:
+		return "node:" + n.ID
+	}
+}
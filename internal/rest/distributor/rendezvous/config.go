@@ -0,0 +1,14 @@
+package rendezvous
+
+import (
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+type DistributorConfig struct {
+	Nodes     []topology.Node
+	Parts     distributor.PartSizing
+	Placement distributor.Placement
+	Health    distributor.HealthChecker
+	Capacity  distributor.CapacityChecker
+}
@@ -0,0 +1,291 @@
+package rendezvous
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type node struct {
+	id     string
+	domain string
+	weight float64
+}
+
+// RendezvousDistributor places every part on the node with the highest weighted rendezvous score
+// for bucket/key/version/part. Placement is reproducible, and adding a node only moves the parts
+// that the new node wins.
+type RendezvousDistributor struct {
+	mu      sync.RWMutex
+	nodes   []node
+	clients map[string]proto.StorageClient
+	parts   distributor.PartSizing
+
+	placement distributor.Placement
+
+	health   distributor.HealthChecker
+	capacity distributor.CapacityChecker
+}
+
+// GetPlan places every part on the highest ranked node and its replicas on the next ranked nodes from
+// other failure domains, falling back to nodes from used domains when there are not enough domains.
+func (r *RendezvousDistributor) GetPlan(req *distributor.PlanRequest) ([][]string, int) {
+	parts, size := r.parts.Split(req.FileSize)
+	if parts == 0 {
+		return nil, 0
+	}
+
+	nodes := r.availableNodes()
+	if len(nodes) == 0 {
+		return nil, 0
+	}
+
+	replicas := max(r.placement.Replicas, 1)
+
+	plan := make([][]string, parts)
+	for i := range plan {
+		plan[i] = spread(rankNodes(nodes, PartKey(req.Bucket, req.Key, req.Version, i)), replicas)
+	}
+
+	return plan, size
+}
+
+func (r *RendezvousDistributor) GetClientByID(id string) (proto.StorageClient, error) {
+	r.mu.RLock()
+	cl, ok := r.clients[id]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("client %s not found", id)
+	}
+
+	return cl, nil
+}
+
+// Rank returns IDs of all nodes ordered by their score for the part, regardless of their health.
+// The first node is where the part should live.
+func (r *RendezvousDistributor) Rank(bucket, key string, version, part int) []string {
+	r.mu.RLock()
+	nodes := r.nodes
+	r.mu.RUnlock()
+
+	return rank(nodes, PartKey(bucket, key, version, part))
+}
+
+// Place returns where replicas of the part should live. It ranks nodes with the same capacity-scaled
+// weights as GetPlan, so parts GetPlan placed are not moved back onto fuller nodes, but it ignores health,
+// so the target doesn't change while nodes flap.
+func (r *RendezvousDistributor) Place(bucket, key string, version, part int) []string {
+	return spread(rankNodes(r.weightedNodes(), PartKey(bucket, key, version, part)), max(r.placement.Replicas, 1))
+}
+
+func (r *RendezvousDistributor) PickReplica(bucket, key string, version, part int, keep []string) (string, bool) {
+	ranked := rankNodes(r.availableNodes(), PartKey(bucket, key, version, part))
+
+	usedDomains := make(map[string]bool, len(keep))
+	for _, n := range ranked {
+		if slices.Contains(keep, n.id) {
+			usedDomains[n.domain] = true
+		}
+	}
+
+	for _, spread := range []bool{true, false} {
+		for _, n := range ranked {
+			if !slices.Contains(keep, n.id) && (!spread || !usedDomains[n.domain]) {
+				return n.id, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// availableNodes returns the weighted nodes, skipping unhealthy ones. Unhealthy nodes are kept if there
+// are no others, see distributor.HealthChecker.
+func (r *RendezvousDistributor) availableNodes() []node {
+	withSpace := r.weightedNodes()
+
+	if r.health == nil {
+		return withSpace
+	}
+
+	healthy := slices.DeleteFunc(slices.Clone(withSpace), func(n node) bool {
+		return !r.health.Available(n.id)
+	})
+	if len(healthy) == 0 {
+		return withSpace
+	}
+
+	return healthy
+}
+
+// weightedNodes returns nodes with weights scaled by free capacity, skipping full ones.
+func (r *RendezvousDistributor) weightedNodes() []node {
+	r.mu.RLock()
+	nodes := r.nodes
+	r.mu.RUnlock()
+
+	res := make([]node, 0, len(nodes))
+	for _, n := range nodes {
+		var ok bool
+		if n.weight, ok = distributor.CapacityWeight(r.capacity, n.id, n.weight); ok {
+			res = append(res, n)
+		}
+	}
+
+	return res
+}
+
+// SetNodes replaces the node set. Drained nodes keep their clients but are not ranked. The set may be
+// empty, then GetPlan returns no plan.
+func (r *RendezvousDistributor) SetNodes(nodes []topology.Node) error {
+	placed := make([]node, 0, len(nodes))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clients := make(map[string]proto.StorageClient, len(r.clients)+len(nodes))
+	for id, cl := range r.clients {
+		clients[id] = cl
+	}
+
+	for _, n := range nodes {
+		if n.ID == "" || n.Client == nil {
+			return fmt.Errorf("node %s is not connected", n.Address)
+		}
+
+		clients[n.ID] = n.Client
+		if !n.Drain && n.Weight > 0 {
+			placed = append(placed, node{id: n.ID, domain: r.placement.Domain.Of(n), weight: float64(n.Weight)})
+		}
+	}
+
+	r.nodes, r.clients = placed, clients
+
+	return nil
+}
+
+func New(cfg DistributorConfig) (*RendezvousDistributor, error) {
+	if err := cfg.Parts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Placement.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &RendezvousDistributor{
+		parts:     cfg.Parts,
+		placement: cfg.Placement,
+
+		health:   cfg.Health,
+		capacity: cfg.Capacity,
+	}
+
+	if err := r.SetNodes(cfg.Nodes); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func PartKey(bucket, key string, version, part int) string {
+	return bucket + "/" + key + "/" + strconv.Itoa(version) + "/" + strconv.Itoa(part)
+}
+
+func rank(nodes []node, key string) []string {
+	ranked := rankNodes(nodes, key)
+
+	res := make([]string, len(ranked))
+	for i := range ranked {
+		res[i] = ranked[i].id
+	}
+
+	return res
+}
+
+func rankNodes(nodes []node, key string) []node {
+	type scored struct {
+		node
+		score float64
+	}
+
+	scores := make([]scored, len(nodes))
+	for i, n := range nodes {
+		scores[i] = scored{node: n, score: score(key, n)}
+	}
+
+	slices.SortFunc(scores, func(a, b scored) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		default:
+			return strings.Compare(a.id, b.id)
+		}
+	})
+
+	res := make([]node, len(scores))
+	for i := range scores {
+		res[i] = scores[i].node
+	}
+
+	return res
+}
+
+// spread picks n nodes in rank order, skipping nodes from already used domains while possible.
+func spread(ranked []node, n int) []string {
+	res := make([]string, 0, n)
+	used := make([]bool, len(ranked))
+	domains := make(map[string]bool, n)
+
+	for _, sameDomain := range []bool{false, true} {
+		for i, nd := range ranked {
+			if len(res) == n {
+				return res
+			}
+
+			if used[i] || (!sameDomain && domains[nd.domain]) {
+				continue
+			}
+
+			res = append(res, nd.id)
+			used[i] = true
+			domains[nd.domain] = true
+		}
+	}
+
+	return res
+}
+
+// score is the weighted rendezvous score -w/ln(h), where h is the key/node hash mapped to (0, 1).
+func score(key string, n node) float64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(n.id))
+
+	unit := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+
+	return -n.weight / math.Log(unit)
+}
+
+// mix is the splitmix64 finalizer, fnv alone is poorly distributed in the high bits for similar keys.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
@@ -0,0 +1,199 @@
+package rendezvous
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+)
+
+type testHealth map[string]bool
+
+func (h testHealth) Available(id string) bool {
+	return !h[id]
+}
+
+func newTestDistributor(health distributor.HealthChecker, weights ...int) *RendezvousDistributor {
+	r := &RendezvousDistributor{
+		parts:  distributor.PartSizing{MinPartSize: 1, MaxParts: 1},
+		health: health,
+	}
+
+	for i, w := range weights {
+		r.nodes = append(r.nodes, node{id: fmt.Sprintf("node-%02d", i), weight: float64(w)})
+	}
+
+	return r
+}
+
+func place(r *RendezvousDistributor, objects int) map[string]string {
+	res := make(map[string]string, objects)
+
+	for i := 0; i < objects; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		servers, _ := r.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: key, FileSize: 1})
+		res[key] = servers[0][0]
+	}
+
+	return res
+}
+
+func TestRendezvousDistributor_GetPlan(t *testing.T) {
+	const objects = 20000
+
+	tests := []struct {
+		name      string
+		weights   []int
+		health    testHealth
+		wantShare map[string]float64
+	}{
+		{
+			name:    "equal weights",
+			weights: []int{1, 1, 1, 1},
+			wantShare: map[string]float64{
+				"node-00": 0.25,
+				"node-01": 0.25,
+				"node-02": 0.25,
+				"node-03": 0.25,
+			},
+		},
+		{
+			name:    "weighted",
+			weights: []int{1, 3},
+			wantShare: map[string]float64{
+				"node-00": 0.25,
+				"node-01": 0.75,
+			},
+		},
+		{
+			name:    "unhealthy node is skipped",
+			weights: []int{1, 1, 1},
+			health:  testHealth{"node-01": true},
+			wantShare: map[string]float64{
+				"node-00": 0.5,
+				"node-02": 0.5,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestDistributor(tt.health, tt.weights...)
+
+			placement := place(r, objects)
+			assert.Equal(t, placement, place(r, objects), "placement is reproducible")
+
+			usage := make(map[string]int)
+			for _, id := range placement {
+				usage[id]++
+			}
+
+			require.Len(t, usage, len(tt.wantShare))
+			for id, share := range tt.wantShare {
+				assert.InDeltaf(t, share, float64(usage[id])/objects, 0.02, "share of %s", id)
+			}
+		})
+	}
+}
+
+type testCapacity map[string]float64
+
+func (c testCapacity) Factor(id string) (float64, bool) {
+	factor, ok := c[id]
+	if !ok {
+		return 1, true
+	}
+
+	return factor, factor > 0
+}
+
+func TestRendezvousDistributor_Place(t *testing.T) {
+	r := newTestDistributor(testHealth{"node-03": true}, 1, 1, 1, 1)
+	r.placement = distributor.Placement{Replicas: 2, Domain: distributor.DomainNone}
+	r.capacity = testCapacity{"node-00": 0.1, "node-01": 0.5, "node-02": 0}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		servers := r.Place("bucket", key, 0, 0)
+		assert.NotContains(t, servers, "node-02", "full nodes get no parts")
+
+		if slices.Contains(servers, "node-03") {
+			// Place ignores health, GetPlan avoids the unhealthy node
+			continue
+		}
+
+		plan, _ := r.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: key, FileSize: 1})
+		assert.Equal(t, plan[0], servers, "parts placed by GetPlan are not moved")
+	}
+}
+
+func TestRendezvousDistributor_AddNode(t *testing.T) {
+	const objects = 20000
+
+	before := place(newTestDistributor(nil, 1, 1, 1, 1), objects)
+	after := place(newTestDistributor(nil, 1, 1, 1, 1, 1), objects)
+
+	moved := 0
+	for key, id := range after {
+		if id != before[key] {
+			moved++
+			assert.Equal(t, "node-04", id, "parts only move to the new node")
+		}
+	}
+
+	assert.InDelta(t, 0.2, float64(moved)/objects, 0.02)
+}
+
+func TestRendezvousDistributor_Replicas(t *testing.T) {
+	tests := []struct {
+		name        string
+		domains     []string
+		replicas    int
+		wantDomains int
+	}{
+		{
+			name:        "replicas on different domains",
+			domains:     []string{"h1", "h1", "h2", "h2", "h3", "h3"},
+			replicas:    3,
+			wantDomains: 3,
+		},
+		{
+			name:        "more replicas than domains",
+			domains:     []string{"h1", "h1", "h1", "h2"},
+			replicas:    3,
+			wantDomains: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestDistributor(nil)
+			r.placement = distributor.Placement{Replicas: tt.replicas, Domain: distributor.DomainHost}
+			r.parts.MaxParts = 1
+
+			domainOf := make(map[string]string)
+			for i, domain := range tt.domains {
+				id := fmt.Sprintf("node-%02d", i)
+				r.nodes = append(r.nodes, node{id: id, domain: domain, weight: 1})
+				domainOf[id] = domain
+			}
+
+			for i := 0; i < 1000; i++ {
+				plan, _ := r.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: fmt.Sprintf("key-%d", i), FileSize: 1})
+				require.Len(t, plan, 1)
+				require.Len(t, plan[0], tt.replicas)
+
+				domains := make(map[string]bool)
+				for _, id := range plan[0] {
+					domains[domainOf[id]] = true
+				}
+				assert.Len(t, domains, tt.wantDomains)
+				assert.Equal(t, r.Rank("bucket", fmt.Sprintf("key-%d", i), 0, 0)[0], plan[0][0])
+			}
+		})
+	}
+}
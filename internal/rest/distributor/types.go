@@ -1,8 +1,78 @@
 package distributor
 
-import "github.com/theoptz/basic-s3/proto"
+import (
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type PlanRequest struct {
+	Bucket   string
+	Key      string
+	Version  int
+	FileSize int
+	// StorageClass is empty for the default class.
+	StorageClass string
+}
 
 type Distributor interface {
-	GetPlan(fileSize int) (clients []int, size int)
-	GetClientByID(id int) (proto.StorageClient, error)
+	// GetPlan returns node IDs for every part, one per replica, and the part size.
+	GetPlan(req *PlanRequest) (parts [][]string, size int)
+	GetClientByID(id string) (proto.StorageClient, error)
+}
+
+// Dynamic is a Distributor whose node set can be replaced at runtime. Clients of removed nodes stay
+// resolvable by ID, so parts already placed there can still be read.
+type Dynamic interface {
+	Distributor
+	SetNodes(nodes []topology.Node) error
+}
+
+// Placer is implemented by distributors with a stable placement. Place returns the nodes the replicas of
+// a part should live on, fewer than the replication factor only if there are not enough nodes.
+type Placer interface {
+	Place(bucket, key string, version, part int) []string
+}
+
+// ReplicaPicker chooses a node for a new replica of an existing part, e.g. when a node is drained.
+// The node is not one of keep and is from a failure domain keep doesn't use, if there is one.
+type ReplicaPicker interface {
+	PickReplica(bucket, key string, version, part int, keep []string) (string, bool)
+}
+
+// ClassRouter is implemented by distributors that place storage classes on separate node pools.
+// ForClass returns the distributor of the class and Replicas the number of replicas of its parts,
+// both for the default class if the name is empty.
+type ClassRouter interface {
+	ForClass(name string) (Distributor, bool)
+	Replicas(name string) (int, bool)
+}
+
+// HealthChecker reports whether a storage node may receive new requests. It must not change the state of
+// the node, plans are made without sending anything. If every node with free space is unavailable,
+// distributors plan on them anyway, so uploads fail fast instead of having no plan.
+type HealthChecker interface {
+	Available(id string) bool
+}
+
+// CapacityChecker scales node weights by free space. ok is false for nodes that must not get new parts.
+type CapacityChecker interface {
+	Factor(id string) (factor float64, ok bool)
+}
+
+// minCapacityFactor keeps nodes that are almost full but below the high-water mark in rotation.
+const minCapacityFactor = 0.01
+
+// CapacityWeight scales the weight of a node by its free capacity. ok is false for nodes that must not
+// get new parts. A nil checker keeps every weight.
+func CapacityWeight(capacity CapacityChecker, id string, weight float64) (float64, bool) {
+	if capacity == nil {
+		return weight, true
+	}
+
+	factor, ok := capacity.Factor(id)
+	if !ok {
+		return 0, false
+	}
+
+	return weight * max(factor, minCapacityFactor), true
 }
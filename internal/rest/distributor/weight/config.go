@@ -1,8 +1,14 @@
 package weight
 
+import (
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
 type DistributorConfig struct {
-	Endpoints   []string
-	Weights     []int
-	MaxParts    int
-	MinPartSize int
+	Nodes     []topology.Node
+	Parts     distributor.PartSizing
+	Placement distributor.Placement
+	Health    distributor.HealthChecker
+	Capacity  distributor.CapacityChecker
 }
@@ -3,103 +3,347 @@ package weight
 import (
 	"fmt"
 	"math/rand"
+	"slices"
+	"sync"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
 	"github.com/theoptz/basic-s3/proto"
 )
 
 type WeightDistributor struct {
-	clients     []proto.StorageClient
-	weights     []int
-	minPartSize int
-	maxParts    int
+	mu      sync.RWMutex
+	ids     []string
+	domains []string
+	clients map[string]proto.StorageClient
+	weights []int
+
+	parts     distributor.PartSizing
+	placement distributor.Placement
+
+	health   distributor.HealthChecker
+	capacity distributor.CapacityChecker
 }
 
-func (w *WeightDistributor) GetPlan(fileSize int) ([]int, int) {
-	if fileSize <= 0 {
+// GetPlan spreads parts evenly over failure domains and then over nodes inside a domain, picking both
+// proportionally to weight. Replicas of a part go to other domains while there are any left.
+func (w *WeightDistributor) GetPlan(req *distributor.PlanRequest) ([][]string, int) {
+	parts, size := w.parts.Split(req.FileSize)
+	if parts == 0 {
+		return nil, 0
+	}
+
+	w.mu.RLock()
+	ids, domains := w.ids, w.domains
+	weights, available := w.availableWeights()
+	w.mu.RUnlock()
+
+	if available == 0 {
 		return nil, 0
 	}
 
-	var parts int
-	size := fileSize / w.maxParts
-	if size >= w.minPartSize {
-		parts = w.maxParts
-	} else {
-		size = w.minPartSize
-		parts = fileSize / w.minPartSize
-		if fileSize%w.minPartSize != 0 {
-			parts++
+	if len(domains) != len(ids) {
+		domains = ids
+	}
+
+	replicas := min(max(w.placement.Replicas, 1), available)
+	primaries := selectPrimaries(weights, domains, parts)
+
+	plan := make([][]string, parts)
+	for i, primary := range primaries {
+		servers := make([]string, 0, replicas)
+		for _, idx := range selectReplicas(weights, domains, primary, replicas) {
+			servers = append(servers, ids[idx])
 		}
+
+		plan[i] = servers
 	}
 
-	selectedServers := selectServers(w.weights, parts)
+	return plan, size
+}
+
+func (w *WeightDistributor) PickReplica(_, _ string, _, _ int, keep []string) (string, bool) {
+	w.mu.RLock()
+	ids, domains := w.ids, w.domains
+	weights, _ := w.availableWeights()
+	w.mu.RUnlock()
 
-	return selectedServers, size
+	if len(domains) != len(ids) {
+		domains = ids
+	}
+
+	usedDomains := make(map[string]bool, len(keep))
+	for i, id := range ids {
+		if slices.Contains(keep, id) {
+			weights[i] = 0
+			usedDomains[domains[i]] = true
+		}
+	}
+
+	candidates := make([]float64, len(weights))
+	for _, spread := range []bool{true, false} {
+		found := false
+		for i, weight := range weights {
+			candidates[i] = 0
+			if weight > 0 && (!spread || !usedDomains[domains[i]]) {
+				candidates[i] = weight
+				found = true
+			}
+		}
+
+		if found {
+			return ids[selectServers(candidates, 1)[0]], true
+		}
+	}
+
+	return "", false
 }
 
-func (w *WeightDistributor) GetClientByID(id int) (proto.StorageClient, error) {
-	if id >= len(w.clients) {
-		return nil, fmt.Errorf("client %d not found", id)
+// availableWeights returns weights scaled by free capacity, with full and unhealthy nodes zeroed, and
+// the number of nodes left. Unhealthy nodes are kept if there are no others, see distributor.HealthChecker.
+func (w *WeightDistributor) availableWeights() ([]float64, int) {
+	weights := make([]float64, len(w.weights))
+	healthy := make([]bool, len(w.weights))
+
+	available, withSpace := 0, 0
+
+	for i, weight := range w.weights {
+		if weight <= 0 {
+			continue
+		}
+
+		scaled, ok := distributor.CapacityWeight(w.capacity, w.ids[i], float64(weight))
+		if !ok {
+			continue
+		}
+
+		weights[i] = scaled
+		withSpace++
+
+		if w.health == nil || w.health.Available(w.ids[i]) {
+			healthy[i] = true
+			available++
+		}
+	}
+
+	if available == 0 {
+		return weights, withSpace
+	}
+
+	for i := range weights {
+		if !healthy[i] {
+			weights[i] = 0
+		}
 	}
 
-	return w.clients[id], nil
+	return weights, available
+}
+
+func (w *WeightDistributor) GetClientByID(id string) (proto.StorageClient, error) {
+	w.mu.RLock()
+	cl, ok := w.clients[id]
+	w.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("client %s not found", id)
+	}
+
+	return cl, nil
+}
+
+// SetNodes replaces the node set. Drained nodes keep their clients but get no new parts. The set may be
+// empty, e.g. before storage nodes have registered, then GetPlan returns no plan.
+func (w *WeightDistributor) SetNodes(nodes []topology.Node) error {
+	ids := make([]string, len(nodes))
+	domains := make([]string, len(nodes))
+	weights := make([]int, len(nodes))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	clients := make(map[string]proto.StorageClient, len(w.clients)+len(nodes))
+	for id, cl := range w.clients {
+		clients[id] = cl
+	}
+
+	for i, node := range nodes {
+		if node.ID == "" || node.Client == nil {
+			return fmt.Errorf("node %s is not connected", node.Address)
+		}
+
+		ids[i] = node.ID
+		domains[i] = w.placement.Domain.Of(node)
+		clients[node.ID] = node.Client
+		if !node.Drain && node.Weight > 0 {
+			weights[i] = node.Weight
+		}
+	}
+
+	w.ids, w.domains, w.weights, w.clients = ids, domains, weights, clients
+
+	return nil
 }
 
 func New(cfg DistributorConfig) (*WeightDistributor, error) {
-	if len(cfg.Endpoints) == 0 {
-		return nil, fmt.Errorf("no endpoints provided")
+	if err := cfg.Parts.Validate(); err != nil {
+		return nil, err
 	}
 
-	if len(cfg.Weights) != len(cfg.Endpoints) {
-		return nil, fmt.Errorf("invalid weights")
+	if err := cfg.Placement.Validate(); err != nil {
+		return nil, err
 	}
 
 	w := &WeightDistributor{
-		clients:     make([]proto.StorageClient, len(cfg.Endpoints)),
-		weights:     cfg.Weights,
-		maxParts:    cfg.MaxParts,
-		minPartSize: cfg.MinPartSize,
+		parts:     cfg.Parts,
+		placement: cfg.Placement,
+		health:    cfg.Health,
+		capacity:  cfg.Capacity,
+	}
+
+	if err := w.SetNodes(cfg.Nodes); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// selectPrimaries picks a node for each of n parts. Domains are picked with selectServers by their total
+// weight, so parts are spread over domains, and then nodes are picked the same way inside each domain.
+func selectPrimaries(weights []float64, domains []string, n int) []int {
+	index := make(map[string]int)
+	var domainWeights []float64
+	var members [][]int
+
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+
+		d, ok := index[domains[i]]
+		if !ok {
+			d = len(domainWeights)
+			index[domains[i]] = d
+			domainWeights = append(domainWeights, 0)
+			members = append(members, nil)
+		}
+
+		domainWeights[d] += weight
+		members[d] = append(members[d], i)
+	}
+
+	picked := selectServers(domainWeights, n)
+
+	counts := make([]int, len(members))
+	for _, d := range picked {
+		counts[d]++
 	}
 
-	for i := range cfg.Endpoints {
-		conn, err := grpc.NewClient(cfg.Endpoints[i], grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			return nil, err
+	nodes := make([][]int, len(members))
+	for d := range members {
+		if counts[d] == 0 {
+			continue
+		}
+
+		memberWeights := make([]float64, len(members[d]))
+		for j, idx := range members[d] {
+			memberWeights[j] = weights[idx]
 		}
 
-		w.clients[i] = proto.NewStorageClient(conn)
+		for _, j := range selectServers(memberWeights, counts[d]) {
+			nodes[d] = append(nodes[d], members[d][j])
+		}
 	}
 
-	return w, nil
+	res := make([]int, n)
+	for i, d := range picked {
+		res[i] = nodes[d][0]
+		nodes[d] = nodes[d][1:]
+	}
+
+	return res
 }
 
-func selectServers(weights []int, n int) []int {
-	availableServers := make([]int, len(weights))
-	copy(availableServers, weights)
+// selectReplicas returns the primary followed by n-1 more nodes picked proportionally to weight, from
+// domains not used by the part yet if possible and from any other node otherwise.
+func selectReplicas(weights []float64, domains []string, primary, n int) []int {
+	res := []int{primary}
+	usedDomains := map[string]bool{domains[primary]: true}
+	usedNodes := map[int]bool{primary: true}
 
-	selectedServers := make([]int, 0, n)
+	candidates := make([]float64, len(weights))
+	for len(res) < n {
+		found := false
+		for _, spread := range []bool{true, false} {
+			for i, weight := range weights {
+				candidates[i] = 0
+				if weight > 0 && !usedNodes[i] && (!spread || !usedDomains[domains[i]]) {
+					candidates[i] = weight
+					found = true
+				}
+			}
+
+			if found {
+				break
+			}
+		}
+
+		if !found {
+			break
+		}
 
-	totalWeight := 0
-	for _, weight := range availableServers {
-		totalWeight += weight
+		idx := selectServers(candidates, 1)[0]
+		res = append(res, idx)
+		usedNodes[idx] = true
+		usedDomains[domains[idx]] = true
 	}
 
+	return res
+}
+
+// selectServers picks n servers with probability proportional to their weights. A server is not picked
+// twice until every server with a positive weight has been picked, so parts are spread over all servers
+// even when there are more parts than servers.
+func selectServers(weights []float64, n int) []int {
+	availableServers := make([]float64, len(weights))
+	selectedServers := make([]int, 0, n)
+
+	var totalWeight float64
+	left := 0
+
 	for i := 0; i < n; i++ {
-		randomValue := rand.Intn(totalWeight) + 1
+		if left == 0 {
+			copy(availableServers, weights)
+
+			totalWeight = 0
+			for _, weight := range availableServers {
+				if weight > 0 {
+					totalWeight += weight
+					left++
+				}
+			}
+		}
 
-		cumulativeWeight := 0
+		randomValue := rand.Float64() * totalWeight
+
+		selected := -1
+		var cumulativeWeight float64
 		for index, weight := range availableServers {
-			cumulativeWeight += weight
-			if randomValue <= cumulativeWeight {
-				selectedServers = append(selectedServers, index)
+			if weight <= 0 {
+				continue
+			}
 
-				totalWeight -= weight
-				availableServers[index] = 0
+			selected = index
+			cumulativeWeight += weight
+			if randomValue < cumulativeWeight {
 				break
 			}
 		}
+
+		selectedServers = append(selectedServers, selected)
+
+		totalWeight -= availableServers[selected]
+		availableServers[selected] = 0
+		left--
 	}
 
 	return selectedServers
@@ -0,0 +1,447 @@
+package weight
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testHealth map[string]bool
+
+func (h testHealth) Available(id string) bool {
+	return !h[id]
+}
+
+type testCapacity map[string]float64
+
+func (c testCapacity) Factor(id string) (float64, bool) {
+	factor, ok := c[id]
+	if !ok {
+		return 1, true
+	}
+
+	return factor, factor > 0
+}
+
+func TestWeightDistributor_GetPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		distributor *WeightDistributor
+		fileSize    int
+		wantParts   int
+		wantSize    int
+		wantServers []string
+	}{
+		{
+			name: "empty file",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 2},
+			},
+			fileSize:  0,
+			wantParts: 0,
+			wantSize:  0,
+		},
+		{
+			name: "small file uses min part size",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 3},
+			},
+			fileSize:  15,
+			wantParts: 2,
+			wantSize:  10,
+		},
+		{
+			name: "max parts",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 3},
+			},
+			fileSize:  300,
+			wantParts: 3,
+			wantSize:  100,
+		},
+		{
+			name: "more parts than servers",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 7},
+			},
+			fileSize:  700,
+			wantParts: 7,
+			wantSize:  100,
+		},
+		{
+			name: "max part size splits large files",
+			distributor: &WeightDistributor{
+				weights: []int{1, 2, 3},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxPartSize: 40, MaxParts: 3},
+			},
+			fileSize:  1000,
+			wantParts: 25,
+			wantSize:  40,
+		},
+		{
+			name: "max part size rounds part size up",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxPartSize: 40, MaxParts: 2},
+			},
+			fileSize:  110,
+			wantParts: 3,
+			wantSize:  37,
+		},
+		{
+			name: "unhealthy servers are skipped",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 4},
+				health:  testHealth{"a": true, "c": true},
+			},
+			fileSize:    400,
+			wantParts:   4,
+			wantSize:    100,
+			wantServers: []string{"b"},
+		},
+		{
+			name: "all servers unhealthy",
+			distributor: &WeightDistributor{
+				weights: []int{1, 1},
+				parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 2},
+				health:  testHealth{"a": true, "b": true},
+			},
+			fileSize:    200,
+			wantParts:   2,
+			wantSize:    100,
+			wantServers: []string{"a", "b"},
+		},
+		{
+			name: "full servers are refused",
+			distributor: &WeightDistributor{
+				weights:  []int{1, 1, 1},
+				parts:    distributor.PartSizing{MinPartSize: 10, MaxParts: 4},
+				capacity: testCapacity{"a": 0, "b": 0.5},
+			},
+			fileSize:    400,
+			wantParts:   4,
+			wantSize:    100,
+			wantServers: []string{"b", "c"},
+		},
+		{
+			name: "full servers are refused even if others are unhealthy",
+			distributor: &WeightDistributor{
+				weights:  []int{1, 1},
+				parts:    distributor.PartSizing{MinPartSize: 10, MaxParts: 2},
+				health:   testHealth{"b": true},
+				capacity: testCapacity{"a": 0},
+			},
+			fileSize:    200,
+			wantParts:   2,
+			wantSize:    100,
+			wantServers: []string{"b"},
+		},
+		{
+			name: "all servers full",
+			distributor: &WeightDistributor{
+				weights:  []int{1, 1},
+				parts:    distributor.PartSizing{MinPartSize: 10, MaxParts: 2},
+				capacity: testCapacity{"a": 0, "b": 0},
+			},
+			fileSize:  200,
+			wantParts: 0,
+			wantSize:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.distributor.ids = []string{"a", "b", "c"}[:len(tt.distributor.weights)]
+
+			servers, size := tt.distributor.GetPlan(&distributor.PlanRequest{
+				Bucket:   "bucket",
+				Key:      "key",
+				FileSize: tt.fileSize,
+			})
+
+			assert.Len(t, servers, tt.wantParts)
+			assert.Equal(t, tt.wantSize, size)
+
+			usage := make(map[string]int)
+			for _, part := range servers {
+				assert.Len(t, part, 1)
+				usage[part[0]]++
+			}
+
+			if tt.wantServers != nil {
+				assert.ElementsMatch(t, tt.wantServers, keys(usage))
+			}
+
+			// parts are spread evenly over the servers in use
+			minUsage, maxUsage := tt.wantParts, 0
+			for _, n := range usage {
+				minUsage = min(minUsage, n)
+				maxUsage = max(maxUsage, n)
+			}
+			if len(usage) > 0 {
+				assert.LessOrEqual(t, maxUsage-minUsage, 1)
+			}
+		})
+	}
+}
+
+func TestWeightDistributor_GetPlan_EqualWeights(t *testing.T) {
+	w := &WeightDistributor{
+		ids:     []string{"a", "b", "c"},
+		weights: []int{1, 1, 1},
+		parts:   distributor.PartSizing{MinPartSize: 10, MaxParts: 7},
+	}
+
+	total := make(map[string]int)
+	for range 300 {
+		servers, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 700})
+		require.Len(t, servers, 7)
+
+		usage := make(map[string]int)
+		for _, part := range servers {
+			usage[part[0]]++
+			total[part[0]]++
+		}
+
+		// every object puts two or three of its seven parts on each server
+		require.Len(t, usage, 3)
+		for id, n := range usage {
+			assert.InDelta(t, 2.5, n, 0.5, id)
+		}
+	}
+
+	// the extra part goes to a random server, so over many objects the servers get the same share
+	for id, n := range total {
+		assert.InDelta(t, 700, n, 70, id)
+	}
+}
+
+func keys(m map[string]int) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+
+	return res
+}
+
+// TestWeightDistributor_GetPlan_Shares checks that weights scaled by free capacity decide which servers get
+// the parts of objects with fewer parts than servers, while parts of larger objects stay spread.
+func TestWeightDistributor_GetPlan_Shares(t *testing.T) {
+	const plans = 2000
+
+	tests := []struct {
+		name      string
+		weights   []int
+		capacity  testCapacity
+		wantShare map[string]float64
+	}{
+		{
+			name:      "static weights",
+			weights:   []int{1, 3},
+			wantShare: map[string]float64{"a": 0.25, "b": 0.75},
+		},
+		{
+			name:      "free capacity",
+			weights:   []int{1, 1, 1},
+			capacity:  testCapacity{"a": 0.2, "b": 0.8},
+			wantShare: map[string]float64{"a": 0.1, "b": 0.4, "c": 0.5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &WeightDistributor{
+				ids:      []string{"a", "b", "c"}[:len(tt.weights)],
+				weights:  tt.weights,
+				parts:    distributor.PartSizing{MinPartSize: 10, MaxParts: len(tt.weights)},
+				capacity: tt.capacity,
+			}
+
+			usage := make(map[string]int)
+			for range plans {
+				servers, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 10})
+				require.Len(t, servers, 1)
+				usage[servers[0][0]]++
+			}
+
+			for id, share := range tt.wantShare {
+				assert.InDeltaf(t, share, float64(usage[id])/plans, 0.03, "share of %s", id)
+			}
+
+			// an object with a part per server still puts one on every server
+			servers, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 10 * len(tt.weights)})
+			primaries := make([]string, 0, len(servers))
+			for _, part := range servers {
+				primaries = append(primaries, part[0])
+			}
+			assert.ElementsMatch(t, w.ids, primaries)
+		})
+	}
+}
+
+type testClient struct {
+	proto.StorageClient
+}
+
+func TestWeightDistributor_SetNodes(t *testing.T) {
+	nodes := []topology.Node{
+		{ID: "a", Address: "a", Weight: 1, Client: &testClient{}},
+		{ID: "b", Address: "b", Weight: 1, Client: &testClient{}},
+	}
+
+	w, err := New(DistributorConfig{
+		Nodes:     nodes,
+		Parts:     distributor.PartSizing{MinPartSize: 10, MaxParts: 4},
+		Placement: distributor.Placement{Replicas: 1, Domain: distributor.DomainNone},
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			servers, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 400})
+			for _, part := range servers {
+				_, clErr := w.GetClientByID(part[0])
+				assert.NoError(t, clErr)
+			}
+		}
+	}()
+
+	require.NoError(t, w.SetNodes([]topology.Node{
+		{ID: "b", Address: "b", Weight: 1, Client: &testClient{}, Drain: true},
+		{ID: "c", Address: "c", Weight: 1, Client: &testClient{}},
+	}))
+	close(stop)
+	wg.Wait()
+
+	servers, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 400})
+	assert.Equal(t, [][]string{{"c"}, {"c"}, {"c"}, {"c"}}, servers)
+
+	// parts on removed and drained nodes are still readable
+	for _, id := range []string{"a", "b", "c"} {
+		_, err = w.GetClientByID(id)
+		assert.NoError(t, err)
+	}
+
+	require.NoError(t, w.SetNodes(nil))
+	servers, _ = w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 400})
+	assert.Empty(t, servers)
+
+	err = w.SetNodes([]topology.Node{{ID: "d", Address: "d"}})
+	assert.Error(t, err)
+}
+
+func TestWeightDistributor_Placement(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []string
+		replicas int
+		domain   distributor.FailureDomain
+		capacity testCapacity
+		// wantHosts is the number of distinct hosts of every part's replicas
+		wantHosts int
+		// wantPrimaries is the number of primaries per host
+		wantPrimaries int
+	}{
+		{
+			name:          "replicas on different hosts",
+			hosts:         []string{"h1", "h1", "h2", "h2", "h3", "h3"},
+			replicas:      2,
+			domain:        distributor.DomainHost,
+			wantHosts:     2,
+			wantPrimaries: 2,
+		},
+		{
+			name:          "more replicas than hosts",
+			hosts:         []string{"h1", "h1", "h2", "h2"},
+			replicas:      3,
+			domain:        distributor.DomainHost,
+			wantHosts:     2,
+			wantPrimaries: 3,
+		},
+		{
+			name:      "replicas are capped by node count",
+			hosts:     []string{"h1", "h2"},
+			replicas:  3,
+			domain:    distributor.DomainHost,
+			wantHosts: 2,
+			// parts go to the single node of each host in turn
+			wantPrimaries: 3,
+		},
+		{
+			// six containers on three hosts, one host almost full
+			name:          "parts on different hosts with little free space",
+			hosts:         []string{"h1", "h1", "h2", "h2", "h3", "h3"},
+			replicas:      1,
+			domain:        distributor.DomainHost,
+			capacity:      testCapacity{"a": 0.1, "b": 0.1},
+			wantHosts:     1,
+			wantPrimaries: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := make([]topology.Node, len(tt.hosts))
+			hostOf := make(map[string]string, len(tt.hosts))
+			for i, host := range tt.hosts {
+				id := string(rune('a' + i))
+				nodes[i] = topology.Node{ID: id, Address: id, Weight: 1, Host: host, Client: &testClient{}}
+				hostOf[id] = host
+			}
+
+			w, err := New(DistributorConfig{
+				Nodes:     nodes,
+				Parts:     distributor.PartSizing{MinPartSize: 10, MaxParts: 6},
+				Placement: distributor.Placement{Replicas: tt.replicas, Domain: tt.domain},
+				Capacity:  tt.capacity,
+			})
+			require.NoError(t, err)
+
+			plan, _ := w.GetPlan(&distributor.PlanRequest{Bucket: "bucket", Key: "key", FileSize: 600})
+			require.Len(t, plan, 6)
+
+			primaries := make(map[string]int)
+			for _, part := range plan {
+				assert.Len(t, part, min(tt.replicas, len(nodes)))
+
+				hosts := make(map[string]bool)
+				ids := make(map[string]bool)
+				for _, id := range part {
+					hosts[hostOf[id]] = true
+					ids[id] = true
+				}
+				assert.Len(t, hosts, tt.wantHosts)
+				assert.Len(t, ids, len(part))
+
+				primaries[hostOf[part[0]]]++
+			}
+
+			for host, n := range primaries {
+				assert.Equal(t, tt.wantPrimaries, n, host)
+			}
+		})
+	}
+}
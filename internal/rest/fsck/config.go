@@ -0,0 +1,21 @@
+package fsck
+
+import "time"
+
+type Config struct {
+	// OrphanAge protects parts of uploads and moves in progress: files modified later than OrphanAge
+	// before the check started are never reported as orphaned.
+	OrphanAge time.Duration
+	// TransferTimeout limits the copy of a replica during repair, 0 - no limit.
+	TransferTimeout time.Duration
+}
+
+// Options of a single check.
+type Options struct {
+	// Checksums reads every replica to compare its checksum, otherwise only sizes are compared.
+	Checksums bool `json:"checksums"`
+	// Repair copies missing and corrupt replicas from a healthy one.
+	Repair bool `json:"repair"`
+	// DeleteOrphans removes orphaned files from the nodes.
+	DeleteOrphans bool `json:"delete_orphans"`
+}
@@ -0,0 +1,448 @@
+package fsck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+// maxIssues is the number of issues kept in the report, the counters include all of them.
+const maxIssues = 1000
+
+type Kind string
+
+const (
+	// KindMissing is a replica listed in meta that the node doesn't have.
+	KindMissing Kind = "missing"
+	// KindCorrupt is a replica whose size or checksum differs from the one recorded in meta.
+	KindCorrupt Kind = "corrupt"
+	// KindOrphaned is a file on a node that no version in meta references.
+	KindOrphaned Kind = "orphaned"
+)
+
+type Issue struct {
+	Kind    Kind   `json:"kind"`
+	Node    string `json:"node"`
+	File    string `json:"file"`
+	Version int    `json:"version"`
+	Part    int    `json:"part"`
+	Detail  string `json:"detail,omitempty"`
+	// Fixed is set when the replica was repaired or the orphaned file deleted.
+	Fixed bool `json:"fixed,omitempty"`
+}
+
+type Report struct {
+	Running    bool       `json:"running"`
+	Options    Options    `json:"options"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Versions   int        `json:"versions"`
+	Replicas   int        `json:"replicas"`
+	Missing    int        `json:"missing"`
+	Corrupt    int        `json:"corrupt"`
+	Orphaned   int        `json:"orphaned"`
+	Repaired   int        `json:"repaired"`
+	Deleted    int        `json:"deleted"`
+	// Failed counts replicas and nodes that couldn't be checked and fixes that failed.
+	Failed    int     `json:"failed"`
+	Issues    []Issue `json:"issues"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+type replicaKey struct {
+	node    string
+	file    meta.File
+	version int
+	part    int
+}
+
+// Checker reconciles meta with the contents of storage nodes: every replica of ready versions must exist
+// with the size and checksum recorded in meta, and every file on a node must be referenced by meta.
+type Checker struct {
+	meta      meta.Meta
+	clients   distributor.Distributor
+	nodes     func() []string
+	addresses func(id string) (string, bool)
+	cfg       Config
+	logger    zerolog.Logger
+
+	trigger chan Options
+
+	mu     sync.Mutex
+	report Report
+}
+
+func New(
+	m meta.Meta,
+	d distributor.Distributor,
+	nodes func() []string,
+	addresses func(id string) (string, bool),
+	cfg Config,
+	logger zerolog.Logger,
+) *Checker {
+	return &Checker{
+		meta:      m,
+		clients:   d,
+		nodes:     nodes,
+		addresses: addresses,
+		cfg:       cfg,
+		logger:    logger,
+		trigger:   make(chan Options, 1),
+	}
+}
+
+// Run starts a check on Trigger until ctx is done.
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case opts := <-c.trigger:
+			c.check(ctx, opts)
+		}
+	}
+}
+
+// Trigger requests a check. It returns false if one is already requested.
+func (c *Checker) Trigger(opts Options) bool {
+	select {
+	case c.trigger <- opts:
+		return true
+	default:
+		return false
+	}
+}
+
+// Report returns the report of the running or the last check.
+func (c *Checker) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := c.report
+	res.Issues = append([]Issue(nil), c.report.Issues...)
+
+	return res
+}
+
+func (c *Checker) check(ctx context.Context, opts Options) {
+	startedAt := time.Now()
+	c.update(func(r *Report) {
+		*r = Report{Running: true, Options: opts, StartedAt: &startedAt}
+	})
+
+	c.logger.Info().Any("options", opts).Msg("fsck started")
+
+	referenced := make(map[replicaKey]struct{})
+	err := c.meta.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		c.update(func(r *Report) { r.Versions++ })
+
+		for _, part := range fv.Parts {
+			for _, id := range part.Servers {
+				referenced[replicaKey{node: id, file: f, version: fv.Version, part: part.Index}] = struct{}{}
+			}
+
+			// parts of versions being uploaded may not be written yet
+			if fv.Status == meta.StatusReady {
+				c.checkPart(ctx, f, fv.Version, part, opts)
+			}
+		}
+
+		return ctx.Err()
+	})
+	if err == nil {
+		err = c.findOrphans(ctx, referenced, startedAt.Add(-c.cfg.OrphanAge), opts)
+	}
+
+	finishedAt := time.Now()
+	c.update(func(r *Report) {
+		r.Running = false
+		r.FinishedAt = &finishedAt
+		if err != nil {
+			r.LastError = err.Error()
+		}
+	})
+
+	report := c.Report()
+	c.logger.Info().Err(err).Int("versions", report.Versions).Int("missing", report.Missing).
+		Int("corrupt", report.Corrupt).Int("orphaned", report.Orphaned).Int("repaired", report.Repaired).
+		Int("deleted", report.Deleted).Int("failed", report.Failed).Msg("fsck finished")
+}
+
+// checkPart checks every replica of the part and, with Repair, copies a healthy replica over the broken ones.
+// Replicas that couldn't be checked are neither used as a source nor repaired.
+func (c *Checker) checkPart(ctx context.Context, f meta.File, version int, part meta.Part, opts Options) {
+	var healthy []string
+	var broken []Issue
+
+	for _, id := range part.Servers {
+		c.update(func(r *Report) { r.Replicas++ })
+
+		kind, detail, err := c.checkReplica(ctx, f, version, part, id, opts.Checksums)
+		switch {
+		case err != nil:
+			c.fail(fmt.Errorf("failed to check %s/%d/%d on %s: %w", f, version, part.Index, id, err))
+		case kind == "":
+			healthy = append(healthy, id)
+		default:
+			broken = append(broken, Issue{
+				Kind:    kind,
+				Node:    id,
+				File:    f.String(),
+				Version: version,
+				Part:    part.Index,
+				Detail:  detail,
+			})
+		}
+	}
+
+	for _, issue := range broken {
+		if opts.Repair {
+			issue.Fixed = c.repair(ctx, f, version, part.Index, healthy, issue.Node)
+		}
+
+		c.addIssue(issue)
+	}
+}
+
+func (c *Checker) checkReplica(
+	ctx context.Context,
+	f meta.File,
+	version int,
+	part meta.Part,
+	id string,
+	checksums bool,
+) (Kind, string, error) {
+	cl, err := c.clients.GetClientByID(id)
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := cl.Stat(ctx, &proto.StatRequest{
+		Bucket:   f.Bucket,
+		Key:      f.Key,
+		Version:  int32(version),
+		Part:     int32(part.Index),
+		Checksum: checksums && part.Checksum != "",
+	})
+	if status.Code(err) == codes.NotFound {
+		return KindMissing, "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	// sizes and checksums are recorded together, older parts can only be checked for existence
+	if part.Checksum == "" {
+		return "", "", nil
+	}
+
+	if res.Size != part.Size {
+		return KindCorrupt, fmt.Sprintf("size is %d, expected %d", res.Size, part.Size), nil
+	}
+
+	if res.Checksum != "" && res.Checksum != part.Checksum {
+		return KindCorrupt, fmt.Sprintf("checksum is %s, expected %s", res.Checksum, part.Checksum), nil
+	}
+
+	return "", "", nil
+}
+
+// repair copies the part to dst from the first healthy replica that succeeds. Transfer overwrites the
+// file on dst, so corrupt replicas are replaced.
+func (c *Checker) repair(ctx context.Context, f meta.File, version, part int, healthy []string, dst string) bool {
+	if len(healthy) == 0 {
+		c.fail(fmt.Errorf("no healthy replica of %s/%d/%d to repair %s from", f, version, part, dst))
+		return false
+	}
+
+	address, ok := c.addresses(dst)
+	if !ok {
+		c.fail(fmt.Errorf("unknown node %s", dst))
+		return false
+	}
+
+	var errs error
+	for _, src := range healthy {
+		err := c.transfer(ctx, src, &proto.TransferRequest{
+			Bucket:   f.Bucket,
+			Key:      f.Key,
+			Version:  int32(version),
+			Part:     int32(part),
+			Target:   address,
+			TargetId: dst,
+		})
+		if err == nil {
+			c.update(func(r *Report) { r.Repaired++ })
+			return true
+		}
+
+		errs = multierror.Append(errs, fmt.Errorf("transfer from %s to %s: %w", src, dst, err))
+	}
+
+	c.fail(fmt.Errorf("failed to repair %s/%d/%d: %w", f, version, part, errs))
+
+	return false
+}
+
+func (c *Checker) transfer(ctx context.Context, src string, req *proto.TransferRequest) error {
+	cl, err := c.clients.GetClientByID(src)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.TransferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.TransferTimeout)
+		defer cancel()
+	}
+
+	_, err = cl.Transfer(ctx, req)
+
+	return err
+}
+
+// findOrphans lists every node and reports files that meta doesn't reference and that were modified
+// before the given time. Orphans are deleted after the listing, so it isn't changed while it's read.
+func (c *Checker) findOrphans(
+	ctx context.Context,
+	referenced map[replicaKey]struct{},
+	before time.Time,
+	opts Options,
+) error {
+	for _, id := range c.nodes() {
+		orphans, err := c.listOrphans(ctx, id, referenced, before)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			c.fail(fmt.Errorf("failed to list %s: %w", id, err))
+			continue
+		}
+
+		for _, issue := range orphans {
+			if opts.DeleteOrphans {
+				issue.Fixed = c.deleteOrphan(ctx, issue)
+			}
+
+			c.addIssue(issue)
+		}
+	}
+
+	return nil
+}
+
+func (c *Checker) listOrphans(
+	ctx context.Context,
+	id string,
+	referenced map[replicaKey]struct{},
+	before time.Time,
+) ([]Issue, error) {
+	cl, err := c.clients.GetClientByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := cl.List(ctx, &proto.ListRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []Issue
+	for {
+		file, recvErr := stream.Recv()
+		if errors.Is(recvErr, io.EOF) {
+			return res, nil
+		} else if recvErr != nil {
+			return nil, recvErr
+		}
+
+		f := meta.File{Bucket: file.Bucket, Key: file.Key}
+		key := replicaKey{node: id, file: f, version: int(file.Version), part: int(file.Part)}
+		if _, ok := referenced[key]; ok || file.ModifiedAt.AsTime().After(before) {
+			continue
+		}
+
+		res = append(res, Issue{
+			Kind:    KindOrphaned,
+			Node:    id,
+			File:    f.String(),
+			Version: int(file.Version),
+			Part:    int(file.Part),
+			Detail:  fmt.Sprintf("%d bytes", file.Size),
+		})
+	}
+}
+
+func (c *Checker) deleteOrphan(ctx context.Context, issue Issue) bool {
+	cl, err := c.clients.GetClientByID(issue.Node)
+	if err == nil {
+		f, _ := meta.FileFromString(issue.File)
+		_, err = cl.Delete(ctx, &proto.DeleteRequest{
+			Bucket:  f.Bucket,
+			Key:     f.Key,
+			Version: int32(issue.Version),
+			Part:    int32(issue.Part),
+		})
+	}
+
+	if err != nil {
+		c.fail(fmt.Errorf("failed to delete %s/%d/%d on %s: %w", issue.File, issue.Version, issue.Part, issue.Node, err))
+		return false
+	}
+
+	c.update(func(r *Report) { r.Deleted++ })
+
+	return true
+}
+
+func (c *Checker) addIssue(issue Issue) {
+	c.logger.Warn().Str("kind", string(issue.Kind)).Str("node", issue.Node).Str("file", issue.File).
+		Int("version", issue.Version).Int("part", issue.Part).Str("detail", issue.Detail).Bool("fixed", issue.Fixed).
+		Msg("fsck issue")
+
+	c.update(func(r *Report) {
+		switch issue.Kind {
+		case KindMissing:
+			r.Missing++
+		case KindCorrupt:
+			r.Corrupt++
+		case KindOrphaned:
+			r.Orphaned++
+		}
+
+		if len(r.Issues) < maxIssues {
+			r.Issues = append(r.Issues, issue)
+		}
+	})
+}
+
+func (c *Checker) fail(err error) {
+	c.logger.Warn().Err(err).Msg("fsck failure")
+
+	c.update(func(r *Report) {
+		r.Failed++
+		r.LastError = err.Error()
+	})
+}
+
+func (c *Checker) update(fn func(*Report)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fn(&c.report)
+}
@@ -0,0 +1,285 @@
+package fsck
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/storage/filestorage"
+	"github.com/theoptz/basic-s3/internal/storage/server"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testNode struct {
+	address string
+	dir     string
+	client  proto.StorageClient
+}
+
+type testCluster struct {
+	ids   []string
+	nodes map[string]testNode
+}
+
+func (c *testCluster) GetPlan(*distributor.PlanRequest) ([][]string, int) {
+	return nil, 0
+}
+
+func (c *testCluster) GetClientByID(id string) (proto.StorageClient, error) {
+	n, ok := c.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("client %s not found", id)
+	}
+
+	return n.client, nil
+}
+
+func (c *testCluster) address(id string) (string, bool) {
+	n, ok := c.nodes[id]
+	return n.address, ok
+}
+
+func startCluster(t *testing.T, ids ...string) *testCluster {
+	t.Helper()
+
+	c := &testCluster{ids: ids, nodes: make(map[string]testNode, len(ids))}
+	for _, id := range ids {
+		dir := t.TempDir()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv := grpc.NewServer()
+		proto.RegisterStorageServer(srv, server.New(id, filestorage.New(dir), zerolog.Nop()))
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		t.Cleanup(srv.Stop)
+
+		conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		c.nodes[id] = testNode{address: listener.Addr().String(), dir: dir, client: proto.NewStorageClient(conn)}
+	}
+
+	return c
+}
+
+// writePart writes the part file directly, modified at the given time.
+func (c *testCluster) writePart(t *testing.T, id string, f meta.File, version, part int, data string, at time.Time) {
+	t.Helper()
+
+	filename := filepath.Join(c.nodes[id].dir, f.Bucket, f.Key, strconv.Itoa(version), strconv.Itoa(part)+".bin")
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0644))
+	require.NoError(t, os.Chtimes(filename, at, at))
+}
+
+func (c *testCluster) readPart(t *testing.T, id string, f meta.File, version, part int) (string, bool) {
+	t.Helper()
+
+	by, err := os.ReadFile(filepath.Join(c.nodes[id].dir, f.Bucket, f.Key, strconv.Itoa(version), strconv.Itoa(part)+".bin"))
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	require.NoError(t, err)
+
+	return string(by), true
+}
+
+func putVersion(t *testing.T, m meta.Meta, f meta.File, status meta.Status, data string, servers ...string) {
+	t.Helper()
+	ctx := context.Background()
+
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{})
+	require.NoError(t, err)
+
+	part := &meta.Part{Index: 0, Servers: servers}
+	if data != "" {
+		sum := sha256.Sum256([]byte(data))
+		part.Size = int64(len(data))
+		part.Checksum = hex.EncodeToString(sum[:])
+	}
+	require.NoError(t, m.NewPart(ctx, &f, fv, part))
+
+	fv.Status = status
+	require.NoError(t, m.UpdateStatus(ctx, &f, fv))
+}
+
+func TestChecker(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c")
+	m := inmemory.NewVolatile(inmemory.Config{}, zerolog.Nop())
+	old := time.Now().Add(-2 * time.Hour)
+
+	corrupt := meta.File{Bucket: "bucket", Key: "corrupt"}
+	putVersion(t, m, corrupt, meta.StatusReady, "hello", "a", "b")
+	cluster.writePart(t, "a", corrupt, 0, 0, "hello", old)
+	cluster.writePart(t, "b", corrupt, 0, 0, "hellx", old)
+
+	missing := meta.File{Bucket: "bucket", Key: "dir/missing"}
+	putVersion(t, m, missing, meta.StatusReady, "world", "a", "c")
+	cluster.writePart(t, "a", missing, 0, 0, "world", old)
+
+	// parts written before checksums are only checked for existence
+	legacy := meta.File{Bucket: "bucket", Key: "legacy"}
+	putVersion(t, m, legacy, meta.StatusReady, "", "b")
+	cluster.writePart(t, "b", legacy, 0, 0, "anything", old)
+
+	loading := meta.File{Bucket: "bucket", Key: "loading"}
+	putVersion(t, m, loading, meta.StatusLoading, "data", "c")
+
+	orphan := meta.File{Bucket: "bucket", Key: "orphan"}
+	cluster.writePart(t, "c", orphan, 0, 0, "orphan", old)
+	cluster.writePart(t, "c", orphan, 1, 0, "upload in progress", time.Now())
+	// a replica a move or a repair left behind
+	cluster.writePart(t, "b", missing, 0, 0, "world", old)
+
+	checker := New(m, cluster, func() []string { return cluster.ids }, cluster.address, Config{OrphanAge: time.Hour}, zerolog.Nop())
+
+	tests := []struct {
+		name     string
+		opts     Options
+		missing  int
+		corrupt  int
+		orphaned int
+		repaired int
+		deleted  int
+	}{
+		{
+			name:     "sizes only",
+			opts:     Options{},
+			missing:  1,
+			orphaned: 2,
+		},
+		{
+			name:     "checksums",
+			opts:     Options{Checksums: true},
+			missing:  1,
+			corrupt:  1,
+			orphaned: 2,
+		},
+		{
+			name:     "repair",
+			opts:     Options{Checksums: true, Repair: true, DeleteOrphans: true},
+			missing:  1,
+			corrupt:  1,
+			orphaned: 2,
+			repaired: 2,
+			deleted:  2,
+		},
+		{
+			name: "repaired",
+			opts: Options{Checksums: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker.check(ctx, tt.opts)
+
+			report := checker.Report()
+			assert.False(t, report.Running)
+			assert.Empty(t, report.LastError)
+			assert.Equal(t, 4, report.Versions)
+			assert.Equal(t, 5, report.Replicas)
+			assert.Equal(t, tt.missing, report.Missing)
+			assert.Equal(t, tt.corrupt, report.Corrupt)
+			assert.Equal(t, tt.orphaned, report.Orphaned)
+			assert.Equal(t, tt.repaired, report.Repaired)
+			assert.Equal(t, tt.deleted, report.Deleted)
+			assert.Len(t, report.Issues, tt.missing+tt.corrupt+tt.orphaned)
+
+			for _, issue := range report.Issues {
+				assert.Equal(t, tt.opts.Repair, issue.Fixed, issue)
+			}
+		})
+	}
+
+	data, ok := cluster.readPart(t, "b", corrupt, 0, 0)
+	require.True(t, ok)
+	assert.Equal(t, "hello", data)
+
+	data, ok = cluster.readPart(t, "c", missing, 0, 0)
+	require.True(t, ok)
+	assert.Equal(t, "world", data)
+
+	_, ok = cluster.readPart(t, "c", orphan, 0, 0)
+	assert.False(t, ok)
+	_, ok = cluster.readPart(t, "c", orphan, 1, 0)
+	assert.True(t, ok, "recent files are kept")
+}
+
+func TestChecker_Trigger(t *testing.T) {
+	checker := New(inmemory.NewVolatile(inmemory.Config{}, zerolog.Nop()), &testCluster{}, func() []string { return nil },
+		func(string) (string, bool) { return "", false }, Config{}, zerolog.Nop())
+
+	assert.True(t, checker.Trigger(Options{}))
+	assert.False(t, checker.Trigger(Options{}), "a check is already requested")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checker.Run(ctx)
+
+	require.Eventually(t, func() bool {
+		report := checker.Report()
+		return !report.Running && report.FinishedAt != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, checker.Trigger(Options{}))
+}
+
+func TestUpload_ReplacesPartOnCommit(t *testing.T) {
+	cluster := startCluster(t, "a")
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	cluster.writePart(t, "a", f, 0, 0, "old", time.Now())
+
+	upload := func(ctx context.Context) grpc.ClientStreamingClient[proto.UploadRequest, proto.UploadResponse] {
+		stream, err := cluster.nodes["a"].client.Upload(ctx)
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(&proto.UploadRequest{Bucket: f.Bucket, Key: f.Key, Chunk: []byte("new")}))
+
+		return stream
+	}
+
+	dir := filepath.Join(cluster.nodes["a"].dir, f.Bucket, f.Key, "0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upload(ctx)
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(dir)
+		return err == nil && len(entries) == 1
+	}, time.Second, 10*time.Millisecond, "interrupted upload is discarded")
+
+	data, _ := cluster.readPart(t, "a", f, 0, 0)
+	assert.Equal(t, "old", data)
+
+	stream := upload(context.Background())
+	data, _ = cluster.readPart(t, "a", f, 0, 0)
+	assert.Equal(t, "old", data, "readers see the old part until the upload is done")
+
+	_, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	data, _ = cluster.readPart(t, "a", f, 0, 0)
+	assert.Equal(t, "new", data)
+}
@@ -0,0 +1,14 @@
+package health
+
+import "time"
+
+type Config struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker.
+	FailureThreshold int
+	// OpenTimeout is how long the breaker stays open before a trial request is let through, and how long
+	// the trial may take before another one is.
+	OpenTimeout time.Duration
+	// ProbeInterval is the interval of active probes, zero disables probing.
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+}
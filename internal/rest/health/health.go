@@ -0,0 +1,257 @@
+package health
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	latencyAlpha = 0.2
+)
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half-open"
+)
+
+type NodeHealth struct {
+	ID                  string  `json:"id"`
+	State               State   `json:"state"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	LatencyMs           float64 `json:"latency_ms"`
+	LastError           string  `json:"last_error,omitempty"`
+}
+
+type node struct {
+	state    State
+	failures int
+	latency  time.Duration
+	openedAt time.Time
+	// trialAt is the start of the trial request of a half-open breaker
+	trialAt time.Time
+	lastErr error
+}
+
+// Tracker keeps a circuit breaker per storage node. It is fed by results of orchestrator calls
+// and active probes.
+type Tracker struct {
+	cfg    Config
+	nodes  map[string]*node
+	now    func() time.Time
+	logger zerolog.Logger
+	mu     sync.Mutex
+}
+
+func New(cfg Config, logger zerolog.Logger) *Tracker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 1
+	}
+	if cfg.ProbeTimeout <= 0 {
+		cfg.ProbeTimeout = cfg.ProbeInterval
+	}
+
+	return &Tracker{
+		cfg:    cfg,
+		nodes:  make(map[string]*node),
+		now:    time.Now,
+		logger: logger,
+	}
+}
+
+// Available reports whether a request to the node would be let through: the breaker is closed, or it has
+// been open for OpenTimeout and no trial request is in flight. It doesn't change the breaker, so it is
+// used for planning and ordering.
+func (t *Tracker) Available(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.nodes[id]
+
+	return !ok || t.available(n)
+}
+
+// State returns the state of the breaker of the node.
+func (t *Tracker) State(id string) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n, ok := t.nodes[id]; ok {
+		return n.state
+	}
+
+	return StateClosed
+}
+
+// TryAcquire is called right before a request is sent to the node and reports whether it may be sent.
+// A breaker that has been open for OpenTimeout becomes half-open and lets only this request through as a
+// trial. Until its result is reported or it is released other requests are refused, a trial that is never
+// reported expires after OpenTimeout.
+func (t *Tracker) TryAcquire(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.get(id)
+	if n.state == StateClosed {
+		return true
+	}
+
+	if !t.available(n) {
+		return false
+	}
+
+	if n.state == StateOpen {
+		t.logger.Info().Str("node", id).Msg("circuit breaker half-open")
+	}
+
+	n.state = StateHalfOpen
+	n.trialAt = t.now()
+
+	return true
+}
+
+// Release is called for a request that ended without saying anything about the node (e.g. it was cancelled).
+// If it was the trial of a half-open breaker, the next request may be sent as a new trial right away
+// instead of waiting for the trial to expire.
+func (t *Tracker) Release(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n, ok := t.nodes[id]; ok && n.state == StateHalfOpen {
+		n.trialAt = time.Time{}
+	}
+}
+
+func (t *Tracker) available(n *node) bool {
+	switch n.state {
+	case StateOpen:
+		return t.now().Sub(n.openedAt) >= t.cfg.OpenTimeout
+	case StateHalfOpen:
+		return t.now().Sub(n.trialAt) >= t.cfg.OpenTimeout
+	default:
+		return true
+	}
+}
+
+func (t *Tracker) ReportSuccess(id string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.get(id)
+	n.failures = 0
+	n.lastErr = nil
+
+	if n.latency == 0 {
+		n.latency = latency
+	} else {
+		n.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(n.latency))
+	}
+
+	if n.state != StateClosed {
+		n.state = StateClosed
+		t.logger.Info().Str("node", id).Msg("circuit breaker closed")
+	}
+}
+
+func (t *Tracker) ReportFailure(id string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.get(id)
+	n.failures++
+	n.lastErr = err
+
+	switch {
+	case n.state == StateOpen:
+		n.openedAt = t.now()
+	case n.state == StateHalfOpen, n.failures >= t.cfg.FailureThreshold:
+		n.state = StateOpen
+		n.openedAt = t.now()
+		t.logger.Warn().Err(err).Str("node", id).Int("failures", n.failures).Msg("circuit breaker opened")
+	}
+}
+
+func (t *Tracker) Snapshot() []NodeHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]NodeHealth, 0, len(t.nodes))
+	for id, n := range t.nodes {
+		nh := NodeHealth{
+			ID:                  id,
+			State:               n.state,
+			ConsecutiveFailures: n.failures,
+			LatencyMs:           float64(n.latency) / float64(time.Millisecond),
+		}
+		if n.lastErr != nil {
+			nh.LastError = n.lastErr.Error()
+		}
+
+		res = append(res, nh)
+	}
+
+	slices.SortFunc(res, func(a, b NodeHealth) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return res
+}
+
+// Run probes every node returned by nodes each ProbeInterval until ctx is done.
+func (t *Tracker) Run(ctx context.Context, nodes func() []string, probe func(ctx context.Context, id string) error) {
+	if t.cfg.ProbeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(t.cfg.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, id := range nodes() {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				probeCtx, cancel := context.WithTimeout(ctx, t.cfg.ProbeTimeout)
+				defer cancel()
+
+				startTime := time.Now()
+				if err := probe(probeCtx, id); err != nil {
+					if ctx.Err() == nil {
+						t.ReportFailure(id, err)
+					}
+					return
+				}
+
+				t.ReportSuccess(id, time.Since(startTime))
+			}()
+		}
+
+		wg.Wait()
+	}
+}
+
+func (t *Tracker) get(id string) *node {
+	n, ok := t.nodes[id]
+	if !ok {
+		n = &node{state: StateClosed}
+		t.nodes[id] = n
+	}
+
+	return n
+}
@@ -0,0 +1,160 @@
+package health
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	const id = "node-1"
+
+	errFailed := errors.New("failed")
+
+	type step struct {
+		advance time.Duration
+		success bool
+		failure bool
+		release bool
+		// acquire calls TryAcquire expecting wantAcquire
+		acquire       bool
+		wantAcquire   bool
+		wantAvailable bool
+		wantState     State
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "unknown node is available",
+			steps: []step{
+				{wantAvailable: true, wantState: StateClosed},
+				{acquire: true, wantAcquire: true, wantAvailable: true, wantState: StateClosed},
+			},
+		},
+		{
+			name: "opens after consecutive failures",
+			steps: []step{
+				{failure: true, wantAvailable: true, wantState: StateClosed},
+				{failure: true, wantAvailable: true, wantState: StateClosed},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{acquire: true, wantAcquire: false, wantAvailable: false, wantState: StateOpen},
+			},
+		},
+		{
+			name: "success resets failures",
+			steps: []step{
+				{failure: true, wantAvailable: true, wantState: StateClosed},
+				{failure: true, wantAvailable: true, wantState: StateClosed},
+				{success: true, wantAvailable: true, wantState: StateClosed},
+				{failure: true, wantAvailable: true, wantState: StateClosed},
+			},
+		},
+		{
+			name: "availability checks don't change the breaker",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{advance: 10 * time.Second, wantAvailable: true, wantState: StateOpen},
+				{wantAvailable: true, wantState: StateOpen},
+			},
+		},
+		{
+			name: "half-open lets a single trial through and closes on success",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{advance: 10 * time.Second, acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+				{acquire: true, wantAcquire: false, wantAvailable: false, wantState: StateHalfOpen},
+				{success: true, wantAvailable: true, wantState: StateClosed},
+			},
+		},
+		{
+			name: "half-open reopens on failure",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{advance: 10 * time.Second, acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+			},
+		},
+		{
+			name: "unreported trial expires",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{advance: 10 * time.Second, acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+				{advance: 10 * time.Second, wantAvailable: true, wantState: StateHalfOpen},
+				{acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+			},
+		},
+		{
+			name: "released trial lets the next one through",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{advance: 10 * time.Second, acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+				{release: true, wantAvailable: true, wantState: StateHalfOpen},
+				{acquire: true, wantAcquire: true, wantAvailable: false, wantState: StateHalfOpen},
+			},
+		},
+		{
+			name: "release doesn't close the breaker",
+			steps: []step{
+				{failure: true},
+				{failure: true},
+				{failure: true, wantAvailable: false, wantState: StateOpen},
+				{release: true, wantAvailable: false, wantState: StateOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+
+			tracker := New(Config{
+				FailureThreshold: 3,
+				OpenTimeout:      10 * time.Second,
+			}, zerolog.Nop())
+			tracker.now = func() time.Time {
+				return now
+			}
+
+			for i, s := range tt.steps {
+				now = now.Add(s.advance)
+
+				if s.success {
+					tracker.ReportSuccess(id, time.Millisecond)
+				}
+				if s.failure {
+					tracker.ReportFailure(id, errFailed)
+				}
+				if s.release {
+					tracker.Release(id)
+				}
+
+				if s.acquire {
+					assert.Equalf(t, s.wantAcquire, tracker.TryAcquire(id), "step %d", i)
+				}
+
+				if s.wantState == "" {
+					continue
+				}
+
+				assert.Equalf(t, s.wantAvailable, tracker.Available(id), "step %d", i)
+				assert.Equalf(t, s.wantState, tracker.State(id), "step %d", i)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package membership
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/theoptz/basic-s3/internal/registry"
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+// Heartbeat is sent by storage nodes registering themselves, see internal/storage/registration.
+type Heartbeat = registry.Heartbeat
+
+type NodeStatus struct {
+	topology.Node
+	Dead          bool       `json:"dead,omitempty"`
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+}
+
+// Heartbeat registers the node on its first heartbeat and marks it alive. Weight is taken only on
+// registration, so a node reweighted through the admin API keeps its weight. A changed address, failure
+// domain or pool is applied, as the node may have been rescheduled.
+func (m *Manager) Heartbeat(ctx context.Context, id string, hb *Heartbeat) error {
+	if id == "" || hb.Address == "" {
+		return fmt.Errorf("%w: node id and address are required", common.ErrBadRequest)
+	}
+
+	var registered, wasDead, added bool
+	err := m.change(ctx, func(dialed dials) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nodes := slices.Clone(m.nodes)
+		changed := false
+
+		idx := slices.IndexFunc(nodes, func(n topology.Node) bool { return n.ID == id })
+		switch {
+		case idx < 0:
+			nodes = append(nodes, topology.Node{
+				ID:      id,
+				Address: hb.Address,
+				Weight:  max(hb.Weight, 1),
+				Zone:    hb.Zone,
+				Rack:    hb.Rack,
+				Host:    hb.Host,
+				Pool:    hb.Pool,
+			})
+			changed = true
+		case nodes[idx].Address != hb.Address || nodes[idx].Zone != hb.Zone ||
+			nodes[idx].Rack != hb.Rack || nodes[idx].Host != hb.Host || nodes[idx].Pool != hb.Pool:
+			nodes[idx].Address = hb.Address
+			nodes[idx].Zone, nodes[idx].Rack, nodes[idx].Host = hb.Zone, hb.Rack, hb.Host
+			nodes[idx].Pool = hb.Pool
+			changed = true
+		}
+
+		wasDead = m.dead[id]
+		delete(m.dead, id)
+
+		if changed || wasDead {
+			if err := m.apply(nodes, dialed); err != nil {
+				if wasDead {
+					m.dead[id] = true
+				}
+
+				return err
+			}
+		}
+
+		_, registered = m.lastSeen[id]
+		m.lastSeen[id] = m.now()
+		added = idx < 0
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case added:
+		m.logger.Info().Str("id", id).Str("address", hb.Address).Str("zone", hb.Zone).Msg("node registered")
+	case !registered:
+		m.logger.Info().Str("id", id).Msg("node started sending heartbeats")
+	case wasDead:
+		m.logger.Info().Str("id", id).Msg("node is alive again")
+	}
+
+	return nil
+}
+
+func (m *Manager) Status() []NodeStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]NodeStatus, len(m.nodes))
+	for i, n := range m.nodes {
+		res[i] = NodeStatus{Node: n, Dead: m.dead[n.ID]}
+		if t, ok := m.lastSeen[n.ID]; ok {
+			res[i].LastHeartbeat = &t
+		}
+	}
+
+	return res
+}
+
+// RunLiveness marks registered nodes dead once they miss heartbeats for HeartbeatTimeout.
+func (m *Manager) RunLiveness(ctx context.Context) {
+	if m.cfg.HeartbeatTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(m.cfg.HeartbeatTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.checkLiveness()
+		}
+	}
+}
+
+func (m *Manager) checkLiveness() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	changed := false
+
+	for id, last := range m.lastSeen {
+		if m.dead[id] || now.Sub(last) <= m.cfg.HeartbeatTimeout {
+			continue
+		}
+
+		m.dead[id] = true
+		changed = true
+		m.logger.Warn().Str("id", id).Time("last_heartbeat", last).Msg("node missed heartbeats, marked dead")
+	}
+
+	if !changed {
+		return
+	}
+
+	if err := m.distributor.SetNodes(m.placement(m.nodes)); err != nil {
+		m.logger.Error().Err(err).Msg("failed to update distributor nodes")
+	}
+}
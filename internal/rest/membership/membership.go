@@ -0,0 +1,439 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+)
+
+type Config struct {
+	ConnectTimeout time.Duration
+	// HeartbeatTimeout after which a registered node that stopped sending heartbeats gets no new parts.
+	HeartbeatTimeout time.Duration
+	// File is the topology file the node set is written to on every change, empty - changes are
+	// kept in memory only.
+	File string
+}
+
+// Manager owns the current set of storage nodes and pushes every change to the distributor.
+// Changes are serialized, and a change is only kept if the distributor accepts it.
+type Manager struct {
+	mu    sync.Mutex
+	nodes []topology.Node
+
+	// lastSeen holds the last heartbeat of registered nodes, nodes from the static config never get there.
+	lastSeen map[string]time.Time
+	dead     map[string]bool
+	now      func() time.Time
+	// fileMod is the modification time of the topology file last loaded or saved.
+	fileMod time.Time
+
+	distributor distributor.Dynamic
+	connect     func(ctx context.Context, node *topology.Node) error
+	cfg         Config
+	logger      zerolog.Logger
+}
+
+func New(nodes []topology.Node, d distributor.Dynamic, cfg Config, logger zerolog.Logger) *Manager {
+	return &Manager{
+		nodes:       slices.Clone(nodes),
+		lastSeen:    make(map[string]time.Time),
+		dead:        make(map[string]bool),
+		now:         time.Now,
+		distributor: d,
+		connect:     topology.ConnectNode,
+		cfg:         cfg,
+		logger:      logger,
+	}
+}
+
+func (m *Manager) Nodes() []topology.Node {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Clone(m.nodes)
+}
+
+func (m *Manager) IDs() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, len(m.nodes))
+	for i := range m.nodes {
+		ids[i] = m.nodes[i].ID
+	}
+
+	return ids
+}
+
+func (m *Manager) Address(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.nodes {
+		if n.ID == id {
+			return n.Address, true
+		}
+	}
+
+	return "", false
+}
+
+// Zone returns the zone label of the node, empty if the node or the label is unknown.
+func (m *Manager) Zone(id string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, n := range m.nodes {
+		if n.ID == id {
+			return n.Zone
+		}
+	}
+
+	return ""
+}
+
+// Put adds a node or updates an existing one with the same ID. An empty address keeps the current one,
+// and a node is dialed again only if its address has changed. The drain of an existing node is kept,
+// it is only changed by SetDrain.
+func (m *Manager) Put(ctx context.Context, node topology.Node) error {
+	if node.ID == "" {
+		return fmt.Errorf("%w: node id is required", common.ErrBadRequest)
+	}
+
+	err := m.change(ctx, func(dialed dials) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nodes := slices.Clone(m.nodes)
+		idx := slices.IndexFunc(nodes, func(n topology.Node) bool { return n.ID == node.ID })
+		if idx < 0 {
+			nodes = append(nodes, node)
+		} else {
+			if node.Address == "" {
+				node.Address = nodes[idx].Address
+			}
+			node.Drain = nodes[idx].Drain
+			nodes[idx] = node
+		}
+
+		return m.apply(nodes, dialed)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info().Str("id", node.ID).Str("address", node.Address).
+		Int("weight", node.Weight).Bool("drain", node.Drain).Msg("node updated")
+
+	return nil
+}
+
+// SetDrain stops or resumes placing new parts on the node.
+func (m *Manager) SetDrain(ctx context.Context, id string, drain bool) error {
+	err := m.change(ctx, func(dialed dials) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nodes := slices.Clone(m.nodes)
+		idx := slices.IndexFunc(nodes, func(n topology.Node) bool { return n.ID == id })
+		if idx < 0 {
+			return fmt.Errorf("%w: node %s", common.ErrNotFound, id)
+		}
+
+		nodes[idx].Drain = drain
+
+		return m.apply(nodes, dialed)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info().Str("id", id).Bool("drain", drain).Msg("node drain changed")
+
+	return nil
+}
+
+func (m *Manager) Remove(id string) error {
+	err := m.change(context.Background(), func(dialed dials) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nodes := slices.DeleteFunc(slices.Clone(m.nodes), func(n topology.Node) bool { return n.ID == id })
+		if len(nodes) == len(m.nodes) {
+			return fmt.Errorf("%w: node %s", common.ErrNotFound, id)
+		}
+
+		if err := m.apply(nodes, dialed); err != nil {
+			return err
+		}
+
+		delete(m.lastSeen, id)
+		delete(m.dead, id)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info().Str("id", id).Msg("node removed")
+
+	return nil
+}
+
+// Replace swaps the whole node set, e.g. after the topology file has changed. Drained nodes stay drained
+// even if the new set doesn't drain them, a drain is only cancelled by SetDrain.
+func (m *Manager) Replace(ctx context.Context, t *topology.Topology) error {
+	err := m.change(ctx, func(dialed dials) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		nodes := slices.Clone(t.Nodes)
+		for i := range nodes {
+			nodes[i].Drain = nodes[i].Drain || slices.ContainsFunc(m.nodes, func(n topology.Node) bool {
+				return n.ID == nodes[i].ID && n.Drain
+			})
+		}
+
+		if err := m.apply(nodes, dialed); err != nil {
+			return err
+		}
+
+		for id := range m.lastSeen {
+			if !slices.ContainsFunc(m.nodes, func(n topology.Node) bool { return n.ID == id }) {
+				delete(m.lastSeen, id)
+				delete(m.dead, id)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.logger.Info().Int("nodes", len(t.Nodes)).Msg("topology replaced")
+
+	return nil
+}
+
+// WatchFile polls the topology file and replaces the node set whenever the file changes. Changes written
+// by the manager itself are not reloaded.
+func (m *Manager) WatchFile(ctx context.Context, interval time.Duration) {
+	if m.cfg.File == "" || interval <= 0 {
+		return
+	}
+
+	if st, err := os.Stat(m.cfg.File); err == nil {
+		m.mu.Lock()
+		m.fileMod = st.ModTime()
+		m.mu.Unlock()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st, err := os.Stat(m.cfg.File)
+		if errors.Is(err, fs.ErrNotExist) {
+			// no node has registered yet
+			continue
+		}
+		if err != nil {
+			m.logger.Error().Err(err).Str("file", m.cfg.File).Msg("failed to stat topology file")
+			continue
+		}
+
+		m.mu.Lock()
+		lastMod := m.fileMod
+		m.fileMod = st.ModTime()
+		m.mu.Unlock()
+
+		if st.ModTime().Equal(lastMod) {
+			continue
+		}
+
+		t, err := topology.Load(m.cfg.File)
+		if err == nil {
+			err = m.Replace(ctx, t)
+		}
+		if err != nil {
+			m.logger.Error().Err(err).Str("file", m.cfg.File).Msg("failed to reload topology")
+		}
+	}
+}
+
+type dialKey struct {
+	id      string
+	address string
+}
+
+// dials holds nodes dialed for a change that are not in the node set yet.
+type dials map[dialKey]topology.Node
+
+// notDialedError is returned by apply when the new node set has nodes that must be dialed first.
+type notDialedError struct {
+	nodes []topology.Node
+}
+
+func (e *notDialedError) Error() string {
+	return fmt.Sprintf("%d nodes are not connected", len(e.nodes))
+}
+
+// change runs fn until it no longer needs nodes to be dialed. Nodes are dialed without holding m.mu, so
+// a slow node doesn't block heartbeats and lookups, then fn applies the change to the node set as it is
+// by then. Connections that didn't make it into the node set are closed.
+func (m *Manager) change(ctx context.Context, fn func(dialed dials) error) error {
+	dialed := make(dials)
+	defer func() {
+		for _, n := range dialed {
+			closeConn(n)
+		}
+	}()
+
+	for {
+		err := fn(dialed)
+
+		var notDialed *notDialedError
+		if !errors.As(err, &notDialed) {
+			return err
+		}
+
+		for _, n := range notDialed.nodes {
+			if err = m.connectNode(ctx, &n); err != nil {
+				return err
+			}
+
+			dialed[dialKey{id: n.ID, address: n.Address}] = n
+		}
+	}
+}
+
+// apply hands the node set to the distributor and saves it. Known nodes keep their clients, new or moved
+// ones take them from dialed, and clients of removed or moved nodes are closed. Must be called with
+// m.mu held.
+func (m *Manager) apply(nodes []topology.Node, dialed dials) error {
+	if err := (&topology.Topology{Nodes: nodes}).Validate(); err != nil {
+		return fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+	}
+
+	known := make(map[dialKey]topology.Node, len(m.nodes))
+	for _, n := range m.nodes {
+		known[dialKey{id: n.ID, address: n.Address}] = n
+	}
+
+	var missing []topology.Node
+	for i := range nodes {
+		node := &nodes[i]
+		key := dialKey{id: node.ID, address: node.Address}
+
+		prev, ok := known[key]
+		if !ok {
+			prev, ok = dialed[key]
+		}
+		if !ok {
+			missing = append(missing, *node)
+			continue
+		}
+
+		node.Client, node.Conn = prev.Client, prev.Conn
+	}
+
+	if len(missing) > 0 {
+		return &notDialedError{nodes: missing}
+	}
+
+	if err := m.distributor.SetNodes(m.placement(nodes)); err != nil {
+		return fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+	}
+
+	if err := m.save(nodes); err != nil {
+		if rollbackErr := m.distributor.SetNodes(m.placement(m.nodes)); rollbackErr != nil {
+			m.logger.Error().Err(rollbackErr).Msg("failed to restore distributor nodes")
+		}
+
+		return err
+	}
+
+	for _, n := range nodes {
+		key := dialKey{id: n.ID, address: n.Address}
+		delete(known, key)
+		delete(dialed, key)
+	}
+
+	for _, n := range known {
+		closeConn(n)
+	}
+
+	m.nodes = nodes
+
+	return nil
+}
+
+// save writes the node set to the topology file, so nodes added or changed at runtime survive a restart.
+func (m *Manager) save(nodes []topology.Node) error {
+	if m.cfg.File == "" {
+		return nil
+	}
+
+	if err := (&topology.Topology{Nodes: nodes}).Save(m.cfg.File); err != nil {
+		return fmt.Errorf("failed to save topology: %w", err)
+	}
+
+	if st, err := os.Stat(m.cfg.File); err == nil {
+		m.fileMod = st.ModTime()
+	}
+
+	return nil
+}
+
+// placement returns nodes as the distributor should see them: dead nodes are drained, so their parts
+// are still readable if they come back but nothing new is placed there.
+func (m *Manager) placement(nodes []topology.Node) []topology.Node {
+	res := slices.Clone(nodes)
+	for i := range res {
+		if m.dead[res[i].ID] {
+			res[i].Drain = true
+		}
+	}
+
+	return res
+}
+
+func (m *Manager) connectNode(ctx context.Context, node *topology.Node) error {
+	if m.cfg.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.ConnectTimeout)
+		defer cancel()
+	}
+
+	if err := m.connect(ctx, node); err != nil {
+		return fmt.Errorf("%w: %w", common.ErrBadRequest, err)
+	}
+
+	return nil
+}
+
+func closeConn(node topology.Node) {
+	if node.Conn != nil {
+		_ = node.Conn.Close()
+	}
+}
@@ -0,0 +1,309 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testClient struct {
+	proto.StorageClient
+	address string
+	conns   *testConns
+}
+
+func (c *testClient) Close() error {
+	c.conns.closed = append(c.conns.closed, c.address)
+	return nil
+}
+
+type testConns struct {
+	dialed []string
+	closed []string
+}
+
+type testDistributor struct {
+	distributor.Distributor
+	nodes []topology.Node
+}
+
+func (d *testDistributor) SetNodes(nodes []topology.Node) error {
+	for _, n := range nodes {
+		if n.Pool == "unknown" {
+			return errors.New("unknown pool")
+		}
+	}
+
+	for _, n := range nodes {
+		if !n.Drain {
+			d.nodes = nodes
+			return nil
+		}
+	}
+
+	return errors.New("no nodes available for placement")
+}
+
+func newTestManager(t *testing.T) (*Manager, *testDistributor, *testConns) {
+	t.Helper()
+
+	conns := &testConns{}
+	a := &testClient{address: "a:5555", conns: conns}
+
+	d := &testDistributor{}
+	m := New([]topology.Node{
+		{ID: "a", Address: "a:5555", Weight: 1, Client: a, Conn: a},
+	}, d, Config{}, zerolog.Nop())
+
+	m.connect = func(_ context.Context, node *topology.Node) error {
+		if node.Address == "down:5555" {
+			return context.DeadlineExceeded
+		}
+
+		conns.dialed = append(conns.dialed, node.Address)
+		client := &testClient{address: node.Address, conns: conns}
+		node.Client, node.Conn = client, client
+		return nil
+	}
+
+	return m, d, conns
+}
+
+func TestManager_Put(t *testing.T) {
+	tests := []struct {
+		name       string
+		node       topology.Node
+		wantErr    error
+		wantDialed []string
+		wantClosed []string
+		wantNodes  map[string]string
+	}{
+		{
+			name:       "new node is connected",
+			node:       topology.Node{ID: "b", Address: "b:5555", Weight: 2},
+			wantDialed: []string{"b:5555"},
+			wantNodes:  map[string]string{"a": "a:5555", "b": "b:5555"},
+		},
+		{
+			name:      "reweight keeps connection",
+			node:      topology.Node{ID: "a", Weight: 5},
+			wantNodes: map[string]string{"a": "a:5555"},
+		},
+		{
+			name:       "moved node is reconnected",
+			node:       topology.Node{ID: "a", Address: "a2:5555", Weight: 1},
+			wantDialed: []string{"a2:5555"},
+			wantClosed: []string{"a:5555"},
+			wantNodes:  map[string]string{"a": "a2:5555"},
+		},
+		{
+			name:      "unreachable node",
+			node:      topology.Node{ID: "b", Address: "down:5555", Weight: 1},
+			wantErr:   common.ErrBadRequest,
+			wantNodes: map[string]string{"a": "a:5555"},
+		},
+		{
+			name:      "invalid weight",
+			node:      topology.Node{ID: "b", Address: "b:5555"},
+			wantErr:   common.ErrBadRequest,
+			wantNodes: map[string]string{"a": "a:5555"},
+		},
+		{
+			name:      "rejected by distributor",
+			node:      topology.Node{ID: "a", Weight: 1, Pool: "unknown"},
+			wantErr:   common.ErrBadRequest,
+			wantNodes: map[string]string{"a": "a:5555"},
+		},
+		{
+			name:       "rejected moved node is disconnected",
+			node:       topology.Node{ID: "a", Address: "a2:5555", Weight: 1, Pool: "unknown"},
+			wantErr:    common.ErrBadRequest,
+			wantDialed: []string{"a2:5555"},
+			wantClosed: []string{"a2:5555"},
+			wantNodes:  map[string]string{"a": "a:5555"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, d, conns := newTestManager(t)
+
+			err := m.Put(context.Background(), tt.node)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, d.nodes)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, m.Nodes(), d.nodes)
+			}
+
+			assert.Equal(t, tt.wantDialed, conns.dialed)
+			assert.Equal(t, tt.wantClosed, conns.closed)
+
+			nodes := make(map[string]string)
+			for _, n := range m.Nodes() {
+				nodes[n.ID] = n.Address
+				assert.Equal(t, n.Address, n.Client.(*testClient).address)
+			}
+			assert.Equal(t, tt.wantNodes, nodes)
+		})
+	}
+}
+
+func TestManager_Remove(t *testing.T) {
+	m, d, conns := newTestManager(t)
+
+	require.NoError(t, m.Put(context.Background(), topology.Node{ID: "b", Address: "b:5555", Weight: 1}))
+
+	require.ErrorIs(t, m.Remove("c"), common.ErrNotFound)
+
+	require.NoError(t, m.Remove("a"))
+	assert.Equal(t, []string{"b"}, m.IDs())
+	assert.Equal(t, m.Nodes(), d.nodes)
+	assert.Equal(t, []string{"a:5555"}, conns.closed)
+
+	require.ErrorIs(t, m.Remove("b"), common.ErrBadRequest)
+	assert.Equal(t, []string{"b"}, m.IDs())
+}
+
+func TestManager_Heartbeat(t *testing.T) {
+	m, d, conns := newTestManager(t)
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.cfg.HeartbeatTimeout = 10 * time.Second
+
+	drained := func() map[string]bool {
+		res := make(map[string]bool)
+		for _, n := range d.nodes {
+			res[n.ID] = n.Drain
+		}
+
+		return res
+	}
+
+	hb := &Heartbeat{Address: "b:5555", Weight: 3, Zone: "z1"}
+	require.NoError(t, m.Heartbeat(context.Background(), "b", hb))
+	assert.Equal(t, []string{"b:5555"}, conns.dialed)
+	assert.Equal(t, map[string]bool{"a": false, "b": false}, drained())
+	assert.Equal(t, topology.Node{ID: "b", Address: "b:5555", Weight: 3, Zone: "z1"}, withoutClient(m.Nodes()[1]))
+
+	now = now.Add(5 * time.Second)
+	m.checkLiveness()
+	assert.Equal(t, map[string]bool{"a": false, "b": false}, drained())
+
+	// only registered nodes can die
+	now = now.Add(6 * time.Second)
+	m.checkLiveness()
+	assert.Equal(t, map[string]bool{"a": false, "b": true}, drained())
+	assert.True(t, m.Status()[1].Dead)
+	assert.False(t, m.Status()[0].Dead)
+
+	// weight set through the admin API is kept, the node comes back without reconnecting
+	require.NoError(t, m.Put(context.Background(), topology.Node{ID: "b", Weight: 1, Zone: "z1"}))
+	require.NoError(t, m.Heartbeat(context.Background(), "b", hb))
+	assert.Equal(t, []string{"b:5555"}, conns.dialed)
+	assert.Equal(t, map[string]bool{"a": false, "b": false}, drained())
+	assert.Equal(t, 1, m.Nodes()[1].Weight)
+
+	// moved node is reconnected
+	require.NoError(t, m.Heartbeat(context.Background(), "b", &Heartbeat{Address: "b2:5555", Zone: "z1"}))
+	assert.Equal(t, []string{"b:5555", "b2:5555"}, conns.dialed)
+
+	require.ErrorIs(t, m.Heartbeat(context.Background(), "c", &Heartbeat{}), common.ErrBadRequest)
+}
+
+func withoutClient(n topology.Node) topology.Node {
+	n.Client, n.Conn = nil, nil
+	return n
+}
+
+func TestManager_SetDrain(t *testing.T) {
+	ctx := context.Background()
+	m, d, _ := newTestManager(t)
+
+	require.NoError(t, m.Put(ctx, topology.Node{ID: "b", Address: "b:5555", Weight: 2}))
+
+	require.ErrorIs(t, m.SetDrain(ctx, "c", true), common.ErrNotFound)
+
+	require.NoError(t, m.SetDrain(ctx, "a", true))
+	assert.Equal(t, m.Nodes(), d.nodes)
+	assert.True(t, m.Nodes()[0].Drain)
+	assert.Equal(t, "a:5555", m.Nodes()[0].Address)
+	assert.Equal(t, 1, m.Nodes()[0].Weight)
+
+	require.ErrorIs(t, m.SetDrain(ctx, "b", true), common.ErrBadRequest, "the last node is not drained")
+	assert.False(t, m.Nodes()[1].Drain)
+
+	require.NoError(t, m.Put(ctx, topology.Node{ID: "a", Weight: 3}))
+	assert.True(t, m.Nodes()[0].Drain, "put keeps the drain")
+
+	require.NoError(t, m.Replace(ctx, &topology.Topology{Nodes: []topology.Node{
+		{ID: "a", Address: "a:5555", Weight: 1},
+		{ID: "b", Address: "b:5555", Weight: 2},
+	}}))
+	assert.True(t, m.Nodes()[0].Drain, "reload keeps the drain")
+
+	require.NoError(t, m.SetDrain(ctx, "a", false))
+	assert.False(t, m.Nodes()[0].Drain)
+}
+
+func TestManager_DialWithoutLock(t *testing.T) {
+	m, _, _ := newTestManager(t)
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	m.connect = func(_ context.Context, node *topology.Node) error {
+		close(dialing)
+		<-release
+		node.Client = &testClient{address: node.Address}
+		return nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.Put(context.Background(), topology.Node{ID: "b", Address: "b:5555", Weight: 1})
+	}()
+
+	<-dialing
+	address, ok := m.Address("a")
+	assert.True(t, ok)
+	assert.Equal(t, "a:5555", address)
+	require.NoError(t, m.SetDrain(context.Background(), "a", false))
+
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"a", "b"}, m.IDs())
+}
+
+func TestManager_File(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newTestManager(t)
+	m.cfg.File = filepath.Join(t.TempDir(), "topology.json")
+
+	require.NoError(t, m.Put(ctx, topology.Node{ID: "b", Address: "b:5555", Weight: 2, Zone: "z1"}))
+	require.NoError(t, m.Heartbeat(ctx, "c", &Heartbeat{Address: "c:5555"}))
+	require.NoError(t, m.Remove("a"))
+
+	saved, err := topology.Load(m.cfg.File)
+	require.NoError(t, err)
+	assert.Equal(t, []topology.Node{
+		{ID: "b", Address: "b:5555", Weight: 2, Zone: "z1"},
+		{ID: "c", Address: "c:5555", Weight: 1},
+	}, saved.Nodes)
+
+	m.cfg.File = filepath.Join(t.TempDir(), "missing", "topology.json")
+	require.Error(t, m.Remove("b"))
+	assert.Equal(t, []string{"b", "c"}, m.IDs(), "change that can't be saved is not applied")
+}
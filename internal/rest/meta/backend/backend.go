@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/boltdb"
+	"github.com/theoptz/basic-s3/internal/rest/meta/feed"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/meta/raftmeta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/remote"
+	"github.com/theoptz/basic-s3/internal/rest/meta/sqlite"
+)
+
+const (
+	InMemory = "inmemory"
+	Bolt     = "bolt"
+	SQLite   = "sqlite"
+	// Remote is a meta server shared by several REST instances.
+	Remote = "remote"
+	// Raft is an inmemory meta replicated over meta servers.
+	Raft = "raft"
+)
+
+type Config struct {
+	Backend string
+	// File is the state file or database of local backends.
+	File   string
+	Shards int
+	// Addresses are the addresses of the meta servers of the remote backend.
+	Addresses []string
+	Raft      raftmeta.Config
+	// FeedSize is the number of retained change events, 0 disables the change feed.
+	FeedSize int
+}
+
+type Meta interface {
+	meta.Meta
+	io.Closer
+}
+
+// Open returns the meta storage selected by the config. Local backends are wrapped with the change
+// feed, numbering its events in a file next to File. A remote one serves the feed of its meta server,
+// a raft one publishes the changes applied by every node.
+func Open(cfg Config, logger zerolog.Logger) (Meta, error) {
+	m, err := open(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.FeedSize <= 0 || cfg.Backend == Remote || cfg.Backend == Raft {
+		return m, nil
+	}
+
+	f, err := feed.New(m, feed.Config{Size: cfg.FeedSize, File: feedFilename(cfg.File)}, logger)
+	if err != nil {
+		_ = m.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func feedFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+
+	return filename + ".feed"
+}
+
+func open(cfg Config, logger zerolog.Logger) (Meta, error) {
+	switch cfg.Backend {
+	case InMemory, "":
+		m, err := inmemory.New(cfg.File, inmemory.Config{Shards: cfg.Shards}, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	case Bolt:
+		m, err := boltdb.New(cfg.File, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	case SQLite:
+		m, err := sqlite.New(cfg.File, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	case Remote:
+		m, err := remote.Dial(cfg.Addresses, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	case Raft:
+		rc := cfg.Raft
+		rc.Shards = cfg.Shards
+		rc.FeedSize = cfg.FeedSize
+
+		m, err := raftmeta.New(rc, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unknown meta backend %q", cfg.Backend)
+	}
+}
+
+// RunSnapshots takes snapshots of an inmemory meta until ctx is done. Other backends persist every
+// change themselves.
+func RunSnapshots(ctx context.Context, m Meta, interval time.Duration) {
+	if s, ok := meta.As[*inmemory.Meta](m); ok {
+		s.RunSnapshots(ctx, interval)
+	}
+}
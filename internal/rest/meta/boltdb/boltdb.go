@@ -0,0 +1,466 @@
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+const (
+	// walkBatch is the number of versions read by one transaction of Walk.
+	walkBatch = 1000
+
+	openTimeout = 5 * time.Second
+)
+
+var versionsBucket = []byte("versions")
+
+// Meta keeps versions in a bbolt database. Keys are bucket, key and big-endian version, separated by
+// zero bytes, so versions of a file, files of a bucket and keys with a common prefix are stored
+// next to each other in order.
+type Meta struct {
+	db     *bolt.DB
+	logger zerolog.Logger
+}
+
+func New(filename string, logger zerolog.Logger) (*Meta, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, bucketErr := tx.CreateBucketIfNotExists(versionsBucket)
+		return bucketErr
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	return &Meta{db: db, logger: logger}, nil
+}
+
+func (m *Meta) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if file == nil || info == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	createdAt := time.Now().UTC()
+	fv := meta.FileVersion{
+		Status:       meta.StatusLoading,
+		ContentType:  info.ContentType,
+		StorageClass: info.StorageClass,
+		CreatedAt:    &createdAt,
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(versionsBucket)
+
+		prefix := filePrefix(file)
+		if k, _ := seekLast(b.Cursor(), prefix); k != nil {
+			fv.Version = int(versionOf(k)) + 1
+		}
+
+		return put(b, file, &fv)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Debug().
+		Str("bucket", file.Bucket).
+		Str("key", file.Key).
+		Int("version", fv.Version).
+		Msg("new version created")
+
+	return &fv, nil
+}
+
+func (m *Meta) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	} else if p == nil {
+		return fmt.Errorf("%w: no part provided", common.ErrBadRequest)
+	}
+
+	return m.update(f, fv.Version, func(stored *meta.FileVersion) error {
+		if p.Index != len(stored.Parts) {
+			return fmt.Errorf("%w: invalid part index", common.ErrBadRequest)
+		}
+
+		stored.Parts = append(stored.Parts, *p)
+
+		return nil
+	})
+}
+
+func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	}
+
+	return m.update(f, fv.Version, func(stored *meta.FileVersion) error {
+		if stored.Status != fv.Status && stored.Status != meta.StatusLoading {
+			return fmt.Errorf("%w: can't update final status", common.ErrBadRequest)
+		}
+
+		stored.Status = fv.Status
+
+		return nil
+	})
+}
+
+func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	var fv *meta.FileVersion
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(versionsBucket).Cursor()
+		prefix := filePrefix(f)
+
+		k, v := seekLast(c, prefix)
+		if k == nil {
+			return fmt.Errorf("%w: file not found", common.ErrNotFound)
+		}
+
+		// the latest ready version, skipping versions being uploaded or failed
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			var stored meta.FileVersion
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("failed to unmarshal version: %w", err)
+			}
+
+			if stored.Status == meta.StatusReady {
+				fv = &stored
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Debug().
+		Str("bucket", f.Bucket).
+		Str("key", f.Key).
+		Int("version", fv.Version).
+		Int("parts", len(fv.Parts)).
+		Msg("get version")
+
+	return fv, nil
+}
+
+// Walk reads versions in key order in batches, each in its own transaction, and calls fn outside of
+// them, so fn may change meta and long walks don't hold the database.
+func (m *Meta) Walk(ctx context.Context, fn func(meta.File, meta.FileVersion) error) error {
+	type entry struct {
+		file meta.File
+		fv   meta.FileVersion
+	}
+
+	var after []byte
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entries := make([]entry, 0, walkBatch)
+
+		err := m.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(versionsBucket).Cursor()
+
+			k, v := c.First()
+			if after != nil {
+				k, v = c.Seek(after)
+				if bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+
+			for ; k != nil && len(entries) < walkBatch; k, v = c.Next() {
+				file, err := fileOf(k)
+				if err != nil {
+					return err
+				}
+
+				var fv meta.FileVersion
+				if err = json.Unmarshal(v, &fv); err != nil {
+					return fmt.Errorf("failed to unmarshal version of %s: %w", file, err)
+				}
+
+				entries = append(entries, entry{file: file, fv: fv})
+				after = slices.Clone(k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			if err = fn(e.file, e.fv); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < walkBatch {
+			return nil
+		}
+	}
+}
+
+func (m *Meta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if len(servers) == 0 {
+		return fmt.Errorf("%w: no servers provided", common.ErrBadRequest)
+	}
+
+	return m.update(f, version, func(stored *meta.FileVersion) error {
+		if part < 0 || len(stored.Parts) <= part {
+			return fmt.Errorf("%w: part not found", common.ErrNotFound)
+		}
+
+		if !slices.Equal(stored.Parts[part].Servers, prev) {
+			return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+		}
+
+		stored.Parts[part].Servers = slices.Clone(servers)
+
+		return nil
+	})
+}
+
+func (m *Meta) UpdateStorageClass(
+	ctx context.Context,
+	f *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	for _, part := range parts {
+		if len(part.Servers) == 0 {
+			return fmt.Errorf("%w: no servers provided for part %d", common.ErrBadRequest, part.Index)
+		}
+	}
+
+	return m.update(f, version, func(stored *meta.FileVersion) error {
+		if len(parts) != len(stored.Parts) {
+			return fmt.Errorf("%w: version has %d parts", common.ErrBadRequest, len(stored.Parts))
+		}
+
+		if !slices.EqualFunc(stored.Parts, prev, func(a, b meta.Part) bool {
+			return a.Index == b.Index && slices.Equal(a.Servers, b.Servers)
+		}) {
+			return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+		}
+
+		stored.StorageClass = class
+		stored.Parts = slices.Clone(parts)
+
+		return nil
+	})
+}
+
+func (m *Meta) PruneVersions(ctx context.Context, f *meta.File, keep int) ([]meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if keep < 1 {
+		return nil, fmt.Errorf("%w: at least one version must be kept", common.ErrBadRequest)
+	}
+
+	var pruned []meta.FileVersion
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(versionsBucket)
+		c := b.Cursor()
+		prefix := filePrefix(f)
+
+		var versions []meta.FileVersion
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var stored meta.FileVersion
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("failed to unmarshal version: %w", err)
+			}
+
+			versions = append(versions, stored)
+		}
+
+		if len(versions) == 0 {
+			return fmt.Errorf("%w: file not found", common.ErrNotFound)
+		}
+
+		pruned = meta.Prunable(versions, keep)
+		for _, fv := range pruned {
+			if err := b.Delete(versionKey(f, fv.Version)); err != nil {
+				return fmt.Errorf("failed to delete version: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pruned, nil
+}
+
+func (m *Meta) Close() error {
+	if err := m.db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+
+	return nil
+}
+
+// update applies fn to the stored version in a single transaction.
+func (m *Meta) update(f *meta.File, version int, fn func(*meta.FileVersion) error) error {
+	if version < 0 {
+		return fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(versionsBucket)
+
+		v := b.Get(versionKey(f, version))
+		if v == nil {
+			if k, _ := seekLast(b.Cursor(), filePrefix(f)); k == nil {
+				return fmt.Errorf("%w: file not found", common.ErrNotFound)
+			}
+
+			return fmt.Errorf("%w: file version not found", common.ErrNotFound)
+		}
+
+		var stored meta.FileVersion
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return fmt.Errorf("failed to unmarshal version: %w", err)
+		}
+
+		if err := fn(&stored); err != nil {
+			return err
+		}
+
+		return put(b, f, &stored)
+	})
+}
+
+func put(b *bolt.Bucket, f *meta.File, fv *meta.FileVersion) error {
+	v, err := json.Marshal(fv)
+	if err != nil {
+		return fmt.Errorf("failed to marshal version: %w", err)
+	}
+
+	if err = b.Put(versionKey(f, fv.Version), v); err != nil {
+		return fmt.Errorf("failed to put version: %w", err)
+	}
+
+	return nil
+}
+
+// seekLast positions the cursor at the latest version of the file.
+func seekLast(c *bolt.Cursor, prefix []byte) ([]byte, []byte) {
+	k, v := c.Seek(append(slices.Clone(prefix), 0xff, 0xff, 0xff, 0xff))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	if k == nil || !bytes.HasPrefix(k, prefix) {
+		return nil, nil
+	}
+
+	return k, v
+}
+
+func filePrefix(f *meta.File) []byte {
+	prefix := make([]byte, 0, len(f.Bucket)+len(f.Key)+2)
+	prefix = append(prefix, f.Bucket...)
+	prefix = append(prefix, 0)
+	prefix = append(prefix, f.Key...)
+
+	return append(prefix, 0)
+}
+
+func versionKey(f *meta.File, version int) []byte {
+	return binary.BigEndian.AppendUint32(filePrefix(f), uint32(version))
+}
+
+func versionOf(k []byte) uint32 {
+	return binary.BigEndian.Uint32(k[len(k)-4:])
+}
+
+func fileOf(k []byte) (meta.File, error) {
+	if len(k) < 6 {
+		return meta.File{}, errors.New("invalid key")
+	}
+
+	name := k[:len(k)-5]
+	bucket, key, ok := bytes.Cut(name, []byte{0})
+	if !ok {
+		return meta.File{}, fmt.Errorf("invalid key %q", k)
+	}
+
+	return meta.File{Bucket: string(bucket), Key: string(key)}, nil
+}
@@ -0,0 +1,95 @@
+package boltdb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
+)
+
+func TestMeta_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		m, err := New(filepath.Join(t.TempDir(), "meta.db"), zerolog.Nop())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = m.Close()
+		})
+
+		return m
+	})
+}
+
+func TestMeta_Reopen(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.db")
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	m, err := New(filename, zerolog.Nop())
+	require.NoError(t, err)
+
+	metatest.PutFile(t, m, f, meta.StatusReady, []string{"a"})
+	require.NoError(t, m.Close())
+
+	reopened, err := New(filename, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = reopened.Close()
+	}()
+
+	got, err := reopened.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, got.Parts)
+
+	fv, err := reopened.NewVersion(ctx, &f, &meta.FileVersion{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, fv.Version)
+}
+
+func TestMeta_WalkOrder(t *testing.T) {
+	m, err := New(filepath.Join(t.TempDir(), "meta.db"), zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = m.Close()
+	}()
+
+	files := []meta.File{
+		{Bucket: "b", Key: "x"},
+		{Bucket: "a", Key: "dir/2"},
+		{Bucket: "a", Key: "dir"},
+		{Bucket: "a", Key: "dir/1"},
+		{Bucket: "ab", Key: "a"},
+	}
+	for _, f := range files {
+		metatest.PutFile(t, m, f, meta.StatusReady)
+	}
+	// versions past 255 keep their order
+	for range 300 {
+		metatest.PutFile(t, m, files[4], meta.StatusReady)
+	}
+
+	var got []string
+	require.NoError(t, m.Walk(context.Background(), func(f meta.File, fv meta.FileVersion) error {
+		if fv.Version == 0 || fv.Version == 255 || fv.Version == 256 {
+			got = append(got, fmt.Sprintf("%s/%d", f, fv.Version))
+		}
+
+		return nil
+	}))
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("%s/0", meta.File{Bucket: "a", Key: "dir"}),
+		fmt.Sprintf("%s/0", meta.File{Bucket: "a", Key: "dir/1"}),
+		fmt.Sprintf("%s/0", meta.File{Bucket: "a", Key: "dir/2"}),
+		fmt.Sprintf("%s/0", meta.File{Bucket: "ab", Key: "a"}),
+		fmt.Sprintf("%s/255", meta.File{Bucket: "ab", Key: "a"}),
+		fmt.Sprintf("%s/256", meta.File{Bucket: "ab", Key: "a"}),
+		fmt.Sprintf("%s/0", meta.File{Bucket: "b", Key: "x"}),
+	}, got)
+}
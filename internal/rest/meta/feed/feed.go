@@ -0,0 +1,287 @@
+package feed
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+const (
+	DefaultSize = 10000
+
+	// watchBatch is the number of events Watch takes under the lock at once.
+	watchBatch = 1000
+	// stripes is the number of locks that order changes of a file with their events.
+	stripes = 64
+)
+
+type Config struct {
+	// Size is the number of retained events.
+	Size int
+	// File keeps the reserved sequence numbers, so they keep growing across restarts and a watcher resuming
+	// after one gets meta.ErrFeedTruncated instead of other events. Without it numbering starts from zero.
+	File string
+}
+
+// Feed wraps a meta and publishes its changes as events. Events are kept in memory, only the last Size of
+// them can be watched.
+type Feed struct {
+	meta.Meta
+	// locks are held while a change is made and published, so events of a file are in the order of its changes
+	locks  [stripes]sync.Mutex
+	now    func() time.Time
+	log    *Log
+	logger zerolog.Logger
+
+	// mu orders numbering of events with appending them to the log
+	mu  sync.Mutex
+	seq *sequence
+}
+
+func New(m meta.Meta, cfg Config, logger zerolog.Logger) (*Feed, error) {
+	seq, err := openSequence(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Feed{
+		Meta:   m,
+		now:    time.Now,
+		log:    NewLog(cfg.Size, seq.last),
+		logger: logger,
+		seq:    seq,
+	}, nil
+}
+
+type timeKey struct{}
+
+// WithTime makes the changes made with the context publish events with the time instead of the current
+// one. A replicated meta uses it, so every node publishes the same events.
+func WithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, timeKey{}, t)
+}
+
+func (f *Feed) Unwrap() meta.Meta {
+	return f.Meta
+}
+
+func (f *Feed) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
+	if file == nil {
+		return f.Meta.NewVersion(ctx, file, info)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	fv, err := f.Meta.NewVersion(ctx, file, info)
+	if err != nil {
+		return nil, err
+	}
+
+	f.publish(ctx, meta.Event{
+		Type:         meta.EventVersionCreated,
+		File:         *file,
+		Version:      fv.Version,
+		Status:       fv.Status,
+		StorageClass: fv.StorageClass,
+	})
+
+	return fv, nil
+}
+
+func (f *Feed) NewPart(ctx context.Context, file *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	if file == nil || fv == nil || p == nil {
+		return f.Meta.NewPart(ctx, file, fv, p)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	if err := f.Meta.NewPart(ctx, file, fv, p); err != nil {
+		return err
+	}
+
+	f.publish(ctx, meta.Event{
+		Type:    meta.EventPartAdded,
+		File:    *file,
+		Version: fv.Version,
+		Parts:   []meta.Part{*p},
+	})
+
+	return nil
+}
+
+func (f *Feed) UpdateStatus(ctx context.Context, file *meta.File, fv *meta.FileVersion) error {
+	if file == nil || fv == nil {
+		return f.Meta.UpdateStatus(ctx, file, fv)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	if err := f.Meta.UpdateStatus(ctx, file, fv); err != nil {
+		return err
+	}
+
+	f.publish(ctx, meta.Event{
+		Type:    meta.EventStatusChanged,
+		File:    *file,
+		Version: fv.Version,
+		Status:  fv.Status,
+	})
+
+	return nil
+}
+
+func (f *Feed) UpdatePartServers(
+	ctx context.Context,
+	file *meta.File,
+	version, part int,
+	prev, servers []string,
+) error {
+	if file == nil {
+		return f.Meta.UpdatePartServers(ctx, file, version, part, prev, servers)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	if err := f.Meta.UpdatePartServers(ctx, file, version, part, prev, servers); err != nil {
+		return err
+	}
+
+	f.publish(ctx, meta.Event{
+		Type:    meta.EventPartServersChanged,
+		File:    *file,
+		Version: version,
+		Parts:   []meta.Part{{Index: part, Servers: servers}},
+	})
+
+	return nil
+}
+
+func (f *Feed) UpdateStorageClass(
+	ctx context.Context,
+	file *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	if file == nil {
+		return f.Meta.UpdateStorageClass(ctx, file, version, prev, class, parts)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	if err := f.Meta.UpdateStorageClass(ctx, file, version, prev, class, parts); err != nil {
+		return err
+	}
+
+	f.publish(ctx, meta.Event{
+		Type:         meta.EventStorageClassChanged,
+		File:         *file,
+		Version:      version,
+		StorageClass: class,
+		Parts:        parts,
+	})
+
+	return nil
+}
+
+func (f *Feed) PruneVersions(ctx context.Context, file *meta.File, keep int) ([]meta.FileVersion, error) {
+	if file == nil {
+		return f.Meta.PruneVersions(ctx, file, keep)
+	}
+
+	unlock := f.lock(*file)
+	defer unlock()
+
+	versions, err := f.Meta.PruneVersions(ctx, file, keep)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fv := range versions {
+		f.publish(ctx, meta.Event{
+			Type:         meta.EventVersionDeleted,
+			File:         *file,
+			Version:      fv.Version,
+			Status:       fv.Status,
+			StorageClass: fv.StorageClass,
+			Parts:        fv.Parts,
+		})
+	}
+
+	return versions, nil
+}
+
+// Close closes the wrapped meta.
+func (f *Feed) Close() error {
+	if c, ok := f.Meta.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (f *Feed) Watch(ctx context.Context, from uint64, fn func(meta.Event) error) error {
+	return f.log.Watch(ctx, from, fn)
+}
+
+// Last returns the sequence number of the last published event.
+func (f *Feed) Last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.seq.last
+}
+
+// Reset drops the retained events and continues numbering after last. It is used when the state of the
+// wrapped meta is replaced.
+func (f *Feed) Reset(last uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq.last = last
+	f.log.Reset(last)
+}
+
+func (f *Feed) publish(ctx context.Context, e meta.Event) {
+	if t, ok := ctx.Value(timeKey{}).(time.Time); ok {
+		e.Time = t.UTC()
+	} else {
+		e.Time = f.now().UTC()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seq, err := f.seq.next()
+	if err != nil {
+		// the number may be repeated after a restart, so watchers start over instead of getting the event
+		f.logger.Error().Err(err).Msg("failed to publish meta change")
+		f.log.Reset(seq)
+		return
+	}
+
+	e.Seq = seq
+	f.log.Append(e)
+}
+
+func (f *Feed) lock(file meta.File) func() {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(file.String()))
+
+	mu := &f.locks[h.Sum32()%stripes]
+	mu.Lock()
+
+	return mu.Unlock
+}
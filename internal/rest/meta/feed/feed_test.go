@@ -0,0 +1,213 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
+)
+
+var errStop = errors.New("stop")
+
+func newFeed(t *testing.T, cfg Config) *Feed {
+	t.Helper()
+
+	f, err := New(inmemory.NewVolatile(inmemory.Config{}, zerolog.Nop()), cfg, zerolog.Nop())
+	require.NoError(t, err)
+
+	return f
+}
+
+// collect returns the retained events after from.
+func collect(t *testing.T, f *Feed, from uint64) []meta.Event {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var res []meta.Event
+	err := f.Watch(ctx, from, func(e meta.Event) error {
+		res = append(res, e)
+		return nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	return res
+}
+
+func TestFeed_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		return newFeed(t, Config{})
+	})
+}
+
+func TestFeed_Events(t *testing.T) {
+	ctx := context.Background()
+	f := newFeed(t, Config{})
+	file := meta.File{Bucket: "bucket", Key: "key"}
+
+	fv := metatest.PutFile(t, f, file, meta.StatusReady, []string{"a"})
+	require.NoError(t, f.UpdatePartServers(ctx, &file, fv.Version, 0, []string{"a"}, []string{"b"}))
+	require.NoError(t, f.UpdateStorageClass(ctx, &file, fv.Version, []meta.Part{{Index: 0, Servers: []string{"b"}}},
+		"COLD", []meta.Part{{Index: 0, Servers: []string{"c"}}}))
+
+	_, err := f.NewVersion(ctx, nil, &meta.FileVersion{})
+	require.Error(t, err)
+	err = f.UpdatePartServers(ctx, &file, fv.Version, 0, []string{"a"}, []string{"d"})
+	require.Error(t, err, "failed changes are not published")
+
+	events := collect(t, f, 0)
+	require.Len(t, events, 5)
+
+	for i, e := range events {
+		assert.Equal(t, file, e.File)
+		assert.Equal(t, fv.Version, e.Version)
+		assert.False(t, e.Time.IsZero())
+		if i > 0 {
+			assert.Equal(t, events[i-1].Seq+1, e.Seq)
+		}
+	}
+
+	assert.Equal(t, meta.EventVersionCreated, events[0].Type)
+	assert.Equal(t, meta.Status(meta.StatusLoading), events[0].Status)
+	assert.Equal(t, meta.EventPartAdded, events[1].Type)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, events[1].Parts)
+	assert.Equal(t, meta.EventStatusChanged, events[2].Type)
+	assert.Equal(t, meta.Status(meta.StatusReady), events[2].Status)
+	assert.Equal(t, meta.EventPartServersChanged, events[3].Type)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"b"}}}, events[3].Parts)
+	assert.Equal(t, meta.EventStorageClassChanged, events[4].Type)
+	assert.Equal(t, "COLD", events[4].StorageClass)
+
+	assert.Equal(t, events[3:], collect(t, f, events[2].Seq), "watch resumes after the given event")
+	assert.Empty(t, collect(t, f, events[4].Seq))
+}
+
+func TestFeed_PruneVersions(t *testing.T) {
+	f := newFeed(t, Config{})
+	file := meta.File{Bucket: "bucket", Key: "key"}
+
+	first := metatest.PutFile(t, f, file, meta.StatusReady, []string{"a"})
+	metatest.PutFile(t, f, file, meta.StatusReady, []string{"b"})
+
+	_, err := f.PruneVersions(context.Background(), &file, 1)
+	require.NoError(t, err)
+
+	events := collect(t, f, 0)
+	require.Len(t, events, 7)
+
+	deleted := events[6]
+	assert.Equal(t, meta.EventVersionDeleted, deleted.Type)
+	assert.Equal(t, first.Version, deleted.Version)
+	assert.Equal(t, meta.Status(meta.StatusReady), deleted.Status)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, deleted.Parts)
+}
+
+func TestFeed_Truncated(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "meta.json.feed")
+	f := newFeed(t, Config{Size: 3, File: file})
+
+	for _, key := range []string{"a", "b"} {
+		metatest.PutFile(t, f, meta.File{Bucket: "bucket", Key: key}, meta.StatusReady, []string{"s"})
+	}
+
+	events := collect(t, f, 0)
+	require.Len(t, events, 3, "only the last events are retained")
+	assert.Equal(t, meta.EventVersionCreated, events[0].Type)
+	assert.Equal(t, "b", events[0].File.Key)
+
+	err := f.Watch(context.Background(), events[0].Seq-2, func(meta.Event) error { return nil })
+	require.ErrorIs(t, err, meta.ErrFeedTruncated)
+
+	err = f.Watch(context.Background(), events[2].Seq+1, func(meta.Event) error { return nil })
+	require.ErrorIs(t, err, meta.ErrFeedTruncated, "events of another run")
+
+	restarted := newFeed(t, Config{Size: 3, File: file})
+	err = restarted.Watch(context.Background(), events[2].Seq, func(meta.Event) error { return nil })
+	require.ErrorIs(t, err, meta.ErrFeedTruncated, "sequence numbers grow across restarts")
+
+	metatest.PutFile(t, restarted, meta.File{Bucket: "bucket", Key: "c"}, meta.StatusReady, []string{"s"})
+	assert.Greater(t, collect(t, restarted, 0)[0].Seq, events[2].Seq)
+}
+
+func TestFeed_Reset(t *testing.T) {
+	f := newFeed(t, Config{})
+	file := meta.File{Bucket: "bucket", Key: "key"}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	_, err := f.NewVersion(WithTime(context.Background(), at), &file, &meta.FileVersion{})
+	require.NoError(t, err)
+
+	events := collect(t, f, 0)
+	require.Len(t, events, 1)
+	assert.Equal(t, uint64(1), events[0].Seq, "numbering starts from zero without a file")
+	assert.Equal(t, at, events[0].Time)
+
+	f.Reset(10)
+	assert.Equal(t, uint64(10), f.Last())
+
+	err = f.Watch(context.Background(), events[0].Seq, func(meta.Event) error { return nil })
+	require.ErrorIs(t, err, meta.ErrFeedTruncated)
+
+	_, err = f.NewVersion(context.Background(), &file, &meta.FileVersion{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), collect(t, f, 10)[0].Seq)
+}
+
+func TestFeed_WatchLive(t *testing.T) {
+	ctx := context.Background()
+	f := newFeed(t, Config{})
+
+	got := make(chan meta.Event)
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Watch(ctx, 0, func(e meta.Event) error {
+			got <- e
+			if e.Type == meta.EventStatusChanged {
+				return errStop
+			}
+
+			return nil
+		})
+	}()
+
+	metatest.PutFile(t, f, meta.File{Bucket: "bucket", Key: "key"}, meta.StatusReady, []string{"s"})
+
+	var types []meta.EventType
+	for range 3 {
+		select {
+		case e := <-got:
+			types = append(types, e.Type)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no event")
+		}
+	}
+
+	assert.Equal(t, []meta.EventType{meta.EventVersionCreated, meta.EventPartAdded, meta.EventStatusChanged}, types)
+	require.ErrorIs(t, <-done, errStop)
+}
+
+func TestAs(t *testing.T) {
+	storage := inmemory.NewVolatile(inmemory.Config{}, zerolog.Nop())
+	f, err := New(storage, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	got, ok := meta.As[*inmemory.Meta](f)
+	require.True(t, ok)
+	assert.Same(t, storage, got)
+
+	_, ok = meta.As[meta.Watcher](f)
+	assert.True(t, ok)
+
+	_, ok = meta.As[meta.Cluster](f)
+	assert.False(t, ok)
+}
@@ -0,0 +1,144 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// Log retains the last events in memory and serves them to watchers. Sequence numbers are assigned by
+// the publisher and grow by one.
+type Log struct {
+	mu sync.Mutex
+	// events is a ring of retained events starting at head
+	events  []meta.Event
+	head    int
+	last    uint64
+	changed chan struct{}
+}
+
+// NewLog returns a log retaining size events, the first appended one follows last.
+func NewLog(size int, last uint64) *Log {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	return &Log{
+		events:  make([]meta.Event, 0, size),
+		last:    last,
+		changed: make(chan struct{}),
+	}
+}
+
+// Last returns the sequence number of the last event.
+func (l *Log) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.last
+}
+
+// Append retains the event, its Seq must follow the last one.
+func (l *Log) Append(e meta.Event) {
+	e.Parts = cloneParts(e.Parts)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last = e.Seq
+
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, e)
+	} else {
+		l.events[l.head] = e
+		l.head = (l.head + 1) % len(l.events)
+	}
+
+	l.notify()
+}
+
+// Reset drops the retained events, the next one follows last. Watchers of the dropped events get
+// meta.ErrFeedTruncated.
+func (l *Log) Reset(last uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = l.events[:0]
+	l.head = 0
+	l.last = last
+
+	l.notify()
+}
+
+func (l *Log) Watch(ctx context.Context, from uint64, fn func(meta.Event) error) error {
+	for {
+		events, changed, err := l.since(from)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if err = fn(e); err != nil {
+				return err
+			}
+			from = e.Seq
+		}
+
+		if len(events) > 0 {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// since returns retained events after from and a channel closed on the next event.
+func (l *Log) since(from uint64) ([]meta.Event, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := uint64(len(l.events))
+	// the sequence number of the event before the oldest retained one
+	before := l.last - n
+	if from == 0 {
+		from = before
+	}
+
+	if from < before || from > l.last {
+		return nil, nil, fmt.Errorf("%w: events after %d are not retained", meta.ErrFeedTruncated, from)
+	}
+
+	skip := from - before
+	res := make([]meta.Event, min(n-skip, watchBatch))
+	for i := range res {
+		res[i] = l.events[(l.head+int(skip)+i)%len(l.events)]
+	}
+
+	return res, l.changed, nil
+}
+
+func (l *Log) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func cloneParts(parts []meta.Part) []meta.Part {
+	if parts == nil {
+		return nil
+	}
+
+	res := make([]meta.Part, len(parts))
+	for i, p := range parts {
+		res[i] = p
+		res[i].Servers = slices.Clone(p.Servers)
+	}
+
+	return res
+}
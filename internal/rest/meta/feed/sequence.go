@@ -0,0 +1,64 @@
+package feed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+)
+
+// sequenceBlock is the number of sequence numbers reserved by one write of the sequence file.
+const sequenceBlock = 1000
+
+// sequence hands out event sequence numbers. The file keeps the end of the reserved block and a restarted
+// process continues after it, so numbers are never repeated, even after a crash. Without a file numbering
+// starts from zero.
+type sequence struct {
+	file  string
+	last  uint64
+	limit uint64
+}
+
+func openSequence(file string) (*sequence, error) {
+	s := &sequence{file: file}
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read sequence file: %w", err)
+	}
+
+	limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence file %s: %w", file, err)
+	}
+
+	s.last, s.limit = limit, limit
+
+	return s, nil
+}
+
+// next returns the next number, reserving a new block when the current one is used up. The number is
+// taken even if the block can't be reserved.
+func (s *sequence) next() (uint64, error) {
+	s.last++
+
+	if s.file == "" || s.last <= s.limit {
+		return s.last, nil
+	}
+
+	limit := s.last + sequenceBlock - 1
+	if err := atomicfile.WriteFile(s.file, []byte(strconv.FormatUint(limit, 10)+"\n")); err != nil {
+		return s.last, fmt.Errorf("failed to reserve sequence numbers: %w", err)
+	}
+	s.limit = limit
+
+	return s.last, nil
+}
@@ -1,13 +1,16 @@
 package inmemory
 
 import (
-	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/rs/zerolog"
@@ -16,15 +19,41 @@ import (
 	"github.com/theoptz/basic-s3/internal/rest/meta"
 )
 
+// DefaultShards is the number of shards used when Config.Shards isn't set.
+const DefaultShards = 64
+
+type Config struct {
+	// Shards is the number of parts the state is hash-partitioned into, each with its own lock.
+	Shards int
+}
+
+type shard struct {
+	state map[string][]meta.FileVersion
+	mu    sync.RWMutex
+}
+
+// Meta keeps the state in memory, split into shards by file, so changes of unrelated files don't wait
+// for each other. Every change is appended to a write-ahead log next to the meta file before it is
+// applied, and the state is written to the meta file by snapshots, which truncate the log.
 type Meta struct {
-	state  map[string][]meta.FileVersion
+	shards []*shard
 	file   string
 	logger zerolog.Logger
-	closed bool
-	mu     sync.RWMutex
+
+	// mu is held for reading by changes and for writing by snapshots, so a snapshot sees all shards at
+	// the same point of the log.
+	mu sync.RWMutex
+	// walMu serializes appends to the log made by changes in different shards.
+	walMu sync.Mutex
+	wal   walFile
+	// walErr is set when a failed append couldn't be rolled back, further changes are refused until restart.
+	walErr error
+	// snapshotMu allows one snapshot at a time.
+	snapshotMu sync.Mutex
+	closed     bool
 }
 
-func New(filename string, logger zerolog.Logger) (res *Meta, err error) {
+func New(filename string, cfg Config, logger zerolog.Logger) (res *Meta, err error) {
 	f, err := os.OpenFile(filename, os.O_CREATE, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
@@ -44,43 +73,147 @@ func New(filename string, logger zerolog.Logger) (res *Meta, err error) {
 	if len(by) > 0 {
 		err = json.Unmarshal(by, &state)
 		if err != nil {
+			if isLegacyFormat(by) {
+				return nil, ErrLegacyFormat
+			}
+
 			return nil, fmt.Errorf("failed to unmarshal file: %w", err)
 		}
 	}
 
-	return &Meta{
+	wal, err := openWAL(filename, state, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	res = &Meta{
+		shards: newShards(cfg.Shards),
 		file:   filename,
-		state:  state,
+		wal:    wal,
 		logger: logger,
-	}, nil
+	}
+	res.load(state)
+
+	return res, nil
+}
+
+// NewVolatile returns a Meta without a meta file and a log, for callers that persist the state
+// themselves, such as a replicated state machine.
+func NewVolatile(cfg Config, logger zerolog.Logger) *Meta {
+	return &Meta{
+		shards: newShards(cfg.Shards),
+		logger: logger,
+	}
 }
 
-func (m *Meta) NewVersion(ctx context.Context, file *meta.File, contentType string) (*meta.FileVersion, error) {
+func newShards(n int) []*shard {
+	if n <= 0 {
+		n = DefaultShards
+	}
+
+	res := make([]*shard, n)
+	for i := range res {
+		res[i] = &shard{state: make(map[string][]meta.FileVersion)}
+	}
+
+	return res
+}
+
+// load distributes the state over the shards.
+func (m *Meta) load(state map[string][]meta.FileVersion) {
+	for name, versions := range state {
+		m.shardOf(name).state[name] = versions
+	}
+}
+
+func (m *Meta) shardOf(name string) *shard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// lock locks the shard of the file for a change. The returned function unlocks it.
+func (m *Meta) lock(name string) (map[string][]meta.FileVersion, func()) {
+	m.mu.RLock()
+
+	s := m.shardOf(name)
+	s.mu.Lock()
+
+	return s.state, func() {
+		s.mu.Unlock()
+		m.mu.RUnlock()
+	}
+}
+
+// openWAL replays the log of the meta file into the state and opens it for appending.
+func openWAL(filename string, state map[string][]meta.FileVersion, logger zerolog.Logger) (*os.File, error) {
+	wal, err := os.OpenFile(walFilename(filename), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	records, valid, err := replayWAL(wal, state, logger)
+	if err == nil {
+		// drop a torn record, so new records don't follow it
+		err = wal.Truncate(valid)
+	}
+	if err == nil {
+		_, err = wal.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		_ = wal.Close()
+		return nil, fmt.Errorf("failed to replay wal: %w", err)
+	}
+
+	if records > 0 {
+		logger.Info().Int("records", records).Msg("wal replayed")
+	}
+
+	return wal, nil
+}
+
+// NewVersion keeps CreatedAt of info if it is set, so replicas applying the same change agree on it.
+func (m *Meta) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	if file == nil {
+	if file == nil || info == nil {
 		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
 	}
 
+	createdAt := time.Now().UTC()
+	if info.CreatedAt != nil {
+		createdAt = *info.CreatedAt
+	}
 	fv := meta.FileVersion{
-		Status:      meta.StatusLoading,
-		ContentType: contentType,
+		Status:       meta.StatusLoading,
+		ContentType:  info.ContentType,
+		StorageClass: info.StorageClass,
+		CreatedAt:    &createdAt,
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	filename := file.String()
 
-	_, ok := m.state[filename]
+	state, unlock := m.lock(filename)
+	defer unlock()
+
+	versions, ok := state[filename]
 	if !ok {
-		m.state[filename] = make([]meta.FileVersion, 0, 8)
+		versions = make([]meta.FileVersion, 0, 8)
 	}
 
-	fv.Version = len(m.state[filename])
-	m.state[filename] = append(m.state[filename], fv)
+	// versions are never reused, the latest one is never pruned
+	if n := len(versions); n > 0 {
+		fv.Version = versions[n-1].Version + 1
+	}
+
+	if err := m.appendWAL(*file, fv); err != nil {
+		return nil, err
+	}
+
+	state[filename] = append(versions, fv)
 
 	m.logger.Debug().
 		Str("bucket", file.Bucket).
@@ -102,10 +235,10 @@ func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVers
 		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	state, unlock := m.lock(f.String())
+	defer unlock()
 
-	versions, ok := m.state[f.String()]
+	versions, ok := state[f.String()]
 	if !ok {
 		return fmt.Errorf("%w: file not found", common.ErrNotFound)
 	}
@@ -116,7 +249,14 @@ func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVers
 				return fmt.Errorf("%w: can't update final status", common.ErrBadRequest)
 			}
 
-			versions[i].Status = fv.Status
+			next := versions[i]
+			next.Status = fv.Status
+
+			if err := m.appendWAL(*f, next); err != nil {
+				return err
+			}
+
+			versions[i] = next
 			return nil
 		}
 	}
@@ -137,23 +277,31 @@ func (m *Meta) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion,
 		return fmt.Errorf("%w: no part provided", common.ErrBadRequest)
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	state, unlock := m.lock(f.String())
+	defer unlock()
 
-	versions, ok := m.state[f.String()]
+	versions, ok := state[f.String()]
 	if !ok {
 		return fmt.Errorf("%w: file not found", common.ErrNotFound)
 	}
 
-	if len(versions) <= fv.Version {
+	i, found := search(versions, fv.Version)
+	if !found {
 		return fmt.Errorf("%w: file version not found", common.ErrNotFound)
 	}
 
-	if p.Index != len(versions[fv.Version].Parts) {
+	if p.Index != len(versions[i].Parts) {
 		return fmt.Errorf("%w: invalid part index", common.ErrBadRequest)
 	}
 
-	versions[fv.Version].Parts = append(versions[fv.Version].Parts, *p)
+	next := versions[i]
+	next.Parts = append(slices.Clone(next.Parts), *p)
+
+	if err := m.appendWAL(*f, next); err != nil {
+		return err
+	}
+
+	versions[i] = next
 
 	return nil
 }
@@ -167,10 +315,11 @@ func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion,
 		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
 	}
 
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	s := m.shardOf(f.String())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	file, ok := m.state[f.String()]
+	file, ok := s.state[f.String()]
 	if !ok {
 		return nil, fmt.Errorf("%w: file not found", common.ErrNotFound)
 	}
@@ -207,35 +356,217 @@ func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion,
 	return &fv, nil
 }
 
+func (m *Meta) Walk(ctx context.Context, fn func(meta.File, meta.FileVersion) error) error {
+	type entry struct {
+		file meta.File
+		fv   meta.FileVersion
+	}
+
+	var entries []entry
+	for _, s := range m.shards {
+		s.mu.RLock()
+		for name, versions := range s.state {
+			file, err := meta.FileFromString(name)
+			if err != nil {
+				s.mu.RUnlock()
+				return fmt.Errorf("invalid file %q: %w", name, err)
+			}
+
+			for _, fv := range versions {
+				fv.Parts = slices.Clone(fv.Parts)
+				entries = append(entries, entry{file: file, fv: fv})
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(e.file, e.fv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Meta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if len(servers) == 0 {
+		return fmt.Errorf("%w: no servers provided", common.ErrBadRequest)
+	}
+
+	state, unlock := m.lock(f.String())
+	defer unlock()
+
+	versions, ok := state[f.String()]
+	if !ok {
+		return fmt.Errorf("%w: file not found", common.ErrNotFound)
+	}
+
+	i, found := search(versions, version)
+	if !found {
+		return fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	}
+
+	next := versions[i]
+	if part < 0 || len(next.Parts) <= part {
+		return fmt.Errorf("%w: part not found", common.ErrNotFound)
+	}
+
+	if !slices.Equal(next.Parts[part].Servers, prev) {
+		return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+	}
+
+	// parts are copied, so versions returned earlier keep their servers
+	next.Parts = slices.Clone(next.Parts)
+	next.Parts[part].Servers = slices.Clone(servers)
+
+	if err := m.appendWAL(*f, next); err != nil {
+		return err
+	}
+
+	versions[i] = next
+
+	return nil
+}
+
+func (m *Meta) UpdateStorageClass(
+	ctx context.Context,
+	f *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	for _, part := range parts {
+		if len(part.Servers) == 0 {
+			return fmt.Errorf("%w: no servers provided for part %d", common.ErrBadRequest, part.Index)
+		}
+	}
+
+	state, unlock := m.lock(f.String())
+	defer unlock()
+
+	versions, ok := state[f.String()]
+	if !ok {
+		return fmt.Errorf("%w: file not found", common.ErrNotFound)
+	}
+
+	i, found := search(versions, version)
+	if !found {
+		return fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	}
+
+	next := versions[i]
+	if len(parts) != len(next.Parts) {
+		return fmt.Errorf("%w: version has %d parts", common.ErrBadRequest, len(next.Parts))
+	}
+
+	if !slices.EqualFunc(next.Parts, prev, func(a, b meta.Part) bool {
+		return a.Index == b.Index && slices.Equal(a.Servers, b.Servers)
+	}) {
+		return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+	}
+
+	newParts := make([]meta.Part, len(parts))
+	for i, part := range parts {
+		newParts[i] = part
+		newParts[i].Servers = slices.Clone(part.Servers)
+	}
+
+	next.StorageClass = class
+	next.Parts = newParts
+
+	if err := m.appendWAL(*f, next); err != nil {
+		return err
+	}
+
+	versions[i] = next
+
+	return nil
+}
+
+func (m *Meta) PruneVersions(ctx context.Context, f *meta.File, keep int) ([]meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if keep < 1 {
+		return nil, fmt.Errorf("%w: at least one version must be kept", common.ErrBadRequest)
+	}
+
+	state, unlock := m.lock(f.String())
+	defer unlock()
+
+	versions, ok := state[f.String()]
+	if !ok {
+		return nil, fmt.Errorf("%w: file not found", common.ErrNotFound)
+	}
+
+	pruned := meta.Prunable(versions, keep)
+	if len(pruned) == 0 {
+		return nil, nil
+	}
+
+	if err := m.deleteWAL(*f, pruned); err != nil {
+		return nil, err
+	}
+
+	state[f.String()] = slices.DeleteFunc(versions, func(fv meta.FileVersion) bool {
+		_, found := search(pruned, fv.Version)
+		return found
+	})
+
+	m.logger.Debug().
+		Str("bucket", f.Bucket).
+		Str("key", f.Key).
+		Int("versions", len(pruned)).
+		Msg("versions pruned")
+
+	return pruned, nil
+}
+
+// Close takes a final snapshot and closes the log.
 func (m *Meta) Close() (err error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
 
 	if m.closed {
 		return nil
 	}
-	m.closed = true
 
-	by, err := json.Marshal(m.state)
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %w", err)
+	if err = m.snapshot(); err != nil {
+		return err
 	}
 
-	f, err := os.Create(m.file)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
-	}
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			err = multierror.Append(err, closeErr)
-		}
-	}()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	n, err := io.Copy(f, bytes.NewReader(by))
-	if err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
-	} else if n != int64(len(by)) {
-		return fmt.Errorf("failed to write file: wrote %d of %d bytes", n, len(by))
+	m.closed = true
+
+	if m.wal != nil {
+		if err = m.wal.Close(); err != nil {
+			return fmt.Errorf("failed to close wal: %w", err)
+		}
 	}
 
 	return nil
@@ -244,3 +575,10 @@ func (m *Meta) Close() (err error) {
 func canChangeStatus(prev, next meta.Status) bool {
 	return prev == next || prev == meta.StatusLoading
 }
+
+// search returns the position of the version in versions ordered by number and whether it is there.
+func search(versions []meta.FileVersion, version int) (int, bool) {
+	return slices.BinarySearchFunc(versions, version, func(fv meta.FileVersion, v int) int {
+		return cmp.Compare(fv.Version, v)
+	})
+}
@@ -3,12 +3,19 @@ package inmemory
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/rs/zerolog"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/theoptz/basic-s3/internal/rest/common"
 	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
 )
 
 func TestMeta_GetVersion(t *testing.T) {
@@ -60,10 +67,7 @@ func TestMeta_GetVersion(t *testing.T) {
 		{
 			name: "file not found",
 			storage: func() *Meta {
-				res := &Meta{
-					state:  make(map[string][]meta.FileVersion),
-					logger: zerolog.Nop(),
-				}
+				res := newTestMeta(make(map[string][]meta.FileVersion))
 
 				return res
 			}(),
@@ -82,10 +86,7 @@ func TestMeta_GetVersion(t *testing.T) {
 				state := make(map[string][]meta.FileVersion)
 				state[meta.File{Bucket: bucket, Key: key}.String()] = []meta.FileVersion{}
 
-				res := &Meta{
-					state:  state,
-					logger: zerolog.Nop(),
-				}
+				res := newTestMeta(state)
 
 				return res
 			}(),
@@ -117,10 +118,7 @@ func TestMeta_GetVersion(t *testing.T) {
 					},
 				}
 
-				res := &Meta{
-					state:  state,
-					logger: zerolog.Nop(),
-				}
+				res := newTestMeta(state)
 
 				return res
 			}(),
@@ -158,10 +156,7 @@ func TestMeta_GetVersion(t *testing.T) {
 					},
 				}
 
-				res := &Meta{
-					state:  state,
-					logger: zerolog.Nop(),
-				}
+				res := newTestMeta(state)
 
 				return res
 			}(),
@@ -192,3 +187,514 @@ func TestMeta_GetVersion(t *testing.T) {
 		})
 	}
 }
+
+func TestMigrateServerIndexes(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		ids          []string
+		wantMigrated int
+		want         string
+		wantErr      assert.ErrorAssertionFunc
+	}{
+		{
+			name:    "empty file",
+			content: "",
+			ids:     []string{"a"},
+			want:    "",
+			wantErr: assert.NoError,
+		},
+		{
+			name:    "already migrated",
+			content: `{"bucket/key":[{"version":0,"content_type":"","status":"ready","parts":[{"servers":["a"],"index":0}]}]}`,
+			ids:     []string{"a"},
+			want:    `{"bucket/key":[{"version":0,"content_type":"","status":"ready","parts":[{"servers":["a"],"index":0}]}]}`,
+			wantErr: assert.NoError,
+		},
+		{
+			name: "legacy indexes",
+			content: `{"bucket/key":[{"version":0,"content_type":"text/plain","status":"ready",` +
+				`"parts":[{"servers":[1],"index":0},{"servers":[0,2],"index":1}]}]}`,
+			ids:          []string{"a", "b", "c"},
+			wantMigrated: 2,
+			want: `{"bucket/key":[{"version":0,"content_type":"text/plain","status":"ready",` +
+				`"parts":[{"servers":["b"],"index":0},{"servers":["a","c"],"index":1}]}]}`,
+			wantErr: assert.NoError,
+		},
+		{
+			name:    "unknown index",
+			content: `{"bucket/key":[{"version":0,"content_type":"","status":"ready","parts":[{"servers":[3],"index":0}]}]}`,
+			ids:     []string{"a"},
+			want:    `{"bucket/key":[{"version":0,"content_type":"","status":"ready","parts":[{"servers":[3],"index":0}]}]}`,
+			wantErr: assert.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "meta.json")
+			require.NoError(t, os.WriteFile(filename, []byte(tt.content), 0666))
+
+			migrated, err := MigrateServerIndexes(filename, tt.ids)
+			if !tt.wantErr(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantMigrated, migrated)
+
+			by, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(by))
+		})
+	}
+}
+
+func TestMeta_UpdatePartServers(t *testing.T) {
+	newMeta := func() *Meta {
+		return newTestMeta(map[string][]meta.FileVersion{
+			"bucket/key": {
+				{
+					Version: 0,
+					Status:  meta.StatusReady,
+					Parts: []meta.Part{
+						{Index: 0, Servers: []string{"a"}},
+						{Index: 1, Servers: []string{"b", "c"}},
+					},
+				},
+			},
+		})
+	}
+
+	tests := []struct {
+		name        string
+		file        *meta.File
+		version     int
+		part        int
+		prev        []string
+		servers     []string
+		wantErr     error
+		wantServers []string
+	}{
+		{
+			name:        "success",
+			file:        &meta.File{Bucket: "bucket", Key: "key"},
+			part:        1,
+			prev:        []string{"b", "c"},
+			servers:     []string{"d", "c"},
+			wantServers: []string{"d", "c"},
+		},
+		{
+			name:        "servers have changed",
+			file:        &meta.File{Bucket: "bucket", Key: "key"},
+			part:        1,
+			prev:        []string{"b"},
+			servers:     []string{"d"},
+			wantErr:     common.ErrConflict,
+			wantServers: []string{"b", "c"},
+		},
+		{
+			name:        "part not found",
+			file:        &meta.File{Bucket: "bucket", Key: "key"},
+			part:        2,
+			servers:     []string{"d"},
+			wantErr:     common.ErrNotFound,
+			wantServers: []string{"b", "c"},
+		},
+		{
+			name:        "version not found",
+			file:        &meta.File{Bucket: "bucket", Key: "key"},
+			version:     1,
+			servers:     []string{"d"},
+			wantErr:     common.ErrNotFound,
+			wantServers: []string{"b", "c"},
+		},
+		{
+			name:        "no servers",
+			file:        &meta.File{Bucket: "bucket", Key: "key"},
+			part:        1,
+			prev:        []string{"b", "c"},
+			wantErr:     common.ErrBadRequest,
+			wantServers: []string{"b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMeta()
+
+			before, err := m.GetVersion(context.Background(), &meta.File{Bucket: "bucket", Key: "key"})
+			require.NoError(t, err)
+
+			err = m.UpdatePartServers(context.Background(), tt.file, tt.version, tt.part, tt.prev, tt.servers)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			after, err := m.GetVersion(context.Background(), &meta.File{Bucket: "bucket", Key: "key"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantServers, after.Parts[1].Servers)
+			assert.Equal(t, []string{"b", "c"}, before.Parts[1].Servers, "returned versions are not changed")
+		})
+	}
+}
+
+func TestMeta_UpdateStorageClass(t *testing.T) {
+	file := &meta.File{Bucket: "bucket", Key: "key"}
+	parts := []meta.Part{
+		{Index: 0, Servers: []string{"a"}},
+		{Index: 1, Servers: []string{"b", "c"}},
+	}
+	moved := []meta.Part{
+		{Index: 0, Servers: []string{"d"}},
+		{Index: 1, Servers: []string{"d", "e"}},
+	}
+
+	tests := []struct {
+		name      string
+		prev      []meta.Part
+		parts     []meta.Part
+		wantErr   error
+		wantClass string
+		wantParts []meta.Part
+	}{
+		{
+			name:      "success",
+			prev:      parts,
+			parts:     moved,
+			wantClass: "COLD",
+			wantParts: moved,
+		},
+		{
+			name: "servers have changed",
+			prev: []meta.Part{
+				{Index: 0, Servers: []string{"a"}},
+				{Index: 1, Servers: []string{"b"}},
+			},
+			parts:     moved,
+			wantErr:   common.ErrConflict,
+			wantParts: parts,
+		},
+		{
+			name:      "parts count differs",
+			prev:      parts,
+			parts:     moved[:1],
+			wantErr:   common.ErrBadRequest,
+			wantParts: parts,
+		},
+		{
+			name: "no servers",
+			prev: parts,
+			parts: []meta.Part{
+				{Index: 0, Servers: []string{"d"}},
+				{Index: 1},
+			},
+			wantErr:   common.ErrBadRequest,
+			wantParts: parts,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMeta(map[string][]meta.FileVersion{
+				"bucket/key": {{Version: 0, Status: meta.StatusReady, Parts: parts}},
+			})
+
+			before, err := m.GetVersion(context.Background(), file)
+			require.NoError(t, err)
+
+			err = m.UpdateStorageClass(context.Background(), file, 0, tt.prev, "COLD", tt.parts)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			after, err := m.GetVersion(context.Background(), file)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantClass, after.StorageClass)
+			assert.Equal(t, tt.wantParts, after.Parts)
+			assert.Equal(t, parts, before.Parts, "returned versions are not changed")
+		})
+	}
+}
+
+func TestMeta_Walk(t *testing.T) {
+	m, err := New(filepath.Join(t.TempDir(), "meta.json"), Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, f := range []meta.File{{Bucket: "b1", Key: "k1"}, {Bucket: "b1", Key: "dir/k2"}, {Bucket: "b1", Key: "k1"}} {
+		_, err = m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+		require.NoError(t, err)
+	}
+
+	var got []string
+	err = m.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		got = append(got, fmt.Sprintf("%s/%d", f, fv.Version))
+
+		// walk doesn't hold the lock
+		_, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+		return err
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"b1/k1/0", "b1/k1/1", "b1/dir/k2/0"}, got)
+}
+
+func TestMeta_WAL(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.json")
+	file := &meta.File{Bucket: "bucket", Key: "key"}
+
+	m, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	fv, err := m.NewVersion(ctx, file, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	require.NoError(t, m.NewPart(ctx, file, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.UpdateStatus(ctx, file, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+	require.NoError(t, m.UpdatePartServers(ctx, file, fv.Version, 0, []string{"a"}, []string{"b"}))
+
+	want, err := m.GetVersion(ctx, file)
+	require.NoError(t, err)
+
+	// a crash leaves the meta file empty and a torn record at the end of the log
+	wal, err := os.OpenFile(walFilename(filename), os.O_APPEND|os.O_WRONLY, 0666)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`{"file":{"bucket":"bucket","key":"ke`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	recovered, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	got, err := recovered.GetVersion(ctx, file)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = recovered.NewVersion(ctx, file, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	require.NoError(t, recovered.Snapshot())
+
+	info, err := os.Stat(walFilename(filename))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size(), "snapshot truncates the log")
+
+	require.NoError(t, recovered.UpdateStatus(ctx, file, &meta.FileVersion{Version: 1, Status: meta.StatusError}))
+
+	restarted, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	var versions []meta.FileVersion
+	require.NoError(t, restarted.Walk(ctx, func(_ meta.File, fv meta.FileVersion) error {
+		versions = append(versions, fv)
+		return nil
+	}))
+	require.Len(t, versions, 2)
+	assert.Equal(t, *want, versions[0])
+	assert.Equal(t, meta.Status(meta.StatusError), versions[1].Status, "changes after the snapshot are replayed")
+}
+
+// failingWAL writes half of the first record after armed and then fails, as on a full disk.
+type failingWAL struct {
+	walFile
+	armed        bool
+	failTruncate bool
+}
+
+func (w *failingWAL) Write(p []byte) (int, error) {
+	if !w.armed {
+		return w.walFile.Write(p)
+	}
+
+	w.armed = false
+	n, _ := w.walFile.Write(p[:len(p)/2])
+	return n, syscall.ENOSPC
+}
+
+func (w *failingWAL) Truncate(size int64) error {
+	if w.failTruncate {
+		return syscall.EIO
+	}
+
+	return w.walFile.Truncate(size)
+}
+
+func TestMeta_WAL_FailedWrite(t *testing.T) {
+	tests := []struct {
+		name         string
+		failTruncate bool
+		// wantVersions are the versions replayed after a restart
+		wantVersions []int
+	}{
+		{name: "torn record is rolled back", wantVersions: []int{0, 1}},
+		{name: "broken log refuses changes", failTruncate: true, wantVersions: []int{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			filename := filepath.Join(t.TempDir(), "meta.json")
+			file := &meta.File{Bucket: "bucket", Key: "key"}
+
+			m, err := New(filename, Config{}, zerolog.Nop())
+			require.NoError(t, err)
+
+			_, err = m.NewVersion(ctx, file, &meta.FileVersion{ContentType: "text/plain"})
+			require.NoError(t, err)
+
+			wal := &failingWAL{walFile: m.wal, armed: true, failTruncate: tt.failTruncate}
+			m.wal = wal
+
+			_, err = m.NewVersion(ctx, file, &meta.FileVersion{ContentType: "text/plain"})
+			require.ErrorIs(t, err, syscall.ENOSPC)
+
+			_, err = m.NewVersion(ctx, file, &meta.FileVersion{ContentType: "text/plain"})
+			if tt.failTruncate {
+				require.ErrorIs(t, err, syscall.ENOSPC, "changes after a torn record are refused")
+			} else {
+				require.NoError(t, err)
+			}
+
+			restarted, err := New(filename, Config{}, zerolog.Nop())
+			require.NoError(t, err)
+
+			var versions []int
+			require.NoError(t, restarted.Walk(ctx, func(_ meta.File, fv meta.FileVersion) error {
+				versions = append(versions, fv.Version)
+				return nil
+			}))
+			assert.Equal(t, tt.wantVersions, versions)
+		})
+	}
+}
+
+func TestMeta_PruneWAL(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.json")
+	file := meta.File{Bucket: "bucket", Key: "key"}
+
+	m, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	for range 3 {
+		metatest.PutFile(t, m, file, meta.StatusReady, []string{"a"})
+	}
+
+	pruned, err := m.PruneVersions(ctx, &file, 1)
+	require.NoError(t, err)
+	require.Len(t, pruned, 2)
+
+	walBefore, err := os.ReadFile(walFilename(filename))
+	require.NoError(t, err)
+
+	walk := func(m *Meta) []int {
+		var versions []int
+		require.NoError(t, m.Walk(ctx, func(_ meta.File, fv meta.FileVersion) error {
+			versions = append(versions, fv.Version)
+			return nil
+		}))
+
+		return versions
+	}
+
+	replayed, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, walk(replayed), "deletions are replayed")
+
+	require.NoError(t, replayed.Snapshot())
+	// a crash after the snapshot is written, but before the log is truncated
+	require.NoError(t, os.WriteFile(walFilename(filename), walBefore, 0666))
+
+	restarted, err := New(filename, Config{}, zerolog.Nop())
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, walk(restarted), "the log is replayed over a newer snapshot")
+
+	fv, err := restarted.NewVersion(ctx, &file, &meta.FileVersion{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, fv.Version)
+}
+
+func TestMeta_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		m, err := New(filepath.Join(t.TempDir(), "meta.json"), Config{}, zerolog.Nop())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = m.Close()
+		})
+
+		return m
+	})
+}
+
+func newTestMeta(state map[string][]meta.FileVersion) *Meta {
+	m := &Meta{shards: newShards(DefaultShards), logger: zerolog.Nop()}
+	m.load(state)
+
+	return m
+}
+
+func TestMeta_ConcurrentSnapshots(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.json")
+
+	m, err := New(filename, Config{Shards: 4}, zerolog.Nop())
+	require.NoError(t, err)
+
+	const files = 20
+
+	var wg sync.WaitGroup
+	for i := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			f := meta.File{Bucket: "bucket", Key: fmt.Sprintf("key-%d", i)}
+			for range 5 {
+				metatest.PutFile(t, m, f, meta.StatusReady, []string{"a"})
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for range 10 {
+			assert.NoError(t, m.Snapshot())
+		}
+	}()
+
+	wg.Wait()
+	<-done
+
+	used := 0
+	for _, s := range m.shards {
+		if len(s.state) > 0 {
+			used++
+		}
+	}
+	assert.Greater(t, used, 1, "files are spread over shards")
+
+	// the last snapshot may miss changes, they are replayed from the log
+	require.NoError(t, m.Snapshot())
+	_, err = m.NewVersion(ctx, &meta.File{Bucket: "bucket", Key: "key-0"}, &meta.FileVersion{})
+	require.NoError(t, err)
+
+	restarted, err := New(filename, Config{Shards: 8}, zerolog.Nop())
+	require.NoError(t, err)
+
+	versions := make(map[string]int)
+	require.NoError(t, restarted.Walk(ctx, func(f meta.File, _ meta.FileVersion) error {
+		versions[f.Key]++
+		return nil
+	}))
+	require.Len(t, versions, files)
+	for key, n := range versions {
+		if key == "key-0" {
+			assert.Equal(t, 6, n)
+		} else {
+			assert.Equal(t, 5, n, key)
+		}
+	}
+}
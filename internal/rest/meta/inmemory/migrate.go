@@ -0,0 +1,95 @@
+package inmemory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+var ErrLegacyFormat = errors.New("meta file references storages by index, migrate it with meta-migrate")
+
+type legacyPart struct {
+	Servers []int `json:"servers"`
+	Index   int   `json:"index"`
+}
+
+type legacyVersion struct {
+	meta.FileVersion
+	Parts []legacyPart `json:"parts"`
+}
+
+// MigrateServerIndexes rewrites a meta file created when parts referenced storages by their position
+// in the STORAGES list. ids must list node IDs in that same order. The original file is kept with
+// a .bak suffix. It returns the number of migrated parts.
+func MigrateServerIndexes(filename string, ids []string) (int, error) {
+	by, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if len(by) == 0 || json.Unmarshal(by, new(map[string][]meta.FileVersion)) == nil {
+		return 0, nil
+	}
+
+	var legacy map[string][]legacyVersion
+	if err = json.Unmarshal(by, &legacy); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal legacy file: %w", err)
+	}
+
+	state := make(map[string][]meta.FileVersion, len(legacy))
+	migrated := 0
+
+	for file, versions := range legacy {
+		state[file] = make([]meta.FileVersion, len(versions))
+
+		for i, v := range versions {
+			fv := v.FileVersion
+			fv.Parts = make([]meta.Part, len(v.Parts))
+
+			for j, p := range v.Parts {
+				fv.Parts[j] = meta.Part{
+					Index:   p.Index,
+					Servers: make([]string, len(p.Servers)),
+				}
+
+				for k, idx := range p.Servers {
+					if idx < 0 || idx >= len(ids) {
+						return 0, fmt.Errorf("%s version %d part %d: unknown storage index %d", file, fv.Version, p.Index, idx)
+					}
+
+					fv.Parts[j].Servers[k] = ids[idx]
+				}
+
+				migrated++
+			}
+
+			state[file][i] = fv
+		}
+	}
+
+	res, err := json.Marshal(state)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if err = atomicfile.WriteFile(filename+".bak", by); err != nil {
+		return 0, fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	// the backup is on disk before the file is replaced, and a crash never leaves it half written
+	if err = atomicfile.WriteFile(filename, res); err != nil {
+		return 0, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return migrated, nil
+}
+
+func isLegacyFormat(by []byte) bool {
+	var legacy map[string][]legacyVersion
+
+	return json.Unmarshal(by, &legacy) == nil
+}
@@ -0,0 +1,333 @@
+package inmemory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// walRecord holds a version as it is after a change, or only its number if it is deleted, so replaying
+// a record twice or over a newer snapshot ends in the same state.
+type walRecord struct {
+	File    meta.File        `json:"file"`
+	Version meta.FileVersion `json:"version"`
+	Deleted bool             `json:"deleted,omitempty"`
+}
+
+// walFile is the log file, an *os.File outside of tests.
+type walFile interface {
+	io.Writer
+	io.Seeker
+	io.ReaderAt
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+func walFilename(filename string) string {
+	return filename + ".wal"
+}
+
+// appendWAL writes the version to the log and fsyncs it. It must be called with the shard locked and
+// before the change is applied, so a change that isn't durable isn't visible either.
+func (m *Meta) appendWAL(f meta.File, fv meta.FileVersion) error {
+	return m.writeWAL(walRecord{File: f, Version: fv})
+}
+
+// deleteWAL writes the deletion of the versions to the log with a single fsync, the same way as appendWAL.
+func (m *Meta) deleteWAL(f meta.File, versions []meta.FileVersion) error {
+	records := make([]walRecord, len(versions))
+	for i, fv := range versions {
+		records[i] = walRecord{File: f, Version: meta.FileVersion{Version: fv.Version}, Deleted: true}
+	}
+
+	return m.writeWAL(records...)
+}
+
+func (m *Meta) writeWAL(records ...walRecord) error {
+	if m.wal == nil {
+		return nil
+	}
+
+	var buf []byte
+	for _, rec := range records {
+		by, err := json.Marshal(rec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal wal record: %w", err)
+		}
+
+		buf = append(append(buf, by...), '\n')
+	}
+
+	m.walMu.Lock()
+	defer m.walMu.Unlock()
+
+	if m.walErr != nil {
+		return fmt.Errorf("wal is broken, restart to recover: %w", m.walErr)
+	}
+
+	offset, err := m.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get wal offset: %w", err)
+	}
+
+	if _, err = m.wal.Write(buf); err != nil {
+		return m.rewindWAL(offset, fmt.Errorf("failed to write wal: %w", err))
+	}
+
+	if err = m.wal.Sync(); err != nil {
+		return m.rewindWAL(offset, fmt.Errorf("failed to sync wal: %w", err))
+	}
+
+	return nil
+}
+
+// rewindWAL drops what a failed append may have left after offset, so the next append doesn't follow a
+// torn record the replay would stop at. If it can't, the log is broken and every further change is
+// refused until a restart replays the log, skipping the torn record at its end. It must be called with
+// walMu held and returns cause.
+func (m *Meta) rewindWAL(offset int64, cause error) error {
+	err := m.wal.Truncate(offset)
+	if err == nil {
+		_, err = m.wal.Seek(offset, io.SeekStart)
+	}
+
+	if err != nil {
+		m.walErr = cause
+		m.logger.Error().Err(err).Msg("failed to roll back wal, changes are refused until restart")
+	}
+
+	return cause
+}
+
+// replayWAL applies the log to the state and returns the number of records and the size of the valid
+// part of the log. A torn last record, left by a crash during a write, is skipped.
+func replayWAL(r io.Reader, state map[string][]meta.FileVersion, logger zerolog.Logger) (int, int64, error) {
+	reader := bufio.NewReader(r)
+
+	var records int
+	var valid int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				logger.Warn().Int("size", len(line)).Msg("skipping torn wal record")
+			}
+
+			return records, valid, nil
+		} else if err != nil {
+			return records, valid, fmt.Errorf("failed to read wal: %w", err)
+		}
+
+		var rec walRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return records, valid, fmt.Errorf("invalid wal record %d: %w", records, err)
+		}
+
+		name := rec.File.String()
+		versions := state[name]
+
+		i, found := search(versions, rec.Version.Version)
+		switch {
+		case rec.Deleted && found:
+			state[name] = slices.Delete(versions, i, i+1)
+		case rec.Deleted:
+		case found:
+			versions[i] = rec.Version
+		default:
+			state[name] = slices.Insert(versions, i, rec.Version)
+		}
+
+		records++
+		valid += int64(len(line))
+	}
+}
+
+// Snapshot writes the state to the meta file and truncates the log.
+func (m *Meta) Snapshot() error {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	return m.snapshot()
+}
+
+// snapshot copies all shards and notes the end of the log while changes are stopped, writes the copy
+// without stopping them and then drops the part of the log the snapshot covers. It must be called
+// with snapshotMu held.
+func (m *Meta) snapshot() error {
+	m.mu.Lock()
+	state := m.copyState()
+
+	var offset int64
+	if m.wal != nil {
+		var err error
+		if offset, err = m.wal.Seek(0, io.SeekCurrent); err != nil {
+			m.mu.Unlock()
+			return fmt.Errorf("failed to get wal offset: %w", err)
+		}
+	}
+	m.mu.Unlock()
+
+	if m.file == "" {
+		return nil
+	}
+
+	by, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %w", err)
+	}
+
+	if err = atomicfile.WriteFile(m.file, by); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.dropWAL(offset)
+}
+
+// copyState returns the state of all shards. It must be called with mu held for writing. Versions are
+// copied, because changes replace them in place, parts are not, because changes replace them.
+func (m *Meta) copyState() map[string][]meta.FileVersion {
+	state := make(map[string][]meta.FileVersion)
+	for _, s := range m.shards {
+		for name, versions := range s.state {
+			state[name] = slices.Clone(versions)
+		}
+	}
+
+	return state
+}
+
+// WriteState writes the state in the format of the meta file.
+func (m *Meta) WriteState(w io.Writer) error {
+	m.mu.Lock()
+	state := m.copyState()
+	m.mu.Unlock()
+
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceState replaces the state with the one written by WriteState. The log isn't changed, so it is
+// meant for a Meta created by NewVolatile.
+func (m *Meta) ReplaceState(r io.Reader) error {
+	state := make(map[string][]meta.FileVersion)
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("failed to read state: %w", err)
+	}
+
+	next := make(map[*shard]map[string][]meta.FileVersion, len(m.shards))
+	for _, s := range m.shards {
+		next[s] = make(map[string][]meta.FileVersion)
+	}
+
+	for name, versions := range state {
+		next[m.shardOf(name)][name] = versions
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// readers lock only shards
+	for _, s := range m.shards {
+		s.mu.Lock()
+		s.state = next[s]
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+// dropWAL removes the first offset bytes of the log. Records appended after them are kept in a new log
+// that atomically replaces the old one. It must be called with mu held for writing.
+func (m *Meta) dropWAL(offset int64) error {
+	if m.wal == nil {
+		return nil
+	}
+
+	end, err := m.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to get wal offset: %w", err)
+	}
+
+	if end == offset {
+		if err = m.wal.Truncate(0); err != nil {
+			return fmt.Errorf("failed to truncate wal: %w", err)
+		}
+
+		if _, err = m.wal.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to truncate wal: %w", err)
+		}
+
+		return nil
+	}
+
+	tail := make([]byte, end-offset)
+	if _, err = m.wal.ReadAt(tail, offset); err != nil {
+		return fmt.Errorf("failed to read wal: %w", err)
+	}
+
+	filename := walFilename(m.file)
+	if err = atomicfile.WriteFile(filename, tail); err != nil {
+		return err
+	}
+
+	wal, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	if _, err = wal.Seek(0, io.SeekEnd); err != nil {
+		_ = wal.Close()
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+
+	_ = m.wal.Close()
+	m.wal = wal
+
+	return nil
+}
+
+// RunSnapshots takes a snapshot every interval until ctx is done, keeping the log and the replay on
+// startup short.
+func (m *Meta) RunSnapshots(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Snapshot(); err != nil {
+				m.logger.Error().Err(err).Msg("failed to take snapshot")
+			}
+		}
+	}
+}
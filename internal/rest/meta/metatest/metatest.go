@@ -0,0 +1,267 @@
+// Package metatest checks that meta.Meta implementations behave the same way.
+package metatest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// Run runs the conformance tests against metas created by newMeta, a new empty one for every test.
+func Run(t *testing.T, newMeta func(t *testing.T) meta.Meta) {
+	t.Run("versions", func(t *testing.T) {
+		testVersions(t, newMeta(t))
+	})
+	t.Run("parts", func(t *testing.T) {
+		testParts(t, newMeta(t))
+	})
+	t.Run("update part servers", func(t *testing.T) {
+		testUpdatePartServers(t, newMeta(t))
+	})
+	t.Run("update storage class", func(t *testing.T) {
+		testUpdateStorageClass(t, newMeta(t))
+	})
+	t.Run("walk", func(t *testing.T) {
+		testWalk(t, newMeta(t))
+	})
+	t.Run("prune versions", func(t *testing.T) {
+		testPruneVersions(t, newMeta(t))
+	})
+}
+
+// PutFile creates a version of the file with a part per servers list and sets its status.
+func PutFile(t *testing.T, m meta.Meta, f meta.File, status meta.Status, servers ...[]string) *meta.FileVersion {
+	t.Helper()
+
+	ctx := context.Background()
+
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+
+	for i, ids := range servers {
+		require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: i, Servers: ids}))
+	}
+
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: status}))
+
+	return fv
+}
+
+func testVersions(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+	f := &meta.File{Bucket: "bucket", Key: "key"}
+
+	_, err := m.GetVersion(ctx, f)
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	first, err := m.NewVersion(ctx, f, &meta.FileVersion{ContentType: "text/plain", StorageClass: "COLD"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, first.Version)
+	assert.Equal(t, meta.Status(meta.StatusLoading), first.Status)
+	assert.NotNil(t, first.CreatedAt)
+
+	second, err := m.NewVersion(ctx, f, &meta.FileVersion{ContentType: "image/png"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, second.Version)
+
+	_, err = m.GetVersion(ctx, f)
+	require.ErrorIs(t, err, common.ErrNotFound, "versions being uploaded are not visible")
+
+	require.NoError(t, m.UpdateStatus(ctx, f, &meta.FileVersion{Version: 0, Status: meta.StatusReady}))
+	require.NoError(t, m.UpdateStatus(ctx, f, &meta.FileVersion{Version: 1, Status: meta.StatusError}))
+
+	got, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, 0, got.Version, "the latest ready version")
+	assert.Equal(t, "text/plain", got.ContentType)
+	assert.Equal(t, "COLD", got.StorageClass)
+
+	err = m.UpdateStatus(ctx, f, &meta.FileVersion{Version: 0, Status: meta.StatusError})
+	require.ErrorIs(t, err, common.ErrBadRequest, "final status can't be changed")
+
+	err = m.UpdateStatus(ctx, f, &meta.FileVersion{Version: 2, Status: meta.StatusReady})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	err = m.UpdateStatus(ctx, &meta.File{Bucket: "bucket", Key: "other"}, &meta.FileVersion{Status: meta.StatusReady})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	third := PutFile(t, m, *f, meta.StatusReady)
+	assert.Equal(t, 2, third.Version)
+
+	got, err = m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, 2, got.Version)
+}
+
+func testParts(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+	f := &meta.File{Bucket: "bucket", Key: "key"}
+
+	fv, err := m.NewVersion(ctx, f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+
+	err = m.NewPart(ctx, f, fv, &meta.Part{Index: 1, Servers: []string{"a"}})
+	require.ErrorIs(t, err, common.ErrBadRequest, "parts are added in order")
+
+	require.NoError(t, m.NewPart(ctx, f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.NewPart(ctx, f, fv, &meta.Part{Index: 1, Servers: []string{"b", "c"}, Size: 3, Checksum: "abc"}))
+
+	err = m.NewPart(ctx, f, &meta.FileVersion{Version: 1}, &meta.Part{Index: 0, Servers: []string{"a"}})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	err = m.NewPart(ctx, &meta.File{Bucket: "bucket", Key: "other"}, fv, &meta.Part{Index: 0})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	require.NoError(t, m.UpdateStatus(ctx, f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	got, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, []meta.Part{
+		{Index: 0, Servers: []string{"a"}},
+		{Index: 1, Servers: []string{"b", "c"}, Size: 3, Checksum: "abc"},
+	}, got.Parts)
+}
+
+func testUpdatePartServers(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+	f := &meta.File{Bucket: "bucket", Key: "key"}
+
+	fv := PutFile(t, m, *f, meta.StatusReady, []string{"a"}, []string{"b", "c"})
+
+	before, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+
+	require.NoError(t, m.UpdatePartServers(ctx, f, fv.Version, 1, []string{"b", "c"}, []string{"d", "c"}))
+
+	err = m.UpdatePartServers(ctx, f, fv.Version, 1, []string{"b", "c"}, []string{"e"})
+	require.ErrorIs(t, err, common.ErrConflict)
+
+	err = m.UpdatePartServers(ctx, f, fv.Version, 2, nil, []string{"e"})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	err = m.UpdatePartServers(ctx, f, fv.Version+1, 0, []string{"a"}, []string{"e"})
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	err = m.UpdatePartServers(ctx, f, fv.Version, 0, []string{"a"}, nil)
+	require.ErrorIs(t, err, common.ErrBadRequest)
+
+	got, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, got.Parts[0].Servers)
+	assert.Equal(t, []string{"d", "c"}, got.Parts[1].Servers)
+	assert.Equal(t, []string{"b", "c"}, before.Parts[1].Servers, "returned versions are not changed")
+}
+
+func testUpdateStorageClass(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+	f := &meta.File{Bucket: "bucket", Key: "key"}
+
+	fv := PutFile(t, m, *f, meta.StatusReady, []string{"a"}, []string{"b"})
+	prev := []meta.Part{{Index: 0, Servers: []string{"a"}}, {Index: 1, Servers: []string{"b"}}}
+	moved := []meta.Part{{Index: 0, Servers: []string{"c"}}, {Index: 1, Servers: []string{"d"}, Size: 3, Checksum: "abc"}}
+
+	err := m.UpdateStorageClass(ctx, f, fv.Version, prev, "COLD", moved[:1])
+	require.ErrorIs(t, err, common.ErrBadRequest)
+
+	err = m.UpdateStorageClass(ctx, f, fv.Version, moved, "COLD", moved)
+	require.ErrorIs(t, err, common.ErrConflict)
+
+	require.NoError(t, m.UpdateStorageClass(ctx, f, fv.Version, prev, "COLD", moved))
+
+	got, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, "COLD", got.StorageClass)
+	assert.Equal(t, moved, got.Parts)
+}
+
+func testWalk(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+
+	want := make(map[string]meta.Status)
+	for i := range 3 {
+		f := meta.File{Bucket: "bucket", Key: fmt.Sprintf("key-%d", i)}
+		PutFile(t, m, f, meta.StatusReady, []string{"a"})
+		want[fmt.Sprintf("%s/0", f)] = meta.StatusReady
+
+		PutFile(t, m, f, meta.StatusError)
+		want[fmt.Sprintf("%s/1", f)] = meta.StatusError
+	}
+
+	got := make(map[string]meta.Status)
+	require.NoError(t, m.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		got[fmt.Sprintf("%s/%d", f, fv.Version)] = fv.Status
+
+		// fn may change meta
+		return m.UpdateStatus(ctx, &f, &fv)
+	}))
+	assert.Equal(t, want, got)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := m.Walk(ctx, func(meta.File, meta.FileVersion) error {
+		calls++
+		return errStop
+	})
+	require.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, calls)
+}
+
+func testPruneVersions(t *testing.T, m meta.Meta) {
+	ctx := context.Background()
+	f := &meta.File{Bucket: "bucket", Key: "key"}
+
+	_, err := m.PruneVersions(ctx, f, 1)
+	require.ErrorIs(t, err, common.ErrNotFound)
+
+	PutFile(t, m, *f, meta.StatusReady, []string{"a"})
+	PutFile(t, m, *f, meta.StatusError, []string{"b"})
+	current := PutFile(t, m, *f, meta.StatusReady, []string{"c"})
+	loading, err := m.NewVersion(ctx, f, &meta.FileVersion{})
+	require.NoError(t, err)
+	PutFile(t, m, *f, meta.StatusError)
+
+	_, err = m.PruneVersions(ctx, f, 0)
+	require.ErrorIs(t, err, common.ErrBadRequest)
+
+	pruned, err := m.PruneVersions(ctx, f, 2)
+	require.NoError(t, err)
+	require.Len(t, pruned, 2, "the current version and versions being uploaded are kept")
+	assert.Equal(t, 0, pruned[0].Version)
+	assert.Equal(t, meta.Status(meta.StatusReady), pruned[0].Status)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, pruned[0].Parts)
+	assert.Equal(t, 1, pruned[1].Version)
+
+	pruned, err = m.PruneVersions(ctx, f, 2)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	err = m.NewPart(ctx, f, &meta.FileVersion{Version: 0}, &meta.Part{Index: 1, Servers: []string{"a"}})
+	require.ErrorIs(t, err, common.ErrNotFound, "pruned versions are gone")
+
+	// versions are found by number, not by position
+	require.NoError(t, m.NewPart(ctx, f, loading, &meta.Part{Index: 0, Servers: []string{"d"}}))
+	require.NoError(t, m.UpdatePartServers(ctx, f, current.Version, 0, []string{"c"}, []string{"e"}))
+
+	next, err := m.NewVersion(ctx, f, &meta.FileVersion{})
+	require.NoError(t, err)
+	assert.Equal(t, 5, next.Version, "numbers of pruned versions are not reused")
+
+	got, err := m.GetVersion(ctx, f)
+	require.NoError(t, err)
+	assert.Equal(t, current.Version, got.Version)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"e"}}}, got.Parts)
+
+	var versions []int
+	require.NoError(t, m.Walk(ctx, func(_ meta.File, fv meta.FileVersion) error {
+		versions = append(versions, fv.Version)
+		return nil
+	}))
+	assert.Equal(t, []int{2, 3, 4, 5}, versions)
+}
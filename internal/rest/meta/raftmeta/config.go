@@ -0,0 +1,31 @@
+package raftmeta
+
+import "time"
+
+const (
+	defaultApplyTimeout = 10 * time.Second
+
+	snapshotsRetained = 2
+	transportPool     = 3
+	transportTimeout  = 10 * time.Second
+)
+
+type Config struct {
+	// ID identifies the node in the cluster and must not change between restarts.
+	ID string
+	// Address is the replication address the node listens on and other nodes reach it at.
+	Address string
+	// Directory keeps the raft log and snapshots.
+	Directory string
+	// Bootstrap starts a new cluster with the node as its only member, unless it already has state.
+	Bootstrap bool
+	// Shards is the number of shards of the inmemory state.
+	Shards int
+	// ApplyTimeout limits the time a change or a read waits for the cluster.
+	ApplyTimeout time.Duration
+	// SnapshotInterval and SnapshotThreshold control how often the log is compacted (0 - raft defaults).
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+	// FeedSize is the number of retained change events, 0 disables watching them.
+	FeedSize int
+}
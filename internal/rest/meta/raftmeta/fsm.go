@@ -0,0 +1,191 @@
+package raftmeta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/feed"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+)
+
+type op string
+
+const (
+	opNewVersion         op = "new_version"
+	opNewPart            op = "new_part"
+	opUpdateStatus       op = "update_status"
+	opUpdatePartServers  op = "update_part_servers"
+	opUpdateStorageClass op = "update_storage_class"
+	opPruneVersions      op = "prune_versions"
+)
+
+// command is a change of meta replicated through the log. Everything a change depends on, such as
+// the creation time of a version, is in the command, so every node applies it the same way.
+type command struct {
+	Op      op               `json:"op"`
+	File    meta.File        `json:"file"`
+	Version meta.FileVersion `json:"version"`
+
+	NewPart *meta.Part `json:"new_part,omitempty"`
+
+	Part    int      `json:"part,omitempty"`
+	Prev    []string `json:"prev,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+
+	PrevParts []meta.Part `json:"prev_parts,omitempty"`
+	Parts     []meta.Part `json:"parts,omitempty"`
+
+	Keep int `json:"keep,omitempty"`
+}
+
+// applyResult is the response of a command, validation errors included, so they are returned by the
+// node the command was applied through.
+type applyResult struct {
+	fv       *meta.FileVersion
+	versions []meta.FileVersion
+	err      error
+}
+
+// fsm applies commands to an inmemory meta. The log and snapshots of raft persist it. Every node publishes
+// the changes it applies, the sequence number of the last event is a part of the replicated state, so
+// events are numbered the same way on all nodes.
+type fsm struct {
+	state   *inmemory.Meta
+	changes *feed.Feed
+	logger  zerolog.Logger
+}
+
+func newFSM(shards, feedSize int, logger zerolog.Logger) (*fsm, error) {
+	state := inmemory.NewVolatile(inmemory.Config{Shards: shards}, logger)
+
+	changes, err := feed.New(state, feed.Config{Size: feedSize}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fsm{
+		state:   state,
+		changes: changes,
+		logger:  logger,
+	}, nil
+}
+
+func (f *fsm) Apply(l *raft.Log) any {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		f.logger.Error().Err(err).Uint64("index", l.Index).Msg("invalid command")
+		return applyResult{err: fmt.Errorf("invalid command: %w", err)}
+	}
+
+	// the leader sets the append time of the entry, so every node publishes the same events
+	appendedAt := l.AppendedAt
+	if appendedAt.IsZero() {
+		appendedAt = time.Now()
+	}
+	ctx := feed.WithTime(context.Background(), appendedAt)
+
+	switch cmd.Op {
+	case opNewVersion:
+		fv, err := f.changes.NewVersion(ctx, &cmd.File, &cmd.Version)
+		return applyResult{fv: fv, err: err}
+	case opNewPart:
+		return applyResult{err: f.changes.NewPart(ctx, &cmd.File, &cmd.Version, cmd.NewPart)}
+	case opUpdateStatus:
+		return applyResult{err: f.changes.UpdateStatus(ctx, &cmd.File, &cmd.Version)}
+	case opUpdatePartServers:
+		return applyResult{
+			err: f.changes.UpdatePartServers(ctx, &cmd.File, cmd.Version.Version, cmd.Part, cmd.Prev, cmd.Servers),
+		}
+	case opUpdateStorageClass:
+		return applyResult{
+			err: f.changes.UpdateStorageClass(
+				ctx,
+				&cmd.File,
+				cmd.Version.Version,
+				cmd.PrevParts,
+				cmd.Version.StorageClass,
+				cmd.Parts,
+			),
+		}
+	case opPruneVersions:
+		versions, err := f.changes.PruneVersions(ctx, &cmd.File, cmd.Keep)
+		return applyResult{versions: versions, err: err}
+	default:
+		return applyResult{err: fmt.Errorf("unknown command %q", cmd.Op)}
+	}
+}
+
+// snapshotState is the state of the fsm in a snapshot. Older snapshots hold only the state of the
+// inmemory meta, their events are numbered from zero.
+type snapshotState struct {
+	EventSeq uint64          `json:"event_seq"`
+	State    json.RawMessage `json:"state"`
+}
+
+// Snapshot copies the state. It is called between applies, so the copy matches the last applied index.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	var buf bytes.Buffer
+	if err := f.state.WriteState(&buf); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(snapshotState{EventSeq: f.changes.Last(), State: buf.Bytes()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	return &stateSnapshot{data: data}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snapshot snapshotState
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	state := []byte(snapshot.State)
+	if state == nil {
+		state = data
+	}
+
+	if err = f.state.ReplaceState(bytes.NewReader(state)); err != nil {
+		return err
+	}
+
+	f.changes.Reset(snapshot.EventSeq)
+
+	return nil
+}
+
+// stateSnapshot is the marshaled snapshotState.
+type stateSnapshot struct {
+	data []byte
+}
+
+func (s *stateSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s.data); err != nil {
+		_ = sink.Cancel()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return sink.Close()
+}
+
+func (s *stateSnapshot) Release() {}
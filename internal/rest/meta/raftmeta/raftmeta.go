@@ -0,0 +1,503 @@
+package raftmeta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// Meta replicates an inmemory meta over a raft cluster. Changes are applied through the leader. Reads
+// are served by the leader after a barrier, so they see every change finished before them. Other nodes
+// return meta.ErrNotLeader, except for Watch.
+type Meta struct {
+	raft    *raft.Raft
+	fsm     *fsm
+	cfg     Config
+	closers []io.Closer
+	logger  zerolog.Logger
+
+	barrierMu      sync.Mutex
+	barrierRunning bool
+	nextBarrier    *barrier
+}
+
+type barrier struct {
+	done chan struct{}
+	err  error
+}
+
+func New(cfg Config, logger zerolog.Logger) (res *Meta, err error) {
+	if cfg.ID == "" {
+		return nil, errors.New("no node id provided")
+	}
+
+	if err = os.MkdirAll(cfg.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for _, c := range closers {
+				_ = c.Close()
+			}
+		}
+	}()
+
+	transport, err := raft.NewTCPTransport(cfg.Address, nil, transportPool, transportTimeout, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+	closers = append(closers, transport)
+
+	store, err := raftboltdb.New(raftboltdb.Options{Path: filepath.Join(cfg.Directory, "raft.db")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log: %w", err)
+	}
+	closers = append(closers, store)
+
+	snapshots, err := raft.NewFileSnapshotStore(cfg.Directory, snapshotsRetained, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshots: %w", err)
+	}
+
+	res, err = open(cfg, raftConfig(cfg, logger), transport, store, store, snapshots, logger)
+	if err != nil {
+		return nil, err
+	}
+	res.closers = closers
+
+	return res, nil
+}
+
+func raftConfig(cfg Config, logger zerolog.Logger) *raft.Config {
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.ID)
+	rc.LogOutput = logger
+	rc.LogLevel = "WARN"
+
+	if cfg.SnapshotInterval > 0 {
+		rc.SnapshotInterval = cfg.SnapshotInterval
+	}
+
+	if cfg.SnapshotThreshold > 0 {
+		rc.SnapshotThreshold = cfg.SnapshotThreshold
+	}
+
+	return rc
+}
+
+func open(
+	cfg Config,
+	rc *raft.Config,
+	transport raft.Transport,
+	logs raft.LogStore,
+	stable raft.StableStore,
+	snapshots raft.SnapshotStore,
+	logger zerolog.Logger,
+) (*Meta, error) {
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = defaultApplyTimeout
+	}
+
+	f, err := newFSM(cfg.Shards, cfg.FeedSize, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(rc, f, logs, stable, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft: %w", err)
+	}
+
+	if cfg.Bootstrap {
+		hasState, stateErr := raft.HasExistingState(logs, stable, snapshots)
+		if stateErr != nil {
+			_ = r.Shutdown().Error()
+			return nil, fmt.Errorf("failed to check raft state: %w", stateErr)
+		}
+
+		if !hasState {
+			err = r.BootstrapCluster(raft.Configuration{
+				Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}},
+			}).Error()
+			if err != nil {
+				_ = r.Shutdown().Error()
+				return nil, fmt.Errorf("failed to bootstrap cluster: %w", err)
+			}
+
+			logger.Info().Str("id", cfg.ID).Msg("cluster bootstrapped")
+		}
+	}
+
+	return &Meta{
+		raft:   r,
+		fsm:    f,
+		cfg:    cfg,
+		logger: logger,
+	}, nil
+}
+
+func (m *Meta) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
+	if file == nil || info == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	createdAt := time.Now().UTC()
+
+	return m.apply(ctx, command{
+		Op:   opNewVersion,
+		File: *file,
+		Version: meta.FileVersion{
+			ContentType:  info.ContentType,
+			StorageClass: info.StorageClass,
+			CreatedAt:    &createdAt,
+		},
+	})
+}
+
+func (m *Meta) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	} else if p == nil {
+		return fmt.Errorf("%w: no part provided", common.ErrBadRequest)
+	}
+
+	_, err := m.apply(ctx, command{
+		Op:      opNewPart,
+		File:    *f,
+		Version: meta.FileVersion{Version: fv.Version},
+		NewPart: p,
+	})
+
+	return err
+}
+
+func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVersion) error {
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	}
+
+	_, err := m.apply(ctx, command{
+		Op:      opUpdateStatus,
+		File:    *f,
+		Version: meta.FileVersion{Version: fv.Version, Status: fv.Status},
+	})
+
+	return err
+}
+
+func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	if err := m.barrier(ctx); err != nil {
+		return nil, err
+	}
+
+	return m.fsm.state.GetVersion(ctx, f)
+}
+
+// Walk walks the state of the leader as it is after a barrier. fn may change meta.
+func (m *Meta) Walk(ctx context.Context, fn func(meta.File, meta.FileVersion) error) error {
+	if err := m.barrier(ctx); err != nil {
+		return err
+	}
+
+	return m.fsm.state.Walk(ctx, fn)
+}
+
+// Watch streams the changes applied by this node, followers included. Events are numbered the same way on
+// every node, so a watcher can resume on another one.
+func (m *Meta) Watch(ctx context.Context, from uint64, fn func(meta.Event) error) error {
+	if m.cfg.FeedSize <= 0 {
+		return fmt.Errorf("%w: meta change feed is disabled", errors.ErrUnsupported)
+	}
+
+	return m.fsm.changes.Watch(ctx, from, fn)
+}
+
+func (m *Meta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	_, err := m.apply(ctx, command{
+		Op:      opUpdatePartServers,
+		File:    *f,
+		Version: meta.FileVersion{Version: version},
+		Part:    part,
+		Prev:    prev,
+		Servers: servers,
+	})
+
+	return err
+}
+
+func (m *Meta) UpdateStorageClass(
+	ctx context.Context,
+	f *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	_, err := m.apply(ctx, command{
+		Op:        opUpdateStorageClass,
+		File:      *f,
+		Version:   meta.FileVersion{Version: version, StorageClass: class},
+		PrevParts: prev,
+		Parts:     parts,
+	})
+
+	return err
+}
+
+func (m *Meta) PruneVersions(ctx context.Context, f *meta.File, keep int) ([]meta.FileVersion, error) {
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	res, err := m.applyCommand(ctx, command{
+		Op:   opPruneVersions,
+		File: *f,
+		Keep: keep,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.versions, res.err
+}
+
+func (m *Meta) Join(ctx context.Context, id, address string) error {
+	if id == "" || address == "" {
+		return fmt.Errorf("%w: no node id or address provided", common.ErrBadRequest)
+	}
+
+	servers, err := m.servers()
+	if err != nil {
+		return err
+	}
+
+	for _, srv := range servers {
+		if srv.ID == raft.ServerID(id) && srv.Address == raft.ServerAddress(address) {
+			return nil
+		}
+	}
+
+	err = m.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(address), 0, m.timeout(ctx)).Error()
+	if err != nil {
+		return m.raftError(err)
+	}
+
+	m.logger.Info().Str("id", id).Str("address", address).Msg("node joined")
+
+	return nil
+}
+
+func (m *Meta) Leave(ctx context.Context, id string) error {
+	servers, err := m.servers()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, srv := range servers {
+		found = found || srv.ID == raft.ServerID(id)
+	}
+
+	if !found {
+		return fmt.Errorf("%w: node %s is not a member", common.ErrNotFound, id)
+	}
+
+	if err = m.raft.RemoveServer(raft.ServerID(id), 0, m.timeout(ctx)).Error(); err != nil {
+		return m.raftError(err)
+	}
+
+	m.logger.Info().Str("id", id).Msg("node left")
+
+	return nil
+}
+
+// Members returns the configuration known to the node, which may lag behind the leader's.
+func (m *Meta) Members(_ context.Context) ([]meta.Member, error) {
+	servers, err := m.servers()
+	if err != nil {
+		return nil, err
+	}
+
+	_, leader := m.raft.LeaderWithID()
+
+	res := make([]meta.Member, 0, len(servers))
+	for _, srv := range servers {
+		res = append(res, meta.Member{
+			ID:      string(srv.ID),
+			Address: string(srv.Address),
+			Voter:   srv.Suffrage == raft.Voter,
+			Leader:  srv.ID == leader,
+		})
+	}
+
+	return res, nil
+}
+
+// Close stops the node. The state is restored from the log and snapshots on the next start.
+func (m *Meta) Close() error {
+	var res error
+	if err := m.raft.Shutdown().Error(); err != nil {
+		res = multierror.Append(res, fmt.Errorf("failed to shutdown raft: %w", err))
+	}
+
+	for _, c := range m.closers {
+		if err := c.Close(); err != nil {
+			res = multierror.Append(res, err)
+		}
+	}
+
+	return res
+}
+
+func (m *Meta) apply(ctx context.Context, cmd command) (*meta.FileVersion, error) {
+	res, err := m.applyCommand(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.fv, res.err
+}
+
+func (m *Meta) applyCommand(ctx context.Context, cmd command) (applyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return applyResult{}, err
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return applyResult{}, fmt.Errorf("failed to marshal command: %w", err)
+	}
+
+	future := m.raft.Apply(data, m.timeout(ctx))
+	if err = future.Error(); err != nil {
+		return applyResult{}, m.raftError(err)
+	}
+
+	res, ok := future.Response().(applyResult)
+	if !ok {
+		return applyResult{}, fmt.Errorf("unexpected apply response %T", future.Response())
+	}
+
+	return res, nil
+}
+
+// barrier waits until the node, being the leader, has applied every change committed before the call.
+// Callers that arrive while a barrier is in flight share the next one.
+func (m *Meta) barrier(ctx context.Context) error {
+	if m.raft.State() != raft.Leader {
+		return m.raftError(raft.ErrNotLeader)
+	}
+
+	m.barrierMu.Lock()
+	if m.nextBarrier == nil {
+		m.nextBarrier = &barrier{done: make(chan struct{})}
+	}
+	b := m.nextBarrier
+
+	if !m.barrierRunning {
+		m.barrierRunning = true
+		go m.runBarriers()
+	}
+	m.barrierMu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.done:
+		return b.err
+	}
+}
+
+func (m *Meta) runBarriers() {
+	for {
+		m.barrierMu.Lock()
+		b := m.nextBarrier
+		m.nextBarrier = nil
+		if b == nil {
+			m.barrierRunning = false
+			m.barrierMu.Unlock()
+			return
+		}
+		m.barrierMu.Unlock()
+
+		if err := m.raft.Barrier(m.cfg.ApplyTimeout).Error(); err != nil {
+			b.err = m.raftError(err)
+		}
+		close(b.done)
+	}
+}
+
+func (m *Meta) servers() ([]raft.Server, error) {
+	future := m.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("failed to get configuration: %w", err)
+	}
+
+	return future.Configuration().Servers, nil
+}
+
+func (m *Meta) timeout(ctx context.Context) time.Duration {
+	timeout := m.cfg.ApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+
+	return timeout
+}
+
+// raftError returns meta.ErrNotLeader with the known leader for errors of nodes that can't serve requests.
+// A lost leadership is meta.ErrIndeterminate, the entry may still be committed by the new leader.
+func (m *Meta) raftError(err error) error {
+	if errors.Is(err, raft.ErrLeadershipLost) {
+		return fmt.Errorf("%w: %w", meta.ErrIndeterminate, err)
+	}
+
+	if !errors.Is(err, raft.ErrNotLeader) &&
+		!errors.Is(err, raft.ErrLeadershipTransferInProgress) &&
+		!errors.Is(err, raft.ErrNotVoter) {
+		return err
+	}
+
+	address, id := m.raft.LeaderWithID()
+	if address == "" {
+		return fmt.Errorf("%w: no leader", meta.ErrNotLeader)
+	}
+
+	return fmt.Errorf("%w: leader is %s at %s", meta.ErrNotLeader, id, address)
+}
@@ -0,0 +1,287 @@
+package raftmeta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
+)
+
+type testNode struct {
+	*Meta
+	id        string
+	transport *raft.InmemTransport
+}
+
+// startNodes starts in-process nodes connected by an in-memory transport. The first one bootstraps the
+// cluster, the others join it.
+func startNodes(t *testing.T, n int) []*testNode {
+	t.Helper()
+
+	nodes := make([]*testNode, 0, n)
+	for i := range n {
+		node := startNode(t, fmt.Sprintf("node-%d", i), i == 0, nodes)
+		if i > 0 {
+			require.NoError(t, waitLeader(t, nodes...).Join(context.Background(), node.id, string(node.transport.LocalAddr())))
+		}
+
+		nodes = append(nodes, node)
+		waitLeader(t, nodes...)
+	}
+
+	return nodes
+}
+
+func startNode(t *testing.T, id string, bootstrap bool, peers []*testNode) *testNode {
+	t.Helper()
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(id))
+	for _, p := range peers {
+		transport.Connect(p.transport.LocalAddr(), p.transport)
+		p.transport.Connect(transport.LocalAddr(), transport)
+	}
+
+	cfg := Config{ID: id, Bootstrap: bootstrap, ApplyTimeout: 5 * time.Second, FeedSize: 100}
+
+	rc := raftConfig(cfg, zerolog.Nop())
+	rc.HeartbeatTimeout = 50 * time.Millisecond
+	rc.ElectionTimeout = 50 * time.Millisecond
+	rc.LeaderLeaseTimeout = 50 * time.Millisecond
+	rc.CommitTimeout = 5 * time.Millisecond
+	// a joining node gets the state by a snapshot rather than the log
+	rc.TrailingLogs = 1
+
+	store := raft.NewInmemStore()
+	m, err := open(cfg, rc, transport, store, store, raft.NewInmemSnapshotStore(), zerolog.Nop())
+	require.NoError(t, err)
+
+	node := &testNode{Meta: m, id: id, transport: transport}
+	t.Cleanup(func() {
+		_ = node.Close()
+	})
+
+	return node
+}
+
+func waitLeader(t *testing.T, nodes ...*testNode) *testNode {
+	t.Helper()
+
+	var leader *testNode
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.raft.State() == raft.Leader {
+				leader = n
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return leader
+}
+
+func followers(nodes []*testNode, leader *testNode) []*testNode {
+	var res []*testNode
+	for _, n := range nodes {
+		if n != leader {
+			res = append(res, n)
+		}
+	}
+
+	return res
+}
+
+func TestMeta_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		return startNodes(t, 1)[0]
+	})
+}
+
+func TestMeta_Replication(t *testing.T) {
+	ctx := context.Background()
+	nodes := startNodes(t, 3)
+	leader := waitLeader(t, nodes...)
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	want := metatest.PutFile(t, leader, f, meta.StatusReady, []string{"a"})
+
+	for _, n := range followers(nodes, leader) {
+		_, err := n.GetVersion(ctx, &f)
+		require.ErrorIs(t, err, meta.ErrNotLeader, "followers don't serve reads")
+		assert.Contains(t, err.Error(), leader.id)
+
+		_, err = n.NewVersion(ctx, &f, &meta.FileVersion{})
+		require.ErrorIs(t, err, meta.ErrNotLeader)
+
+		require.Eventually(t, func() bool {
+			got, err := n.fsm.state.GetVersion(ctx, &f)
+			return err == nil && got.Version == want.Version && got.CreatedAt.Equal(*want.CreatedAt)
+		}, 5*time.Second, 10*time.Millisecond, "changes are replicated")
+	}
+
+	err := leader.UpdatePartServers(ctx, &f, want.Version, 0, []string{"b"}, []string{"c"})
+	require.ErrorIs(t, err, common.ErrConflict, "validation errors are returned by the leader")
+}
+
+func TestMeta_Failover(t *testing.T) {
+	ctx := context.Background()
+	nodes := startNodes(t, 3)
+	leader := waitLeader(t, nodes...)
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	want := metatest.PutFile(t, leader, f, meta.StatusReady, []string{"a"})
+	require.NoError(t, leader.Close())
+
+	next := waitLeader(t, followers(nodes, leader)...)
+
+	got, err := next.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, want.Version, got.Version)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, got.Parts)
+
+	fv := metatest.PutFile(t, next, f, meta.StatusReady)
+	assert.Equal(t, 1, fv.Version, "the new leader continues the versions")
+}
+
+// watch returns the events after from that the node has published by now.
+func watch(t *testing.T, n *testNode, from uint64) []meta.Event {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var res []meta.Event
+	err := n.Watch(ctx, from, func(e meta.Event) error {
+		res = append(res, e)
+		return nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	return res
+}
+
+func TestMeta_Watch(t *testing.T) {
+	nodes := startNodes(t, 3)
+	leader := waitLeader(t, nodes...)
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	metatest.PutFile(t, leader, f, meta.StatusReady, []string{"a"})
+
+	events := watch(t, leader, 0)
+	require.Len(t, events, 3)
+	assert.Equal(t, meta.EventVersionCreated, events[0].Type)
+	assert.Equal(t, meta.EventStatusChanged, events[2].Type)
+
+	for _, n := range followers(nodes, leader) {
+		require.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(events, watch(t, n, 0))
+		}, 5*time.Second, 10*time.Millisecond, "followers publish the same events")
+	}
+
+	require.NoError(t, leader.Close())
+	next := waitLeader(t, followers(nodes, leader)...)
+
+	metatest.PutFile(t, next, f, meta.StatusReady)
+
+	resumed := watch(t, next, events[2].Seq)
+	require.Len(t, resumed, 2, "the watch resumes on the new leader")
+	assert.Equal(t, events[2].Seq+1, resumed[0].Seq)
+	assert.Equal(t, 1, resumed[0].Version)
+}
+
+func TestMeta_Membership(t *testing.T) {
+	ctx := context.Background()
+	nodes := startNodes(t, 2)
+	leader := waitLeader(t, nodes...)
+
+	for i := range 5 {
+		metatest.PutFile(t, leader, meta.File{Bucket: "bucket", Key: fmt.Sprintf("key-%d", i)}, meta.StatusReady)
+	}
+	require.NoError(t, leader.raft.Snapshot().Error())
+
+	// the log is compacted, so the new node restores the snapshot
+	joined := startNode(t, "node-2", false, nodes)
+	require.NoError(t, leader.Join(ctx, joined.id, string(joined.transport.LocalAddr())))
+	require.NoError(t, leader.Join(ctx, joined.id, string(joined.transport.LocalAddr())), "join is idempotent")
+
+	require.Eventually(t, func() bool {
+		_, err := joined.fsm.state.GetVersion(ctx, &meta.File{Bucket: "bucket", Key: "key-4"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	members, err := leader.Members(ctx)
+	require.NoError(t, err)
+	require.Len(t, members, 3)
+	for _, m := range members {
+		assert.True(t, m.Voter)
+		assert.Equal(t, m.ID == leader.id, m.Leader)
+	}
+
+	follower := followers(nodes, leader)[0]
+	require.NoError(t, leader.Leave(ctx, follower.id))
+	require.ErrorIs(t, leader.Leave(ctx, follower.id), common.ErrNotFound)
+
+	members, err = leader.Members(ctx)
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+
+	err = joined.Join(ctx, "node-3", "node-3")
+	require.ErrorIs(t, err, meta.ErrNotLeader)
+}
+
+type testSink struct {
+	bytes.Buffer
+}
+
+func (s *testSink) ID() string    { return "test" }
+func (s *testSink) Cancel() error { return nil }
+func (s *testSink) Close() error  { return nil }
+
+func TestFSM_SnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+
+	source, err := newFSM(4, 0, zerolog.Nop())
+	require.NoError(t, err)
+	metatest.PutFile(t, source.changes, meta.File{Bucket: "bucket", Key: "a"}, meta.StatusReady, []string{"x"})
+	metatest.PutFile(t, source.changes, meta.File{Bucket: "bucket", Key: "b"}, meta.StatusError)
+	last := source.changes.Last()
+
+	snapshot, err := source.Snapshot()
+	require.NoError(t, err)
+
+	// changes after the snapshot aren't in it
+	metatest.PutFile(t, source.changes, meta.File{Bucket: "bucket", Key: "c"}, meta.StatusReady)
+
+	var sink testSink
+	require.NoError(t, snapshot.Persist(&sink))
+
+	restored, err := newFSM(8, 0, zerolog.Nop())
+	require.NoError(t, err)
+	metatest.PutFile(t, restored.changes, meta.File{Bucket: "bucket", Key: "old"}, meta.StatusReady)
+	require.NoError(t, restored.Restore(io.NopCloser(&sink)))
+	assert.Equal(t, last, restored.changes.Last(), "events continue the numbering of the snapshot")
+
+	var got []string
+	require.NoError(t, restored.state.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		got = append(got, fmt.Sprintf("%s/%d/%s", f, fv.Version, fv.Status))
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"bucket/a/0/ready", "bucket/b/0/error"}, got)
+
+	var old bytes.Buffer
+	require.NoError(t, source.state.WriteState(&old))
+	require.NoError(t, restored.Restore(io.NopCloser(&old)), "snapshots of the state alone are restored")
+	assert.Zero(t, restored.changes.Last())
+}
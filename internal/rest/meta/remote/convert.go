@@ -0,0 +1,208 @@
+package remote
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+var errorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{err: meta.ErrFeedTruncated, code: codes.OutOfRange},
+	{err: common.ErrNotFound, code: codes.NotFound},
+	{err: common.ErrBadRequest, code: codes.InvalidArgument},
+	{err: common.ErrConflict, code: codes.Aborted},
+	{err: meta.ErrNotLeader, code: codes.FailedPrecondition},
+	{err: meta.ErrIndeterminate, code: codes.Unknown},
+	{err: errors.ErrUnsupported, code: codes.Unimplemented},
+	{err: context.Canceled, code: codes.Canceled},
+	{err: context.DeadlineExceeded, code: codes.DeadlineExceeded},
+}
+
+// toStatus converts a meta error to a gRPC status, so the client can turn it back into the same error.
+func toStatus(err error) error {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return status.Error(c.code, err.Error())
+		}
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// remoteError keeps the message of an error returned by the meta server and the meta error it wraps.
+type remoteError struct {
+	err error
+	msg string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
+
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	for _, c := range errorCodes {
+		if st.Code() == c.code {
+			return &remoteError{err: c.err, msg: st.Message()}
+		}
+	}
+
+	return err
+}
+
+func fileToProto(f *meta.File) *proto.MetaFile {
+	if f == nil {
+		return nil
+	}
+
+	return &proto.MetaFile{Bucket: f.Bucket, Key: f.Key}
+}
+
+func fileFromProto(f *proto.MetaFile) *meta.File {
+	if f == nil {
+		return nil
+	}
+
+	return &meta.File{Bucket: f.Bucket, Key: f.Key}
+}
+
+func versionToProto(fv *meta.FileVersion) *proto.MetaFileVersion {
+	res := &proto.MetaFileVersion{
+		Version:      int32(fv.Version),
+		ContentType:  fv.ContentType,
+		StorageClass: fv.StorageClass,
+		Status:       string(fv.Status),
+		Parts:        partsToProto(fv.Parts),
+	}
+
+	if fv.CreatedAt != nil {
+		res.CreatedAt = timestamppb.New(*fv.CreatedAt)
+	}
+
+	return res
+}
+
+func versionFromProto(fv *proto.MetaFileVersion) *meta.FileVersion {
+	res := &meta.FileVersion{
+		Version:      int(fv.Version),
+		ContentType:  fv.ContentType,
+		StorageClass: fv.StorageClass,
+		Status:       meta.Status(fv.Status),
+		Parts:        partsFromProto(fv.Parts),
+	}
+
+	if fv.CreatedAt != nil {
+		createdAt := fv.CreatedAt.AsTime()
+		res.CreatedAt = &createdAt
+	}
+
+	return res
+}
+
+func partToProto(p *meta.Part) *proto.MetaPart {
+	if p == nil {
+		return nil
+	}
+
+	return &proto.MetaPart{Index: int32(p.Index), Servers: p.Servers, Size: p.Size, Checksum: p.Checksum}
+}
+
+func partsToProto(parts []meta.Part) []*proto.MetaPart {
+	if parts == nil {
+		return nil
+	}
+
+	res := make([]*proto.MetaPart, len(parts))
+	for i := range parts {
+		res[i] = partToProto(&parts[i])
+	}
+
+	return res
+}
+
+func partsFromProto(parts []*proto.MetaPart) []meta.Part {
+	if len(parts) == 0 {
+		return nil
+	}
+
+	res := make([]meta.Part, len(parts))
+	for i, p := range parts {
+		res[i] = meta.Part{Index: int(p.Index), Servers: p.Servers, Size: p.Size, Checksum: p.Checksum}
+	}
+
+	return res
+}
+
+func membersToProto(members []meta.Member) []*proto.MetaMember {
+	res := make([]*proto.MetaMember, len(members))
+	for i, m := range members {
+		res[i] = &proto.MetaMember{Id: m.ID, Address: m.Address, Voter: m.Voter, Leader: m.Leader}
+	}
+
+	return res
+}
+
+func membersFromProto(members []*proto.MetaMember) []meta.Member {
+	res := make([]meta.Member, len(members))
+	for i, m := range members {
+		res[i] = meta.Member{ID: m.Id, Address: m.Address, Voter: m.Voter, Leader: m.Leader}
+	}
+
+	return res
+}
+
+func eventToProto(e *meta.Event) *proto.MetaEvent {
+	return &proto.MetaEvent{
+		Seq:          e.Seq,
+		Type:         string(e.Type),
+		Time:         timestamppb.New(e.Time),
+		File:         fileToProto(&e.File),
+		Version:      int32(e.Version),
+		Status:       string(e.Status),
+		StorageClass: e.StorageClass,
+		Parts:        partsToProto(e.Parts),
+	}
+}
+
+func eventFromProto(e *proto.MetaEvent) meta.Event {
+	res := meta.Event{
+		Seq:          e.Seq,
+		Type:         meta.EventType(e.Type),
+		Version:      int(e.Version),
+		Status:       meta.Status(e.Status),
+		StorageClass: e.StorageClass,
+		Parts:        partsFromProto(e.Parts),
+	}
+
+	if e.Time != nil {
+		res.Time = e.Time.AsTime()
+	}
+
+	if e.File != nil {
+		res.File = *fileFromProto(e.File)
+	}
+
+	return res
+}
@@ -0,0 +1,388 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+// Meta is a client of meta servers. Errors of the servers are returned as the same common errors.
+// Requests go to the server that answered last, a server that is unavailable or isn't the leader of a
+// replicated meta is skipped for the next one. Changes are sent only to a connected server and aren't
+// retried once sent: if the connection breaks, the error is meta.ErrIndeterminate.
+type Meta struct {
+	clients []proto.MetaClient
+	current atomic.Int32
+	conns   []*grpc.ClientConn
+	logger  zerolog.Logger
+}
+
+func New(clients []proto.MetaClient, logger zerolog.Logger) *Meta {
+	return &Meta{
+		clients: clients,
+		logger:  logger,
+	}
+}
+
+// Dial creates a client of the meta servers at the addresses. Connections are established on first use.
+func Dial(addresses []string, logger zerolog.Logger) (*Meta, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no meta addresses provided")
+	}
+
+	res := New(make([]proto.MetaClient, 0, len(addresses)), logger)
+	for _, address := range addresses {
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			_ = res.Close()
+			return nil, fmt.Errorf("failed to create meta client for %s: %w", address, err)
+		}
+
+		res.conns = append(res.conns, conn)
+		res.clients = append(res.clients, proto.NewMetaClient(conn))
+	}
+
+	return res, nil
+}
+
+// call calls fn with the current server and fails over to the next ones while they are unavailable
+// or aren't the leader.
+func call[T any](ctx context.Context, m *Meta, fn func(proto.MetaClient) (T, error)) (T, error) {
+	return invoke(ctx, m, false, fn)
+}
+
+// change calls fn like call, but fails over only while nothing could have been applied: the server
+// wasn't reachable or answered that it isn't the leader.
+func change[T any](ctx context.Context, m *Meta, fn func(proto.MetaClient) (T, error)) (T, error) {
+	return invoke(ctx, m, true, fn)
+}
+
+func invoke[T any](ctx context.Context, m *Meta, write bool, fn func(proto.MetaClient) (T, error)) (T, error) {
+	var (
+		res T
+		err error
+	)
+
+	start := int(m.current.Load())
+	for i := range m.clients {
+		idx := (start + i) % len(m.clients)
+
+		if write && !m.connected(ctx, idx) {
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+
+			err = status.Error(codes.Unavailable, "meta server is unreachable")
+			m.logger.Debug().Int("server", idx).Msg("meta server is unreachable")
+			continue
+		}
+
+		res, err = fn(m.clients[idx])
+
+		code := status.Code(err)
+		if code == codes.FailedPrecondition || (code == codes.Unavailable && !write) {
+			if ctx.Err() == nil {
+				m.logger.Debug().Err(err).Int("server", idx).Msg("meta server is unavailable")
+				continue
+			}
+		}
+
+		if code == codes.Unavailable && write {
+			// the next change goes to another server, this one may be down
+			m.current.Store(int32((idx + 1) % len(m.clients)))
+			return res, fmt.Errorf("%w: %w", meta.ErrIndeterminate, err)
+		}
+
+		if i > 0 {
+			m.current.Store(int32(idx))
+		}
+
+		return res, fromStatus(err)
+	}
+
+	return res, fromStatus(err)
+}
+
+// connected waits until the connection to the server is established. Clients created by New have no
+// connections to check.
+func (m *Meta) connected(ctx context.Context, idx int) bool {
+	if len(m.conns) != len(m.clients) {
+		return true
+	}
+
+	conn := m.conns[idx]
+	conn.Connect()
+
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return true
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return false
+		}
+
+		if !conn.WaitForStateChange(ctx, state) {
+			return false
+		}
+	}
+}
+
+func (m *Meta) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
+	if file == nil || info == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	req := &proto.NewVersionRequest{
+		File:         fileToProto(file),
+		ContentType:  info.ContentType,
+		StorageClass: info.StorageClass,
+	}
+
+	res, err := change(ctx, m, func(c proto.MetaClient) (*proto.MetaFileVersion, error) {
+		return c.NewVersion(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versionFromProto(res), nil
+}
+
+func (m *Meta) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	}
+
+	req := &proto.NewPartRequest{
+		File:    fileToProto(f),
+		Version: int32(fv.Version),
+		Part:    partToProto(p),
+	}
+
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.NewPartResponse, error) {
+		return c.NewPart(ctx, req)
+	})
+
+	return err
+}
+
+func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVersion) error {
+	if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	}
+
+	req := &proto.UpdateStatusRequest{
+		File:    fileToProto(f),
+		Version: int32(fv.Version),
+		Status:  string(fv.Status),
+	}
+
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.UpdateStatusResponse, error) {
+		return c.UpdateStatus(ctx, req)
+	})
+
+	return err
+}
+
+func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion, error) {
+	req := &proto.GetVersionRequest{File: fileToProto(f)}
+
+	res, err := call(ctx, m, func(c proto.MetaClient) (*proto.MetaFileVersion, error) {
+		return c.GetVersion(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versionFromProto(res), nil
+}
+
+// Walk calls fn while versions are streamed from the server. If fn fails, the stream is cancelled.
+// The walk fails over to another server only until the first version is received.
+func (m *Meta) Walk(ctx context.Context, fn func(meta.File, meta.FileVersion) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	first, err := call(ctx, m, func(c proto.MetaClient) (*walkStream, error) {
+		stream, err := c.Walk(ctx, &proto.WalkRequest{})
+		if err != nil {
+			return nil, err
+		}
+
+		// errors of the server are returned by the first receive
+		res, err := stream.Recv()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		return &walkStream{stream: stream, first: res, err: err}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for res, recvErr := first.first, first.err; ; res, recvErr = first.stream.Recv() {
+		if errors.Is(recvErr, io.EOF) {
+			return nil
+		} else if recvErr != nil {
+			return fromStatus(recvErr)
+		}
+
+		if res.File == nil || res.Version == nil {
+			return errors.New("invalid walk response")
+		}
+
+		if err = fn(*fileFromProto(res.File), *versionFromProto(res.Version)); err != nil {
+			return err
+		}
+	}
+}
+
+type walkStream struct {
+	stream grpc.ServerStreamingClient[proto.WalkResponse]
+	first  *proto.WalkResponse
+	err    error
+}
+
+func (m *Meta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	req := &proto.UpdatePartServersRequest{
+		File:    fileToProto(f),
+		Version: int32(version),
+		Part:    int32(part),
+		Prev:    prev,
+		Servers: servers,
+	}
+
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.UpdatePartServersResponse, error) {
+		return c.UpdatePartServers(ctx, req)
+	})
+
+	return err
+}
+
+func (m *Meta) UpdateStorageClass(
+	ctx context.Context,
+	f *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	req := &proto.UpdateStorageClassRequest{
+		File:         fileToProto(f),
+		Version:      int32(version),
+		Prev:         partsToProto(prev),
+		StorageClass: class,
+		Parts:        partsToProto(parts),
+	}
+
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.UpdateStorageClassResponse, error) {
+		return c.UpdateStorageClass(ctx, req)
+	})
+
+	return err
+}
+
+func (m *Meta) PruneVersions(ctx context.Context, f *meta.File, keep int) ([]meta.FileVersion, error) {
+	req := &proto.PruneVersionsRequest{File: fileToProto(f), Keep: int32(keep)}
+
+	res, err := change(ctx, m, func(c proto.MetaClient) (*proto.PruneVersionsResponse, error) {
+		return c.PruneVersions(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.Versions) == 0 {
+		return nil, nil
+	}
+
+	versions := make([]meta.FileVersion, len(res.Versions))
+	for i, fv := range res.Versions {
+		versions[i] = *versionFromProto(fv)
+	}
+
+	return versions, nil
+}
+
+func (m *Meta) Join(ctx context.Context, id, address string) error {
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.JoinResponse, error) {
+		return c.Join(ctx, &proto.JoinRequest{Id: id, Address: address})
+	})
+
+	return err
+}
+
+func (m *Meta) Leave(ctx context.Context, id string) error {
+	_, err := change(ctx, m, func(c proto.MetaClient) (*proto.LeaveResponse, error) {
+		return c.Leave(ctx, &proto.LeaveRequest{Id: id})
+	})
+
+	return err
+}
+
+func (m *Meta) Members(ctx context.Context) ([]meta.Member, error) {
+	res, err := call(ctx, m, func(c proto.MetaClient) (*proto.MembersResponse, error) {
+		return c.Members(ctx, &proto.MembersRequest{})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return membersFromProto(res.Members), nil
+}
+
+// Watch calls fn with the changes streamed from the server after the event from. Every node of a replicated
+// meta publishes all changes with the same sequence numbers, so the watch can resume on another node.
+func (m *Meta) Watch(ctx context.Context, from uint64, fn func(meta.Event) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := call(ctx, m, func(c proto.MetaClient) (grpc.ServerStreamingClient[proto.MetaEvent], error) {
+		return c.Watch(ctx, &proto.WatchRequest{From: from})
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			// the server never ends a watch on its own, it is shutting down
+			return fmt.Errorf("%w: stream closed by the server", meta.ErrFeedInterrupted)
+		} else if err != nil {
+			return fromStatus(err)
+		}
+
+		if err = fn(eventFromProto(res)); err != nil {
+			return err
+		}
+	}
+}
+
+// Close closes the connections created by Dial.
+func (m *Meta) Close() error {
+	var res error
+	for _, conn := range m.conns {
+		if err := conn.Close(); err != nil {
+			res = multierror.Append(res, fmt.Errorf("failed to close meta connection: %w", err))
+		}
+	}
+
+	return res
+}
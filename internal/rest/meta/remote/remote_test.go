@@ -0,0 +1,277 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/feed"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+// startServer serves a new inmemory meta and returns its address.
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	storage, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = storage.Close()
+	})
+
+	changes, err := feed.New(storage, feed.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	return serve(t, changes)
+}
+
+// serve serves the meta and returns its address.
+func serve(t *testing.T, m meta.Meta) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer()
+	proto.RegisterMetaServer(srv, NewServer(m, zerolog.Nop()))
+
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(srv.Stop)
+
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, address string) *Meta {
+	t.Helper()
+
+	m, err := Dial([]string{address}, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = m.Close()
+	})
+
+	return m
+}
+
+func TestMeta_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		return dial(t, startServer(t))
+	})
+}
+
+func TestMeta_SharedState(t *testing.T) {
+	ctx := context.Background()
+	address := startServer(t)
+	first, second := dial(t, address), dial(t, address)
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	fv := metatest.PutFile(t, first, f, meta.StatusReady, []string{"a"})
+
+	got, err := second.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, fv.Version, got.Version)
+	assert.Equal(t, fv.CreatedAt.UnixNano(), got.CreatedAt.UnixNano())
+
+	require.NoError(t, second.UpdatePartServers(ctx, &f, fv.Version, 0, []string{"a"}, []string{"b"}))
+
+	err = first.UpdatePartServers(ctx, &f, fv.Version, 0, []string{"a"}, []string{"c"})
+	require.ErrorIs(t, err, common.ErrConflict, "changes of other replicas are seen")
+	assert.Contains(t, err.Error(), "part servers have changed")
+}
+
+func TestMeta_Failover(t *testing.T) {
+	ctx := context.Background()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unavailable := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	m, err := Dial([]string{unavailable, startServer(t)}, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = m.Close()
+	})
+
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	fv := metatest.PutFile(t, m, f, meta.StatusReady, []string{"a"})
+	assert.Equal(t, int32(1), m.current.Load(), "the available server is used next")
+
+	m.current.Store(0)
+	var walked []meta.File
+	require.NoError(t, m.Walk(ctx, func(f meta.File, got meta.FileVersion) error {
+		walked = append(walked, f)
+		assert.Equal(t, fv.Version, got.Version)
+		return nil
+	}))
+	assert.Equal(t, []meta.File{f}, walked)
+
+	_, err = m.Members(ctx)
+	require.Error(t, err, "an inmemory meta isn't replicated")
+	assert.Contains(t, err.Error(), "meta is not replicated")
+}
+
+// fakeClient answers NewVersion and GetVersion with err, counting the calls.
+type fakeClient struct {
+	proto.MetaClient
+	err   error
+	calls int
+}
+
+func (c *fakeClient) NewVersion(context.Context, *proto.NewVersionRequest, ...grpc.CallOption) (*proto.MetaFileVersion, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return &proto.MetaFileVersion{Version: 1}, nil
+}
+
+func (c *fakeClient) GetVersion(context.Context, *proto.GetVersionRequest, ...grpc.CallOption) (*proto.MetaFileVersion, error) {
+	return c.NewVersion(context.Background(), nil)
+}
+
+func TestMeta_ChangeFailover(t *testing.T) {
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	newVersion := func(m *Meta) error {
+		_, err := m.NewVersion(context.Background(), &f, &meta.FileVersion{})
+		return err
+	}
+	getVersion := func(m *Meta) error {
+		_, err := m.GetVersion(context.Background(), &f)
+		return err
+	}
+
+	tests := []struct {
+		name        string
+		err         error
+		fn          func(m *Meta) error
+		wantErr     error
+		wantCalls   int
+		wantCurrent int32
+	}{
+		{
+			name:        "change fails over from a follower",
+			err:         toStatus(meta.ErrNotLeader),
+			fn:          newVersion,
+			wantCalls:   1,
+			wantCurrent: 1,
+		},
+		{
+			name:        "change isn't retried after lost leadership",
+			err:         toStatus(fmt.Errorf("%w: leadership lost", meta.ErrIndeterminate)),
+			fn:          newVersion,
+			wantErr:     meta.ErrIndeterminate,
+			wantCurrent: 0,
+		},
+		{
+			name:        "change isn't retried after a broken connection",
+			err:         status.Error(codes.Unavailable, "transport is closing"),
+			fn:          newVersion,
+			wantErr:     meta.ErrIndeterminate,
+			wantCurrent: 1,
+		},
+		{
+			name:        "read fails over after a broken connection",
+			err:         status.Error(codes.Unavailable, "transport is closing"),
+			fn:          getVersion,
+			wantCalls:   1,
+			wantCurrent: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, second := &fakeClient{err: tt.err}, &fakeClient{}
+			m := New([]proto.MetaClient{first, second}, zerolog.Nop())
+
+			err := tt.fn(m)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, 1, first.calls)
+			assert.Equal(t, tt.wantCalls, second.calls)
+			assert.Equal(t, tt.wantCurrent, m.current.Load())
+		})
+	}
+}
+
+func TestMeta_Watch(t *testing.T) {
+	ctx := context.Background()
+	m := dial(t, startServer(t))
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	errStop := errors.New("stop")
+
+	fv := metatest.PutFile(t, m, f, meta.StatusReady, []string{"a"})
+
+	watch := func(from uint64, n int) ([]meta.Event, error) {
+		var res []meta.Event
+		err := m.Watch(ctx, from, func(e meta.Event) error {
+			res = append(res, e)
+			if len(res) == n {
+				return errStop
+			}
+
+			return nil
+		})
+
+		return res, err
+	}
+
+	events, err := watch(0, 3)
+	require.ErrorIs(t, err, errStop)
+	require.Len(t, events, 3)
+	assert.Equal(t, meta.EventVersionCreated, events[0].Type)
+	assert.Equal(t, meta.EventPartAdded, events[1].Type)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, events[1].Parts)
+	assert.Equal(t, meta.EventStatusChanged, events[2].Type)
+	assert.Equal(t, meta.Status(meta.StatusReady), events[2].Status)
+	for _, e := range events {
+		assert.Equal(t, f, e.File)
+		assert.Equal(t, fv.Version, e.Version)
+		assert.False(t, e.Time.IsZero())
+	}
+
+	resumed, err := watch(events[1].Seq, 1)
+	require.ErrorIs(t, err, errStop)
+	assert.Equal(t, events[2:], resumed)
+
+	_, err = watch(events[2].Seq+1, 1)
+	require.ErrorIs(t, err, meta.ErrFeedTruncated)
+}
+
+// endedFeed is a meta whose watches end without an error, as on a graceful shutdown.
+type endedFeed struct {
+	meta.Meta
+}
+
+func (endedFeed) Watch(context.Context, uint64, func(meta.Event) error) error {
+	return nil
+}
+
+func TestMeta_Watch_Interrupted(t *testing.T) {
+	m := dial(t, serve(t, endedFeed{}))
+
+	err := m.Watch(context.Background(), 0, func(meta.Event) error { return nil })
+	require.ErrorIs(t, err, meta.ErrFeedInterrupted, "the watcher resumes instead of taking the end for a normal one")
+}
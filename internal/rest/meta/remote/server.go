@@ -0,0 +1,214 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+// Server exposes a meta storage over gRPC, so several REST instances share it.
+type Server struct {
+	proto.UnimplementedMetaServer
+	meta   meta.Meta
+	logger zerolog.Logger
+}
+
+func NewServer(m meta.Meta, logger zerolog.Logger) *Server {
+	return &Server{
+		meta:   m,
+		logger: logger,
+	}
+}
+
+func (s *Server) NewVersion(ctx context.Context, req *proto.NewVersionRequest) (*proto.MetaFileVersion, error) {
+	fv, err := s.meta.NewVersion(ctx, fileFromProto(req.File), &meta.FileVersion{
+		ContentType:  req.ContentType,
+		StorageClass: req.StorageClass,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return versionToProto(fv), nil
+}
+
+func (s *Server) NewPart(ctx context.Context, req *proto.NewPartRequest) (*proto.NewPartResponse, error) {
+	if req.Part == nil {
+		return nil, toStatus(fmt.Errorf("%w: no part provided", common.ErrBadRequest))
+	}
+
+	err := s.meta.NewPart(ctx, fileFromProto(req.File), &meta.FileVersion{Version: int(req.Version)}, &meta.Part{
+		Index:    int(req.Part.Index),
+		Servers:  req.Part.Servers,
+		Size:     req.Part.Size,
+		Checksum: req.Part.Checksum,
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.NewPartResponse{}, nil
+}
+
+func (s *Server) UpdateStatus(ctx context.Context, req *proto.UpdateStatusRequest) (*proto.UpdateStatusResponse, error) {
+	err := s.meta.UpdateStatus(ctx, fileFromProto(req.File), &meta.FileVersion{
+		Version: int(req.Version),
+		Status:  meta.Status(req.Status),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.UpdateStatusResponse{}, nil
+}
+
+func (s *Server) GetVersion(ctx context.Context, req *proto.GetVersionRequest) (*proto.MetaFileVersion, error) {
+	fv, err := s.meta.GetVersion(ctx, fileFromProto(req.File))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return versionToProto(fv), nil
+}
+
+func (s *Server) Walk(_ *proto.WalkRequest, stream grpc.ServerStreamingServer[proto.WalkResponse]) error {
+	err := s.meta.Walk(stream.Context(), func(f meta.File, fv meta.FileVersion) error {
+		return stream.Send(&proto.WalkResponse{
+			File:    fileToProto(&f),
+			Version: versionToProto(&fv),
+		})
+	})
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("walk stopped")
+		return toStatus(err)
+	}
+
+	return nil
+}
+
+func (s *Server) UpdatePartServers(
+	ctx context.Context,
+	req *proto.UpdatePartServersRequest,
+) (*proto.UpdatePartServersResponse, error) {
+	err := s.meta.UpdatePartServers(
+		ctx,
+		fileFromProto(req.File),
+		int(req.Version),
+		int(req.Part),
+		req.Prev,
+		req.Servers,
+	)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.UpdatePartServersResponse{}, nil
+}
+
+func (s *Server) UpdateStorageClass(
+	ctx context.Context,
+	req *proto.UpdateStorageClassRequest,
+) (*proto.UpdateStorageClassResponse, error) {
+	err := s.meta.UpdateStorageClass(
+		ctx,
+		fileFromProto(req.File),
+		int(req.Version),
+		partsFromProto(req.Prev),
+		req.StorageClass,
+		partsFromProto(req.Parts),
+	)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.UpdateStorageClassResponse{}, nil
+}
+
+func (s *Server) PruneVersions(ctx context.Context, req *proto.PruneVersionsRequest) (*proto.PruneVersionsResponse, error) {
+	versions, err := s.meta.PruneVersions(ctx, fileFromProto(req.File), int(req.Keep))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	res := &proto.PruneVersionsResponse{Versions: make([]*proto.MetaFileVersion, len(versions))}
+	for i := range versions {
+		res.Versions[i] = versionToProto(&versions[i])
+	}
+
+	return res, nil
+}
+
+// Watch streams the changes of a meta that publishes them.
+func (s *Server) Watch(req *proto.WatchRequest, stream grpc.ServerStreamingServer[proto.MetaEvent]) error {
+	w, ok := meta.As[meta.Watcher](s.meta)
+	if !ok {
+		return status.Error(codes.Unimplemented, "meta change feed is disabled")
+	}
+
+	err := w.Watch(stream.Context(), req.From, func(e meta.Event) error {
+		return stream.Send(eventToProto(&e))
+	})
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("watch stopped")
+		return toStatus(err)
+	}
+
+	return nil
+}
+
+func (s *Server) cluster() (meta.Cluster, error) {
+	c, ok := meta.As[meta.Cluster](s.meta)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "meta is not replicated")
+	}
+
+	return c, nil
+}
+
+func (s *Server) Join(ctx context.Context, req *proto.JoinRequest) (*proto.JoinResponse, error) {
+	c, err := s.cluster()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.Join(ctx, req.Id, req.Address); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.JoinResponse{}, nil
+}
+
+func (s *Server) Leave(ctx context.Context, req *proto.LeaveRequest) (*proto.LeaveResponse, error) {
+	c, err := s.cluster()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.Leave(ctx, req.Id); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.LeaveResponse{}, nil
+}
+
+func (s *Server) Members(ctx context.Context, _ *proto.MembersRequest) (*proto.MembersResponse, error) {
+	c, err := s.cluster()
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := c.Members(ctx)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &proto.MembersResponse{Members: membersToProto(members)}, nil
+}
@@ -0,0 +1,110 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// loadMigrations returns the embedded migrations ordered by version, taken from the number the file
+// name starts with, e.g. 0002_part_checksums.sql.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	names, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	res := make([]migration, 0, len(names))
+	seen := make(map[int]string, len(names))
+
+	for _, name := range names {
+		base := path.Base(name)
+
+		prefix, _, _ := strings.Cut(base, "_")
+		version, convErr := strconv.Atoi(prefix)
+		if convErr != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration name %s", base)
+		}
+
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, base)
+		}
+		seen[version] = base
+
+		by, readErr := fs.ReadFile(fsys, name)
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", base, readErr)
+		}
+
+		res = append(res, migration{version: version, name: base, query: string(by)})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].version < res[j].version
+	})
+
+	return res, nil
+}
+
+// migrate applies migrations newer than the schema version, each in its own transaction together with
+// its schema_migrations row, and returns the number of applied ones.
+func migrate(ctx context.Context, db *sql.DB, migrations []migration) (int, error) {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	var applied int
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err = inTx(ctx, db, func(tx *sql.Tx) error {
+			if _, execErr := tx.ExecContext(ctx, m.query); execErr != nil {
+				return execErr
+			}
+
+			_, execErr := tx.ExecContext(
+				ctx,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.name, time.Now().UTC().Format(time.RFC3339),
+			)
+			return execErr
+		})
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %s: %w", m.name, err)
+		}
+
+		applied++
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,34 @@
+CREATE TABLE versions (
+    bucket        TEXT    NOT NULL,
+    key           TEXT    NOT NULL,
+    version       INTEGER NOT NULL,
+    content_type  TEXT    NOT NULL DEFAULT '',
+    storage_class TEXT    NOT NULL DEFAULT '',
+    status        TEXT    NOT NULL,
+    created_at    TEXT,
+    PRIMARY KEY (bucket, key, version)
+) WITHOUT ROWID;
+
+CREATE INDEX versions_status ON versions (status);
+
+CREATE TABLE parts (
+    bucket     TEXT    NOT NULL,
+    key        TEXT    NOT NULL,
+    version    INTEGER NOT NULL,
+    part_index INTEGER NOT NULL,
+    PRIMARY KEY (bucket, key, version, part_index),
+    FOREIGN KEY (bucket, key, version) REFERENCES versions (bucket, key, version) ON DELETE CASCADE
+) WITHOUT ROWID;
+
+CREATE TABLE part_servers (
+    bucket     TEXT    NOT NULL,
+    key        TEXT    NOT NULL,
+    version    INTEGER NOT NULL,
+    part_index INTEGER NOT NULL,
+    position   INTEGER NOT NULL,
+    server_id  TEXT    NOT NULL,
+    PRIMARY KEY (bucket, key, version, part_index, position),
+    FOREIGN KEY (bucket, key, version, part_index) REFERENCES parts (bucket, key, version, part_index) ON DELETE CASCADE
+) WITHOUT ROWID;
+
+CREATE INDEX part_servers_server ON part_servers (server_id);
@@ -0,0 +1,2 @@
+ALTER TABLE parts ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE parts ADD COLUMN checksum TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,623 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+const (
+	// walkBatch is the number of versions read by one query of Walk.
+	walkBatch = 1000
+
+	busyTimeout = 5 * time.Second
+)
+
+// selectVersions reads versions chosen by the subquery together with their parts and servers in one
+// statement, so they are consistent without a transaction.
+const selectVersions = `SELECT v.bucket, v.key, v.version, v.content_type, v.storage_class, v.status, v.created_at,
+	p.part_index, p.size, p.checksum, s.server_id
+FROM (%s) v
+LEFT JOIN parts p ON p.bucket = v.bucket AND p.key = v.key AND p.version = v.version
+LEFT JOIN part_servers s ON s.bucket = p.bucket AND s.key = p.key AND s.version = p.version
+	AND s.part_index = p.part_index
+ORDER BY v.bucket, v.key, v.version, p.part_index, s.position`
+
+// Meta keeps versions, parts and their servers in SQLite tables, so the inventory can be queried with
+// SQL and the database backed up with the usual tools. The schema is created and upgraded by the
+// embedded migrations on start.
+type Meta struct {
+	db     *sql.DB
+	logger zerolog.Logger
+}
+
+func New(filename string, logger zerolog.Logger) (*Meta, error) {
+	// immediate transactions take the write lock on begin, so concurrent writers wait for each other
+	// for busy_timeout instead of failing on a lock upgrade
+	dsn := fmt.Sprintf(
+		"file:%s?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_txlock=immediate",
+		filename, busyTimeout.Milliseconds(),
+	)
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	applied, err := migrate(context.Background(), db, migrations)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	if applied > 0 {
+		logger.Info().Int("migrations", applied).Msg("database schema migrated")
+	}
+
+	return &Meta{db: db, logger: logger}, nil
+}
+
+func (m *Meta) NewVersion(ctx context.Context, file *meta.File, info *meta.FileVersion) (*meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if file == nil || info == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	createdAt := time.Now().UTC()
+	fv := meta.FileVersion{
+		Status:       meta.StatusLoading,
+		ContentType:  info.ContentType,
+		StorageClass: info.StorageClass,
+		CreatedAt:    &createdAt,
+	}
+
+	err := inTx(ctx, m.db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(
+			ctx,
+			`SELECT COALESCE(MAX(version) + 1, 0) FROM versions WHERE bucket = ? AND key = ?`,
+			file.Bucket, file.Key,
+		).Scan(&fv.Version)
+		if err != nil {
+			return fmt.Errorf("failed to get last version: %w", err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO versions (bucket, key, version, content_type, storage_class, status, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			file.Bucket, file.Key, fv.Version, fv.ContentType, fv.StorageClass, fv.Status,
+			createdAt.Format(time.RFC3339Nano),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert version: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	m.logger.Debug().
+		Str("bucket", file.Bucket).
+		Str("key", file.Key).
+		Int("version", fv.Version).
+		Msg("new version created")
+
+	return &fv, nil
+}
+
+func (m *Meta) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	} else if p == nil {
+		return fmt.Errorf("%w: no part provided", common.ErrBadRequest)
+	}
+
+	return inTx(ctx, m.db, func(tx *sql.Tx) error {
+		if _, err := versionStatus(ctx, tx, f, fv.Version); err != nil {
+			return err
+		}
+
+		var parts int
+		err := tx.QueryRowContext(
+			ctx,
+			`SELECT COUNT(*) FROM parts WHERE bucket = ? AND key = ? AND version = ?`,
+			f.Bucket, f.Key, fv.Version,
+		).Scan(&parts)
+		if err != nil {
+			return fmt.Errorf("failed to count parts: %w", err)
+		}
+
+		if p.Index != parts {
+			return fmt.Errorf("%w: invalid part index", common.ErrBadRequest)
+		}
+
+		return insertPart(ctx, tx, f, fv.Version, *p)
+	})
+}
+
+func (m *Meta) UpdateStatus(ctx context.Context, f *meta.File, fv *meta.FileVersion) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if fv == nil {
+		return fmt.Errorf("%w: no file version provided", common.ErrBadRequest)
+	}
+
+	return inTx(ctx, m.db, func(tx *sql.Tx) error {
+		status, err := versionStatus(ctx, tx, f, fv.Version)
+		if err != nil {
+			return err
+		}
+
+		if status != fv.Status && status != meta.StatusLoading {
+			return fmt.Errorf("%w: can't update final status", common.ErrBadRequest)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE versions SET status = ? WHERE bucket = ? AND key = ? AND version = ?`,
+			fv.Status, f.Bucket, f.Key, fv.Version,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update status: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (m *Meta) GetVersion(ctx context.Context, f *meta.File) (*meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	rows, err := m.db.QueryContext(
+		ctx,
+		fmt.Sprintf(selectVersions, `SELECT * FROM versions WHERE bucket = ? AND key = ? AND status = ?
+			ORDER BY version DESC LIMIT 1`),
+		f.Bucket, f.Key, meta.StatusReady,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query version: %w", err)
+	}
+
+	entries, err := scanVersions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	}
+
+	fv := entries[0].fv
+
+	m.logger.Debug().
+		Str("bucket", f.Bucket).
+		Str("key", f.Key).
+		Int("version", fv.Version).
+		Int("parts", len(fv.Parts)).
+		Msg("get version")
+
+	return &fv, nil
+}
+
+// Walk reads versions ordered by bucket, key and version in batches and calls fn between the queries,
+// so fn may change meta.
+func (m *Meta) Walk(ctx context.Context, fn func(meta.File, meta.FileVersion) error) error {
+	afterFile := meta.File{}
+	afterVersion := -1
+
+	for {
+		rows, err := m.db.QueryContext(
+			ctx,
+			fmt.Sprintf(selectVersions, `SELECT * FROM versions WHERE (bucket, key, version) > (?, ?, ?)
+				ORDER BY bucket, key, version LIMIT ?`),
+			afterFile.Bucket, afterFile.Key, afterVersion, walkBatch,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to query versions: %w", err)
+		}
+
+		entries, err := scanVersions(rows)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			if err = fn(e.file, e.fv); err != nil {
+				return err
+			}
+		}
+
+		if len(entries) < walkBatch {
+			return nil
+		}
+
+		last := entries[len(entries)-1]
+		afterFile, afterVersion = last.file, last.fv.Version
+	}
+}
+
+func (m *Meta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if len(servers) == 0 {
+		return fmt.Errorf("%w: no servers provided", common.ErrBadRequest)
+	}
+
+	return inTx(ctx, m.db, func(tx *sql.Tx) error {
+		parts, err := versionParts(ctx, tx, f, version)
+		if err != nil {
+			return err
+		}
+
+		if part < 0 || len(parts) <= part {
+			return fmt.Errorf("%w: part not found", common.ErrNotFound)
+		}
+
+		if !slices.Equal(parts[part].Servers, prev) {
+			return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`DELETE FROM part_servers WHERE bucket = ? AND key = ? AND version = ? AND part_index = ?`,
+			f.Bucket, f.Key, version, part,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete part servers: %w", err)
+		}
+
+		return insertServers(ctx, tx, f, version, part, servers)
+	})
+}
+
+func (m *Meta) UpdateStorageClass(
+	ctx context.Context,
+	f *meta.File,
+	version int,
+	prev []meta.Part,
+	class string,
+	parts []meta.Part,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if f == nil {
+		return fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	}
+
+	for _, part := range parts {
+		if len(part.Servers) == 0 {
+			return fmt.Errorf("%w: no servers provided for part %d", common.ErrBadRequest, part.Index)
+		}
+	}
+
+	return inTx(ctx, m.db, func(tx *sql.Tx) error {
+		stored, err := versionParts(ctx, tx, f, version)
+		if err != nil {
+			return err
+		}
+
+		if len(parts) != len(stored) {
+			return fmt.Errorf("%w: version has %d parts", common.ErrBadRequest, len(stored))
+		}
+
+		if !slices.EqualFunc(stored, prev, func(a, b meta.Part) bool {
+			return a.Index == b.Index && slices.Equal(a.Servers, b.Servers)
+		}) {
+			return fmt.Errorf("%w: part servers have changed", common.ErrConflict)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`UPDATE versions SET storage_class = ? WHERE bucket = ? AND key = ? AND version = ?`,
+			class, f.Bucket, f.Key, version,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update storage class: %w", err)
+		}
+
+		_, err = tx.ExecContext(
+			ctx,
+			`DELETE FROM parts WHERE bucket = ? AND key = ? AND version = ?`,
+			f.Bucket, f.Key, version,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete parts: %w", err)
+		}
+
+		for _, part := range parts {
+			if err = insertPart(ctx, tx, f, version, part); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *Meta) PruneVersions(ctx context.Context, f *meta.File, keep int) ([]meta.FileVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f == nil {
+		return nil, fmt.Errorf("%w: no file provided", common.ErrBadRequest)
+	} else if keep < 1 {
+		return nil, fmt.Errorf("%w: at least one version must be kept", common.ErrBadRequest)
+	}
+
+	var pruned []meta.FileVersion
+
+	err := inTx(ctx, m.db, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(
+			ctx,
+			fmt.Sprintf(selectVersions, `SELECT * FROM versions WHERE bucket = ? AND key = ?`),
+			f.Bucket, f.Key,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to query versions: %w", err)
+		}
+
+		entries, err := scanVersions(rows)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			return fmt.Errorf("%w: file not found", common.ErrNotFound)
+		}
+
+		versions := make([]meta.FileVersion, len(entries))
+		for i, e := range entries {
+			versions[i] = e.fv
+		}
+
+		pruned = meta.Prunable(versions, keep)
+		for _, fv := range pruned {
+			// parts and their servers are deleted by the foreign keys
+			_, err = tx.ExecContext(
+				ctx,
+				`DELETE FROM versions WHERE bucket = ? AND key = ? AND version = ?`,
+				f.Bucket, f.Key, fv.Version,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to delete version: %w", err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pruned, nil
+}
+
+func (m *Meta) Close() error {
+	if err := m.db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+
+	return nil
+}
+
+func inTx(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func versionStatus(ctx context.Context, tx *sql.Tx, f *meta.File, version int) (meta.Status, error) {
+	var status meta.Status
+
+	err := tx.QueryRowContext(
+		ctx,
+		`SELECT status FROM versions WHERE bucket = ? AND key = ? AND version = ?`,
+		f.Bucket, f.Key, version,
+	).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: file version not found", common.ErrNotFound)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to get version: %w", err)
+	}
+
+	return status, nil
+}
+
+func versionParts(ctx context.Context, tx *sql.Tx, f *meta.File, version int) ([]meta.Part, error) {
+	if _, err := versionStatus(ctx, tx, f, version); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT p.part_index, p.size, p.checksum, s.server_id
+		FROM parts p
+		LEFT JOIN part_servers s ON s.bucket = p.bucket AND s.key = p.key AND s.version = p.version
+			AND s.part_index = p.part_index
+		WHERE p.bucket = ? AND p.key = ? AND p.version = ?
+		ORDER BY p.part_index, s.position`,
+		f.Bucket, f.Key, version,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query parts: %w", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var parts []meta.Part
+
+	for rows.Next() {
+		var p meta.Part
+		var server sql.NullString
+		if err = rows.Scan(&p.Index, &p.Size, &p.Checksum, &server); err != nil {
+			return nil, fmt.Errorf("failed to scan part: %w", err)
+		}
+
+		parts = appendServer(parts, p, server)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read parts: %w", err)
+	}
+
+	return parts, nil
+}
+
+func insertPart(ctx context.Context, tx *sql.Tx, f *meta.File, version int, p meta.Part) error {
+	_, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO parts (bucket, key, version, part_index, size, checksum) VALUES (?, ?, ?, ?, ?, ?)`,
+		f.Bucket, f.Key, version, p.Index, p.Size, p.Checksum,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert part: %w", err)
+	}
+
+	return insertServers(ctx, tx, f, version, p.Index, p.Servers)
+}
+
+func insertServers(ctx context.Context, tx *sql.Tx, f *meta.File, version, part int, servers []string) error {
+	for i, id := range servers {
+		_, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO part_servers (bucket, key, version, part_index, position, server_id)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			f.Bucket, f.Key, version, part, i, id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert part server: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type entry struct {
+	file meta.File
+	fv   meta.FileVersion
+}
+
+// scanVersions groups the rows of selectVersions, one per version, part and server, into versions.
+func scanVersions(rows *sql.Rows) ([]entry, error) {
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var res []entry
+
+	for rows.Next() {
+		var e entry
+		var createdAt, checksum, server sql.NullString
+		var partIndex, size sql.NullInt64
+
+		err := rows.Scan(
+			&e.file.Bucket, &e.file.Key, &e.fv.Version, &e.fv.ContentType, &e.fv.StorageClass, &e.fv.Status,
+			&createdAt, &partIndex, &size, &checksum, &server,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan version: %w", err)
+		}
+
+		if n := len(res); n == 0 || res[n-1].file != e.file || res[n-1].fv.Version != e.fv.Version {
+			if createdAt.Valid {
+				t, parseErr := time.Parse(time.RFC3339Nano, createdAt.String)
+				if parseErr != nil {
+					return nil, fmt.Errorf("invalid created_at of %s: %w", e.file, parseErr)
+				}
+				e.fv.CreatedAt = &t
+			}
+
+			res = append(res, e)
+		}
+
+		if partIndex.Valid {
+			last := &res[len(res)-1].fv
+			last.Parts = appendServer(last.Parts, meta.Part{
+				Index:    int(partIndex.Int64),
+				Size:     size.Int64,
+				Checksum: checksum.String,
+			}, server)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read versions: %w", err)
+	}
+
+	return res, nil
+}
+
+// appendServer adds a row of a part ordered by index and server position.
+func appendServer(parts []meta.Part, p meta.Part, server sql.NullString) []meta.Part {
+	if n := len(parts); n == 0 || parts[n-1].Index != p.Index {
+		parts = append(parts, p)
+	}
+
+	if server.Valid {
+		last := &parts[len(parts)-1]
+		last.Servers = append(last.Servers, server.String)
+	}
+
+	return parts
+}
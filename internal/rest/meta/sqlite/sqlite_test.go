@@ -0,0 +1,176 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/metatest"
+)
+
+func TestMeta_Conformance(t *testing.T) {
+	metatest.Run(t, func(t *testing.T) meta.Meta {
+		m, err := New(filepath.Join(t.TempDir(), "meta.sqlite"), zerolog.Nop())
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = m.Close()
+		})
+
+		return m
+	})
+}
+
+func TestMeta_Reopen(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.sqlite")
+	f := meta.File{Bucket: "bucket", Key: "key"}
+
+	m, err := New(filename, zerolog.Nop())
+	require.NoError(t, err)
+
+	metatest.PutFile(t, m, f, meta.StatusReady, []string{"a", "b"})
+	require.NoError(t, m.Close())
+
+	reopened, err := New(filename, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = reopened.Close()
+	}()
+
+	embedded, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+
+	var migrations int
+	require.NoError(t, reopened.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&migrations))
+	assert.Equal(t, len(embedded), migrations, "migrations are applied once")
+
+	got, err := reopened.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a", "b"}}}, got.Parts)
+}
+
+func TestMeta_Upgrade(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "meta.sqlite")
+
+	embedded, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+
+	db, err := sql.Open("sqlite", "file:"+filename+"?_pragma=foreign_keys(1)")
+	require.NoError(t, err)
+
+	// a database of the first release, before parts had sizes and checksums
+	_, err = migrate(ctx, db, embedded[:1])
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `INSERT INTO versions (bucket, key, version, status) VALUES ('bucket', 'key', 0, 'ready');
+		INSERT INTO parts (bucket, key, version, part_index) VALUES ('bucket', 'key', 0, 0);
+		INSERT INTO part_servers (bucket, key, version, part_index, position, server_id)
+			VALUES ('bucket', 'key', 0, 0, 0, 'a');`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	m, err := New(filename, zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = m.Close()
+	}()
+
+	got, err := m.GetVersion(ctx, &meta.File{Bucket: "bucket", Key: "key"})
+	require.NoError(t, err)
+	assert.Equal(t, []meta.Part{{Index: 0, Servers: []string{"a"}}}, got.Parts, "old parts have no checksum")
+}
+
+func TestMeta_Inventory(t *testing.T) {
+	ctx := context.Background()
+
+	m, err := New(filepath.Join(t.TempDir(), "meta.sqlite"), zerolog.Nop())
+	require.NoError(t, err)
+	defer func() {
+		_ = m.Close()
+	}()
+
+	metatest.PutFile(t, m, meta.File{Bucket: "a", Key: "1"}, meta.StatusReady, []string{"s1", "s2"}, []string{"s2"})
+	metatest.PutFile(t, m, meta.File{Bucket: "a", Key: "2"}, meta.StatusError, []string{"s1"})
+	metatest.PutFile(t, m, meta.File{Bucket: "b", Key: "1"}, meta.StatusReady, []string{"s3"})
+
+	rows, err := m.db.QueryContext(ctx, `SELECT s.server_id, COUNT(*)
+		FROM part_servers s
+		JOIN versions v ON v.bucket = s.bucket AND v.key = s.key AND v.version = s.version
+		WHERE v.status = 'ready'
+		GROUP BY s.server_id
+		ORDER BY s.server_id`)
+	require.NoError(t, err)
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	got := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var parts int
+		require.NoError(t, rows.Scan(&id, &parts))
+		got[id] = parts
+	}
+	require.NoError(t, rows.Err())
+
+	assert.Equal(t, map[string]int{"s1": 1, "s2": 2, "s3": 1}, got)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []int
+		wantErr bool
+	}{
+		{
+			name: "ordered by version",
+			files: fstest.MapFS{
+				"migrations/0010_c.sql": {Data: []byte("c")},
+				"migrations/0002_b.sql": {Data: []byte("b")},
+				"migrations/0001_a.sql": {Data: []byte("a")},
+				"migrations/README.md":  {Data: []byte("skipped")},
+			},
+			want: []int{1, 2, 10},
+		},
+		{
+			name: "no version",
+			files: fstest.MapFS{
+				"migrations/init.sql": {Data: []byte("a")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "same version",
+			files: fstest.MapFS{
+				"migrations/0001_a.sql": {Data: []byte("a")},
+				"migrations/01_b.sql":   {Data: []byte("b")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(tt.files)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			versions := make([]int, 0, len(got))
+			for _, m := range got {
+				versions = append(versions, m.version)
+			}
+			assert.Equal(t, tt.want, versions)
+		})
+	}
+}
@@ -4,13 +4,132 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"time"
 )
 
 type Meta interface {
-	NewVersion(context.Context, *File, string) (*FileVersion, error)
+	// NewVersion creates a Loading version with the content type and storage class of the given one.
+	NewVersion(context.Context, *File, *FileVersion) (*FileVersion, error)
 	NewPart(context.Context, *File, *FileVersion, *Part) error
 	UpdateStatus(context.Context, *File, *FileVersion) error
 	GetVersion(context.Context, *File) (*FileVersion, error)
+	// Walk calls fn for every version of every file. fn gets copies and may call other methods.
+	Walk(ctx context.Context, fn func(File, FileVersion) error) error
+	// UpdatePartServers replaces servers of a part if they are still prev, otherwise returns common.ErrConflict.
+	UpdatePartServers(ctx context.Context, f *File, version, part int, prev, servers []string) error
+	// UpdateStorageClass moves a version to the storage class and servers of parts at once if its parts
+	// are still on the servers of prev, otherwise returns common.ErrConflict.
+	UpdateStorageClass(ctx context.Context, f *File, version int, prev []Part, class string, parts []Part) error
+	// PruneVersions deletes the versions of a file older than the newest keep ones and returns them, so
+	// their parts can be deleted. The current version and versions being uploaded are kept.
+	PruneVersions(ctx context.Context, f *File, keep int) ([]FileVersion, error)
+}
+
+// Prunable returns the versions PruneVersions deletes from versions ordered by number.
+func Prunable(versions []FileVersion, keep int) []FileVersion {
+	current := -1
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Status == StatusReady {
+			current = i
+			break
+		}
+	}
+
+	var res []FileVersion
+	for i := 0; i < len(versions)-keep; i++ {
+		if i != current && versions[i].Status != StatusLoading {
+			res = append(res, versions[i])
+		}
+	}
+
+	return res
+}
+
+// ErrNotLeader is returned by replicated metas when the node can't serve the request, because another
+// node leads the cluster or there is no leader.
+var ErrNotLeader = errors.New("not the leader")
+
+// ErrIndeterminate is returned by replicated and remote metas when a change may or may not have been
+// applied, e.g. the leader lost leadership or the connection broke after the request was sent.
+var ErrIndeterminate = errors.New("outcome of the change is unknown")
+
+// Cluster is implemented by metas replicated over several nodes.
+type Cluster interface {
+	// Join adds the node with the replication address to the cluster.
+	Join(ctx context.Context, id, address string) error
+	// Leave removes the node from the cluster.
+	Leave(ctx context.Context, id string) error
+	Members(ctx context.Context) ([]Member, error)
+}
+
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Voter   bool   `json:"voter"`
+	Leader  bool   `json:"leader"`
+}
+
+// Unwrapper is implemented by metas that wrap another one, e.g. to publish its changes.
+type Unwrapper interface {
+	Unwrap() Meta
+}
+
+// As returns the first meta in the chain of wrapped metas that implements T.
+func As[T any](m Meta) (T, bool) {
+	for m != nil {
+		if res, ok := m.(T); ok {
+			return res, true
+		}
+
+		u, ok := m.(Unwrapper)
+		if !ok {
+			break
+		}
+		m = u.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+// ErrFeedTruncated is returned by Watch when the events after the requested one are no longer retained,
+// the watcher has to resync with Walk.
+var ErrFeedTruncated = errors.New("change feed is truncated")
+
+// ErrFeedInterrupted is returned by Watch when the feed ended before ctx was done, e.g. the remote meta
+// shut down. The watcher resumes after the last event it got.
+var ErrFeedInterrupted = errors.New("change feed is interrupted")
+
+// Watcher is implemented by metas that publish their changes.
+type Watcher interface {
+	// Watch calls fn for every event after the one with the sequence number from, in order, until ctx is
+	// done or fn fails. With from 0 it starts from the oldest retained event.
+	Watch(ctx context.Context, from uint64, fn func(Event) error) error
+}
+
+type EventType string
+
+const (
+	EventVersionCreated      EventType = "version_created"
+	EventPartAdded           EventType = "part_added"
+	EventStatusChanged       EventType = "status_changed"
+	EventPartServersChanged  EventType = "part_servers_changed"
+	EventStorageClassChanged EventType = "storage_class_changed"
+	EventVersionDeleted      EventType = "version_deleted"
+)
+
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	File    File      `json:"file"`
+	Version int       `json:"version"`
+	// Status is set for created and deleted versions and status changes, StorageClass for created and
+	// deleted versions and storage class changes.
+	Status       Status `json:"status,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	// Parts are the added or changed parts, or all parts of a deleted version.
+	Parts []Part `json:"parts,omitempty"`
 }
 
 type File struct {
@@ -34,13 +153,20 @@ func FileFromString(s string) (File, error) {
 type FileVersion struct {
 	Version     int    `json:"version"`
 	ContentType string `json:"content_type"`
-	Status      Status `json:"status"`
-	Parts       []Part `json:"parts"`
+	// StorageClass is empty for the default class.
+	StorageClass string     `json:"storage_class,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	Status       Status     `json:"status"`
+	Parts        []Part     `json:"parts"`
 }
 
 type Part struct {
-	Servers []int `json:"servers"`
-	Index   int   `json:"index"`
+	Servers []string `json:"servers"`
+	Index   int      `json:"index"`
+	// Size and Checksum (hex SHA-256) are what every replica of the part holds, both are empty for parts
+	// written before they were recorded.
+	Size     int64  `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
 }
 
 type FilePart struct {
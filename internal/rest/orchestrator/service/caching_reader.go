@@ -0,0 +1,52 @@
+package service
+
+import (
+	"errors"
+	"io"
+)
+
+// cachingReader collects everything read from the underlying reader and hands it over
+// once the reader is fully consumed. Objects larger than limit are not collected.
+type cachingReader struct {
+	reader   io.Reader
+	buf      []byte
+	limit    int
+	overflow bool
+	onEOF    func([]byte)
+}
+
+func (c *cachingReader) Read(p []byte) (n int, err error) {
+	n, err = c.reader.Read(p)
+
+	if !c.overflow && n > 0 {
+		if len(c.buf)+n > c.limit {
+			c.overflow = true
+			c.buf = nil
+		} else {
+			c.buf = append(c.buf, p[:n]...)
+		}
+	}
+
+	if errors.Is(err, io.EOF) && !c.overflow && c.onEOF != nil {
+		c.onEOF(c.buf)
+		c.onEOF = nil
+	}
+
+	return n, err
+}
+
+func (c *cachingReader) Close() error {
+	if closer, ok := c.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+func newCachingReader(reader io.Reader, limit int, onEOF func([]byte)) *cachingReader {
+	return &cachingReader{
+		reader: reader,
+		limit:  limit,
+		onEOF:  onEOF,
+	}
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"time"
+
+	"github.com/theoptz/basic-s3/internal/rest/cache"
+	"github.com/theoptz/basic-s3/internal/rest/health"
+	"github.com/theoptz/basic-s3/internal/rest/pruner"
+	"github.com/theoptz/basic-s3/internal/rest/replica"
+)
+
+type Config struct {
+	ChunkSize         int
+	UploadConcurrency int
+	// UploadMemory bounds the memory of part buffers shared by all uploads, 0 - unlimited.
+	UploadMemory int64
+
+	// HedgePercentile is the percentile of observed time-to-first-chunk after which a part download
+	// is hedged against another replica. Zero disables hedging.
+	HedgePercentile float64
+	// HedgeDelay is used until enough latency samples are collected.
+	HedgeDelay time.Duration
+
+	// Cache is an optional cache for downloaded objects.
+	Cache              cache.Cache
+	CacheMaxObjectSize int
+
+	// Health is an optional tracker fed with results of storage node calls.
+	Health *health.Tracker
+
+	// BucketClasses maps buckets to the storage class of uploads without one.
+	BucketClasses map[string]string
+
+	// Replicas is an optional selector that orders replicas for reading, random order if nil.
+	Replicas *replica.Selector
+
+	// MaxVersions is the number of versions kept per key, 0 - unlimited. BucketMaxVersions overrides it
+	// for buckets.
+	MaxVersions       int
+	BucketMaxVersions map[string]int
+	// Pruner deletes parts of pruned versions, without it they are left on the nodes.
+	Pruner *pruner.Pruner
+}
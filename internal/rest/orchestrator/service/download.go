@@ -2,16 +2,18 @@ package service
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand/v2"
+	"slices"
 
 	"github.com/valyala/fasthttp"
 
 	"google.golang.org/grpc"
 
+	"github.com/theoptz/basic-s3/internal/rest/cache"
 	"github.com/theoptz/basic-s3/internal/rest/meta"
 	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
 	"github.com/theoptz/basic-s3/proto"
@@ -30,36 +32,64 @@ func (s *Service) Download(ctx context.Context, req *orchestrator.DownloadReques
 		return "", nil, fmt.Errorf("file has no parts")
 	}
 
-	clients := make([]proto.StorageClient, len(fv.Parts))
+	cacheKey := cache.Key{
+		Bucket:  metaFile.Bucket,
+		Key:     metaFile.Key,
+		Version: fv.Version,
+	}
+
+	if s.cache != nil {
+		if data, ok := s.cache.Get(cacheKey); ok {
+			return fv.ContentType, s.makeBodyStreamWriter(bytes.NewReader(data), func() {}), nil
+		}
+	}
+
+	servers := make([][]string, len(fv.Parts))
 
 	for i := 0; i < len(fv.Parts); i++ {
 		if len(fv.Parts[i].Servers) == 0 {
 			return "", nil, fmt.Errorf("failed to locate part server")
 		}
 
-		randId := fv.Parts[i].Servers[rand.IntN(len(fv.Parts[i].Servers))]
-		cl, err := s.partDistributor.GetClientByID(randId)
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to get storage client: %w", err)
-		}
-
-		clients[i] = cl
+		servers[i] = slices.Clone(fv.Parts[i].Servers)
+		s.orderReplicas(servers[i])
+		s.preferHealthy(servers[i])
 	}
 
+	// the request context is only done when the server shuts down, part streams are cancelled once the
+	// stream writer returns, e.g. because the client has gone
+	ctx, cancel := context.WithCancel(ctx)
+
 	reader := newStreamReader(func(i int) (grpc.ServerStreamingClient[proto.DownloadResponse], error) {
-		return clients[i].Download(ctx, &proto.DownloadRequest{
+		return s.openPartStream(ctx, &proto.DownloadRequest{
 			Bucket:  metaFile.Bucket,
 			Key:     metaFile.Key,
 			Version: int32(fv.Version),
 			Part:    int32(i),
-		})
+		}, servers[i])
 	}, len(fv.Parts), s.logger)
 
-	return fv.ContentType, s.makeBodyStreamWriter(reader), nil
+	if s.cache == nil {
+		return fv.ContentType, s.makeBodyStreamWriter(reader, cancel), nil
+	}
+
+	return fv.ContentType, s.makeBodyStreamWriter(newCachingReader(reader, s.cacheMaxObjectSize, func(data []byte) {
+		s.cache.Set(cacheKey, data)
+	}), cancel), nil
 }
 
-func (s *Service) makeBodyStreamWriter(reader io.Reader) fasthttp.StreamWriter {
+// makeBodyStreamWriter copies the reader to the response and calls done when it returns, whether the body
+// is written or the client has gone. A reader that is an io.Closer is closed first.
+func (s *Service) makeBodyStreamWriter(reader io.Reader, done func()) fasthttp.StreamWriter {
 	return func(writer *bufio.Writer) {
+		defer done()
+
+		if closer, ok := reader.(io.Closer); ok {
+			defer func() {
+				_ = closer.Close()
+			}()
+		}
+
 		var err error
 
 		var total, n int64
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+
+	"github.com/theoptz/basic-s3/internal/rest/health"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
+	"github.com/theoptz/basic-s3/internal/rest/replica"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+func slowDownloads(delay time.Duration) grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(
+		srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		if info.FullMethod == proto.Storage_Download_FullMethodName {
+			select {
+			case <-time.After(delay):
+			case <-ss.Context().Done():
+				return ss.Context().Err()
+			}
+		}
+
+		return handler(srv, ss)
+	})
+}
+
+func countDownloads(n *atomic.Int32) grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(
+		srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		if info.FullMethod == proto.Storage_Download_FullMethodName {
+			n.Add(1)
+		}
+
+		return handler(srv, ss)
+	})
+}
+
+func putReplicatedFile(t *testing.T, s *Service, bucket, key string, parts, partSize, clients int) []byte {
+	t.Helper()
+
+	ctx := context.Background()
+	file := &meta.File{Bucket: bucket, Key: key}
+
+	fv, err := s.metaClient.NewVersion(ctx, file, &meta.FileVersion{ContentType: "application/octet-stream"})
+	require.NoError(t, err)
+
+	data := make([]byte, partSize*parts)
+	_, _ = rand.Read(data)
+
+	servers := make([]string, clients)
+	for id := range servers {
+		servers[id] = testNodeID(id)
+	}
+
+	for i := 0; i < parts; i++ {
+		for id := range servers {
+			_, err = s.uploadPart(ctx, streamInfo{
+				Bucket:   bucket,
+				Key:      key,
+				Version:  fv.Version,
+				Part:     i,
+				Size:     partSize,
+				ClientID: testNodeID(id),
+			}, bytes.NewReader(data[i*partSize:(i+1)*partSize]))
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, s.metaClient.NewPart(ctx, file, fv, &meta.Part{Index: i, Servers: servers}))
+	}
+
+	require.NoError(t, s.metaClient.UpdateStatus(ctx, file, &meta.FileVersion{
+		Version: fv.Version,
+		Status:  meta.StatusReady,
+	}))
+
+	return data
+}
+
+func TestService_Download_Hedged(t *testing.T) {
+	const (
+		bucket   = "bucket"
+		key      = "key"
+		partSize = 32 * 1024
+		parts    = 4
+	)
+
+	tests := []struct {
+		name            string
+		hedgePercentile float64
+		wantFast        bool
+		// wantDownloads of every part, 0 - not checked
+		wantDownloads int
+	}{
+		{
+			name:            "hedging enabled",
+			hedgePercentile: 95,
+			wantFast:        true,
+		},
+		{
+			name:            "hedging disabled",
+			hedgePercentile: 0,
+			wantFast:        false,
+			wantDownloads:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var slowDownloadsCount, fastDownloadsCount atomic.Int32
+			clients := []proto.StorageClient{
+				startStorage(t, slowDownloads(time.Second), countDownloads(&slowDownloadsCount)),
+				startStorage(t, countDownloads(&fastDownloadsCount)),
+			}
+
+			s := newTestService(t, &testDistributor{clients: clients, partSize: partSize}, Config{
+				ChunkSize:       chunkSize,
+				HedgePercentile: tt.hedgePercentile,
+				HedgeDelay:      20 * time.Millisecond,
+			})
+
+			data := putReplicatedFile(t, s, bucket, key, parts, partSize, len(clients))
+
+			startTime := time.Now()
+			require.Equal(t, data, download(t, s, bucket, key))
+
+			if tt.wantFast {
+				assert.Less(t, time.Since(startTime), 500*time.Millisecond)
+			}
+
+			if tt.wantDownloads > 0 {
+				assert.Equal(t, int32(tt.wantDownloads*parts), slowDownloadsCount.Load()+fastDownloadsCount.Load(),
+					"only one replica of every part is read")
+			}
+		})
+	}
+}
+
+func TestService_Download_ReadPolicy(t *testing.T) {
+	const (
+		bucket   = "bucket"
+		key      = "key"
+		partSize = 32 * 1024
+		parts    = 4
+	)
+
+	clients := []proto.StorageClient{
+		startStorage(t, slowDownloads(time.Second)),
+		startStorage(t),
+	}
+
+	// replicas keep the upload order while they have no samples, so the slow one is read first
+	selector, err := replica.New(replica.Config{Policy: replica.PolicyEWMA, Shuffle: func([]string) {}}, nil)
+	require.NoError(t, err)
+
+	s := newTestService(t, &testDistributor{clients: clients, partSize: partSize}, Config{
+		ChunkSize:       chunkSize,
+		HedgePercentile: 95,
+		HedgeDelay:      20 * time.Millisecond,
+		Replicas:        selector,
+	})
+
+	data := putReplicatedFile(t, s, bucket, key, parts, partSize, len(clients))
+
+	slowSamples := func() uint64 {
+		for _, stats := range selector.Snapshot() {
+			if stats.ID == testNodeID(0) {
+				return stats.Samples
+			}
+		}
+
+		return 0
+	}
+
+	require.Equal(t, data, download(t, s, bucket, key))
+
+	before := slowSamples()
+	require.NotZero(t, before, "the slow replica is tried while it has no samples")
+
+	for range 3 {
+		require.Equal(t, data, download(t, s, bucket, key))
+	}
+	assert.Equal(t, before, slowSamples(), "the slow replica is not read from again")
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("client has gone")
+}
+
+func TestService_Download_ClientGone(t *testing.T) {
+	const (
+		bucket   = "bucket"
+		key      = "key"
+		partSize = 32 * 1024
+		parts    = 4
+	)
+
+	clients := []proto.StorageClient{
+		startStorage(t, slowDownloads(time.Second)),
+		startStorage(t),
+	}
+
+	selector, err := replica.New(replica.Config{Policy: replica.PolicyLeastOutstanding}, nil)
+	require.NoError(t, err)
+
+	s := newTestService(t, &testDistributor{clients: clients, partSize: partSize}, Config{
+		ChunkSize:       chunkSize,
+		HedgePercentile: 95,
+		HedgeDelay:      20 * time.Millisecond,
+		Replicas:        selector,
+	})
+
+	putReplicatedFile(t, s, bucket, key, parts, partSize, len(clients))
+
+	_, streamWriter, err := s.Download(context.Background(), &orchestrator.DownloadRequest{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+
+	streamWriter(bufio.NewWriterSize(failingWriter{}, chunkSize))
+
+	assert.Eventually(t, func() bool {
+		for _, stats := range selector.Snapshot() {
+			if stats.Outstanding != 0 {
+				return false
+			}
+		}
+
+		return true
+	}, time.Second, 10*time.Millisecond, "part streams and hedged attempts are released")
+}
+
+func TestService_OpenPartStream_ReleasesTrial(t *testing.T) {
+	const (
+		bucket      = "bucket"
+		key         = "key"
+		partSize    = 32 * 1024
+		openTimeout = 500 * time.Millisecond
+	)
+
+	tests := []struct {
+		name string
+		// cancelAfter cancels the download, 0 - not cancelled
+		cancelAfter time.Duration
+		wantErr     bool
+	}{
+		{
+			name: "lost hedge race",
+		},
+		{
+			name:        "download cancelled",
+			cancelAfter: 50 * time.Millisecond,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := []proto.StorageClient{
+				startStorage(t, slowDownloads(time.Second)),
+				startStorage(t),
+			}
+
+			tracker := health.New(health.Config{FailureThreshold: 1, OpenTimeout: openTimeout}, zerolog.Nop())
+
+			s := newTestService(t, &testDistributor{clients: clients, partSize: partSize}, Config{
+				ChunkSize:       chunkSize,
+				HedgePercentile: 95,
+				HedgeDelay:      20 * time.Millisecond,
+				Health:          tracker,
+			})
+
+			putReplicatedFile(t, s, bucket, key, 1, partSize, len(clients))
+			fv, err := s.metaClient.GetVersion(context.Background(), &meta.File{Bucket: bucket, Key: key})
+			require.NoError(t, err)
+
+			tracker.ReportFailure(testNodeID(0), errors.New("failed"))
+			time.Sleep(openTimeout)
+
+			servers := []string{testNodeID(0)}
+			if !tt.wantErr {
+				servers = append(servers, testNodeID(1))
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelAfter > 0 {
+				time.AfterFunc(tt.cancelAfter, cancel)
+			}
+
+			stream, err := s.openPartStream(ctx, &proto.DownloadRequest{
+				Bucket:  bucket,
+				Key:     key,
+				Version: int32(fv.Version),
+			}, servers)
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, stream)
+			}
+
+			assert.Equal(t, health.StateHalfOpen, tracker.State(testNodeID(0)), "the trial is not reported")
+			assert.True(t, tracker.Available(testNodeID(0)), "the trial is released")
+		})
+	}
+}
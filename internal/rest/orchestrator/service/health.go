@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Service) reportResult(ctx context.Context, id string, latency time.Duration, err error) {
+	if s.health == nil {
+		return
+	}
+
+	if err == nil {
+		s.health.ReportSuccess(id, latency)
+		return
+	}
+
+	// cancelled requests (client gone, lost hedge race) say nothing about the node
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled {
+		s.health.Release(id)
+		return
+	}
+
+	s.health.ReportFailure(id, err)
+}
+
+// acquire reports whether a request may be sent to the node now, it is called right before sending one.
+// A node with an open breaker gets only a single trial request.
+func (s *Service) acquire(id string) bool {
+	return s.health == nil || s.health.TryAcquire(id)
+}
+
+// release gives up a request acquired for the node that won't be reported, so a trial it may hold doesn't
+// keep the node unavailable until the trial expires.
+func (s *Service) release(id string) {
+	if s.health != nil {
+		s.health.Release(id)
+	}
+}
+
+// preferHealthy moves unavailable replicas to the end of the list keeping the order of the rest.
+func (s *Service) preferHealthy(servers []string) {
+	if s.health == nil {
+		return
+	}
+
+	slices.SortStableFunc(servers, func(a, b string) int {
+		allowA, allowB := s.health.Available(a), s.health.Available(b)
+
+		switch {
+		case allowA == allowB:
+			return 0
+		case allowA:
+			return -1
+		default:
+			return 1
+		}
+	})
+}
+
+// orderReplicas puts the replica to read from first, following the read policy if there is a selector.
+func (s *Service) orderReplicas(servers []string) {
+	if s.replicas != nil {
+		s.replicas.Order(servers)
+		return
+	}
+
+	rand.Shuffle(len(servers), func(a, b int) {
+		servers[a], servers[b] = servers[b], servers[a]
+	})
+}
@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type attemptResult struct {
+	stream  grpc.ServerStreamingClient[proto.DownloadResponse]
+	first   *proto.DownloadResponse
+	err     error
+	idx     int
+	server  string
+	elapsed time.Duration
+}
+
+// hedgedStream replays the first chunk received while racing replicas and releases
+// the attempt context once the stream is finished or closed early.
+type hedgedStream struct {
+	grpc.ServerStreamingClient[proto.DownloadResponse]
+	first    *proto.DownloadResponse
+	firstErr error
+	consumed bool
+	cancel   context.CancelFunc
+}
+
+func (h *hedgedStream) Recv() (*proto.DownloadResponse, error) {
+	var (
+		res *proto.DownloadResponse
+		err error
+	)
+
+	if !h.consumed {
+		h.consumed = true
+		res, err = h.first, h.firstErr
+	} else {
+		res, err = h.ServerStreamingClient.Recv()
+	}
+
+	if err != nil {
+		h.cancel()
+	}
+
+	return res, err
+}
+
+// Close cancels the attempt, so a stream abandoned before its end doesn't stay open.
+func (h *hedgedStream) Close() error {
+	h.cancel()
+	return nil
+}
+
+// openPartStream starts downloading a part from the first server. If there are other replicas and the
+// first chunk doesn't arrive within the hedge delay, the same request is sent to the next replica.
+// The first attempt to answer wins, the others are cancelled. Failed attempts fall over to the next replica.
+// Every attempt releases the request acquired from the node breaker: by its result or, for cancelled
+// losers, explicitly.
+func (s *Service) openPartStream(
+	ctx context.Context,
+	req *proto.DownloadRequest,
+	servers []string,
+) (grpc.ServerStreamingClient[proto.DownloadResponse], error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("failed to locate part server")
+	}
+
+	var (
+		results  = make(chan attemptResult, len(servers))
+		cancels  = make([]context.CancelFunc, 0, len(servers))
+		started  = make([]time.Time, 0, len(servers))
+		attempts = make([]string, 0, len(servers))
+		finished = make([]bool, 0, len(servers))
+		next     int
+		running  int
+		lastErr  error
+	)
+
+	launch := func() {
+		for next < len(servers) {
+			cl, err := s.partDistributor.GetClientByID(servers[next])
+			next++
+			if err != nil {
+				lastErr = fmt.Errorf("failed to get storage client: %w", err)
+				continue
+			}
+
+			if !s.acquire(servers[next-1]) {
+				lastErr = fmt.Errorf("circuit breaker of storage %s is open", servers[next-1])
+				continue
+			}
+
+			attemptCtx, cancel := context.WithCancel(ctx)
+			if s.replicas != nil {
+				s.replicas.Start(attemptCtx, servers[next-1])
+			}
+
+			startAttempt(attemptCtx, cl, req, len(cancels), servers[next-1], results)
+			cancels = append(cancels, cancel)
+			started = append(started, time.Now())
+			attempts = append(attempts, servers[next-1])
+			finished = append(finished, false)
+			running++
+			return
+		}
+	}
+
+	launch()
+
+	var timer <-chan time.Time
+	if next < len(servers) && s.hedgePercentile > 0 {
+		t := time.NewTimer(s.hedgeDelay())
+		defer t.Stop()
+
+		timer = t.C
+	}
+
+	for running > 0 {
+		select {
+		case res := <-results:
+			running--
+			finished[res.idx] = true
+
+			if res.err == nil || errors.Is(res.err, io.EOF) {
+				s.reportResult(ctx, res.server, res.elapsed, nil)
+
+				// the results of losers are never read
+				for i, cancel := range cancels {
+					if !finished[i] {
+						cancel()
+						s.release(attempts[i])
+					}
+				}
+
+				if res.err == nil {
+					s.latencies.add(res.elapsed)
+					s.observeLatencies(res, attempts, started)
+				}
+
+				return &hedgedStream{
+					ServerStreamingClient: res.stream,
+					first:                 res.first,
+					firstErr:              res.err,
+					cancel:                cancels[res.idx],
+				}, nil
+			}
+
+			cancels[res.idx]()
+			lastErr = res.err
+			s.reportResult(ctx, res.server, res.elapsed, res.err)
+
+			// attempts abandoned with ctx are released by their results, no new ones are started
+			if running == 0 && ctx.Err() == nil {
+				launch()
+			}
+		case <-timer:
+			timer = nil
+
+			s.logger.Debug().Int32("part", req.Part).Msg("hedging part download")
+			launch()
+		}
+	}
+
+	return nil, lastErr
+}
+
+func (s *Service) hedgeDelay() time.Duration {
+	if d, ok := s.latencies.percentile(s.hedgePercentile); ok {
+		return d
+	}
+
+	return s.hedgeInitialDelay
+}
+
+// observeLatencies feeds the read selector with the latency of the winning attempt. Attempts that lost the
+// race or failed are slower than the time they have been running, which is recorded for them, so a stalled
+// replica isn't preferred again just because it never answered.
+func (s *Service) observeLatencies(winner attemptResult, attempts []string, started []time.Time) {
+	if s.replicas == nil {
+		return
+	}
+
+	s.replicas.Observe(winner.server, winner.elapsed)
+
+	for i, startTime := range started {
+		if i != winner.idx {
+			s.replicas.Observe(attempts[i], time.Since(startTime))
+		}
+	}
+}
+
+func startAttempt(
+	ctx context.Context,
+	client proto.StorageClient,
+	req *proto.DownloadRequest,
+	idx int,
+	server string,
+	results chan<- attemptResult,
+) {
+	go func() {
+		startTime := time.Now()
+
+		res := attemptResult{idx: idx, server: server}
+
+		res.stream, res.err = client.Download(ctx, req)
+		if res.err == nil {
+			res.first, res.err = res.stream.Recv()
+		}
+		res.elapsed = time.Since(startTime)
+
+		results <- res
+	}()
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow     = 1024
+	latencyMinSamples = 32
+)
+
+// latencyTracker keeps a sliding window of time-to-first-chunk samples.
+type latencyTracker struct {
+	samples []time.Duration
+	next    int
+	mu      sync.Mutex
+}
+
+func (l *latencyTracker) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of collected samples and
+// false if there are not enough samples yet.
+func (l *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	sorted := slices.Clone(l.samples)
+	l.mu.Unlock()
+
+	if len(sorted) < latencyMinSamples {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	idx = max(0, min(idx, len(sorted)-1))
+
+	return sorted[idx], true
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		samples: make([]time.Duration, 0, latencyWindow),
+	}
+}
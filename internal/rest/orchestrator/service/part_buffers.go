@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBudget bounds the memory held by part buffers of all uploads of the process.
+type memoryBudget struct {
+	mu      sync.Mutex
+	used    int64
+	limit   int64
+	changed chan struct{}
+}
+
+// newMemoryBudget returns a budget of limit bytes, nil (unlimited) if limit is not positive.
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &memoryBudget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// clamp caps n to the whole budget, so a part bigger than the budget is still uploaded, just alone.
+func (b *memoryBudget) clamp(n int64) int64 {
+	if b == nil {
+		return n
+	}
+
+	return min(n, b.limit)
+}
+
+// tryReserve reserves n bytes if they are free.
+func (b *memoryBudget) tryReserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	ok, _ := b.tryReserveOrWait(b.clamp(n))
+	return ok
+}
+
+// reserve waits until n bytes are free and reserves them.
+func (b *memoryBudget) reserve(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+
+	n = b.clamp(n)
+	for {
+		ok, changed := b.tryReserveOrWait(n)
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+}
+
+func (b *memoryBudget) tryReserveOrWait(n int64) (bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used+n > b.limit {
+		return false, b.changed
+	}
+
+	b.used += n
+	return true, nil
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= b.clamp(n)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// partBuffers is a bounded ring of reusable part buffers. Buffers are allocated lazily,
+// so small uploads don't pay for the whole ring, and only while the process-wide budget allows.
+type partBuffers struct {
+	free      chan []byte
+	allocated int
+	limit     int
+	size      int
+	budget    *memoryBudget
+}
+
+// acquire returns a free buffer or allocates a new one. An upload that already holds a buffer
+// waits for it rather than for the budget, so uploads never wait on each other while holding memory.
+func (b *partBuffers) acquire(ctx context.Context) ([]byte, error) {
+	select {
+	case buf := <-b.free:
+		return buf, nil
+	default:
+	}
+
+	if b.allocated < b.limit {
+		if b.allocated == 0 {
+			if err := b.budget.reserve(ctx, int64(b.size)); err != nil {
+				return nil, err
+			}
+			b.allocated++
+			return make([]byte, b.size), nil
+		}
+
+		if b.budget.tryReserve(int64(b.size)) {
+			b.allocated++
+			return make([]byte, b.size), nil
+		}
+	}
+
+	select {
+	case buf := <-b.free:
+		return buf, nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+func (b *partBuffers) release(buf []byte) {
+	b.free <- buf[:cap(buf)]
+}
+
+// close waits until all buffers are released and returns their memory to the budget. The uploads
+// still holding buffers must be finished or canceled.
+func (b *partBuffers) close() {
+	for range b.allocated {
+		<-b.free
+		b.budget.release(int64(b.size))
+	}
+
+	b.allocated = 0
+}
+
+func newPartBuffers(limit, size int, budget *memoryBudget) *partBuffers {
+	return &partBuffers{
+		free:   make(chan []byte, limit),
+		limit:  limit,
+		size:   size,
+		budget: budget,
+	}
+}
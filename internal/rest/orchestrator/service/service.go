@@ -1,10 +1,16 @@
 package service
 
 import (
+	"time"
+
 	"github.com/rs/zerolog"
 
+	"github.com/theoptz/basic-s3/internal/rest/cache"
 	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/health"
 	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/pruner"
+	"github.com/theoptz/basic-s3/internal/rest/replica"
 )
 
 type Service struct {
@@ -12,19 +18,59 @@ type Service struct {
 	partDistributor distributor.Distributor
 	logger          zerolog.Logger
 
-	chunkSize int
+	chunkSize         int
+	uploadConcurrency int
+	uploadMemory      *memoryBudget
+
+	latencies         *latencyTracker
+	hedgePercentile   float64
+	hedgeInitialDelay time.Duration
+
+	cache              cache.Cache
+	cacheMaxObjectSize int
+
+	health   *health.Tracker
+	replicas *replica.Selector
+
+	bucketClasses map[string]string
+
+	maxVersions       int
+	bucketMaxVersions map[string]int
+	pruner            *pruner.Pruner
 }
 
 func New(
 	metaClient meta.Meta,
 	partDistributor distributor.Distributor,
 	logger zerolog.Logger,
-	chunkSize int,
+	cfg Config,
 ) *Service {
+	uploadConcurrency := cfg.UploadConcurrency
+	if uploadConcurrency <= 0 {
+		uploadConcurrency = 1
+	}
+
 	return &Service{
-		metaClient:      metaClient,
-		partDistributor: partDistributor,
-		logger:          logger,
-		chunkSize:       chunkSize,
+		metaClient:        metaClient,
+		partDistributor:   partDistributor,
+		logger:            logger,
+		chunkSize:         cfg.ChunkSize,
+		uploadConcurrency: uploadConcurrency,
+		uploadMemory:      newMemoryBudget(cfg.UploadMemory),
+		latencies:         newLatencyTracker(),
+		hedgePercentile:   cfg.HedgePercentile,
+		hedgeInitialDelay: cfg.HedgeDelay,
+
+		cache:              cfg.Cache,
+		cacheMaxObjectSize: cfg.CacheMaxObjectSize,
+
+		health:   cfg.Health,
+		replicas: cfg.Replicas,
+
+		bucketClasses: cfg.BucketClasses,
+
+		maxVersions:       cfg.MaxVersions,
+		bucketMaxVersions: cfg.BucketMaxVersions,
+		pruner:            cfg.Pruner,
 	}
 }
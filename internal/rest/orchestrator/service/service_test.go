@@ -0,0 +1,120 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
+	"github.com/theoptz/basic-s3/internal/storage/filestorage"
+	"github.com/theoptz/basic-s3/internal/storage/server"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testDistributor struct {
+	clients  []proto.StorageClient
+	partSize int
+	replicas int
+}
+
+func (d *testDistributor) GetPlan(req *distributor.PlanRequest) ([][]string, int) {
+	parts := req.FileSize / d.partSize
+	if req.FileSize%d.partSize != 0 {
+		parts++
+	}
+
+	res := make([][]string, parts)
+	for i := range res {
+		for r := 0; r < max(d.replicas, 1); r++ {
+			res[i] = append(res[i], testNodeID((i+r)%len(d.clients)))
+		}
+	}
+
+	return res, d.partSize
+}
+
+func (d *testDistributor) GetClientByID(id string) (proto.StorageClient, error) {
+	for i := range d.clients {
+		if testNodeID(i) == id {
+			return d.clients[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("client %s not found", id)
+}
+
+func testNodeID(i int) string {
+	return fmt.Sprintf("node-%02d", i)
+}
+
+func startStorages(t *testing.T, n int) []proto.StorageClient {
+	t.Helper()
+
+	clients := make([]proto.StorageClient, n)
+	for i := range clients {
+		clients[i] = startStorage(t)
+	}
+
+	return clients
+}
+
+func startStorage(t *testing.T, opts ...grpc.ServerOption) proto.StorageClient {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer(opts...)
+	proto.RegisterStorageServer(srv, server.New("", filestorage.New(t.TempDir()), zerolog.Nop()))
+
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return proto.NewStorageClient(conn)
+}
+
+func newTestService(t *testing.T, d *testDistributor, cfg Config) *Service {
+	t.Helper()
+
+	metaStorage, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	return New(metaStorage, d, zerolog.Nop(), cfg)
+}
+
+func download(t *testing.T, s *Service, bucket, key string) []byte {
+	t.Helper()
+
+	_, streamWriter, err := s.Download(context.Background(), &orchestrator.DownloadRequest{
+		Bucket: bucket,
+		Key:    key,
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	wr := bufio.NewWriter(&buf)
+	streamWriter(wr)
+	require.NoError(t, wr.Flush())
+
+	return buf.Bytes()
+}
@@ -102,6 +102,15 @@ func (s *streamReader) setNextStream() error {
 	return nil
 }
 
+// Close closes the stream of the current part if it can be closed, so a download stopped midway releases it.
+func (s *streamReader) Close() error {
+	if closer, ok := s.stream.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
 func newStreamReader(getStreamForPart getServerStreamFunc, totalParts int, logger zerolog.Logger) *streamReader {
 	return &streamReader{
 		buf:              bytes.NewBuffer(make([]byte, 0, chunkSize)),
@@ -12,7 +12,7 @@ type streamInfo struct {
 	Version  int
 	Part     int
 	Size     int
-	ClientID int
+	ClientID string
 }
 
 type streamWriter struct {
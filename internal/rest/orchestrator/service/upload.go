@@ -1,15 +1,22 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 
 	"google.golang.org/grpc"
 
+	"github.com/theoptz/basic-s3/internal/rest/common"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
 	"github.com/theoptz/basic-s3/internal/rest/meta"
 	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
 	"github.com/theoptz/basic-s3/proto"
@@ -19,16 +26,33 @@ const (
 	chunkSize = 8 * 1024
 )
 
+type partUpload struct {
+	info     streamInfo
+	servers  []string
+	size     int64
+	checksum string
+	done     chan error
+}
+
 func (s *Service) Upload(ctx context.Context, req *orchestrator.UploadRequest, body io.Reader) (err error) {
 	metaFile := &meta.File{
 		Bucket: req.Bucket,
 		Key:    req.Key,
 	}
 
-	fv, err := s.metaClient.NewVersion(ctx, metaFile, req.ContentType)
+	storageClass, err := s.storageClass(req)
+	if err != nil {
+		return err
+	}
+
+	fv, err := s.metaClient.NewVersion(ctx, metaFile, &meta.FileVersion{
+		ContentType:  req.ContentType,
+		StorageClass: storageClass,
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create meta file version: %w", err)
 	}
+	s.pruneVersions(ctx, metaFile)
 	defer func() {
 		var status meta.Status = meta.StatusReady
 		if err != nil {
@@ -40,62 +64,237 @@ func (s *Service) Upload(ctx context.Context, req *orchestrator.UploadRequest, b
 			Status:  status,
 		}); updErr != nil {
 			err = multierror.Append(err, updErr)
+		} else if status == meta.StatusReady && s.cache != nil {
+			s.cache.Invalidate(req.Bucket, req.Key)
 		}
 	}()
 
 	totalLength := req.ContentLength
-	clientIds, partSize := s.partDistributor.GetPlan(req.ContentLength)
-	totalParts := len(clientIds)
+	plan, partSize := s.partDistributor.GetPlan(&distributor.PlanRequest{
+		Bucket:   req.Bucket,
+		Key:      req.Key,
+		Version:  fv.Version,
+		FileSize: req.ContentLength,
+
+		StorageClass: storageClass,
+	})
+	totalParts := len(plan)
+	if totalParts == 0 {
+		return fmt.Errorf("failed to plan upload: no storage available")
+	}
 
 	diff := totalLength - partSize*totalParts
 	firstPartSize := partSize + diff
 
-	var total, n int64
+	pipeCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	concurrency := min(s.uploadConcurrency, totalParts)
+	buffers := newPartBuffers(concurrency, max(partSize, firstPartSize), s.uploadMemory)
+	pending := make(chan *partUpload, concurrency)
+
+	commitDone := make(chan int64)
+	go func() {
+		commitDone <- s.commitParts(pipeCtx, cancel, metaFile, fv, pending)
+	}()
+
+	readErr := s.readParts(pipeCtx, req, fv, body, buffers, pending, plan, partSize, firstPartSize)
+	if readErr != nil {
+		cancel(readErr)
+	}
+	close(pending)
+
+	total := <-commitDone
+	buffers.close()
+
+	if err = context.Cause(pipeCtx); err != nil {
+		return err
+	}
+
+	s.logger.Debug().Str("bucket", req.Bucket).
+		Str("key", req.Key).Int("version", fv.Version).Int64("size", total).Msg("file uploaded")
+
+	return nil
+}
+
+// pruneVersions deletes the oldest versions of the file beyond the limit of its bucket and queues their
+// parts for deletion. Failures don't fail the upload, the versions are pruned by the next one.
+func (s *Service) pruneVersions(ctx context.Context, f *meta.File) {
+	keep := s.maxVersions
+	if n, ok := s.bucketMaxVersions[f.Bucket]; ok {
+		keep = n
+	}
+
+	if keep <= 0 {
+		return
+	}
+
+	versions, err := s.metaClient.PruneVersions(ctx, f, keep)
+	if err != nil {
+		s.logger.Warn().Err(err).Str("bucket", f.Bucket).Str("key", f.Key).Msg("failed to prune versions")
+		return
+	}
+
+	if len(versions) > 0 && s.pruner != nil {
+		s.pruner.Enqueue(*f, versions)
+	}
+}
+
+// storageClass returns the class of the upload, falling back to the class of the bucket.
+func (s *Service) storageClass(req *orchestrator.UploadRequest) (string, error) {
+	storageClass := req.StorageClass
+	if storageClass == "" {
+		storageClass = s.bucketClasses[req.Bucket]
+	}
 
-	part := -1
+	if router, ok := s.partDistributor.(distributor.ClassRouter); ok && storageClass != "" {
+		if _, found := router.ForClass(storageClass); !found {
+			return "", fmt.Errorf("%w: unknown storage class %s", common.ErrBadRequest, storageClass)
+		}
+	}
 
-	for i := 0; i < totalParts; i++ {
-		part++
+	return storageClass, nil
+}
 
-		var curPartSize int
+// readParts reads the body part by part into free buffers and starts an upload for each of them.
+// It blocks while all buffers are in flight or the memory budget of uploads is spent.
+func (s *Service) readParts(
+	ctx context.Context,
+	req *orchestrator.UploadRequest,
+	fv *meta.FileVersion,
+	body io.Reader,
+	buffers *partBuffers,
+	pending chan<- *partUpload,
+	plan [][]string,
+	partSize, firstPartSize int,
+) error {
+	for i := 0; i < len(plan); i++ {
+		curPartSize := partSize
 		if i == 0 {
 			curPartSize = firstPartSize
-		} else {
-			curPartSize = partSize
 		}
 
-		n, err = s.uploadPart(
-			ctx,
-			streamInfo{
-				Bucket:   req.Bucket,
-				Key:      req.Key,
-				Version:  fv.Version,
-				Part:     part,
-				Size:     curPartSize,
-				ClientID: clientIds[i],
+		buf, err := buffers.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		buf = buf[:curPartSize]
+		if _, err = io.ReadFull(body, buf); err != nil {
+			buffers.release(buf)
+			return fmt.Errorf("failed to read part %d: %w", i, err)
+		}
+
+		pu := &partUpload{
+			info: streamInfo{
+				Bucket:  req.Bucket,
+				Key:     req.Key,
+				Version: fv.Version,
+				Part:    i,
+				Size:    curPartSize,
 			},
-			body,
-		)
-		total += n
+			servers: plan[i],
+			done:    make(chan error, 1),
+		}
 
-		if err != nil {
-			return fmt.Errorf("failed to upload part: %w", err)
+		go func() {
+			defer buffers.release(buf)
+
+			sum := sha256.Sum256(buf)
+			pu.checksum = hex.EncodeToString(sum[:])
+
+			var uploadErr error
+			pu.size, uploadErr = s.uploadReplicas(ctx, pu.info, pu.servers, buf)
+			pu.done <- uploadErr
+		}()
+
+		select {
+		case pending <- pu:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+
+	return nil
+}
+
+// commitParts waits for the uploads in the order they were started and saves them to meta, so parts
+// are always committed sequentially even though they are uploaded concurrently.
+func (s *Service) commitParts(
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	metaFile *meta.File,
+	fv *meta.FileVersion,
+	pending <-chan *partUpload,
+) int64 {
+	var total int64
+	failed := false
+
+	for pu := range pending {
+		err := <-pu.done
+		if failed {
+			continue
+		}
+
+		if err == nil {
+			err = s.metaClient.NewPart(ctx, metaFile, fv, &meta.Part{
+				Index:    pu.info.Part,
+				Servers:  pu.servers,
+				Size:     pu.size,
+				Checksum: pu.checksum,
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to save meta for part %d: %w", pu.info.Part, err)
+			}
+		} else {
+			err = fmt.Errorf("failed to upload part: %w", err)
 		}
 
-		if err = s.metaClient.NewPart(ctx, metaFile, fv, &meta.Part{
-			Index:   part,
-			Servers: []int{clientIds[i]},
-		}); err != nil {
-			return fmt.Errorf("failed to save meta for part %d: %w", part, err)
+		if err != nil {
+			failed = true
+			cancel(err)
+			continue
 		}
 
-		s.logger.Debug().Int("part", part).Int64("size", n).Msg("part uploaded")
+		total += pu.size
+		s.logger.Debug().Int("part", pu.info.Part).Int64("size", pu.size).Msg("part uploaded")
 	}
 
-	s.logger.Debug().Str("bucket", req.Bucket).
-		Str("key", req.Key).Int("version", fv.Version).Int64("size", total).Msg("file uploaded")
+	return total
+}
 
-	return nil
+// uploadReplicas uploads the part to all servers concurrently. The part is uploaded only if every
+// replica is written.
+func (s *Service) uploadReplicas(ctx context.Context, info streamInfo, servers []string, buf []byte) (int64, error) {
+	sizes := make([]int64, len(servers))
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+	for i, id := range servers {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			replica := info
+			replica.ClientID = id
+			sizes[i], errs[i] = s.uploadPart(ctx, replica, bytes.NewReader(buf))
+		}()
+	}
+
+	wg.Wait()
+
+	var err error
+	for i := range errs {
+		if errs[i] != nil {
+			err = multierror.Append(err, fmt.Errorf("replica %s: %w", servers[i], errs[i]))
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return sizes[0], nil
 }
 
 func (s *Service) uploadPart(ctx context.Context, info streamInfo, body io.Reader) (n int64, err error) {
@@ -106,6 +305,15 @@ func (s *Service) uploadPart(ctx context.Context, info streamInfo, body io.Reade
 		return 0, fmt.Errorf("failed to get storage client: %w", err)
 	}
 
+	if !s.acquire(info.ClientID) {
+		return 0, fmt.Errorf("circuit breaker of storage %s is open", info.ClientID)
+	}
+
+	startTime := time.Now()
+	defer func() {
+		s.reportResult(ctx, info.ClientID, time.Since(startTime), err)
+	}()
+
 	stream, err = storageClient.Upload(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to start stream: %w", err)
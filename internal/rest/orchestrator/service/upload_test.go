@@ -0,0 +1,320 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
+	"github.com/theoptz/basic-s3/internal/rest/pruner"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+func TestService_Upload(t *testing.T) {
+	const bucket = "bucket"
+
+	clients := startStorages(t, 3)
+
+	tests := []struct {
+		name        string
+		size        int
+		partSize    int
+		concurrency int
+		replicas    int
+		bodySize    int
+		wantErr     assert.ErrorAssertionFunc
+	}{
+		{
+			name:        "single part",
+			size:        1000,
+			partSize:    4096,
+			concurrency: 4,
+			bodySize:    1000,
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "sequential",
+			size:        100_000,
+			partSize:    16 * 1024,
+			concurrency: 1,
+			bodySize:    100_000,
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "concurrent",
+			size:        1_000_000,
+			partSize:    64 * 1024,
+			concurrency: 4,
+			bodySize:    1_000_000,
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "more workers than parts",
+			size:        50_000,
+			partSize:    20_000,
+			concurrency: 16,
+			bodySize:    50_000,
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "replicated",
+			size:        100_000,
+			partSize:    16 * 1024,
+			concurrency: 4,
+			replicas:    3,
+			bodySize:    100_000,
+			wantErr:     assert.NoError,
+		},
+		{
+			name:        "body shorter than content length",
+			size:        100_000,
+			partSize:    16 * 1024,
+			concurrency: 4,
+			bodySize:    50_000,
+			wantErr:     assert.Error,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &testDistributor{clients: clients, partSize: tt.partSize, replicas: tt.replicas}
+			s := newTestService(t, d, Config{
+				ChunkSize:         chunkSize,
+				UploadConcurrency: tt.concurrency,
+			})
+
+			data := make([]byte, tt.bodySize)
+			_, _ = rand.Read(data)
+
+			err := s.Upload(context.Background(), &orchestrator.UploadRequest{
+				Bucket:        bucket,
+				Key:           tt.name,
+				ContentLength: tt.size,
+				ContentType:   "application/octet-stream",
+			}, bytes.NewReader(data))
+			if !tt.wantErr(t, err) || err != nil {
+				return
+			}
+
+			require.Equal(t, data, download(t, s, bucket, tt.name))
+
+			fv, err := s.metaClient.GetVersion(context.Background(), &meta.File{Bucket: bucket, Key: tt.name})
+			require.NoError(t, err)
+			for _, part := range fv.Parts {
+				assert.Len(t, part.Servers, max(tt.replicas, 1))
+			}
+		})
+	}
+}
+
+// partRecorder records the order parts are committed in.
+type partRecorder struct {
+	meta.Meta
+
+	mu    sync.Mutex
+	parts []int
+}
+
+func (m *partRecorder) NewPart(ctx context.Context, f *meta.File, fv *meta.FileVersion, p *meta.Part) error {
+	m.mu.Lock()
+	m.parts = append(m.parts, p.Index)
+	m.mu.Unlock()
+
+	return m.Meta.NewPart(ctx, f, fv, p)
+}
+
+func slowUploads(delay time.Duration) grpc.ServerOption {
+	return grpc.ChainStreamInterceptor(func(
+		srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		if info.FullMethod == proto.Storage_Upload_FullMethodName {
+			time.Sleep(delay)
+		}
+
+		return handler(srv, ss)
+	})
+}
+
+func TestService_Upload_CommitOrder(t *testing.T) {
+	const (
+		bucket   = "bucket"
+		key      = "key"
+		partSize = 16 * 1024
+		parts    = 4
+	)
+
+	// part 0 is placed on the slow node and finishes after the others
+	clients := []proto.StorageClient{startStorage(t, slowUploads(200*time.Millisecond))}
+	clients = append(clients, startStorages(t, parts-1)...)
+
+	metaStorage, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	recorder := &partRecorder{Meta: metaStorage}
+	s := New(recorder, &testDistributor{clients: clients, partSize: partSize}, zerolog.Nop(), Config{
+		ChunkSize:         chunkSize,
+		UploadConcurrency: parts,
+	})
+
+	data := make([]byte, partSize*parts)
+	_, _ = rand.Read(data)
+
+	require.NoError(t, s.Upload(context.Background(), &orchestrator.UploadRequest{
+		Bucket:        bucket,
+		Key:           key,
+		ContentLength: len(data),
+	}, bytes.NewReader(data)))
+
+	assert.Equal(t, []int{0, 1, 2, 3}, recorder.parts)
+
+	fv, err := metaStorage.GetVersion(context.Background(), &meta.File{Bucket: bucket, Key: key})
+	require.NoError(t, err)
+	for i, part := range fv.Parts {
+		assert.Equal(t, i, part.Index)
+	}
+	require.Equal(t, data, download(t, s, bucket, key))
+}
+
+func TestService_Upload_MaxVersions(t *testing.T) {
+	ctx := context.Background()
+	clients := startStorages(t, 2)
+	d := &testDistributor{clients: clients, partSize: 1000}
+	versionPruner := pruner.New(d, pruner.Config{}, zerolog.Nop())
+	s := newTestService(t, d, Config{
+		ChunkSize:         chunkSize,
+		UploadConcurrency: 1,
+		MaxVersions:       3,
+		BucketMaxVersions: map[string]int{"archive": 0},
+		Pruner:            versionPruner,
+	})
+
+	var data []byte
+	for _, bucket := range []string{"bucket", "archive"} {
+		for range 5 {
+			data = make([]byte, 2000)
+			_, _ = rand.Read(data)
+
+			require.NoError(t, s.Upload(ctx, &orchestrator.UploadRequest{
+				Bucket:        bucket,
+				Key:           "key",
+				ContentLength: len(data),
+			}, bytes.NewReader(data)))
+		}
+	}
+
+	versions := make(map[string][]int)
+	require.NoError(t, s.metaClient.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		versions[f.Bucket] = append(versions[f.Bucket], fv.Version)
+		return nil
+	}))
+	assert.Equal(t, []int{2, 3, 4}, versions["bucket"])
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, versions["archive"], "the bucket keeps all versions")
+	assert.Equal(t, 2, versionPruner.Stats().Pending)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go versionPruner.Run(runCtx)
+
+	require.Eventually(t, func() bool {
+		return versionPruner.Stats().Versions == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stats := versionPruner.Stats()
+	assert.Zero(t, stats.Pending)
+	assert.Equal(t, 4, stats.Parts)
+	assert.Zero(t, stats.Failed)
+
+	_, err := clients[0].Stat(ctx, &proto.StatRequest{Bucket: "bucket", Key: "key", Version: 0, Part: 0})
+	assert.Equal(t, codes.NotFound, status.Code(err), "parts of pruned versions are deleted")
+	_, err = clients[0].Stat(ctx, &proto.StatRequest{Bucket: "bucket", Key: "key", Version: 2, Part: 0})
+	require.NoError(t, err)
+
+	assert.Equal(t, data, download(t, s, "archive", "key"))
+}
+
+func TestService_Upload_MemoryBudget(t *testing.T) {
+	const (
+		bucket   = "bucket"
+		partSize = 16 * 1024
+		uploads  = 4
+	)
+
+	clients := []proto.StorageClient{startStorage(t, slowUploads(20*time.Millisecond))}
+	clients = append(clients, startStorages(t, 3)...)
+
+	// the budget fits two parts, every upload would use four buffers without it
+	s := newTestService(t, &testDistributor{clients: clients, partSize: partSize}, Config{
+		ChunkSize:         chunkSize,
+		UploadConcurrency: 4,
+		UploadMemory:      2 * partSize,
+	})
+
+	data := make([][]byte, uploads)
+	var wg sync.WaitGroup
+	for i := range uploads {
+		data[i] = make([]byte, partSize*8)
+		_, _ = rand.Read(data[i])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			assert.NoError(t, s.Upload(context.Background(), &orchestrator.UploadRequest{
+				Bucket:        bucket,
+				Key:           fmt.Sprint(i),
+				ContentLength: len(data[i]),
+			}, bytes.NewReader(data[i])))
+		}()
+	}
+	wg.Wait()
+
+	for i := range uploads {
+		assert.Equal(t, data[i], download(t, s, bucket, fmt.Sprint(i)))
+	}
+	assert.Zero(t, s.uploadMemory.used, "buffers are returned to the budget")
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+
+	require.NoError(t, b.reserve(context.Background(), 60))
+	assert.False(t, b.tryReserve(60))
+	assert.True(t, b.tryReserve(40))
+
+	reserved := make(chan error, 1)
+	go func() {
+		reserved <- b.reserve(context.Background(), 500)
+	}()
+
+	select {
+	case <-reserved:
+		t.Fatal("reserved while the budget is spent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.release(60)
+	b.release(40)
+	require.NoError(t, <-reserved, "a part bigger than the budget takes all of it")
+	assert.Equal(t, int64(100), b.used)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, b.reserve(ctx, 1), context.Canceled)
+
+	var unlimited *memoryBudget
+	assert.True(t, unlimited.tryReserve(1<<40))
+}
@@ -12,6 +12,8 @@ type UploadRequest struct {
 	Key           string
 	ContentLength int
 	ContentType   string
+	// StorageClass is empty for the class of the bucket.
+	StorageClass string
 }
 
 type DownloadRequest struct {
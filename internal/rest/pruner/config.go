@@ -0,0 +1,15 @@
+package pruner
+
+import "time"
+
+type Config struct {
+	// DeleteDelay is how long parts of a pruned version are kept, so downloads that have already read
+	// the version from meta can finish.
+	DeleteDelay time.Duration
+	// QueueSize limits versions waiting for deletion. Parts of versions pruned while the queue is full
+	// are left on the nodes for fsck to find as orphaned.
+	QueueSize int
+	// QueueFile keeps versions waiting for DeleteDelay across restarts, empty - parts of versions
+	// pending on shutdown are left for fsck.
+	QueueFile string
+}
@@ -0,0 +1,260 @@
+package pruner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+const DefaultQueueSize = 10000
+
+// Stats counts pruned versions: Pending wait for their delay, Dropped didn't fit into the queue.
+type Stats struct {
+	Pending   int    `json:"pending"`
+	Versions  int    `json:"versions"`
+	Parts     int    `json:"parts"`
+	Failed    int    `json:"failed"`
+	Dropped   int    `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// pending is a pruned version whose parts are deleted once At has passed.
+type pending struct {
+	At      time.Time        `json:"at"`
+	File    meta.File        `json:"file"`
+	Version meta.FileVersion `json:"version"`
+}
+
+// Pruner deletes parts of versions pruned from meta after DeleteDelay. With QueueFile the queue survives
+// restarts, otherwise parts of versions queued before a restart are left for fsck.
+type Pruner struct {
+	clients distributor.Distributor
+	cfg     Config
+	logger  zerolog.Logger
+
+	wake chan struct{}
+	now  func() time.Time
+
+	mu sync.Mutex
+	// queued versions in the order they are due
+	queue []pending
+	stats Stats
+}
+
+func New(d distributor.Distributor, cfg Config, logger zerolog.Logger) *Pruner {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+
+	p := &Pruner{
+		clients: d,
+		cfg:     cfg,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		now:     time.Now,
+	}
+
+	if err := p.load(); err != nil {
+		logger.Error().Err(err).Str("file", cfg.QueueFile).
+			Msg("failed to load the prune queue, parts of pruned versions are left for fsck")
+	}
+
+	return p
+}
+
+// Enqueue schedules deletion of the parts of the pruned versions. It never blocks, versions that don't
+// fit into the queue are dropped.
+func (p *Pruner) Enqueue(f meta.File, versions []meta.FileVersion) {
+	at := p.now().Add(p.cfg.DeleteDelay)
+
+	p.mu.Lock()
+	for _, fv := range versions {
+		if len(p.queue) >= p.cfg.QueueSize {
+			p.stats.Dropped++
+			p.logger.Warn().Str("file", f.String()).Int("version", fv.Version).
+				Msg("prune queue is full, parts are left orphaned")
+
+			continue
+		}
+
+		p.queue = append(p.queue, pending{At: at, File: f, Version: fv})
+	}
+	p.save()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run deletes queued parts as their delay passes until ctx is done. Versions still queued then stay
+// in QueueFile.
+func (p *Pruner) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+
+		if p.flush(ctx) != nil {
+			return
+		}
+
+		p.mu.Lock()
+		next := time.Hour
+		if len(p.queue) > 0 {
+			next = max(p.queue[0].At.Sub(p.now()), 0)
+		}
+		p.mu.Unlock()
+
+		timer.Reset(next)
+	}
+}
+
+// flush deletes parts of the versions whose delay has passed. A version is removed from the queue only
+// once its parts are deleted, so a crash in between deletes them again on start.
+func (p *Pruner) flush(ctx context.Context) error {
+	p.mu.Lock()
+	now := p.now()
+	due := 0
+	for due < len(p.queue) && !p.queue[due].At.After(now) {
+		due++
+	}
+	items := slices.Clone(p.queue[:due])
+	p.mu.Unlock()
+
+	for _, item := range items {
+		p.deleteParts(ctx, item)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		// only flush removes from the queue, the deleted version is still its head
+		p.queue = p.queue[1:]
+		p.save()
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (p *Pruner) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Pending = len(p.queue)
+	return stats
+}
+
+// deleteParts removes every replica of the version's parts. Failures leave orphaned parts and are only
+// counted and logged.
+func (p *Pruner) deleteParts(ctx context.Context, item pending) {
+	var deleted, failed int
+	var lastErr error
+
+	for _, part := range item.Version.Parts {
+		for _, id := range part.Servers {
+			if err := p.deletePart(ctx, id, item, part.Index); err != nil {
+				failed++
+				lastErr = err
+				p.logger.Warn().Err(err).Str("node", id).Str("file", item.File.String()).
+					Int("version", item.Version.Version).Int("part", part.Index).Msg("failed to delete pruned part")
+
+				continue
+			}
+
+			deleted++
+		}
+	}
+
+	p.updateStats(func(s *Stats) {
+		s.Versions++
+		s.Parts += deleted
+		s.Failed += failed
+		if lastErr != nil {
+			s.LastError = lastErr.Error()
+		}
+	})
+}
+
+func (p *Pruner) deletePart(ctx context.Context, id string, item pending, part int) error {
+	cl, err := p.clients.GetClientByID(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = cl.Delete(ctx, &proto.DeleteRequest{
+		Bucket:  item.File.Bucket,
+		Key:     item.File.Key,
+		Version: int32(item.Version.Version),
+		Part:    int32(part),
+	})
+	if err != nil {
+		return fmt.Errorf("delete from %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (p *Pruner) updateStats(fn func(*Stats)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fn(&p.stats)
+}
+
+func (p *Pruner) load() error {
+	if p.cfg.QueueFile == "" {
+		return nil
+	}
+
+	by, err := os.ReadFile(p.cfg.QueueFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if err = json.Unmarshal(by, &p.queue); err != nil {
+		return fmt.Errorf("failed to unmarshal file: %w", err)
+	}
+
+	return nil
+}
+
+// save writes the queue to QueueFile. A failure is only logged: the versions are already pruned from
+// meta, and parts that are lost from the queue are left for fsck. Must be called with p.mu held.
+func (p *Pruner) save() {
+	if p.cfg.QueueFile == "" {
+		return
+	}
+
+	by, err := json.Marshal(p.queue)
+	if err == nil {
+		err = atomicfile.WriteFile(p.cfg.QueueFile, by)
+	}
+	if err != nil {
+		p.logger.Error().Err(err).Str("file", p.cfg.QueueFile).Msg("failed to save the prune queue")
+	}
+}
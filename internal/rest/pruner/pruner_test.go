@@ -0,0 +1,101 @@
+package pruner
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type noNodes struct{}
+
+func (noNodes) GetPlan(*distributor.PlanRequest) ([][]string, int) {
+	return nil, 0
+}
+
+func (noNodes) GetClientByID(id string) (proto.StorageClient, error) {
+	return nil, errors.New("unknown node " + id)
+}
+
+func TestPruner(t *testing.T) {
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	versions := []meta.FileVersion{
+		{Version: 0, Parts: []meta.Part{{Index: 0, Servers: []string{"a", "b"}}}},
+		{Version: 1},
+	}
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		pending  int
+		versions int
+		failed   int
+	}{
+		{
+			name:     "deleted",
+			cfg:      Config{QueueSize: 1},
+			versions: 1,
+			failed:   2,
+		},
+		{
+			name:    "delayed",
+			cfg:     Config{QueueSize: 1, DeleteDelay: time.Hour},
+			pending: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New(noNodes{}, tt.cfg, zerolog.Nop())
+
+			p.Enqueue(f, versions)
+			assert.Equal(t, 1, p.Stats().Pending)
+			assert.Equal(t, 1, p.Stats().Dropped, "versions beyond the queue are dropped")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			p.Run(ctx)
+
+			stats := p.Stats()
+			assert.Equal(t, tt.pending, stats.Pending)
+			assert.Equal(t, tt.versions, stats.Versions)
+			assert.Equal(t, tt.failed, stats.Failed)
+			if tt.failed > 0 {
+				require.Contains(t, stats.LastError, "unknown node")
+			}
+		})
+	}
+}
+
+func TestPruner_QueueFile(t *testing.T) {
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	cfg := Config{DeleteDelay: time.Hour, QueueFile: filepath.Join(t.TempDir(), "queue.json")}
+
+	p := New(noNodes{}, cfg, zerolog.Nop())
+	p.Enqueue(f, []meta.FileVersion{{Version: 0, Parts: []meta.Part{{Index: 0, Servers: []string{"a"}}}}})
+	require.Equal(t, 1, p.Stats().Pending)
+
+	// the version queued before the restart is deleted once its delay passes
+	restarted := New(noNodes{}, cfg, zerolog.Nop())
+	assert.Equal(t, 1, restarted.Stats().Pending)
+	restarted.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	restarted.Run(ctx)
+
+	stats := restarted.Stats()
+	assert.Zero(t, stats.Pending)
+	assert.Equal(t, 1, stats.Versions)
+	assert.Equal(t, 1, stats.Failed)
+
+	assert.Zero(t, New(noNodes{}, cfg, zerolog.Nop()).Stats().Pending, "deleted versions are removed from the file")
+}
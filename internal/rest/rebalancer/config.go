@@ -0,0 +1,25 @@
+package rebalancer
+
+import "time"
+
+type Config struct {
+	// Interval between runs, 0 - runs only on demand.
+	Interval time.Duration
+	// BytesPerSecond limits the transfer rate, 0 - unlimited.
+	BytesPerSecond  int64
+	TransferTimeout time.Duration
+	// DeleteDelay is how long source copies are kept after a move, so downloads that have already
+	// read the old servers from meta can finish.
+	DeleteDelay time.Duration
+	// DeleteQueueFile keeps source copies waiting for DeleteDelay across restarts, empty - copies
+	// pending on shutdown are left for fsck.
+	DeleteQueueFile string
+	// DrainRetryInterval between evacuation passes while a draining node still has parts.
+	DrainRetryInterval time.Duration
+	// StuckUploadAge after which a loading version is taken for an abandoned upload whose parts don't
+	// keep a draining node from being removed, 0 - never.
+	StuckUploadAge time.Duration
+	// TierInterval between tiering passes, 0 - runs only on demand.
+	TierInterval time.Duration
+	TierRules    []TierRule
+}
@@ -0,0 +1,235 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// pendingDelete is a part's source copies left after a move, deleted once At has passed.
+type pendingDelete struct {
+	At      time.Time `json:"at"`
+	File    meta.File `json:"file"`
+	Version int       `json:"version"`
+	Part    int       `json:"part"`
+	Servers []string  `json:"servers"`
+}
+
+// deleteLater schedules deletion of the copies on servers that are not in target.
+func (r *Rebalancer) deleteLater(ref partRef, servers, target []string) {
+	var extra []string
+	for _, id := range servers {
+		if !slices.Contains(target, id) {
+			extra = append(extra, id)
+		}
+	}
+
+	if len(extra) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	r.pending = append(r.pending, pendingDelete{
+		At:      r.now().Add(r.cfg.DeleteDelay),
+		File:    ref.file,
+		Version: ref.version,
+		Part:    ref.part,
+		Servers: extra,
+	})
+	r.saveDeletes()
+	r.mu.Unlock()
+
+	select {
+	case r.deleteWake <- struct{}{}:
+	default:
+	}
+}
+
+// runDeletes deletes source copies as their delay passes until ctx is done. Copies still pending
+// then stay in the queue file.
+func (r *Rebalancer) runDeletes(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.deleteWake:
+		case <-timer.C:
+		}
+
+		if err := r.flushDeletes(ctx); err != nil {
+			r.logger.Warn().Err(err).Msg("failed to delete source copies, retrying later")
+			timer.Reset(deleteRetryInterval)
+			continue
+		}
+
+		r.mu.Lock()
+		next := time.Hour
+		if len(r.pending) > 0 {
+			next = max(r.pending[0].At.Sub(r.now()), 0)
+		}
+		r.mu.Unlock()
+
+		timer.Reset(next)
+	}
+}
+
+// deleteRetryInterval is how long runDeletes waits after meta couldn't be read.
+const deleteRetryInterval = time.Minute
+
+// flushDeletes deletes source copies whose delay has passed. Copies on nodes meta lists for the part
+// again, e.g. after a cancelled drain moved it back, are dropped from the queue without deleting them.
+// Copies are removed from the queue only once deleted, so a crash in between deletes them again on start.
+func (r *Rebalancer) flushDeletes(ctx context.Context) error {
+	r.mu.Lock()
+	now := r.now()
+	due := slices.Clone(r.pending[:countDue(r.pending, now)])
+	r.mu.Unlock()
+
+	if len(due) == 0 {
+		return nil
+	}
+
+	refs := make([]partRef, len(due))
+	for i, p := range due {
+		refs[i] = partRef{file: p.File, version: p.Version, part: p.Part}
+	}
+
+	live, err := r.liveServers(ctx, refs)
+	if err != nil {
+		return err
+	}
+
+	for i, p := range due {
+		r.deleteCopies(ctx, refs[i], unreferenced(p.Servers, live[refs[i].key()]))
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		r.mu.Lock()
+		// only flushDeletes removes from the queue, the deleted copies are still its head
+		r.pending = r.pending[1:]
+		r.saveDeletes()
+		r.mu.Unlock()
+	}
+
+	return nil
+}
+
+func countDue(pending []pendingDelete, now time.Time) int {
+	for i, p := range pending {
+		if p.At.After(now) {
+			return i
+		}
+	}
+
+	return len(pending)
+}
+
+// partKey identifies a part regardless of its storage class.
+type partKey struct {
+	file    meta.File
+	version int
+	part    int
+}
+
+func (ref partRef) key() partKey {
+	return partKey{file: ref.file, version: ref.version, part: ref.part}
+}
+
+// liveServers reads the servers meta lists for each of the parts in one walk. Parts of deleted versions
+// have none.
+func (r *Rebalancer) liveServers(ctx context.Context, refs []partRef) (map[partKey][]string, error) {
+	res := make(map[partKey][]string, len(refs))
+	for _, ref := range refs {
+		res[ref.key()] = nil
+	}
+
+	err := r.meta.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		for _, part := range fv.Parts {
+			key := partKey{file: f, version: fv.Version, part: part.Index}
+			if _, ok := res[key]; ok {
+				res[key] = part.Servers
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read part servers: %w", err)
+	}
+
+	return res, nil
+}
+
+// deleteUnreferenced deletes the copies of each part on copied[i] that meta doesn't list for refs[i].
+// It is used after a failed meta update, which may have been applied anyway or raced with another
+// update, e.g. an fsck repair, that made some of the copies live. If meta can't be read, the copies
+// are left for fsck.
+func (r *Rebalancer) deleteUnreferenced(ctx context.Context, refs []partRef, copied [][]string) {
+	if !slices.ContainsFunc(copied, func(servers []string) bool { return len(servers) > 0 }) {
+		return
+	}
+
+	live, err := r.liveServers(ctx, refs)
+	if err != nil {
+		r.logger.Warn().Err(err).Msg("failed to clean up part copies, they are left for fsck")
+		return
+	}
+
+	for i, ref := range refs {
+		r.deleteCopies(ctx, ref, unreferenced(copied[i], live[ref.key()]))
+	}
+}
+
+// unreferenced returns the servers that are not in live.
+func unreferenced(servers, live []string) []string {
+	return slices.DeleteFunc(slices.Clone(servers), func(id string) bool {
+		return slices.Contains(live, id)
+	})
+}
+
+func (r *Rebalancer) loadDeletes() error {
+	if r.cfg.DeleteQueueFile == "" {
+		return nil
+	}
+
+	by, err := os.ReadFile(r.cfg.DeleteQueueFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if err = json.Unmarshal(by, &r.pending); err != nil {
+		return fmt.Errorf("failed to unmarshal file: %w", err)
+	}
+
+	return nil
+}
+
+// saveDeletes writes the queue to DeleteQueueFile. A failure is only logged: the moves are done, and
+// copies that are lost from the queue are left for fsck. Must be called with r.mu held.
+func (r *Rebalancer) saveDeletes() {
+	if r.cfg.DeleteQueueFile == "" {
+		return
+	}
+
+	by, err := json.Marshal(r.pending)
+	if err == nil {
+		err = atomicfile.WriteFile(r.cfg.DeleteQueueFile, by)
+	}
+	if err != nil {
+		r.logger.Error().Err(err).Str("file", r.cfg.DeleteQueueFile).Msg("failed to save pending deletes")
+	}
+}
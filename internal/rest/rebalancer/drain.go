@@ -0,0 +1,205 @@
+package rebalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+type DrainStatus struct {
+	Node       string     `json:"node"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Passes     int        `json:"passes"`
+	Moved      int        `json:"moved"`
+	Bytes      int64      `json:"bytes"`
+	// Remaining is the number of parts still on the node after the last pass, including parts of
+	// versions being uploaded that can only be moved once they are ready.
+	Remaining int `json:"remaining"`
+	// Stuck is the number of parts of versions loading for longer than StuckUploadAge, left by crashed
+	// uploads. They are never moved and don't keep the node from being safe to remove.
+	Stuck        int    `json:"stuck"`
+	Failed       int    `json:"failed"`
+	LastError    string `json:"last_error,omitempty"`
+	SafeToRemove bool   `json:"safe_to_remove"`
+}
+
+// Drain starts evacuating parts from the node. The node must already be drained in the distributor,
+// otherwise new parts keep arriving. Draining a node that is being drained is a no-op.
+func (r *Rebalancer) Drain(id string) {
+	r.mu.Lock()
+	if _, ok := r.drains[id]; !ok {
+		r.drains[id] = &DrainStatus{Node: id, StartedAt: time.Now()}
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.drainTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// CancelDrain stops evacuating the node. Parts that were already moved stay where they are.
+func (r *Rebalancer) CancelDrain(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.drains, id)
+}
+
+func (r *Rebalancer) DrainStatus(id string) (DrainStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st, ok := r.drains[id]
+	if !ok {
+		return DrainStatus{}, false
+	}
+
+	return *st, true
+}
+
+// evacuate moves every ready part off the draining nodes, replacing them with nodes from the distributor.
+// Nodes that were safe to remove are checked again, as parts may have been placed on them since.
+func (r *Rebalancer) evacuate(ctx context.Context) {
+	r.mu.Lock()
+	ids := slices.Collect(maps.Keys(r.drains))
+	r.mu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	results := make(map[string]*DrainStatus, len(ids))
+	for _, id := range ids {
+		results[id] = &DrainStatus{}
+	}
+
+	r.logger.Info().Strs("nodes", ids).Msg("evacuation started")
+
+	err := r.meta.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		if fv.Status != meta.StatusReady && fv.Status != meta.StatusLoading {
+			return nil
+		}
+
+		stuck := r.stuckUpload(fv)
+		for _, part := range fv.Parts {
+			affected := slices.DeleteFunc(slices.Clone(part.Servers), func(id string) bool {
+				return results[id] == nil
+			})
+			if len(affected) == 0 {
+				continue
+			}
+
+			if stuck {
+				for _, id := range affected {
+					results[id].Stuck++
+				}
+
+				continue
+			}
+
+			n, moveErr := r.evacuatePart(ctx, partRef{file: f, version: fv.Version, part: part.Index, class: fv.StorageClass}, fv.Status,
+				part.Servers, affected)
+			for _, id := range affected {
+				res := results[id]
+				switch {
+				case moveErr == nil:
+					res.Moved++
+					res.Bytes += n
+				case errors.Is(moveErr, errNotReady):
+					res.Remaining++
+				default:
+					res.Remaining++
+					res.Failed++
+					res.LastError = moveErr.Error()
+				}
+			}
+		}
+
+		return nil
+	})
+
+	finishedAt := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, res := range results {
+		st, ok := r.drains[id]
+		if !ok {
+			// cancelled during the pass
+			continue
+		}
+
+		st.Passes++
+		st.FinishedAt = &finishedAt
+		st.Moved += res.Moved
+		st.Bytes += res.Bytes
+		st.Remaining = res.Remaining
+		st.Stuck = res.Stuck
+		st.Failed = res.Failed
+		st.LastError = res.LastError
+		if err != nil {
+			st.LastError = err.Error()
+		}
+		st.SafeToRemove = err == nil && res.Remaining == 0
+
+		r.logger.Info().Str("node", id).Int("moved", res.Moved).Int("remaining", res.Remaining).
+			Int("stuck", res.Stuck).Bool("safe_to_remove", st.SafeToRemove).Msg("evacuation pass finished")
+	}
+}
+
+// stuckUpload reports whether the version has been loading for longer than StuckUploadAge. Versions
+// created before their creation time was recorded are that old anyway.
+func (r *Rebalancer) stuckUpload(fv meta.FileVersion) bool {
+	if fv.Status != meta.StatusLoading || r.cfg.StuckUploadAge <= 0 {
+		return false
+	}
+
+	return fv.CreatedAt == nil || r.now().Sub(*fv.CreatedAt) > r.cfg.StuckUploadAge
+}
+
+var errNotReady = errors.New("version is not ready")
+
+func (r *Rebalancer) evacuatePart(
+	ctx context.Context,
+	ref partRef,
+	status meta.Status,
+	servers, affected []string,
+) (int64, error) {
+	if status != meta.StatusReady {
+		return 0, errNotReady
+	}
+
+	picker := r.picker(ref.class)
+	if picker == nil {
+		return 0, errors.New("distributor can't pick replicas")
+	}
+
+	keep := slices.DeleteFunc(slices.Clone(servers), func(id string) bool {
+		return slices.Contains(affected, id)
+	})
+
+	target := slices.Clone(servers)
+	for i, id := range target {
+		if !slices.Contains(affected, id) {
+			continue
+		}
+
+		picked, ok := picker.PickReplica(ref.file.Bucket, ref.file.Key, ref.version, ref.part, keep)
+		if !ok {
+			return 0, fmt.Errorf("no node to move part from %s to", id)
+		}
+
+		target[i] = picked
+		keep = append(keep, picked)
+	}
+
+	return r.movePart(ctx, ref, servers, target)
+}
@@ -0,0 +1,428 @@
+package rebalancer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type Status struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Scanned    int        `json:"scanned"`
+	Misplaced  int        `json:"misplaced"`
+	Moved      int        `json:"moved"`
+	Failed     int        `json:"failed"`
+	Bytes      int64      `json:"bytes"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+type partRef struct {
+	file    meta.File
+	version int
+	part    int
+	class   string
+}
+
+// Rebalancer moves parts to the nodes the distributor places them on: it copies a part node-to-node,
+// switches the part's servers in meta and deletes the source copies after DeleteDelay.
+type Rebalancer struct {
+	meta      meta.Meta
+	clients   distributor.Distributor
+	addresses func(id string) (string, bool)
+	cfg       Config
+	logger    zerolog.Logger
+
+	trigger      chan struct{}
+	drainTrigger chan struct{}
+	tierTrigger  chan struct{}
+	deleteWake   chan struct{}
+	now          func() time.Time
+
+	mu         sync.Mutex
+	status     Status
+	tierStatus Status
+	drains     map[string]*DrainStatus
+	// pending source copies in the order they are due
+	pending []pendingDelete
+}
+
+// New creates a rebalancer for the distributor. Rebalance passes need a distributor.Placer and drains
+// need a distributor.ReplicaPicker, without them passes fail. With a distributor.ClassRouter the
+// distributor of the part's storage class is used.
+func New(
+	m meta.Meta,
+	d distributor.Distributor,
+	addresses func(id string) (string, bool),
+	cfg Config,
+	logger zerolog.Logger,
+) *Rebalancer {
+	r := &Rebalancer{
+		meta:         m,
+		clients:      d,
+		addresses:    addresses,
+		cfg:          cfg,
+		logger:       logger,
+		trigger:      make(chan struct{}, 1),
+		drainTrigger: make(chan struct{}, 1),
+		tierTrigger:  make(chan struct{}, 1),
+		deleteWake:   make(chan struct{}, 1),
+		now:          time.Now,
+		drains:       make(map[string]*DrainStatus),
+	}
+
+	if err := r.loadDeletes(); err != nil {
+		logger.Error().Err(err).Str("file", cfg.DeleteQueueFile).
+			Msg("failed to load pending deletes, source copies are left for fsck")
+	}
+
+	return r
+}
+
+// Run starts a pass every Interval and on Trigger, evacuates draining nodes and moves versions between
+// storage classes by tier rules, until ctx is done. Passes never run concurrently, so a part is only
+// moved by one of them at a time. Source copies are deleted in the background as their delay passes.
+func (r *Rebalancer) Run(ctx context.Context) {
+	go r.runDeletes(ctx)
+
+	var tick <-chan time.Time
+	if r.cfg.Interval > 0 && r.HasPlacement() {
+		ticker := time.NewTicker(r.cfg.Interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	var drainTick <-chan time.Time
+	if r.cfg.DrainRetryInterval > 0 {
+		ticker := time.NewTicker(r.cfg.DrainRetryInterval)
+		defer ticker.Stop()
+
+		drainTick = ticker.C
+	}
+
+	var tierTick <-chan time.Time
+	if r.cfg.TierInterval > 0 && len(r.cfg.TierRules) > 0 {
+		ticker := time.NewTicker(r.cfg.TierInterval)
+		defer ticker.Stop()
+
+		tierTick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			r.run(ctx)
+		case <-r.trigger:
+			r.run(ctx)
+		case <-r.drainTrigger:
+			r.evacuate(ctx)
+		case <-drainTick:
+			r.evacuate(ctx)
+		case <-r.tierTrigger:
+			r.tier(ctx)
+		case <-tierTick:
+			r.tier(ctx)
+		}
+	}
+}
+
+// HasPlacement reports whether rebalance passes can run: they move parts to the placement of a
+// distributor.Placer, and only the rendezvous distributor has a stable one.
+func (r *Rebalancer) HasPlacement() bool {
+	return r.placer("") != nil
+}
+
+// Trigger requests a pass. It returns false if one is already requested.
+func (r *Rebalancer) Trigger() bool {
+	select {
+	case r.trigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Rebalancer) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.status
+}
+
+func (r *Rebalancer) run(ctx context.Context) {
+	startedAt := time.Now()
+	r.updateStatus(func(s *Status) {
+		*s = Status{Running: true, StartedAt: &startedAt}
+	})
+
+	if !r.HasPlacement() {
+		r.updateStatus(func(s *Status) {
+			s.Running = false
+			s.LastError = "distributor has no stable placement"
+		})
+		return
+	}
+
+	r.logger.Info().Msg("rebalance started")
+
+	err := r.meta.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		if fv.Status != meta.StatusReady {
+			return nil
+		}
+
+		for _, part := range fv.Parts {
+			ref := partRef{file: f, version: fv.Version, part: part.Index, class: fv.StorageClass}
+			r.rebalancePart(ctx, ref, part.Servers)
+		}
+
+		return nil
+	})
+
+	finishedAt := time.Now()
+	r.updateStatus(func(s *Status) {
+		s.Running = false
+		s.FinishedAt = &finishedAt
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+
+	status := r.Status()
+	r.logger.Info().Err(err).Int("scanned", status.Scanned).Int("moved", status.Moved).
+		Int("failed", status.Failed).Int64("bytes", status.Bytes).Msg("rebalance finished")
+}
+
+func (r *Rebalancer) rebalancePart(ctx context.Context, ref partRef, servers []string) {
+	r.updateStatus(func(s *Status) { s.Scanned++ })
+
+	placer := r.placer(ref.class)
+	if placer == nil {
+		return
+	}
+
+	target := placer.Place(ref.file.Bucket, ref.file.Key, ref.version, ref.part)
+	// replicas are never dropped, a part is moved only when there are enough nodes for all of them
+	if len(target) == 0 || len(target) < len(servers) || sameNodes(target, servers) {
+		return
+	}
+
+	r.updateStatus(func(s *Status) { s.Misplaced++ })
+
+	n, err := r.movePart(ctx, ref, servers, target)
+	if err != nil {
+		r.logger.Warn().Err(err).Str("file", ref.file.String()).Int("version", ref.version).
+			Int("part", ref.part).Msg("failed to move part")
+	}
+
+	r.updateStatus(func(s *Status) {
+		s.Bytes += n
+		if err != nil {
+			s.Failed++
+			s.LastError = err.Error()
+		} else {
+			s.Moved++
+		}
+	})
+}
+
+// distributorFor returns the distributor that places parts of the storage class, nil for an unknown class.
+func (r *Rebalancer) distributorFor(class string) distributor.Distributor {
+	router, ok := r.clients.(distributor.ClassRouter)
+	if !ok {
+		return r.clients
+	}
+
+	d, ok := router.ForClass(class)
+	if !ok {
+		return nil
+	}
+
+	return d
+}
+
+// replicasOf returns the number of replicas of parts of the storage class, 0 if the distributor doesn't
+// route classes.
+func (r *Rebalancer) replicasOf(class string) int {
+	router, ok := r.clients.(distributor.ClassRouter)
+	if !ok {
+		return 0
+	}
+
+	n, _ := router.Replicas(class)
+	return n
+}
+
+func (r *Rebalancer) placer(class string) distributor.Placer {
+	placer, _ := r.distributorFor(class).(distributor.Placer)
+	return placer
+}
+
+func (r *Rebalancer) picker(class string) distributor.ReplicaPicker {
+	picker, _ := r.distributorFor(class).(distributor.ReplicaPicker)
+	return picker
+}
+
+func (r *Rebalancer) movePart(ctx context.Context, ref partRef, servers, target []string) (int64, error) {
+	total, copied, err := r.copyPart(ctx, ref, servers, target)
+	if err != nil {
+		return total, err
+	}
+
+	if err = r.meta.UpdatePartServers(ctx, &ref.file, ref.version, ref.part, servers, target); err != nil {
+		r.deleteUnreferenced(ctx, []partRef{ref}, [][]string{copied})
+		return total, fmt.Errorf("failed to update meta: %w", err)
+	}
+
+	r.deleteLater(ref, servers, target)
+
+	return total, nil
+}
+
+// copyPart copies the part to the target nodes it is not on yet and returns them. If a copy fails,
+// the copies made so far are deleted.
+func (r *Rebalancer) copyPart(ctx context.Context, ref partRef, servers, target []string) (int64, []string, error) {
+	var total int64
+	var copied []string
+
+	for _, dst := range target {
+		if slices.Contains(servers, dst) {
+			continue
+		}
+
+		n, err := r.transfer(ctx, ref, servers, dst)
+		if err == nil {
+			copied = append(copied, dst)
+			total += n
+			err = r.throttle(ctx, n)
+		}
+		if err != nil {
+			r.deleteCopies(ctx, ref, copied)
+			return total, nil, err
+		}
+	}
+
+	return total, copied, nil
+}
+
+// transfer copies the part to dst from the first source that succeeds.
+func (r *Rebalancer) transfer(ctx context.Context, ref partRef, sources []string, dst string) (int64, error) {
+	address, ok := r.addresses(dst)
+	if !ok {
+		return 0, fmt.Errorf("unknown node %s", dst)
+	}
+
+	var errs error
+	for _, src := range sources {
+		cl, err := r.clients.GetClientByID(src)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		res, err := r.transferFrom(ctx, cl, ref, dst, address)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("transfer from %s to %s: %w", src, dst, err))
+			continue
+		}
+
+		return res.Size, nil
+	}
+
+	return 0, errs
+}
+
+func (r *Rebalancer) transferFrom(
+	ctx context.Context,
+	cl proto.StorageClient,
+	ref partRef,
+	dst, address string,
+) (*proto.TransferResponse, error) {
+	if r.cfg.TransferTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.TransferTimeout)
+		defer cancel()
+	}
+
+	return cl.Transfer(ctx, &proto.TransferRequest{
+		Bucket:   ref.file.Bucket,
+		Key:      ref.file.Key,
+		Version:  int32(ref.version),
+		Part:     int32(ref.part),
+		Target:   address,
+		TargetId: dst,
+	})
+}
+
+// deleteCopies removes the part from the servers. Failures leave orphaned copies and are only logged.
+func (r *Rebalancer) deleteCopies(ctx context.Context, ref partRef, servers []string) {
+	for _, id := range servers {
+		cl, err := r.clients.GetClientByID(id)
+		if err == nil {
+			_, err = cl.Delete(ctx, &proto.DeleteRequest{
+				Bucket:  ref.file.Bucket,
+				Key:     ref.file.Key,
+				Version: int32(ref.version),
+				Part:    int32(ref.part),
+			})
+		}
+
+		if err != nil {
+			r.logger.Warn().Err(err).Str("node", id).Str("file", ref.file.String()).Int("version", ref.version).
+				Int("part", ref.part).Msg("failed to delete part copy")
+		}
+	}
+}
+
+func (r *Rebalancer) throttle(ctx context.Context, n int64) error {
+	if r.cfg.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	return sleep(ctx, time.Duration(n*int64(time.Second)/r.cfg.BytesPerSecond))
+}
+
+func (r *Rebalancer) updateStatus(fn func(*Status)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(&r.status)
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
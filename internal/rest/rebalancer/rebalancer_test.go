@@ -0,0 +1,671 @@
+package rebalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/theoptz/basic-s3/internal/nodeid"
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/meta/inmemory"
+	"github.com/theoptz/basic-s3/internal/storage/filestorage"
+	"github.com/theoptz/basic-s3/internal/storage/server"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type testNode struct {
+	address string
+	client  proto.StorageClient
+}
+
+type testCluster struct {
+	nodes     map[string]testNode
+	placement map[string][]string
+	drained   map[string]bool
+}
+
+func (c *testCluster) GetPlan(*distributor.PlanRequest) ([][]string, int) {
+	return nil, 0
+}
+
+func (c *testCluster) GetClientByID(id string) (proto.StorageClient, error) {
+	n, ok := c.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("client %s not found", id)
+	}
+
+	return n.client, nil
+}
+
+func (c *testCluster) Place(bucket, key string, version, part int) []string {
+	return c.placement[fmt.Sprintf("%s/%s/%d/%d", bucket, key, version, part)]
+}
+
+func (c *testCluster) PickReplica(_, _ string, _, _ int, keep []string) (string, bool) {
+	ids := slices.Sorted(maps.Keys(c.nodes))
+	for _, id := range ids {
+		if !c.drained[id] && !slices.Contains(keep, id) {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+func (c *testCluster) address(id string) (string, bool) {
+	n, ok := c.nodes[id]
+	return n.address, ok
+}
+
+func startCluster(t *testing.T, ids ...string) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		nodes:     make(map[string]testNode, len(ids)),
+		placement: make(map[string][]string),
+		drained:   make(map[string]bool),
+	}
+	for _, id := range ids {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv := grpc.NewServer(
+			grpc.ChainUnaryInterceptor(nodeid.UnaryServerInterceptor(id)),
+			grpc.ChainStreamInterceptor(nodeid.StreamServerInterceptor(id)),
+		)
+		proto.RegisterStorageServer(srv, server.New(id, filestorage.New(t.TempDir()), zerolog.Nop()))
+		go func() {
+			_ = srv.Serve(listener)
+		}()
+		t.Cleanup(srv.Stop)
+
+		conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		c.nodes[id] = testNode{address: listener.Addr().String(), client: proto.NewStorageClient(conn)}
+	}
+
+	return c
+}
+
+func putPart(t *testing.T, cl proto.StorageClient, f meta.File, version, part int, data []byte) {
+	t.Helper()
+
+	stream, err := cl.Upload(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&proto.UploadRequest{
+		Bucket:  f.Bucket,
+		Key:     f.Key,
+		Version: int32(version),
+		Part:    int32(part),
+		Chunk:   data,
+	}))
+	_, err = stream.CloseAndRecv()
+	require.NoError(t, err)
+}
+
+func getPart(cl proto.StorageClient, f meta.File, version, part int) ([]byte, error) {
+	stream, err := cl.Download(context.Background(), &proto.DownloadRequest{
+		Bucket:  f.Bucket,
+		Key:     f.Key,
+		Version: int32(version),
+		Part:    int32(part),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		buf.Write(res.Chunk)
+	}
+}
+
+func TestRebalancer_Run(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	addFile := func(f meta.File, status meta.Status, servers ...[]string) {
+		fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+		require.NoError(t, err)
+
+		for i, ids := range servers {
+			for _, id := range ids {
+				putPart(t, cluster.nodes[id].client, f, fv.Version, i, []byte(fmt.Sprintf("%s-%d", f, i)))
+			}
+			require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: i, Servers: ids}))
+		}
+
+		require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: status}))
+	}
+
+	moved := meta.File{Bucket: "bucket", Key: "moved"}
+	addFile(moved, meta.StatusReady, []string{"a"}, []string{"a", "b"}, []string{"b"})
+
+	failed := meta.File{Bucket: "bucket", Key: "failed"}
+	addFile(failed, meta.StatusError, []string{"a"})
+
+	cluster.placement = map[string][]string{
+		"bucket/moved/0/0":  {"c"},
+		"bucket/moved/0/1":  {"b", "c"},
+		"bucket/moved/0/2":  {"b"},
+		"bucket/failed/0/0": {"c"},
+	}
+
+	cfg := Config{DeleteDelay: time.Minute, DeleteQueueFile: filepath.Join(t.TempDir(), "deletes.json")}
+	r := New(m, cluster, cluster.address, cfg, zerolog.Nop())
+	r.run(ctx)
+
+	status := r.Status()
+	assert.False(t, status.Running)
+	assert.Equal(t, 3, status.Scanned)
+	assert.Equal(t, 2, status.Misplaced)
+	assert.Equal(t, 2, status.Moved)
+	assert.Equal(t, 0, status.Failed)
+	assert.Equal(t, int64(len("bucket/moved-0")+len("bucket/moved-1")), status.Bytes)
+
+	fv, err := m.GetVersion(ctx, &moved)
+	require.NoError(t, err)
+
+	wantServers := [][]string{{"c"}, {"b", "c"}, {"b"}}
+	wantDeleted := [][]string{{"a"}, {"a"}, nil}
+	for i, part := range fv.Parts {
+		assert.Equal(t, wantServers[i], part.Servers)
+
+		for _, id := range part.Servers {
+			data, err := getPart(cluster.nodes[id].client, moved, 0, i)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%s-%d", moved, i), string(data))
+		}
+
+		for _, id := range wantDeleted[i] {
+			_, err = getPart(cluster.nodes[id].client, moved, 0, i)
+			assert.NoError(t, err, "source copy is kept for downloads in progress")
+		}
+	}
+
+	// the second pass has nothing to move
+	r.run(ctx)
+	assert.Equal(t, 0, r.Status().Misplaced)
+
+	// source copies are deleted after a restart
+	r = New(m, cluster, cluster.address, cfg, zerolog.Nop())
+	require.NoError(t, r.flushDeletes(ctx))
+	_, err = getPart(cluster.nodes["a"].client, moved, 0, 0)
+	require.NoError(t, err, "delay has not passed")
+
+	r.now = func() time.Time { return time.Now().Add(cfg.DeleteDelay) }
+	require.NoError(t, r.flushDeletes(ctx))
+	for i := range fv.Parts {
+		for _, id := range wantDeleted[i] {
+			_, err = getPart(cluster.nodes[id].client, moved, 0, i)
+			assert.Error(t, err, "source copy is deleted")
+		}
+	}
+	assert.Empty(t, New(m, cluster, cluster.address, cfg, zerolog.Nop()).pending)
+}
+
+func TestRebalancer_Run_TransferFailed(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["a"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	cluster.placement["bucket/key/0/0"] = []string{"unknown"}
+
+	r := New(m, cluster, cluster.address, Config{}, zerolog.Nop())
+	r.run(ctx)
+
+	status := r.Status()
+	assert.Equal(t, 1, status.Failed)
+	assert.NotEmpty(t, status.LastError)
+
+	fv, err = m.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, fv.Parts[0].Servers)
+
+	data, err := getPart(cluster.nodes["a"].client, f, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestRebalancer_Run_StaleAddress(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["a"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	cluster.placement["bucket/key/0/0"] = []string{"b"}
+
+	// the address of b is now served by c
+	r := New(m, cluster, func(string) (string, bool) { return cluster.nodes["c"].address, true }, Config{}, zerolog.Nop())
+	r.run(ctx)
+
+	status := r.Status()
+	assert.Equal(t, 1, status.Failed)
+	assert.Contains(t, status.LastError, `call for node "b" reached node "c"`)
+
+	_, err = getPart(cluster.nodes["c"].client, f, 0, 0)
+	assert.Error(t, err, "the part is not sent to another node")
+}
+
+func TestRebalancer_FlushDeletes_MovedBack(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "c")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["a"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	r := New(m, cluster, cluster.address, Config{DeleteDelay: time.Minute}, zerolog.Nop())
+
+	cluster.placement["bucket/key/0/0"] = []string{"c"}
+	r.run(ctx)
+
+	// the part moves back before the copy on a is deleted
+	cluster.placement["bucket/key/0/0"] = []string{"a"}
+	r.run(ctx)
+	require.Len(t, r.pending, 2)
+
+	r.now = func() time.Time { return time.Now().Add(time.Minute) }
+	require.NoError(t, r.flushDeletes(ctx))
+	assert.Empty(t, r.pending)
+
+	data, err := getPart(cluster.nodes["a"].client, f, 0, 0)
+	require.NoError(t, err, "the live copy is kept")
+	assert.Equal(t, "data", string(data))
+
+	_, err = getPart(cluster.nodes["c"].client, f, 0, 0)
+	assert.Error(t, err, "the copy moved away from is deleted")
+}
+
+// racingMeta makes another update move the part to the servers first, as an fsck repair may.
+type racingMeta struct {
+	meta.Meta
+}
+
+func (m racingMeta) UpdatePartServers(ctx context.Context, f *meta.File, version, part int, prev, servers []string) error {
+	if err := m.Meta.UpdatePartServers(ctx, f, version, part, prev, servers); err != nil {
+		return err
+	}
+
+	return m.Meta.UpdatePartServers(ctx, f, version, part, prev, servers)
+}
+
+func TestRebalancer_Run_Conflict(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "bucket", Key: "key"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["a"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	cluster.placement["bucket/key/0/0"] = []string{"b"}
+
+	r := New(racingMeta{Meta: m}, cluster, cluster.address, Config{}, zerolog.Nop())
+	r.run(ctx)
+	assert.Equal(t, 1, r.Status().Failed)
+
+	got, err := m.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, got.Parts[0].Servers)
+
+	data, err := getPart(cluster.nodes["b"].client, f, 0, 0)
+	require.NoError(t, err, "the copy meta lists is kept")
+	assert.Equal(t, "data", string(data))
+}
+
+func TestRebalancer_Drain(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c")
+	cluster.drained["a"] = true
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	newFile := func(key string, servers ...[]string) (meta.File, *meta.FileVersion) {
+		f := meta.File{Bucket: "bucket", Key: key}
+		fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+		require.NoError(t, err)
+
+		for i, ids := range servers {
+			for _, id := range ids {
+				putPart(t, cluster.nodes[id].client, f, fv.Version, i, []byte(key))
+			}
+			require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: i, Servers: ids}))
+		}
+
+		return f, fv
+	}
+
+	ready, fv := newFile("ready", []string{"a"}, []string{"a", "b"}, []string{"c"})
+	require.NoError(t, m.UpdateStatus(ctx, &ready, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	uploading, uploadingVersion := newFile("uploading", []string{"a"})
+
+	r := New(m, cluster, cluster.address, Config{}, zerolog.Nop())
+	r.Drain("a")
+	r.evacuate(ctx)
+	require.NoError(t, r.flushDeletes(ctx))
+
+	status, ok := r.DrainStatus("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, status.Passes)
+	assert.Equal(t, 2, status.Moved)
+	assert.Equal(t, 1, status.Remaining, "parts of versions being uploaded are moved later")
+	assert.False(t, status.SafeToRemove)
+
+	got, err := m.GetVersion(ctx, &ready)
+	require.NoError(t, err)
+	assert.Equal(t, []meta.Part{
+		{Index: 0, Servers: []string{"b"}},
+		{Index: 1, Servers: []string{"c", "b"}},
+		{Index: 2, Servers: []string{"c"}},
+	}, got.Parts)
+
+	for i := range 2 {
+		_, err = getPart(cluster.nodes["a"].client, ready, 0, i)
+		assert.Error(t, err, "parts are deleted from the drained node")
+	}
+
+	require.NoError(t, m.UpdateStatus(ctx, &uploading, &meta.FileVersion{
+		Version: uploadingVersion.Version,
+		Status:  meta.StatusReady,
+	}))
+	r.evacuate(ctx)
+
+	status, _ = r.DrainStatus("a")
+	assert.Equal(t, 2, status.Passes)
+	assert.Equal(t, 3, status.Moved)
+	assert.Equal(t, 0, status.Remaining)
+	assert.True(t, status.SafeToRemove)
+
+	// a node that was safe to remove is checked again
+	newFile("late", []string{"a"})
+	r.evacuate(ctx)
+
+	status, _ = r.DrainStatus("a")
+	assert.Equal(t, 3, status.Passes)
+	assert.Equal(t, 1, status.Remaining)
+	assert.False(t, status.SafeToRemove)
+
+	r.CancelDrain("a")
+	_, ok = r.DrainStatus("a")
+	assert.False(t, ok)
+}
+
+func TestRebalancer_Drain_StuckUpload(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b")
+	cluster.drained["a"] = true
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "bucket", Key: "crashed"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["a"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"a"}}))
+
+	r := New(m, cluster, cluster.address, Config{StuckUploadAge: time.Hour}, zerolog.Nop())
+	r.Drain("a")
+	r.evacuate(ctx)
+
+	status, ok := r.DrainStatus("a")
+	require.True(t, ok)
+	assert.Equal(t, 1, status.Remaining, "a recent upload may still finish")
+	assert.Equal(t, 0, status.Stuck)
+	assert.False(t, status.SafeToRemove)
+
+	r.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	r.evacuate(ctx)
+
+	status, _ = r.DrainStatus("a")
+	assert.Equal(t, 0, status.Remaining)
+	assert.Equal(t, 1, status.Stuck)
+	assert.Equal(t, 0, status.Moved, "parts of stuck uploads are not moved")
+	assert.True(t, status.SafeToRemove)
+}
+
+type testClass struct {
+	distributor.Distributor
+	replicas int
+}
+
+type testRouter map[string]testClass
+
+func (r testRouter) GetPlan(*distributor.PlanRequest) ([][]string, int) {
+	return nil, 0
+}
+
+func (r testRouter) GetClientByID(id string) (proto.StorageClient, error) {
+	return r["STANDARD"].GetClientByID(id)
+}
+
+func (r testRouter) ForClass(name string) (distributor.Distributor, bool) {
+	if name == "" {
+		name = "STANDARD"
+	}
+
+	c, ok := r[name]
+	return c.Distributor, ok
+}
+
+func (r testRouter) Replicas(name string) (int, bool) {
+	if name == "" {
+		name = "STANDARD"
+	}
+
+	c, ok := r[name]
+	return c.replicas, ok
+}
+
+// pickerOnly hides the placement of the cluster, so replicas are picked one by one.
+type pickerOnly struct {
+	distributor.Distributor
+	distributor.ReplicaPicker
+}
+
+func TestParseTierRule(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    TierRule
+		wantErr bool
+	}{
+		{s: "logs:30d:COLD", want: TierRule{Bucket: "logs", Age: 30 * 24 * time.Hour, Class: "COLD"}},
+		{s: "*:12h:COLD", want: TierRule{Bucket: AnyBucket, Age: 12 * time.Hour, Class: "COLD"}},
+		{s: "logs:30:COLD", wantErr: true},
+		{s: "logs:30d", wantErr: true},
+		{s: "logs:-1h:COLD", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseTierRule(tt.s)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRebalancer_Tier(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c", "d")
+	cold := &testCluster{nodes: cluster.nodes, placement: map[string][]string{
+		"logs/old/0/0": {"c", "d"},
+		"logs/old/0/1": {"d", "a"},
+	}}
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	addFile := func(f meta.File, servers ...[]string) {
+		fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+		require.NoError(t, err)
+
+		for i, ids := range servers {
+			for _, id := range ids {
+				putPart(t, cluster.nodes[id].client, f, fv.Version, i, []byte(fmt.Sprintf("%s-%d", f, i)))
+			}
+			require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: i, Servers: ids}))
+		}
+
+		require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+	}
+
+	old := meta.File{Bucket: "logs", Key: "old"}
+	addFile(old, []string{"a", "b"}, []string{"a", "b"})
+
+	// buckets without rules of their own use * rules
+	young := meta.File{Bucket: "data", Key: "young"}
+	addFile(young, []string{"a"})
+
+	r := New(m, testRouter{"STANDARD": {Distributor: cluster, replicas: 2}, "COLD": {Distributor: cold, replicas: 2}}, cluster.address, Config{
+		TierRules: []TierRule{
+			{Bucket: "logs", Age: 30 * 24 * time.Hour, Class: "COLD"},
+			{Bucket: AnyBucket, Age: 60 * 24 * time.Hour, Class: "COLD"},
+		},
+	}, zerolog.Nop())
+	r.now = func() time.Time { return time.Now().Add(31 * 24 * time.Hour) }
+
+	r.tier(ctx)
+	require.NoError(t, r.flushDeletes(ctx))
+
+	status := r.TieringStatus()
+	assert.Equal(t, 2, status.Scanned)
+	assert.Equal(t, 1, status.Misplaced)
+	assert.Equal(t, 1, status.Moved)
+	assert.Equal(t, 0, status.Failed)
+
+	fv, err := m.GetVersion(ctx, &old)
+	require.NoError(t, err)
+	assert.Equal(t, "COLD", fv.StorageClass)
+	assert.Equal(t, []meta.Part{
+		{Index: 0, Servers: []string{"c", "d"}},
+		{Index: 1, Servers: []string{"d", "a"}},
+	}, fv.Parts)
+
+	for _, part := range fv.Parts {
+		for _, id := range part.Servers {
+			data, err := getPart(cluster.nodes[id].client, old, 0, part.Index)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%s-%d", old, part.Index), string(data))
+		}
+	}
+
+	for i := range 2 {
+		_, err = getPart(cluster.nodes["b"].client, old, 0, i)
+		assert.Error(t, err, "old copies are deleted")
+	}
+
+	fv, err = m.GetVersion(ctx, &young)
+	require.NoError(t, err)
+	assert.Empty(t, fv.StorageClass)
+	assert.Equal(t, []string{"a"}, fv.Parts[0].Servers)
+
+	// the second pass has nothing to move
+	r.tier(ctx)
+	assert.Equal(t, 0, r.TieringStatus().Misplaced)
+}
+
+func TestRebalancer_Tier_TargetReplicas(t *testing.T) {
+	ctx := context.Background()
+	cluster := startCluster(t, "a", "b", "c")
+
+	m, err := inmemory.New(filepath.Join(t.TempDir(), "meta.json"), inmemory.Config{}, zerolog.Nop())
+	require.NoError(t, err)
+
+	f := meta.File{Bucket: "logs", Key: "old"}
+	fv, err := m.NewVersion(ctx, &f, &meta.FileVersion{ContentType: "text/plain"})
+	require.NoError(t, err)
+	putPart(t, cluster.nodes["c"].client, f, fv.Version, 0, []byte("data"))
+	require.NoError(t, m.NewPart(ctx, &f, fv, &meta.Part{Index: 0, Servers: []string{"c"}}))
+	require.NoError(t, m.UpdateStatus(ctx, &f, &meta.FileVersion{Version: fv.Version, Status: meta.StatusReady}))
+
+	// the source class keeps one replica, the target one two
+	router := testRouter{
+		"STANDARD": {Distributor: cluster, replicas: 1},
+		"COLD":     {Distributor: pickerOnly{Distributor: cluster, ReplicaPicker: cluster}, replicas: 2},
+	}
+	r := New(m, router, cluster.address, Config{
+		TierRules: []TierRule{{Bucket: "logs", Age: time.Hour, Class: "COLD"}},
+	}, zerolog.Nop())
+	r.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	r.tier(ctx)
+	require.NoError(t, r.flushDeletes(ctx))
+	require.Equal(t, 1, r.TieringStatus().Moved)
+
+	got, err := m.GetVersion(ctx, &f)
+	require.NoError(t, err)
+	assert.Equal(t, "COLD", got.StorageClass)
+	assert.Equal(t, []string{"a", "b"}, got.Parts[0].Servers)
+
+	for _, id := range got.Parts[0].Servers {
+		data, err := getPart(cluster.nodes[id].client, f, fv.Version, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	}
+}
@@ -0,0 +1,255 @@
+package rebalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+)
+
+// AnyBucket is the bucket of tier rules applied to buckets without rules of their own.
+const AnyBucket = "*"
+
+// TierRule moves versions of the bucket older than Age to the storage class.
+type TierRule struct {
+	Bucket string
+	Age    time.Duration
+	Class  string
+}
+
+// ParseTierRule parses BUCKET:AGE:CLASS, e.g. logs:30d:COLD. Age is a duration, days may be given as Nd.
+func ParseTierRule(s string) (TierRule, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 || fields[0] == "" || fields[2] == "" {
+		return TierRule{}, fmt.Errorf("invalid tier rule %q", s)
+	}
+
+	var age time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(fields[1], "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		age = time.Duration(n) * 24 * time.Hour
+	} else {
+		age, err = time.ParseDuration(fields[1])
+	}
+	if err != nil || age < 0 {
+		return TierRule{}, fmt.Errorf("invalid age of tier rule %q", s)
+	}
+
+	return TierRule{Bucket: fields[0], Age: age, Class: fields[2]}, nil
+}
+
+// TriggerTiering requests a tiering pass. It returns false if one is already requested.
+func (r *Rebalancer) TriggerTiering() bool {
+	select {
+	case r.tierTrigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Rebalancer) TieringStatus() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.tierStatus
+}
+
+// tierClass returns the class of the oldest rule of the bucket the version has reached.
+func (r *Rebalancer) tierClass(bucket string, age time.Duration) (string, bool) {
+	var rules []TierRule
+	for _, bucketRules := range []string{bucket, AnyBucket} {
+		for _, rule := range r.cfg.TierRules {
+			if rule.Bucket == bucketRules {
+				rules = append(rules, rule)
+			}
+		}
+
+		if len(rules) > 0 {
+			break
+		}
+	}
+
+	var found *TierRule
+	for i, rule := range rules {
+		if rule.Age <= age && (found == nil || rule.Age > found.Age) {
+			found = &rules[i]
+		}
+	}
+
+	if found == nil {
+		return "", false
+	}
+
+	return found.Class, true
+}
+
+// tier moves ready versions whose age has reached a tier rule to the storage class of the rule.
+// Versions created before their creation time was recorded are left where they are.
+func (r *Rebalancer) tier(ctx context.Context) {
+	startedAt := time.Now()
+	r.updateTierStatus(func(s *Status) {
+		*s = Status{Running: true, StartedAt: &startedAt}
+	})
+
+	r.logger.Info().Msg("tiering started")
+
+	err := r.meta.Walk(ctx, func(f meta.File, fv meta.FileVersion) error {
+		if fv.Status != meta.StatusReady || fv.CreatedAt == nil {
+			return nil
+		}
+
+		r.updateTierStatus(func(s *Status) { s.Scanned++ })
+
+		class, ok := r.tierClass(f.Bucket, r.now().Sub(*fv.CreatedAt))
+		if !ok {
+			return nil
+		}
+
+		target := r.distributorFor(class)
+		// the same class, possibly the default one under another name
+		if target != nil && target == r.distributorFor(fv.StorageClass) {
+			return nil
+		}
+
+		r.updateTierStatus(func(s *Status) { s.Misplaced++ })
+
+		n, moveErr := r.tierVersion(ctx, f, fv, class, target)
+		if moveErr != nil {
+			r.logger.Warn().Err(moveErr).Str("file", f.String()).Int("version", fv.Version).
+				Str("class", class).Msg("failed to move version")
+		}
+
+		r.updateTierStatus(func(s *Status) {
+			s.Bytes += n
+			if moveErr != nil {
+				s.Failed++
+				s.LastError = moveErr.Error()
+			} else {
+				s.Moved++
+			}
+		})
+
+		return nil
+	})
+
+	finishedAt := time.Now()
+	r.updateTierStatus(func(s *Status) {
+		s.Running = false
+		s.FinishedAt = &finishedAt
+		if err != nil {
+			s.LastError = err.Error()
+		}
+	})
+
+	status := r.TieringStatus()
+	r.logger.Info().Err(err).Int("scanned", status.Scanned).Int("moved", status.Moved).
+		Int("failed", status.Failed).Int64("bytes", status.Bytes).Msg("tiering finished")
+}
+
+// tierVersion copies all parts of the version to nodes of the class, then switches the version to them
+// in one meta update and deletes the old copies after DeleteDelay, so running downloads can finish.
+func (r *Rebalancer) tierVersion(
+	ctx context.Context,
+	f meta.File,
+	fv meta.FileVersion,
+	class string,
+	target distributor.Distributor,
+) (int64, error) {
+	if target == nil {
+		return 0, fmt.Errorf("unknown storage class %s", class)
+	}
+
+	var total int64
+	refs := make([]partRef, len(fv.Parts))
+	copied := make([][]string, len(fv.Parts))
+	parts := make([]meta.Part, len(fv.Parts))
+
+	cleanup := func() {
+		r.deleteUnreferenced(ctx, refs, copied)
+	}
+
+	replicas := r.replicasOf(class)
+	for i, part := range fv.Parts {
+		refs[i] = partRef{file: f, version: fv.Version, part: part.Index, class: class}
+
+		want := replicas
+		if want == 0 {
+			want = len(part.Servers)
+		}
+
+		servers, err := targetServers(target, refs[i], want)
+		if err != nil {
+			cleanup()
+			return total, err
+		}
+
+		n, c, err := r.copyPart(ctx, refs[i], part.Servers, servers)
+		total += n
+		if err != nil {
+			cleanup()
+			return total, err
+		}
+
+		copied[i] = c
+		parts[i] = meta.Part{Index: part.Index, Servers: servers, Size: part.Size, Checksum: part.Checksum}
+	}
+
+	if err := r.meta.UpdateStorageClass(ctx, &f, fv.Version, fv.Parts, class, parts); err != nil {
+		cleanup()
+		return total, fmt.Errorf("failed to update meta: %w", err)
+	}
+
+	for i, part := range fv.Parts {
+		r.deleteLater(refs[i], part.Servers, parts[i].Servers)
+	}
+
+	return total, nil
+}
+
+// targetServers returns where the part lives in the distributor: its placement if it is stable, or n
+// nodes picked for it otherwise.
+func targetServers(d distributor.Distributor, ref partRef, n int) ([]string, error) {
+	if placer, ok := d.(distributor.Placer); ok {
+		if servers := placer.Place(ref.file.Bucket, ref.file.Key, ref.version, ref.part); len(servers) > 0 {
+			return servers, nil
+		}
+
+		return nil, fmt.Errorf("no nodes in storage class %s", ref.class)
+	}
+
+	picker, ok := d.(distributor.ReplicaPicker)
+	if !ok {
+		return nil, errors.New("distributor can't pick replicas")
+	}
+
+	var servers []string
+	for range n {
+		id, found := picker.PickReplica(ref.file.Bucket, ref.file.Key, ref.version, ref.part, servers)
+		if !found {
+			break
+		}
+
+		servers = append(servers, id)
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no nodes in storage class %s", ref.class)
+	}
+
+	return servers, nil
+}
+
+func (r *Rebalancer) updateTierStatus(fn func(*Status)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fn(&r.tierStatus)
+}
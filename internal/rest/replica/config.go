@@ -0,0 +1,22 @@
+package replica
+
+type Policy string
+
+const (
+	// PolicyRandom reads from a random replica.
+	PolicyRandom Policy = "random"
+	// PolicyLeastOutstanding prefers the replica with the fewest downloads in flight from this node.
+	PolicyLeastOutstanding Policy = "least-outstanding"
+	// PolicyEWMA prefers the replica with the lowest moving average of time to first chunk.
+	PolicyEWMA Policy = "ewma"
+	// PolicySameZone prefers replicas in the zone of this node and then the lowest EWMA latency.
+	PolicySameZone Policy = "same-zone"
+)
+
+type Config struct {
+	Policy Policy
+	// Zone is the zone of this node, used by PolicySameZone.
+	Zone string
+	// Shuffle reorders replicas before they are sorted by the policy, nil - random order.
+	Shuffle func(servers []string)
+}
@@ -0,0 +1,184 @@
+package replica
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const latencyAlpha = 0.2
+
+type NodeStats struct {
+	ID          string  `json:"id"`
+	Outstanding int     `json:"outstanding"`
+	LatencyMs   float64 `json:"latency_ms"`
+	Samples     uint64  `json:"samples"`
+}
+
+type node struct {
+	outstanding int
+	latency     time.Duration
+	samples     uint64
+}
+
+// Selector orders replicas of a part for reading. It is fed with downloads started by the orchestrator and
+// their time to first chunk.
+type Selector struct {
+	policy  Policy
+	zone    string
+	zoneOf  func(id string) string
+	shuffle func(servers []string)
+
+	nodes map[string]*node
+	mu    sync.Mutex
+}
+
+// New creates a selector, zoneOf returns the zone of a storage node and is only used by PolicySameZone.
+func New(cfg Config, zoneOf func(id string) string) (*Selector, error) {
+	switch cfg.Policy {
+	case "":
+		cfg.Policy = PolicyRandom
+	case PolicyRandom, PolicyLeastOutstanding, PolicyEWMA:
+	case PolicySameZone:
+		if cfg.Zone == "" || zoneOf == nil {
+			return nil, fmt.Errorf("policy %s requires the zone of this node", cfg.Policy)
+		}
+	default:
+		return nil, fmt.Errorf("unknown read policy %q", cfg.Policy)
+	}
+
+	if cfg.Shuffle == nil {
+		cfg.Shuffle = shuffle
+	}
+
+	return &Selector{
+		policy:  cfg.Policy,
+		zone:    cfg.Zone,
+		zoneOf:  zoneOf,
+		shuffle: cfg.Shuffle,
+		nodes:   make(map[string]*node),
+	}, nil
+}
+
+func shuffle(servers []string) {
+	rand.Shuffle(len(servers), func(a, b int) {
+		servers[a], servers[b] = servers[b], servers[a]
+	})
+}
+
+// Order sorts servers in place, the preferred replica first. Replicas the policy can't tell apart are
+// shuffled, so the load is spread between them.
+func (s *Selector) Order(servers []string) {
+	s.shuffle(servers)
+
+	if s.policy == PolicyRandom || len(servers) < 2 {
+		return
+	}
+
+	type key struct {
+		otherZone   bool
+		outstanding int
+		latency     time.Duration
+	}
+
+	keys := make(map[string]key, len(servers))
+
+	s.mu.Lock()
+	for _, id := range servers {
+		var k key
+		if n, ok := s.nodes[id]; ok {
+			k.outstanding, k.latency = n.outstanding, n.latency
+		}
+		keys[id] = k
+	}
+	s.mu.Unlock()
+
+	if s.policy == PolicySameZone {
+		for _, id := range servers {
+			k := keys[id]
+			k.otherZone = s.zoneOf(id) != s.zone
+			keys[id] = k
+		}
+	}
+
+	slices.SortStableFunc(servers, func(a, b string) int {
+		ka, kb := keys[a], keys[b]
+
+		switch s.policy {
+		case PolicyLeastOutstanding:
+			return cmp.Compare(ka.outstanding, kb.outstanding)
+		case PolicySameZone:
+			if ka.otherZone != kb.otherZone {
+				if ka.otherZone {
+					return 1
+				}
+				return -1
+			}
+		}
+
+		return cmp.Compare(ka.latency, kb.latency)
+	})
+}
+
+// Start registers a download from the node. It is counted as outstanding until ctx is done.
+func (s *Selector) Start(ctx context.Context, id string) {
+	s.mu.Lock()
+	s.get(id).outstanding++
+	s.mu.Unlock()
+
+	context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		s.get(id).outstanding--
+		s.mu.Unlock()
+	})
+}
+
+// Observe adds a time to first chunk sample of the node to its moving average.
+func (s *Selector) Observe(id string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.get(id)
+	if n.samples == 0 {
+		n.latency = latency
+	} else {
+		n.latency = time.Duration(latencyAlpha*float64(latency) + (1-latencyAlpha)*float64(n.latency))
+	}
+	n.samples++
+}
+
+func (s *Selector) Snapshot() []NodeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]NodeStats, 0, len(s.nodes))
+	for id, n := range s.nodes {
+		res = append(res, NodeStats{
+			ID:          id,
+			Outstanding: n.outstanding,
+			LatencyMs:   float64(n.latency) / float64(time.Millisecond),
+			Samples:     n.samples,
+		})
+	}
+
+	slices.SortFunc(res, func(a, b NodeStats) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return res
+}
+
+func (s *Selector) get(id string) *node {
+	n, ok := s.nodes[id]
+	if !ok {
+		n = &node{}
+		s.nodes[id] = n
+	}
+
+	return n
+}
@@ -0,0 +1,114 @@
+package replica
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelector_Order(t *testing.T) {
+	zones := map[string]string{"a": "z1", "b": "z2", "c": "z2"}
+
+	tests := []struct {
+		name        string
+		policy      Policy
+		latencies   map[string]time.Duration
+		outstanding map[string]int
+		wantFirst   []string
+	}{
+		{
+			name:      "ewma prefers the fastest replica",
+			policy:    PolicyEWMA,
+			latencies: map[string]time.Duration{"a": 50 * time.Millisecond, "b": 5 * time.Millisecond, "c": 20 * time.Millisecond},
+			wantFirst: []string{"b"},
+		},
+		{
+			name:      "ewma tries replicas without samples",
+			policy:    PolicyEWMA,
+			latencies: map[string]time.Duration{"a": 50 * time.Millisecond, "b": 5 * time.Millisecond},
+			wantFirst: []string{"c"},
+		},
+		{
+			name:        "least outstanding",
+			policy:      PolicyLeastOutstanding,
+			outstanding: map[string]int{"a": 3, "b": 1, "c": 1},
+			wantFirst:   []string{"b", "c"},
+		},
+		{
+			name:      "same zone before latency",
+			policy:    PolicySameZone,
+			latencies: map[string]time.Duration{"a": 50 * time.Millisecond, "b": 5 * time.Millisecond, "c": 20 * time.Millisecond},
+			wantFirst: []string{"a"},
+		},
+		{
+			name:      "random",
+			policy:    PolicyRandom,
+			latencies: map[string]time.Duration{"a": 50 * time.Millisecond, "b": 5 * time.Millisecond, "c": 20 * time.Millisecond},
+			wantFirst: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := New(Config{Policy: tt.policy, Zone: "z1"}, func(id string) string { return zones[id] })
+			require.NoError(t, err)
+
+			for id, latency := range tt.latencies {
+				s.Observe(id, latency)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			for id, n := range tt.outstanding {
+				for range n {
+					s.Start(ctx, id)
+				}
+			}
+
+			first := make(map[string]bool)
+			for range 100 {
+				servers := []string{"a", "b", "c"}
+				s.Order(servers)
+				assert.ElementsMatch(t, []string{"a", "b", "c"}, servers)
+
+				first[servers[0]] = true
+			}
+
+			got := make([]string, 0, len(first))
+			for id := range first {
+				got = append(got, id)
+			}
+			assert.ElementsMatch(t, tt.wantFirst, got)
+		})
+	}
+}
+
+func TestSelector_Start(t *testing.T) {
+	s, err := New(Config{Policy: PolicyLeastOutstanding}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx, "a")
+	s.Start(context.Background(), "a")
+	s.Observe("a", 10*time.Millisecond)
+	s.Observe("a", 20*time.Millisecond)
+
+	assert.Equal(t, []NodeStats{{ID: "a", Outstanding: 2, LatencyMs: 12, Samples: 2}}, s.Snapshot())
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		return s.Snapshot()[0].Outstanding == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{Policy: PolicySameZone}, nil)
+	assert.Error(t, err, "same-zone requires a zone")
+
+	_, err = New(Config{Policy: "fastest"}, nil)
+	assert.Error(t, err)
+}
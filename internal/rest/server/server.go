@@ -1,35 +1,119 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/gofiber/fiber/v3/middleware/recover"
 	"github.com/rs/zerolog"
 
+	"github.com/theoptz/basic-s3/internal/rest/cache"
+	"github.com/theoptz/basic-s3/internal/rest/capacity"
 	"github.com/theoptz/basic-s3/internal/rest/common"
 	"github.com/theoptz/basic-s3/internal/rest/config"
+	"github.com/theoptz/basic-s3/internal/rest/fsck"
+	"github.com/theoptz/basic-s3/internal/rest/health"
+	"github.com/theoptz/basic-s3/internal/rest/membership"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
 	"github.com/theoptz/basic-s3/internal/rest/orchestrator"
+	"github.com/theoptz/basic-s3/internal/rest/pruner"
+	"github.com/theoptz/basic-s3/internal/rest/rebalancer"
+	"github.com/theoptz/basic-s3/internal/rest/replica"
+	"github.com/theoptz/basic-s3/internal/rest/topology"
 )
 
 const (
 	defaultShutdownTimeout = 15 * time.Second
 	defaultConcurrency     = 1000
 	defaultBodyLimit       = 1 * 1024 * 1024
+	// eventsHeartbeat keeps idle event streams open through proxies and detects closed connections.
+	eventsHeartbeat = 15 * time.Second
 )
 
 type Server struct {
 	endpoint string
+	// adminToken is the bearer token required by /_admin routes, empty - the routes are not served.
+	adminToken string
 
 	app *fiber.App
 	cfg fiber.Config
 
-	service orchestrator.Orchestrator
-	logger  zerolog.Logger
+	service   orchestrator.Orchestrator
+	cache     cache.Cache
+	health    *health.Tracker
+	capacity  *capacity.Monitor
+	members   *membership.Manager
+	rebalance *rebalancer.Rebalancer
+	fsck      *fsck.Checker
+	pruner    *pruner.Pruner
+	replicas  *replica.Selector
+	watcher   meta.Watcher
+	logger    zerolog.Logger
+}
+
+type Option func(*Server)
+
+func WithCache(c cache.Cache) Option {
+	return func(s *Server) {
+		s.cache = c
+	}
+}
+
+func WithHealth(h *health.Tracker) Option {
+	return func(s *Server) {
+		s.health = h
+	}
+}
+
+func WithCapacity(m *capacity.Monitor) Option {
+	return func(s *Server) {
+		s.capacity = m
+	}
+}
+
+func WithMembership(m *membership.Manager) Option {
+	return func(s *Server) {
+		s.members = m
+	}
+}
+
+func WithRebalancer(r *rebalancer.Rebalancer) Option {
+	return func(s *Server) {
+		s.rebalance = r
+	}
+}
+
+func WithFsck(c *fsck.Checker) Option {
+	return func(s *Server) {
+		s.fsck = c
+	}
+}
+
+func WithPruner(p *pruner.Pruner) Option {
+	return func(s *Server) {
+		s.pruner = p
+	}
+}
+
+func WithReplicaSelector(r *replica.Selector) Option {
+	return func(s *Server) {
+		s.replicas = r
+	}
+}
+
+func WithWatcher(w meta.Watcher) Option {
+	return func(s *Server) {
+		s.watcher = w
+	}
 }
 
 func (s *Server) Listen() error {
@@ -37,12 +121,71 @@ func (s *Server) Listen() error {
 
 	s.app.Use(recover.New())
 
+	if s.adminToken != "" {
+		s.registerAdmin(s.app.Group("/_admin", s.requireAdminToken))
+	} else {
+		s.logger.Warn().Msg("admin API is disabled, set ADMIN_TOKEN to enable it")
+	}
+
 	s.app.Put("/:bucket/:key", s.handleUpload)
 	s.app.Get("/:bucket/:key", s.handleDownload)
 
 	return s.app.Listen(s.endpoint)
 }
 
+// registerAdmin adds the admin routes of the configured components. They change the node set and delete
+// data, so they are only served with a token.
+func (s *Server) registerAdmin(admin fiber.Router) {
+	if s.cache != nil {
+		admin.Get("/cache/stats", s.handleCacheStats)
+	}
+	if s.health != nil {
+		admin.Get("/nodes/health", s.handleNodesHealth)
+	}
+	if s.capacity != nil {
+		admin.Get("/nodes/capacity", s.handleNodesCapacity)
+	}
+	if s.replicas != nil {
+		admin.Get("/nodes/reads", s.handleNodesReads)
+	}
+	if s.members != nil {
+		admin.Get("/nodes", s.handleNodesList)
+		admin.Put("/nodes/:id", s.handleNodePut)
+		admin.Delete("/nodes/:id", s.handleNodeDelete)
+		admin.Post("/nodes/:id/heartbeat", s.handleNodeHeartbeat)
+	}
+	if s.rebalance != nil {
+		admin.Get("/rebalance", s.handleRebalanceStatus)
+		admin.Post("/rebalance", s.handleRebalanceStart)
+		admin.Get("/tiering", s.handleTieringStatus)
+		admin.Post("/tiering", s.handleTieringStart)
+	}
+	if s.fsck != nil {
+		admin.Get("/fsck", s.handleFsckReport)
+		admin.Post("/fsck", s.handleFsckStart)
+	}
+	if s.pruner != nil {
+		admin.Get("/versions/prune", s.handlePruneStats)
+	}
+	if s.watcher != nil {
+		admin.Get("/meta/events", s.handleMetaEvents)
+	}
+	if s.members != nil && s.rebalance != nil {
+		admin.Post("/nodes/:id/drain", s.handleNodeDrain)
+		admin.Get("/nodes/:id/drain", s.handleNodeDrainStatus)
+		admin.Delete("/nodes/:id/drain", s.handleNodeDrainCancel)
+	}
+}
+
+func (s *Server) requireAdminToken(ctx fiber.Ctx) error {
+	token, ok := strings.CutPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		return fiber.ErrUnauthorized
+	}
+
+	return ctx.Next()
+}
+
 func (s *Server) Shutdown() error {
 	if s.app != nil {
 		return s.app.ShutdownWithTimeout(defaultShutdownTimeout)
@@ -51,7 +194,7 @@ func (s *Server) Shutdown() error {
 	return nil
 }
 
-func New(cfg config.Config, service orchestrator.Orchestrator, logger zerolog.Logger) *Server {
+func New(cfg config.Config, service orchestrator.Orchestrator, logger zerolog.Logger, opts ...Option) *Server {
 	conf := getDefaultConfig()
 	if cfg.MaxConnections != 0 {
 		conf.Concurrency = cfg.MaxConnections
@@ -62,12 +205,19 @@ func New(cfg config.Config, service orchestrator.Orchestrator, logger zerolog.Lo
 
 	conf.ErrorHandler = makeErrorHandler(logger)
 
-	return &Server{
-		endpoint: fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
-		cfg:      conf,
-		service:  service,
-		logger:   logger,
+	s := &Server{
+		endpoint:   fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		adminToken: cfg.AdminToken,
+		cfg:        conf,
+		service:    service,
+		logger:     logger,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
 }
 
 func (s *Server) handleUpload(ctx fiber.Ctx) (err error) {
@@ -90,6 +240,7 @@ func (s *Server) handleUpload(ctx fiber.Ctx) (err error) {
 			Key:           key,
 			ContentLength: contentLength,
 			ContentType:   ctx.Get("Content-Type", "text/plain"),
+			StorageClass:  ctx.Get("x-amz-storage-class"),
 		},
 		ctx.Context().RequestBodyStream(),
 	)
@@ -121,6 +272,257 @@ func (s *Server) handleDownload(ctx fiber.Ctx) error {
 	return nil
 }
 
+func (s *Server) handleCacheStats(ctx fiber.Ctx) error {
+	return ctx.JSON(s.cache.Stats())
+}
+
+func (s *Server) handleNodesHealth(ctx fiber.Ctx) error {
+	return ctx.JSON(s.health.Snapshot())
+}
+
+func (s *Server) handleNodesCapacity(ctx fiber.Ctx) error {
+	return ctx.JSON(s.capacity.Snapshot())
+}
+
+func (s *Server) handleNodesReads(ctx fiber.Ctx) error {
+	return ctx.JSON(s.replicas.Snapshot())
+}
+
+func (s *Server) handleNodesList(ctx fiber.Ctx) error {
+	return ctx.JSON(s.members.Status())
+}
+
+func (s *Server) handleNodePut(ctx fiber.Ctx) error {
+	var req struct {
+		topology.Node
+		// Drain is only changed when it is given.
+		Drain *bool `json:"drain"`
+	}
+	if err := json.Unmarshal(ctx.Body(), &req); err != nil {
+		return fmt.Errorf("%w: invalid node: %w", common.ErrBadRequest, err)
+	}
+
+	node := req.Node
+	node.ID = ctx.Params("id")
+	node.Drain = req.Drain != nil && *req.Drain
+
+	if err := s.members.Put(ctx.Context(), node); err != nil {
+		return fmt.Errorf("failed to put node: %w", err)
+	}
+
+	if req.Drain != nil {
+		if err := s.setDrain(ctx.Context(), node.ID, *req.Drain); err != nil {
+			return fmt.Errorf("failed to change drain: %w", err)
+		}
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+func (s *Server) handleNodeDelete(ctx fiber.Ctx) error {
+	if err := s.members.Remove(ctx.Params("id")); err != nil {
+		return fmt.Errorf("failed to remove node: %w", err)
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+func (s *Server) handleNodeHeartbeat(ctx fiber.Ctx) error {
+	var hb membership.Heartbeat
+	if err := json.Unmarshal(ctx.Body(), &hb); err != nil {
+		return fmt.Errorf("%w: invalid heartbeat: %w", common.ErrBadRequest, err)
+	}
+
+	id := ctx.Params("id")
+	if err := s.members.Heartbeat(ctx.Context(), id, &hb); err != nil {
+		return fmt.Errorf("failed to handle heartbeat: %w", err)
+	}
+
+	if s.capacity != nil && hb.TotalBytes > 0 {
+		s.capacity.Update(capacity.NodeStats{
+			ID:          id,
+			TotalBytes:  hb.TotalBytes,
+			FreeBytes:   hb.FreeBytes,
+			TotalInodes: hb.TotalInodes,
+			FreeInodes:  hb.FreeInodes,
+			UpdatedAt:   time.Now(),
+		})
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+func (s *Server) handleRebalanceStatus(ctx fiber.Ctx) error {
+	return ctx.JSON(s.rebalance.Status())
+}
+
+func (s *Server) handleRebalanceStart(ctx fiber.Ctx) error {
+	if !s.rebalance.HasPlacement() {
+		return fmt.Errorf("%w: rebalance needs a distributor with stable placement, DISTRIBUTOR=rendezvous",
+			common.ErrBadRequest)
+	}
+
+	if !s.rebalance.Trigger() {
+		return fmt.Errorf("%w: rebalance is already requested", common.ErrConflict)
+	}
+
+	return ctx.SendStatus(http.StatusAccepted)
+}
+
+func (s *Server) handleTieringStatus(ctx fiber.Ctx) error {
+	return ctx.JSON(s.rebalance.TieringStatus())
+}
+
+func (s *Server) handleTieringStart(ctx fiber.Ctx) error {
+	if !s.rebalance.TriggerTiering() {
+		return fmt.Errorf("%w: tiering is already requested", common.ErrConflict)
+	}
+
+	return ctx.SendStatus(http.StatusAccepted)
+}
+
+func (s *Server) handleFsckReport(ctx fiber.Ctx) error {
+	return ctx.JSON(s.fsck.Report())
+}
+
+func (s *Server) handlePruneStats(ctx fiber.Ctx) error {
+	return ctx.JSON(s.pruner.Stats())
+}
+
+func (s *Server) handleFsckStart(ctx fiber.Ctx) error {
+	var opts fsck.Options
+	if body := ctx.Body(); len(body) > 0 {
+		if err := json.Unmarshal(body, &opts); err != nil {
+			return fmt.Errorf("%w: invalid fsck options: %w", common.ErrBadRequest, err)
+		}
+	}
+
+	if !s.fsck.Trigger(opts) {
+		return fmt.Errorf("%w: fsck is already requested", common.ErrConflict)
+	}
+
+	return ctx.SendStatus(http.StatusAccepted)
+}
+
+// handleMetaEvents streams meta changes as server-sent events. The stream resumes after the event in the
+// from query parameter or the Last-Event-ID header sent by reconnecting clients.
+func (s *Server) handleMetaEvents(ctx fiber.Ctx) error {
+	from := ctx.Query("from", ctx.Get("Last-Event-ID"))
+
+	var seq uint64
+	if from != "" {
+		var err error
+		if seq, err = strconv.ParseUint(from, 10, 64); err != nil {
+			return fmt.Errorf("%w: invalid event id %q", common.ErrBadRequest, from)
+		}
+	}
+
+	ctx.Set("Content-Type", "text/event-stream")
+	ctx.Set("Cache-Control", "no-cache")
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		s.streamMetaEvents(w, seq)
+	})
+
+	return nil
+}
+
+func (s *Server) streamMetaEvents(w *bufio.Writer, from uint64) {
+	watchCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan meta.Event)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.watcher.Watch(watchCtx, from, func(e meta.Event) error {
+			select {
+			case events <- e:
+				return nil
+			case <-watchCtx.Done():
+				return watchCtx.Err()
+			}
+		})
+	}()
+
+	ticker := time.NewTicker(eventsHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				s.logger.Error().Err(err).Msg("failed to encode meta event")
+				return
+			}
+
+			_, _ = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, data)
+		case <-ticker.C:
+			_, _ = w.WriteString(": ping\n\n")
+		case err := <-done:
+			// a watch without an error is a normal end of the feed
+			if err != nil {
+				event := "error"
+				if errors.Is(err, meta.ErrFeedTruncated) {
+					event = "truncated"
+				}
+
+				data, _ := json.Marshal(map[string]string{"error": err.Error()})
+				_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			}
+			_ = w.Flush()
+
+			return
+		}
+
+		// the client is gone
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handleNodeDrain(ctx fiber.Ctx) error {
+	if err := s.setDrain(ctx.Context(), ctx.Params("id"), true); err != nil {
+		return fmt.Errorf("failed to drain node: %w", err)
+	}
+
+	return ctx.SendStatus(http.StatusAccepted)
+}
+
+func (s *Server) handleNodeDrainStatus(ctx fiber.Ctx) error {
+	status, ok := s.rebalance.DrainStatus(ctx.Params("id"))
+	if !ok {
+		return fmt.Errorf("%w: node is not draining", common.ErrNotFound)
+	}
+
+	return ctx.JSON(status)
+}
+
+func (s *Server) handleNodeDrainCancel(ctx fiber.Ctx) error {
+	if err := s.setDrain(ctx.Context(), ctx.Params("id"), false); err != nil {
+		return fmt.Errorf("failed to cancel drain: %w", err)
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// setDrain drains the node in the distributor and starts or stops evacuating it, if there is a rebalancer.
+func (s *Server) setDrain(ctx context.Context, id string, drain bool) error {
+	if err := s.members.SetDrain(ctx, id, drain); err != nil {
+		return err
+	}
+
+	switch {
+	case s.rebalance == nil:
+	case drain:
+		s.rebalance.Drain(id)
+	default:
+		s.rebalance.CancelDrain(id)
+	}
+
+	return nil
+}
+
 func (s *Server) getBucketAndKeyFromContext(ctx fiber.Ctx) (string, string, error) {
 	bucket := ctx.Params("bucket")
 	if bucket == "" {
@@ -151,6 +553,8 @@ func makeErrorHandler(logger zerolog.Logger) fiber.ErrorHandler {
 			code = http.StatusNotFound
 		case errors.Is(err, common.ErrBadRequest):
 			code = http.StatusBadRequest
+		case errors.Is(err, common.ErrConflict):
+			code = http.StatusConflict
 		default:
 			var e *fiber.Error
 			if errors.As(err, &e) {
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/distributor"
+	"github.com/theoptz/basic-s3/internal/rest/meta"
+	"github.com/theoptz/basic-s3/internal/rest/rebalancer"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+func TestServer_RequireAdminToken(t *testing.T) {
+	s := &Server{adminToken: "secret"}
+
+	app := fiber.New()
+	app.Group("/_admin", s.requireAdminToken).Get("/nodes", func(ctx fiber.Ctx) error {
+		return ctx.SendStatus(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "valid token", authorization: "Bearer secret", wantStatus: http.StatusNoContent},
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "not a bearer token", authorization: "secret", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_admin/nodes", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			res, err := app.Test(req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+		})
+	}
+}
+
+type testWatcher struct {
+	events []meta.Event
+	err    error
+}
+
+func (w testWatcher) Watch(_ context.Context, _ uint64, fn func(meta.Event) error) error {
+	for _, e := range w.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return w.err
+}
+
+func TestServer_HandleMetaEvents(t *testing.T) {
+	events := []meta.Event{{Seq: 1, Type: meta.EventVersionCreated, File: meta.File{Bucket: "bucket", Key: "key"}}}
+
+	tests := []struct {
+		name      string
+		err       error
+		wantEvent string
+	}{
+		{name: "end of feed"},
+		{name: "truncated", err: meta.ErrFeedTruncated, wantEvent: "event: truncated"},
+		{name: "interrupted", err: meta.ErrFeedInterrupted, wantEvent: "event: error"},
+		{name: "failed", err: errors.New("boom"), wantEvent: "event: error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{watcher: testWatcher{events: events, err: tt.err}}
+
+			app := fiber.New()
+			app.Get("/_admin/meta/events", s.handleMetaEvents)
+
+			res, err := app.Test(httptest.NewRequest(http.MethodGet, "/_admin/meta/events", nil))
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), "id: 1\n")
+
+			if tt.wantEvent == "" {
+				assert.NotContains(t, string(body), "event:")
+			} else {
+				assert.Contains(t, string(body), tt.wantEvent)
+			}
+		})
+	}
+}
+
+// randomPlacement is a distributor without stable placement, like the weight one.
+type randomPlacement struct{}
+
+func (randomPlacement) GetPlan(*distributor.PlanRequest) ([][]string, int) {
+	return nil, 0
+}
+
+func (randomPlacement) GetClientByID(id string) (proto.StorageClient, error) {
+	return nil, errors.New("unknown node " + id)
+}
+
+func TestServer_HandleRebalanceStart_NoPlacement(t *testing.T) {
+	s := &Server{rebalance: rebalancer.New(nil, randomPlacement{}, nil, rebalancer.Config{}, zerolog.Nop())}
+
+	app := fiber.New(fiber.Config{ErrorHandler: makeErrorHandler(zerolog.Nop())})
+	app.Post("/_admin/rebalance", s.handleRebalanceStart)
+
+	res, err := app.Test(httptest.NewRequest(http.MethodPost, "/_admin/rebalance", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
@@ -0,0 +1,217 @@
+package topology
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/theoptz/basic-s3/internal/atomicfile"
+	"github.com/theoptz/basic-s3/internal/nodeid"
+	"github.com/theoptz/basic-s3/proto"
+)
+
+type Node struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Weight  int    `json:"weight"`
+	Zone    string `json:"zone,omitempty"`
+	Rack    string `json:"rack,omitempty"`
+	Host    string `json:"host,omitempty"`
+	// Pool groups nodes of the same kind, e.g. ssd or hdd, storage classes are mapped to pools.
+	Pool string `json:"pool,omitempty"`
+	// Drain keeps the node readable but stops placing new parts on it.
+	Drain bool `json:"drain,omitempty"`
+
+	Client proto.StorageClient `json:"-"`
+	// Conn closes the connection of Client, nil if the client was not dialed by ConnectNode.
+	Conn io.Closer `json:"-"`
+}
+
+type Topology struct {
+	Nodes []Node `json:"nodes"`
+}
+
+func Load(filename string) (*Topology, error) {
+	by, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	var t Topology
+	if err = json.Unmarshal(by, &t); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal file: %w", err)
+	}
+
+	for i := range t.Nodes {
+		if t.Nodes[i].ID == "" {
+			return nil, fmt.Errorf("node %s has no id", t.Nodes[i].Address)
+		}
+	}
+
+	if len(t.Nodes) == 0 {
+		return nil, errors.New("no nodes provided")
+	}
+
+	if err = t.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Save writes the topology in the format read by Load, replacing the file atomically.
+func (t *Topology) Save(filename string) error {
+	by, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal topology: %w", err)
+	}
+
+	return atomicfile.WriteFile(filename, by)
+}
+
+// FromEndpoints builds a topology from a plain list of addresses. Node IDs are unknown
+// until the nodes report them on Connect. Without weights every node gets weight 1.
+func FromEndpoints(endpoints []string, weights []int) (*Topology, error) {
+	if len(weights) == 0 {
+		weights = make([]int, len(endpoints))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	if len(weights) != len(endpoints) {
+		return nil, errors.New("invalid weights")
+	}
+
+	t := &Topology{
+		Nodes: make([]Node, len(endpoints)),
+	}
+
+	for i := range endpoints {
+		t.Nodes[i] = Node{
+			Address: endpoints[i],
+			Weight:  weights[i],
+		}
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Connect creates clients of all nodes. Nodes with a known ID are dialed lazily, so an unreachable node
+// doesn't stop the start and is handled like any node failing later. Nodes without an ID are asked for
+// it. Every call carries the ID, so a node reporting another one refuses it, see nodeid.
+func (t *Topology) Connect(ctx context.Context) error {
+	ids := make(map[string]string, len(t.Nodes))
+	for i := range t.Nodes {
+		node := &t.Nodes[i]
+
+		var err error
+		if node.ID != "" {
+			err = Dial(node)
+		} else {
+			err = ConnectNode(ctx, node)
+		}
+		if err != nil {
+			return err
+		}
+
+		if other, ok := ids[node.ID]; ok {
+			return fmt.Errorf("nodes %s and %s have the same id %q", other, node.Address, node.ID)
+		}
+		ids[node.ID] = node.Address
+	}
+
+	return nil
+}
+
+// Dial sets node.Client and node.Conn without waiting for the node to be reachable. If node.ID is set,
+// calls to a node with another ID fail.
+func Dial(node *Node) error {
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if node.ID != "" {
+		opts = append(opts, nodeid.DialOptions(node.ID)...)
+	}
+
+	conn, err := grpc.NewClient(node.Address, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create client for %s: %w", node.Address, err)
+	}
+
+	node.Client = proto.NewStorageClient(conn)
+	node.Conn = conn
+
+	return nil
+}
+
+// ConnectNode dials a single node, checks its ID and sets node.Client and node.Conn.
+func ConnectNode(ctx context.Context, node *Node) error {
+	dialed := *node
+	if err := Dial(&dialed); err != nil {
+		return err
+	}
+
+	res, err := dialed.Client.Info(ctx, &proto.InfoRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		_ = dialed.Conn.Close()
+		return fmt.Errorf("failed to get info from %s: %w", node.Address, err)
+	}
+
+	if node.ID != "" && node.ID != res.Id {
+		_ = dialed.Conn.Close()
+		return fmt.Errorf("node %s reported id %q, expected %q", node.Address, res.Id, node.ID)
+	}
+
+	if node.ID == "" {
+		// dial again, so calls carry the reported ID
+		_ = dialed.Conn.Close()
+
+		dialed.ID = res.Id
+		if err = Dial(&dialed); err != nil {
+			return err
+		}
+	}
+
+	*node = dialed
+
+	return nil
+}
+
+// Validate checks that addresses and IDs are unique and weights are positive.
+func (t *Topology) Validate() error {
+	ids := make(map[string]struct{}, len(t.Nodes))
+	addresses := make(map[string]struct{}, len(t.Nodes))
+
+	for _, node := range t.Nodes {
+		if node.Address == "" {
+			return fmt.Errorf("node %s has no address", node.ID)
+		}
+		if node.Weight <= 0 {
+			return fmt.Errorf("node %s has invalid weight %d", node.Address, node.Weight)
+		}
+
+		if _, ok := addresses[node.Address]; ok {
+			return fmt.Errorf("duplicate address %s", node.Address)
+		}
+		addresses[node.Address] = struct{}{}
+
+		if node.ID == "" {
+			continue
+		}
+		if _, ok := ids[node.ID]; ok {
+			return fmt.Errorf("duplicate node id %s", node.ID)
+		}
+		ids[node.ID] = struct{}{}
+	}
+
+	return nil
+}
@@ -1,11 +1,26 @@
 package config
 
-import "github.com/jessevdk/go-flags"
+import (
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
 
 type Config struct {
 	Host      string `long:"host" env:"HOST" description:"Host" default:"localhost"`
 	Port      int    `long:"port" env:"PORT" description:"Port" default:"5555"`
 	Directory string `long:"directory" env:"DIRECTORY" description:"Directory" default:"./files"`
+	NodeID    string `long:"node-id" env:"NODE_ID" description:"Node ID (generated and stored in the directory if empty)"`
+
+	RegistryURL       string        `long:"registry-url" env:"REGISTRY_URL" description:"REST URL to register the node with (empty - disabled)"`
+	RegistryToken     string        `long:"registry-token" env:"REGISTRY_TOKEN" description:"Admin token of the REST tier sent with heartbeats"`
+	AdvertiseAddress  string        `long:"advertise-address" env:"ADVERTISE_ADDRESS" description:"Address REST uses to reach the node (empty - hostname and port)"`
+	Weight            int           `long:"weight" env:"WEIGHT" description:"Node weight set on registration" default:"1"`
+	Zone              string        `long:"zone" env:"ZONE" description:"Zone the node runs in"`
+	Rack              string        `long:"rack" env:"RACK" description:"Rack the node runs in"`
+	PhysicalHost      string        `long:"physical-host" env:"PHYSICAL_HOST" description:"Physical host the node runs on"`
+	Pool              string        `long:"pool" env:"POOL" description:"Pool of nodes the node belongs to, e.g. ssd or hdd"`
+	HeartbeatInterval time.Duration `long:"heartbeat-interval" env:"HEARTBEAT_INTERVAL" description:"Heartbeat interval" default:"5s"`
 }
 
 func FromEnv() (*Config, error) {
@@ -0,0 +1,54 @@
+package filestorage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	nodeIDFile = ".node_id"
+)
+
+// LoadOrCreateNodeID returns the node ID stored in the storage directory. A new random ID is generated
+// and saved on first start, so the ID stays with the data even if the node address changes.
+// If id is not empty, it is saved instead, and must match an already stored one.
+func LoadOrCreateNodeID(dir, id string) (string, error) {
+	filename := path.Join(dir, nodeIDFile)
+
+	by, err := os.ReadFile(filename)
+	switch {
+	case err == nil:
+		stored := strings.TrimSpace(string(by))
+		if id != "" && id != stored {
+			return "", fmt.Errorf("node id %q doesn't match stored id %q", id, stored)
+		}
+
+		return stored, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return "", fmt.Errorf("read node id: %w", err)
+	}
+
+	if id == "" {
+		buf := make([]byte, 8)
+		if _, err = rand.Read(buf); err != nil {
+			return "", fmt.Errorf("generate node id: %w", err)
+		}
+
+		id = hex.EncodeToString(buf)
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("mkdirall: %w", err)
+	}
+
+	if err = os.WriteFile(filename, []byte(id+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("write node id: %w", err)
+	}
+
+	return id, nil
+}
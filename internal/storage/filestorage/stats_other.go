@@ -0,0 +1,13 @@
+//go:build !(linux || darwin)
+
+package filestorage
+
+import (
+	"errors"
+
+	"github.com/theoptz/basic-s3/internal/storage"
+)
+
+func (s *FileStorage) Stats() (*storage.Stats, error) {
+	return nil, errors.ErrUnsupported
+}
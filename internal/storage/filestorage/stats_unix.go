@@ -0,0 +1,24 @@
+//go:build linux || darwin
+
+package filestorage
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/theoptz/basic-s3/internal/storage"
+)
+
+func (s *FileStorage) Stats() (*storage.Stats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.dir, &st); err != nil {
+		return nil, fmt.Errorf("statfs: %w", err)
+	}
+
+	return &storage.Stats{
+		TotalBytes:  st.Blocks * uint64(st.Bsize),
+		FreeBytes:   st.Bavail * uint64(st.Bsize),
+		TotalInodes: st.Files,
+		FreeInodes:  st.Ffree,
+	}, nil
+}
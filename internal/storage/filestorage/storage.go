@@ -4,10 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
 
+	"github.com/theoptz/basic-s3/internal/atomicfile"
 	"github.com/theoptz/basic-s3/internal/storage"
 )
 
@@ -23,7 +27,9 @@ func New(dir string) *FileStorage {
 	return &FileStorage{dir: dir}
 }
 
-func (s *FileStorage) NewWriteCloser(req *storage.FileRequest) (io.WriteCloser, error) {
+// NewWriter writes the part next to its file and replaces it on Commit, so downloads of the part being
+// overwritten, e.g. by a repair, read the old content until then.
+func (s *FileStorage) NewWriter(req *storage.FileRequest) (storage.Writer, error) {
 	if req == nil {
 		return nil, errors.New("empty request")
 	}
@@ -35,7 +41,7 @@ func (s *FileStorage) NewWriteCloser(req *storage.FileRequest) (io.WriteCloser,
 		return nil, fmt.Errorf("mkdirall: %w", err)
 	}
 
-	file, err := os.Create(filename)
+	file, err := atomicfile.Create(filename)
 	if err != nil {
 		return nil, fmt.Errorf("create file: %w", err)
 	}
@@ -57,6 +63,96 @@ func (s *FileStorage) NewReadCloser(req *storage.FileRequest) (io.ReadCloser, er
 	return file, nil
 }
 
+// Delete removes the part. A missing part is not an error, so deletes can be retried.
+func (s *FileStorage) Delete(req *storage.FileRequest) error {
+	if req == nil {
+		return errors.New("empty request")
+	}
+
+	dir, filename := getDirAndFilename(s.dir, req)
+	if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove file: %w", err)
+	}
+
+	// the version directory is removed once it is empty
+	_ = os.Remove(dir)
+
+	return nil
+}
+
+func (s *FileStorage) Stat(req *storage.FileRequest) (*storage.FileInfo, error) {
+	if req == nil {
+		return nil, errors.New("empty request")
+	}
+
+	_, filename := getDirAndFilename(s.dir, req)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+
+	return &storage.FileInfo{FileRequest: *req, Size: info.Size(), ModifiedAt: info.ModTime()}, nil
+}
+
+// List walks the storage directory. Files that are not parts, such as the node ID, are skipped.
+func (s *FileStorage) List(fn func(*storage.FileInfo) error) error {
+	return filepath.WalkDir(s.dir, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		req, ok := parseFilename(s.dir, filename)
+		if !ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted while listing
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("stat file: %w", err)
+		}
+
+		return fn(&storage.FileInfo{FileRequest: *req, Size: info.Size(), ModifiedAt: info.ModTime()})
+	})
+}
+
+// parseFilename is the reverse of getDirAndFilename. Keys may contain slashes, so the key is everything
+// between the bucket and the version.
+func parseFilename(storageDir, filename string) (*storage.FileRequest, bool) {
+	rel, err := filepath.Rel(storageDir, filename)
+	if err != nil {
+		return nil, false
+	}
+
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	if len(elems) < 4 || !strings.HasSuffix(elems[len(elems)-1], partExtension) {
+		return nil, false
+	}
+
+	part, err := strconv.Atoi(strings.TrimSuffix(elems[len(elems)-1], partExtension))
+	if err != nil {
+		return nil, false
+	}
+
+	version, err := strconv.Atoi(elems[len(elems)-2])
+	if err != nil {
+		return nil, false
+	}
+
+	return &storage.FileRequest{
+		Bucket:  elems[0],
+		Key:     path.Join(elems[1 : len(elems)-2]...),
+		Version: version,
+		Part:    part,
+	}, true
+}
+
 func getDirAndFilename(storageDir string, req *storage.FileRequest) (string, string) {
 	filename := path.Join(
 		storageDir,
@@ -0,0 +1,120 @@
+package registration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/theoptz/basic-s3/internal/registry"
+	"github.com/theoptz/basic-s3/internal/storage"
+)
+
+type Config struct {
+	// URL of the REST tier, e.g. http://rest:8080, and its admin token.
+	URL      string
+	Token    string
+	Address  string
+	Weight   int
+	Zone     string
+	Rack     string
+	Host     string
+	Pool     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Registrar registers the node with the REST tier and keeps it alive with heartbeats.
+type Registrar struct {
+	id     string
+	store  storage.Storage
+	cfg    Config
+	client *http.Client
+	logger zerolog.Logger
+}
+
+func New(id string, store storage.Storage, cfg Config, logger zerolog.Logger) *Registrar {
+	return &Registrar{
+		id:     id,
+		store:  store,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: logger,
+	}
+}
+
+// Run sends a heartbeat right away and then every Interval until ctx is done. Failures are only
+// logged, the REST tier may not be up yet.
+func (r *Registrar) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	registered := false
+	for {
+		if err := r.send(ctx); err != nil {
+			r.logger.Warn().Err(err).Str("url", r.cfg.URL).Msg("failed to send heartbeat")
+			registered = false
+		} else if !registered {
+			r.logger.Info().Str("url", r.cfg.URL).Str("address", r.cfg.Address).Msg("registered")
+			registered = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Registrar) send(ctx context.Context) error {
+	hb := registry.Heartbeat{
+		Address: r.cfg.Address,
+		Weight:  r.cfg.Weight,
+		Zone:    r.cfg.Zone,
+		Rack:    r.cfg.Rack,
+		Host:    r.cfg.Host,
+		Pool:    r.cfg.Pool,
+	}
+
+	if stats, err := r.store.Stats(); err == nil {
+		hb.TotalBytes = stats.TotalBytes
+		hb.FreeBytes = stats.FreeBytes
+		hb.TotalInodes = stats.TotalInodes
+		hb.FreeInodes = stats.FreeInodes
+	}
+
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
+	}
+
+	endpoint, err := url.JoinPath(r.cfg.URL, "_admin", "nodes", r.id, "heartbeat")
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+r.cfg.Token)
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return nil
+}
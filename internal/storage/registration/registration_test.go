@@ -0,0 +1,81 @@
+package registration
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theoptz/basic-s3/internal/rest/membership"
+	"github.com/theoptz/basic-s3/internal/storage"
+)
+
+type statsStorage struct {
+	storage.Storage
+}
+
+func (statsStorage) Stats() (*storage.Stats, error) {
+	return &storage.Stats{TotalBytes: 100, FreeBytes: 40, TotalInodes: 10, FreeInodes: 4}, nil
+}
+
+func TestRegistrar_Send(t *testing.T) {
+	var (
+		got  membership.Heartbeat
+		keys map[string]any
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_admin/nodes/node-1/heartbeat", r.URL.Path)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		// the REST tier decodes the heartbeat into its own type
+		require.NoError(t, json.Unmarshal(body, &got))
+		require.NoError(t, json.Unmarshal(body, &keys))
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	r := New("node-1", statsStorage{}, Config{
+		URL:     srv.URL,
+		Token:   "token",
+		Address: "storage-01:5555",
+		Weight:  2,
+		Zone:    "zone-a",
+		Rack:    "rack-1",
+		Host:    "host-01",
+		Pool:    "ssd",
+	}, zerolog.Nop())
+	require.NoError(t, r.send(context.Background()))
+
+	assert.Equal(t, membership.Heartbeat{
+		Address:     "storage-01:5555",
+		Weight:      2,
+		Zone:        "zone-a",
+		Rack:        "rack-1",
+		Host:        "host-01",
+		Pool:        "ssd",
+		TotalBytes:  100,
+		FreeBytes:   40,
+		TotalInodes: 10,
+		FreeInodes:  4,
+	}, got)
+
+	// the wire format is part of the admin API
+	wantKeys := []string{
+		"address", "weight", "zone", "rack", "host", "pool",
+		"total_bytes", "free_bytes", "total_inodes", "free_inodes",
+	}
+	assert.Len(t, keys, len(wantKeys))
+	for _, key := range wantKeys {
+		assert.Contains(t, keys, key)
+	}
+}
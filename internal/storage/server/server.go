@@ -2,14 +2,23 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/rs/zerolog"
 
+	"github.com/theoptz/basic-s3/internal/nodeid"
 	"github.com/theoptz/basic-s3/internal/storage"
 	"github.com/theoptz/basic-s3/proto"
 )
@@ -20,19 +29,21 @@ const (
 
 type StorageServer struct {
 	proto.UnimplementedStorageServer
+	id     string
 	store  storage.Storage
 	logger zerolog.Logger
 }
 
-func New(store storage.Storage, logger zerolog.Logger) *StorageServer {
+func New(id string, store storage.Storage, logger zerolog.Logger) *StorageServer {
 	return &StorageServer{
+		id:     id,
 		store:  store,
 		logger: logger,
 	}
 }
 
 func (s *StorageServer) Upload(stream grpc.ClientStreamingServer[proto.UploadRequest, proto.UploadResponse]) error {
-	var fwr io.WriteCloser
+	var fwr storage.Writer
 
 	defer func() {
 		if fwr != nil {
@@ -65,7 +76,7 @@ func (s *StorageServer) Upload(stream grpc.ClientStreamingServer[proto.UploadReq
 				Part:    int(req.Part),
 			}
 
-			fwr, err = s.store.NewWriteCloser(&fileReq)
+			fwr, err = s.store.NewWriter(&fileReq)
 			if err != nil {
 				return err
 			}
@@ -83,6 +94,11 @@ func (s *StorageServer) Upload(stream grpc.ClientStreamingServer[proto.UploadReq
 		return stream.SendAndClose(&proto.UploadResponse{})
 	}
 
+	// an interrupted upload never replaces the part
+	if err := fwr.Commit(); err != nil {
+		return fmt.Errorf("failed to commit file: %w", err)
+	}
+
 	return stream.SendAndClose(&proto.UploadResponse{})
 }
 
@@ -131,3 +147,182 @@ func (s *StorageServer) Download(req *proto.DownloadRequest, stream grpc.ServerS
 
 	return nil
 }
+
+func (s *StorageServer) Ping(context.Context, *proto.PingRequest) (*proto.PingResponse, error) {
+	return &proto.PingResponse{}, nil
+}
+
+func (s *StorageServer) Info(context.Context, *proto.InfoRequest) (*proto.InfoResponse, error) {
+	return &proto.InfoResponse{Id: s.id}, nil
+}
+
+func (s *StorageServer) Stats(context.Context, *proto.StatsRequest) (*proto.StatsResponse, error) {
+	stats, err := s.store.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats: %w", err)
+	}
+
+	return &proto.StatsResponse{
+		TotalBytes:  stats.TotalBytes,
+		FreeBytes:   stats.FreeBytes,
+		TotalInodes: stats.TotalInodes,
+		FreeInodes:  stats.FreeInodes,
+	}, nil
+}
+
+// Transfer copies a part to another storage node, so parts move between nodes without passing
+// through the REST tier. Every call to the target carries the requested ID, an address that now
+// belongs to another node refuses the part.
+func (s *StorageServer) Transfer(ctx context.Context, req *proto.TransferRequest) (*proto.TransferResponse, error) {
+	if req.Bucket == "" || req.Key == "" || req.Target == "" || req.TargetId == "" {
+		return nil, errors.New("invalid request")
+	}
+
+	frd, err := s.store.NewReadCloser(&storage.FileRequest{
+		Bucket:  req.Bucket,
+		Key:     req.Key,
+		Version: int(req.Version),
+		Part:    int(req.Part),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = frd.Close()
+	}()
+
+	conn, err := grpc.NewClient(req.Target, append(nodeid.DialOptions(req.TargetId),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for %s: %w", req.Target, err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	stream, err := proto.NewStorageClient(conn).Upload(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start stream: %w", err)
+	}
+
+	buf := make([]byte, chunkSize)
+
+	var size int64
+	for {
+		n, readErr := frd.Read(buf)
+		if n > 0 {
+			if err = stream.Send(&proto.UploadRequest{
+				Bucket:  req.Bucket,
+				Key:     req.Key,
+				Version: req.Version,
+				Part:    req.Part,
+				Chunk:   buf[:n],
+			}); err != nil {
+				return nil, fmt.Errorf("failed to send chunk: %w", err)
+			}
+
+			size += int64(n)
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				break
+			}
+
+			return nil, fmt.Errorf("failed to read chunk: %w", readErr)
+		}
+	}
+
+	if _, err = stream.CloseAndRecv(); err != nil {
+		return nil, fmt.Errorf("failed to close stream: %w", err)
+	}
+
+	s.logger.Debug().Str("bucket", req.Bucket).Str("key", req.Key).Int32("version", req.Version).
+		Int32("part", req.Part).Str("target", req.TargetId).Int64("size", size).Msg("part transferred")
+
+	return &proto.TransferResponse{Size: size}, nil
+}
+
+func (s *StorageServer) Delete(_ context.Context, req *proto.DeleteRequest) (*proto.DeleteResponse, error) {
+	if req.Bucket == "" || req.Key == "" {
+		return nil, errors.New("invalid request")
+	}
+
+	if err := s.store.Delete(&storage.FileRequest{
+		Bucket:  req.Bucket,
+		Key:     req.Key,
+		Version: int(req.Version),
+		Part:    int(req.Part),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	return &proto.DeleteResponse{}, nil
+}
+
+// Stat returns the size of a part and, if requested, its SHA-256 checksum. A missing part is NotFound.
+func (s *StorageServer) Stat(_ context.Context, req *proto.StatRequest) (*proto.StatResponse, error) {
+	if req.Bucket == "" || req.Key == "" {
+		return nil, errors.New("invalid request")
+	}
+
+	fileReq := &storage.FileRequest{
+		Bucket:  req.Bucket,
+		Key:     req.Key,
+		Version: int(req.Version),
+		Part:    int(req.Part),
+	}
+
+	info, err := s.store.Stat(fileReq)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Error(codes.NotFound, "part not found")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %w", err)
+	}
+
+	res := &proto.StatResponse{Size: info.Size, ModifiedAt: timestamppb.New(info.ModifiedAt)}
+
+	if req.Checksum {
+		if res.Checksum, err = s.checksum(fileReq); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func (s *StorageServer) checksum(req *storage.FileRequest) (string, error) {
+	frd, err := s.store.NewReadCloser(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer func() {
+		_ = frd.Close()
+	}()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, frd); err != nil {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// List streams every part stored on the node.
+func (s *StorageServer) List(_ *proto.ListRequest, stream grpc.ServerStreamingServer[proto.ListResponse]) error {
+	err := s.store.List(func(info *storage.FileInfo) error {
+		return stream.Send(&proto.ListResponse{
+			Bucket:     info.Bucket,
+			Key:        info.Key,
+			Version:    int32(info.Version),
+			Part:       int32(info.Part),
+			Size:       info.Size,
+			ModifiedAt: timestamppb.New(info.ModifiedAt),
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package storage
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type FileRequest struct {
 	Bucket  string
@@ -9,7 +12,33 @@ type FileRequest struct {
 	Part    int
 }
 
+type FileInfo struct {
+	FileRequest
+	Size       int64
+	ModifiedAt time.Time
+}
+
+type Stats struct {
+	TotalBytes  uint64
+	FreeBytes   uint64
+	TotalInodes uint64
+	FreeInodes  uint64
+}
+
+// Writer writes a new part. Commit replaces the part with what was written, Close without Commit
+// discards it, so readers never see a partially written part.
+type Writer interface {
+	io.WriteCloser
+	Commit() error
+}
+
 type Storage interface {
-	NewWriteCloser(*FileRequest) (io.WriteCloser, error)
+	NewWriter(*FileRequest) (Writer, error)
 	NewReadCloser(*FileRequest) (io.ReadCloser, error)
+	Delete(*FileRequest) error
+	Stats() (*Stats, error)
+	// Stat returns an error wrapping os.ErrNotExist for a missing part.
+	Stat(*FileRequest) (*FileInfo, error)
+	// List calls fn for every part in the storage.
+	List(fn func(*FileInfo) error) error
 }